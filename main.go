@@ -1,314 +1,800 @@
 package main
 
 import (
-	"bufio"
-	"encoding/binary"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"log"
 	"net/http"
-	"os"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
+
+	"minikv/minidb"
 )
 
 // ==========================================
-// 1. 数据协议定义 (Data Protocol)
+// HTTP 接口
 // ==========================================
 
-const (
-	HeaderSize    = 16
-	DBFileName    = "minidb.data"
-	MergeFileName = "minidb.data.merge"
+// gzipMinSize 以上的 value 在客户端支持时压缩返回，太小的 value 压缩反而更大
+const gzipMinSize = 1024
+
+// maxValueSize 是 /set 接受的最大 value，查询参数和请求体都适用
+const maxValueSize = 16 << 20
+
+// maxIngestSize 是 /ingest 一次接受的最大请求体
+const maxIngestSize = 64 << 20
+
+// 请求参数不合法时返回的错误
+var (
+	errKeyRequired    = errors.New("key required")
+	errValueRequired  = errors.New("value required (use allowempty=1 to store an empty value)")
+	errInvalidBase64  = errors.New("invalid base64 value")
+	errPrefixRequired = errors.New("prefix required")
+	errPostRequired   = errors.New("POST required")
+	errInvalidLimit   = errors.New("invalid limit")
+	errInvalidSwitch  = errors.New("on must be 0 or 1")
+	errKeyExists      = errors.New("key already exists")
+	errInvalidOffset  = errors.New("invalid offset")
 )
 
-type Entry struct {
-	Key       []byte
-	Value     []byte
-	KeySize   uint32
-	ValueSize uint32
-	Timestamp uint32 // 记录写入时间
-	CRC       uint32 // 校验码
-}
+func main() {
+	logRequests := flag.Bool("access-log", false, "log method, path, key, status and latency of every request")
+	hotKeys := flag.Int("hot-keys", 0, "track read/write counts of up to this many keys for /stats/hotkeys (0 disables)")
+	debug := flag.Bool("debug", false, "expose /debug/entries for inspecting the records in the data file")
+	flag.Parse()
+
+	opts := minidb.DefaultOptions
+	opts.MaxValueSize = maxValueSize
+	opts.HotKeys = *hotKeys
+	db, err := minidb.OpenWithOptions(opts)
+	if err != nil {
+		log.Fatalf("Init DB failed: %v", err)
+	}
+	defer db.Close()
 
-func NewEntry(key, value []byte) *Entry {
-	return &Entry{
-		Key:       key,
-		Value:     value,
-		KeySize:   uint32(len(key)),
-		ValueSize: uint32(len(value)),
-		Timestamp: uint32(time.Now().Unix()),
+	var handler http.Handler = newMux(db, *debug)
+	if *logRequests {
+		handler = accessLog(handler)
 	}
+	log.Println("Server running at :8080")
+	log.Fatal(http.ListenAndServe(":8080", handler))
 }
 
-func (e *Entry) Encode() []byte {
-	buf := make([]byte, HeaderSize+e.KeySize+e.ValueSize)
+// server 持有 HTTP 接口使用的库，每个路由对应一个方法，测试中可以直接对临时库构造
+type server struct {
+	db *minidb.MiniDB
+}
 
-	binary.BigEndian.PutUint32(buf[4:8], e.Timestamp)
-	binary.BigEndian.PutUint32(buf[8:12], e.KeySize)
-	binary.BigEndian.PutUint32(buf[12:16], e.ValueSize)
-	copy(buf[HeaderSize:], e.Key)
-	copy(buf[HeaderSize+e.KeySize:], e.Value)
+// newMux 注册所有路由，debug 为 true 时才注册 /debug/entries
+func newMux(db *minidb.MiniDB, debug bool) *http.ServeMux {
+	s := &server{db: db}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/set", s.handleSet)
+	mux.HandleFunc("/setnx", s.handleSetNX)
+	mux.HandleFunc("/setb64", s.handleSetB64)
+	mux.HandleFunc("/get", s.handleGet)
+	mux.HandleFunc("/del", s.handleDel)
+	mux.HandleFunc("/delprefix", s.handleDelPrefix)
+	mux.HandleFunc("/raw", s.handleRaw)
+	mux.HandleFunc("/ingest", s.handleIngest)
+	mux.HandleFunc("/scan", s.handleScan)
+	mux.HandleFunc("/export", s.handleExport)
+	mux.HandleFunc("/verify", s.handleVerify)
+	mux.HandleFunc("/meta", s.handleMeta)
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/stats/hotkeys", s.handleHotKeys)
+	if debug {
+		mux.HandleFunc("/debug/entries", s.handleEntries)
+	}
+	mux.HandleFunc("/version", s.handleVersion)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/checkpoint", s.handleCheckpoint)
+	mux.HandleFunc("/rotate", s.handleRotate)
+	mux.HandleFunc("/maintenance", s.handleMaintenance)
+	mux.HandleFunc("/merge", s.handleMerge)
+	return mux
+}
 
-	crc := crc32.ChecksumIEEE(buf[4:])
-	binary.BigEndian.PutUint32(buf[0:4], crc)
+func (s *server) handleSet(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		httpError(w, r, errKeyRequired, 400)
+		return
+	}
+	val, ok := requestValue(w, r, maxValueSize)
+	if !ok {
+		return
+	}
+	// 空 value 容易和删除混淆，必须显式声明 allowempty=1，删除请使用 /del
+	if val == "" && r.URL.Query().Get("allowempty") != "1" {
+		httpError(w, r, errValueRequired, 400)
+		return
+	}
+	s.put(w, r, key, val)
+}
 
-	return buf
+// /setnx 只在 key 不存在时写入，key 已存在返回 409，并发请求中只有一个会成功
+func (s *server) handleSetNX(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		httpError(w, r, errKeyRequired, 400)
+		return
+	}
+	val, ok := requestValue(w, r, maxValueSize)
+	if !ok {
+		return
+	}
+	if val == "" && r.URL.Query().Get("allowempty") != "1" {
+		httpError(w, r, errValueRequired, 400)
+		return
+	}
+	wrote, err := s.db.PutNX(key, val)
+	if err != nil {
+		putError(w, r, err)
+		return
+	}
+	if !wrote {
+		httpError(w, r, errKeyExists, 409)
+		return
+	}
+	fmt.Fprint(w, "OK")
 }
 
-func DecodeHeader(buf []byte) (uint32, uint32, uint32, uint32) {
-	crc := binary.BigEndian.Uint32(buf[0:4])
-	ts := binary.BigEndian.Uint32(buf[4:8])
-	kSize := binary.BigEndian.Uint32(buf[8:12])
-	vSize := binary.BigEndian.Uint32(buf[12:16])
-	return crc, ts, kSize, vSize
+// /setb64 的 value 为标准 base64 编码 (查询参数中也可以用 URL 安全的编码)，二进制数据可以无损写入
+func (s *server) handleSetB64(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		httpError(w, r, errKeyRequired, 400)
+		return
+	}
+	encoded, ok := requestValue(w, r, base64.StdEncoding.EncodedLen(maxValueSize))
+	if !ok {
+		return
+	}
+	val, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		if val, err = base64.URLEncoding.DecodeString(encoded); err != nil {
+			httpError(w, r, errInvalidBase64, 400)
+			return
+		}
+	}
+	// 与 /set 相同，解码后为空的 value 也需要 allowempty=1
+	if len(val) == 0 && r.URL.Query().Get("allowempty") != "1" {
+		httpError(w, r, errValueRequired, 400)
+		return
+	}
+	s.put(w, r, key, string(val))
 }
 
-// ==========================================
-// 2. 存储引擎实现 (Storage Engine)
-// ==========================================
+// /get?key=a&default=x 在 key 不存在时返回 200 和 x，而不是 404
+func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	key := q.Get("key")
+	missing := func(err error) bool {
+		if errors.Is(err, minidb.ErrKeyNotFound) && q.Has("default") {
+			fmt.Fprint(w, q.Get("default"))
+			return true
+		}
+		return false
+	}
+	// 先取记录信息再读 value，并发写入时 ETag 只可能比 value 旧，不会让客户端缓存住旧值
+	info, err := s.db.KeyInfo(key)
+	if missing(err) {
+		return
+	}
+	if err != nil {
+		readError(w, r, err)
+		return
+	}
+	etag := etagFor(info)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", info.Timestamp.UTC().Format(http.TimeFormat))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(304)
+		return
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	if rng := r.Header.Get("Range"); rng != "" && s.serveRange(w, r, key, rng) {
+		return
+	}
 
-type MiniDB struct {
-	mu      sync.RWMutex
-	file    *os.File
-	indexes map[string]int64
-	offset  int64
+	val, err := s.db.Get(key)
+	if missing(err) {
+		return
+	}
+	if err != nil {
+		readError(w, r, err)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if len(val) >= gzipMinSize && acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		io.WriteString(gz, val)
+		gz.Close()
+		return
+	}
+	fmt.Fprint(w, val)
 }
 
-func Open() (*MiniDB, error) {
-	db := &MiniDB{
-		indexes: make(map[string]int64),
+func (s *server) handleDel(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if err := s.db.Del(key); err != nil {
+		if errors.Is(err, minidb.ErrMaintenanceMode) {
+			httpError(w, r, err, 503)
+			return
+		}
+		httpError(w, r, err, 500)
+		return
 	}
+	fmt.Fprint(w, "OK")
+}
 
-	if err := db.initFile(); err != nil {
-		return nil, err
+// /delprefix 一次删除一个命名空间下的所有 key，prefix 不能为空，避免误清空整个库
+func (s *server) handleDelPrefix(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		httpError(w, r, errPrefixRequired, 400)
+		return
 	}
-
-	if err := db.loadIndexes(); err != nil {
-		return nil, err
+	n, err := s.db.DeletePrefix(prefix)
+	if err != nil {
+		if errors.Is(err, minidb.ErrMaintenanceMode) {
+			httpError(w, r, err, 503)
+			return
+		}
+		httpError(w, r, err, 500)
+		return
 	}
+	fmt.Fprintf(w, "OK %d", n)
+}
 
-	return db, nil
+func (s *server) handleRaw(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	raw, err := s.db.GetRaw(key)
+	if err != nil {
+		readError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(raw)
 }
 
-func (db *MiniDB) initFile() error {
-	file, err := os.OpenFile(DBFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+func (s *server) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, errPostRequired, 405)
+		return
+	}
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		httpError(w, r, err, 413)
+		return
+	}
 	if err != nil {
-		return err
+		httpError(w, r, err, 400)
+		return
+	}
+	if err := s.db.AppendRaw(raw); err != nil {
+		if errors.Is(err, minidb.ErrDataCorrupted) || errors.Is(err, minidb.ErrEmptyKey) {
+			httpError(w, r, err, 400)
+			return
+		}
+		putError(w, r, err)
+		return
 	}
-	db.file = file
-	stat, _ := file.Stat()
-	db.offset = stat.Size()
-	return nil
+	fmt.Fprint(w, "OK")
 }
 
-func (db *MiniDB) loadIndexes() error {
-	log.Println("Loading indexes from disk...")
+func (s *server) handleScan(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			httpError(w, r, errInvalidLimit, 400)
+			return
+		}
+		limit = n
+	}
 
-	f, err := os.Open(DBFileName)
+	keys, next, err := s.db.Scan(q.Get("prefix"), q.Get("after"), limit)
 	if err != nil {
-		return err
+		httpError(w, r, err, 503)
+		return
 	}
-	defer f.Close()
-
-	reader := bufio.NewReader(f)
-	var offset int64 = 0
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"keys": keys, "next": next})
+}
 
-	for {
-		header := make([]byte, HeaderSize)
-		_, err := io.ReadFull(reader, header)
-		if err == io.EOF {
-			break
+// /export 以 NDJSON 流式导出所有 key，先拿到 key 的快照再逐个读取，不会长时间持有锁。
+// 不是合法 UTF-8 的 value 使用 base64 编码并标记 "base64":true
+func (s *server) handleExport(w http.ResponseWriter, r *http.Request) {
+	keys, _, err := s.db.Scan("", "", 0)
+	if err != nil {
+		httpError(w, r, err, 503)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for i, key := range keys {
+		val, err := s.db.Get(key)
+		if errors.Is(err, minidb.ErrKeyNotFound) {
+			continue // 导出期间被删除
 		}
 		if err != nil {
-			return err
+			log.Printf("Export key %q failed: %v", key, err)
+			continue
 		}
+		line := exportLine{Key: key, Value: val}
+		if !utf8.ValidString(val) {
+			line.Value, line.Base64 = base64.StdEncoding.EncodeToString([]byte(val)), true
+		}
+		if err := enc.Encode(line); err != nil {
+			return // 客户端断开
+		}
+		if flusher != nil && i%1000 == 999 {
+			flusher.Flush()
+		}
+	}
+}
 
-		crc, _, kSize, vSize := DecodeHeader(header)
+// /verify 顺序校验整个数据文件和 value log，以 NDJSON 流式返回每条损坏记录 {"corrupt":...}、
+// 每 64MB 一次的进度 {"progress":...}，最后是汇总 {"done":...}；开始输出后出错时最后一行为 {"error":...}
+func (s *server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	started := false
+	emit := func(line verifyLine) error {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			started = true
+		}
+		if err := enc.Encode(line); err != nil {
+			return err // 客户端断开
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
 
-		payloadSize := int64(kSize + vSize)
-		payload := make([]byte, payloadSize)
-		_, err = io.ReadFull(reader, payload)
+	done, err := s.db.Verify(
+		func(cerr *minidb.CorruptionError) error {
+			return emit(verifyLine{Corrupt: &corruptRecord{cerr.Offset, cerr.Key, cerr.Expected, cerr.Actual, cerr.ValueLog}})
+		},
+		func(p minidb.VerifyProgress) error { return emit(verifyLine{Progress: &p}) },
+	)
+	switch {
+	case errors.Is(err, minidb.ErrMergeInProgress) && !started:
+		httpError(w, r, err, 409)
+	case err != nil && !started:
+		httpError(w, r, err, 500)
+	case err != nil:
+		emit(verifyLine{Error: err.Error()})
+	default:
+		emit(verifyLine{Done: &done})
+	}
+}
+
+// /meta?key=a 返回单个 key 的记录信息；传入多个 key (key=a&key=b) 时返回数组，跳过不存在的 key
+func (s *server) handleMeta(w http.ResponseWriter, r *http.Request) {
+	keys := r.URL.Query()["key"]
+	if len(keys) == 0 {
+		httpError(w, r, errKeyRequired, 400)
+		return
+	}
+	if len(keys) == 1 {
+		info, err := s.db.KeyInfo(keys[0])
 		if err != nil {
-			return err
+			readError(w, r, err)
+			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+		return
+	}
 
-		checkBuf := append(header[4:], payload...)
-		if crc32.ChecksumIEEE(checkBuf) != crc {
-			log.Printf("Warn: Corrupted data at offset %d, skipping...", offset)
-		} else {
-			key := string(payload[:kSize])
-			db.indexes[key] = offset
+	infos := make([]minidb.KeyInfo, 0, len(keys))
+	for _, key := range keys {
+		if info, err := s.db.KeyInfo(key); err == nil {
+			infos = append(infos, info)
 		}
-
-		offset += HeaderSize + payloadSize
 	}
-	log.Printf("Index loaded. Total keys: %d", len(db.indexes))
-	return nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
 }
 
-func (db *MiniDB) Put(key string, value string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	entry := NewEntry([]byte(key), []byte(value))
-	data := entry.Encode()
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.db.Stats())
+}
 
-	n, err := db.file.Write(data)
+// /stats/hotkeys?limit=N 返回访问次数最多的 N 个 key，需要以 -hot-keys 启动
+func (s *server) handleHotKeys(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			httpError(w, r, errInvalidLimit, 400)
+			return
+		}
+		limit = n
+	}
+	keys, err := s.db.HotKeys(limit)
 	if err != nil {
-		return err
+		httpError(w, r, err, 404)
+		return
 	}
-
-	db.indexes[key] = db.offset
-	db.offset += int64(n)
-	return nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
 }
 
-func (db *MiniDB) Get(key string) (string, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-
-	offset, ok := db.indexes[key]
-	if !ok {
-		return "", errors.New("key not found")
+// /debug/entries?offset=N&limit=M 从 offset 开始解码数据文件中的记录，只在以 -debug 启动时注册。
+// 返回的 next 为下一页的 offset，为 0 表示已到文件末尾
+func (s *server) handleEntries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			httpError(w, r, errInvalidLimit, 400)
+			return
+		}
+		limit = min(n, 1000)
+	}
+	var offset int64
+	if o := q.Get("offset"); o != "" {
+		n, err := strconv.ParseInt(o, 10, 64)
+		if err != nil || n < 0 {
+			httpError(w, r, errInvalidOffset, 400)
+			return
+		}
+		offset = n
 	}
 
-	header := make([]byte, HeaderSize)
-	_, err := db.file.ReadAt(header, offset)
+	entries, next, err := s.db.Entries(offset, limit)
+	if errors.Is(err, minidb.ErrInvalidRange) {
+		httpError(w, r, errInvalidOffset, 400)
+		return
+	}
 	if err != nil {
-		return "", err
+		httpError(w, r, err, 500)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"entries": entries, "next": next})
+}
 
-	crc, _, kSize, vSize := DecodeHeader(header)
+// /version 返回引擎版本、数据文件的格式版本以及本版本支持的最高格式版本
+func (s *server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	engine, format := s.db.Version()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"engine": engine, "format": format, "max_format": minidb.FormatVersion})
+}
 
-	body := make([]byte, kSize+vSize)
-	_, err = db.file.ReadAt(body, offset+HeaderSize)
-	if err != nil {
-		return "", err
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := s.db.CheckHealth(); err != nil {
+		httpError(w, r, err, 503)
+		return
 	}
+	fmt.Fprint(w, "OK")
+}
 
-	checkBuf := append(header[4:], body...)
-	if crc32.ChecksumIEEE(checkBuf) != crc {
-		return "", errors.New("data corrupted")
+func (s *server) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
+	if err := s.db.SyncCheckpoint(); err != nil {
+		httpError(w, r, err, 500)
+		return
 	}
-
-	return string(body[kSize:]), nil
+	fmt.Fprint(w, "OK")
 }
 
-func (db *MiniDB) Del(key string) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	delete(db.indexes, key)
+// /rotate 结束当前活跃分段并开始新的分段，之前的分段不再改变，Merge 期间返回 409
+func (s *server) handleRotate(w http.ResponseWriter, r *http.Request) {
+	err := s.db.Rotate()
+	if errors.Is(err, minidb.ErrMergeInProgress) {
+		httpError(w, r, err, 409)
+		return
+	}
+	if err != nil {
+		httpError(w, r, err, 500)
+		return
+	}
+	fmt.Fprint(w, "OK")
 }
 
-func (db *MiniDB) Merge() error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	log.Println("Starting merge process...")
+// /maintenance?on=1 冻结写入，on=0 恢复，不带参数时返回当前状态
+func (s *server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("on") {
+	case "1":
+		s.db.SetMaintenanceMode(true)
+	case "0":
+		s.db.SetMaintenanceMode(false)
+	case "":
+	default:
+		httpError(w, r, errInvalidSwitch, 400)
+		return
+	}
+	if s.db.InMaintenanceMode() {
+		fmt.Fprint(w, "on")
+	} else {
+		fmt.Fprint(w, "off")
+	}
+}
 
-	mergeFile, err := os.OpenFile(MergeFileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+func (s *server) handleMerge(w http.ResponseWriter, r *http.Request) {
+	done, err := s.db.TryMerge()
+	if errors.Is(err, minidb.ErrMergeInProgress) {
+		httpError(w, r, err, 409)
+		return
+	}
 	if err != nil {
-		return err
+		httpError(w, r, err, 500)
+		return
 	}
-	defer mergeFile.Close()
+	go func() {
+		if err := <-done; err != nil {
+			log.Printf("Merge failed: %v", err)
+		}
+	}()
+	fmt.Fprint(w, "Merge task started")
+}
 
-	newIndexes := make(map[string]int64)
-	var newOffset int64 = 0
+// accessLog 为每个请求通过标准库 log (输出位置由 log.SetOutput 决定) 记录一行访问日志:
+// 方法、路径、key、状态码和耗时。value 可能包含敏感数据，不记录请求体和 value 参数
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		next.ServeHTTP(rec, r)
+		log.Printf("%s %s key=%q status=%d latency=%v",
+			r.Method, r.URL.Path, r.URL.Query().Get("key"), rec.status, time.Since(start))
+	})
+}
 
-	for key, oldOffset := range db.indexes {
-		header := make([]byte, HeaderSize)
-		db.file.ReadAt(header, oldOffset)
-		_, _, kSize, vSize := DecodeHeader(header)
+// statusRecorder 记录 handler 写出的状态码，Flush 透传给底层连接，/export 的流式输出不受影响
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
 
-		raw := make([]byte, HeaderSize+kSize+vSize)
-		db.file.ReadAt(raw, oldOffset)
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
 
-		n, err := mergeFile.Write(raw)
+// requestValue 返回 /set 的 value: POST 时取自请求体，否则取自查询参数 value。
+// 超过 limit 时返回 413，请求体在读取时就限制大小，不会先把超大的请求体读进内存
+func requestValue(w http.ResponseWriter, r *http.Request, limit int) (string, bool) {
+	val := r.URL.Query().Get("value")
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(limit)))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(w, r, minidb.ErrValueTooLarge, 413)
+			return "", false
+		}
 		if err != nil {
-			return err
+			httpError(w, r, err, 400)
+			return "", false
 		}
+		val = string(body)
+	}
+	if len(val) > limit {
+		httpError(w, r, minidb.ErrValueTooLarge, 413)
+		return "", false
+	}
+	return val, true
+}
 
-		newIndexes[key] = newOffset
-		newOffset += int64(n)
+func (s *server) put(w http.ResponseWriter, r *http.Request, key, val string) {
+	if err := s.db.Put(key, val); err != nil {
+		putError(w, r, err)
+		return
 	}
+	fmt.Fprint(w, "OK")
+}
 
-	db.file.Close()
-	os.Remove(DBFileName)
-	os.Rename(MergeFileName, DBFileName)
+// etagFor 返回 /get 的 ETag。关闭 CRC 时所有记录的 CRC 都是 0，再加上记录在文件中的位置和时间戳才能区分不同的写入
+func etagFor(info minidb.KeyInfo) string {
+	return fmt.Sprintf(`"%x-%x-%08x"`, info.Offset, info.Timestamp.Unix(), info.CRC)
+}
 
-	file, err := os.OpenFile(DBFileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
-	if err != nil {
-		return err
+// readError 按读取失败的原因选择状态码，关闭后的读取返回 503 而不是 404
+func readError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, minidb.ErrClosed) {
+		httpError(w, r, err, 503)
+		return
 	}
-	db.file = file
-	db.indexes = newIndexes
-	db.offset = newOffset
+	httpError(w, r, notFoundOrError{err}, 404)
+}
 
-	log.Printf("Merge complete. Reclaimed space. New file size: %d", newOffset)
-	return nil
+// putError 按写入失败的原因选择状态码
+func putError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, minidb.ErrTooManyKeys) || errors.Is(err, minidb.ErrLowDiskSpace) || errors.Is(err, minidb.ErrFileFull):
+		httpError(w, r, err, 507)
+	case errors.Is(err, minidb.ErrValueTooLarge):
+		httpError(w, r, err, 413)
+	case errors.Is(err, minidb.ErrMaintenanceMode):
+		httpError(w, r, err, 503)
+	default:
+		httpError(w, r, err, 500)
+	}
 }
 
-func (db *MiniDB) Close() {
-	db.file.Close()
+type exportLine struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Base64 bool   `json:"base64,omitempty"`
 }
 
-// ==========================================
-// 3. HTTP 接口
-// ==========================================
+// verifyLine 是 /verify 输出的一行，只有一个字段非空
+type verifyLine struct {
+	Corrupt  *corruptRecord         `json:"corrupt,omitempty"`
+	Progress *minidb.VerifyProgress `json:"progress,omitempty"`
+	Done     *minidb.VerifyProgress `json:"done,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+}
 
-var db *MiniDB
+// corruptRecord 是一条损坏的记录，expected 和 actual 都为 0 表示记录不完整，value_log 表示 offset 在 value log 中
+type corruptRecord struct {
+	Offset   int64  `json:"offset"`
+	Key      string `json:"key,omitempty"`
+	Expected uint32 `json:"expected"`
+	Actual   uint32 `json:"actual"`
+	ValueLog bool   `json:"value_log,omitempty"`
+}
 
-func main() {
-	var err error
-	db, err = Open()
-	if err != nil {
-		log.Fatalf("Init DB failed: %v", err)
+// serveRange 按 Range 头 (只支持单个区间 bytes=a-b、bytes=a-、bytes=-n) 返回 206，
+// 只读取请求的部分。无法识别的 Range 返回 false，由调用方返回完整的 value
+func (s *server) serveRange(w http.ResponseWriter, r *http.Request, key, rng string) bool {
+	spec, ok := strings.CutPrefix(rng, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return false
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return false
 	}
-	defer db.Close()
 
-	http.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-		val := r.URL.Query().Get("value")
-		if key == "" {
-			http.Error(w, "key required", 400)
-			return
+	total, err := s.db.ValueSize(key)
+	if err != nil {
+		readError(w, r, err)
+		return true
+	}
+	var start, end int64 // [start, end]
+	switch {
+	case first == "":
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return false
 		}
-
-		if err := db.Put(key, val); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
+		start, end = max(total-n, 0), total-1
+	default:
+		if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+			return false
 		}
-		fmt.Fprint(w, "OK")
-	})
+		end = total - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+				return false
+			}
+			end = min(end, total-1)
+		}
+	}
+	if start >= total || start > end {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+		httpError(w, r, minidb.ErrInvalidRange, 416)
+		return true
+	}
 
-	http.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-		val, err := db.Get(key)
-		if err != nil {
-			http.Error(w, "not found or error", 404)
-			return
+	data, err := s.db.GetRange(key, start, end-start+1)
+	if err != nil {
+		httpError(w, r, err, 500)
+		return true
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+int64(len(data))-1, total))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(206)
+	w.Write(data)
+	return true
+}
+
+// apiError 是请求的 Accept 包含 application/json 时返回的错误格式
+type apiError struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// errorCodes 把引擎和请求参数的错误映射为稳定的错误码，客户端按 code 判断而不用解析错误信息
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{minidb.ErrKeyNotFound, "KEY_NOT_FOUND"},
+	{minidb.ErrDataCorrupted, "DATA_CORRUPTED"},
+	{minidb.ErrValueTooLarge, "VALUE_TOO_LARGE"},
+	{minidb.ErrEmptyKey, "EMPTY_KEY"},
+	{minidb.ErrTooManyKeys, "TOO_MANY_KEYS"},
+	{minidb.ErrLowDiskSpace, "LOW_DISK_SPACE"},
+	{minidb.ErrFileFull, "FILE_FULL"},
+	{minidb.ErrMaintenanceMode, "MAINTENANCE_MODE"},
+	{minidb.ErrMergeInProgress, "MERGE_IN_PROGRESS"},
+	{minidb.ErrInvalidRange, "INVALID_RANGE"},
+	{minidb.ErrIncompatibleFormat, "INCOMPATIBLE_FORMAT"},
+	{minidb.ErrReadOnly, "READ_ONLY"},
+	{minidb.ErrClosed, "CLOSED"},
+	{minidb.ErrHotKeysDisabled, "HOT_KEYS_DISABLED"},
+	{errKeyRequired, "KEY_REQUIRED"},
+	{errValueRequired, "VALUE_REQUIRED"},
+	{errInvalidBase64, "INVALID_BASE64"},
+	{errPrefixRequired, "PREFIX_REQUIRED"},
+	{errPostRequired, "POST_REQUIRED"},
+	{errInvalidLimit, "INVALID_LIMIT"},
+	{errInvalidSwitch, "INVALID_SWITCH"},
+	{errKeyExists, "KEY_EXISTS"},
+	{errInvalidOffset, "INVALID_OFFSET"},
+}
+
+// errorCode 返回 err 对应的错误码，不在 errorCodes 中的按状态码生成，例如 INTERNAL_SERVER_ERROR
+func errorCode(err error, status int) string {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
 		}
-		fmt.Fprint(w, val)
-	})
+	}
+	return strings.ToUpper(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
 
-	http.HandleFunc("/del", func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-		db.Del(key)
-		fmt.Fprint(w, "OK")
-	})
+// notFoundOrError 让读取失败时的纯文本响应保持 "not found or error"，JSON 中仍按原始错误给出 code
+type notFoundOrError struct {
+	err error
+}
 
-	http.HandleFunc("/merge", func(w http.ResponseWriter, r *http.Request) {
-		go func() {
-			if err := db.Merge(); err != nil {
-				log.Printf("Merge failed: %v", err)
-			}
-		}()
-		fmt.Fprint(w, "Merge task started")
-	})
+func (e notFoundOrError) Error() string { return "not found or error" }
+func (e notFoundOrError) Unwrap() error { return e.err }
 
-	log.Println("Server running at :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+// httpError 默认与 http.Error 相同返回纯文本，请求的 Accept 包含 application/json 时
+// 返回 {"error":"...","code":"..."}
+func httpError(w http.ResponseWriter, r *http.Request, err error, status int) {
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Error: err.Error(), Code: errorCode(err, status)})
+}
+
+// acceptsGzip 判断客户端的 Accept-Encoding 是否接受 gzip (q=0 表示明确拒绝)
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
 }
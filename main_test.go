@@ -0,0 +1,807 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"minikv/minidb"
+)
+
+// newTestServer 在临时目录打开一个库并注册所有路由
+func newTestServer(t *testing.T, opts minidb.Options) (http.Handler, *minidb.MiniDB) {
+	t.Helper()
+	opts.FilePrefix = filepath.Join(t.TempDir(), minidb.DefaultFilePrefix)
+	db, err := minidb.OpenWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return newMux(db, true), db
+}
+
+// do 发出一个请求，body 非空时以 POST 发送
+func do(h http.Handler, target, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if body != "" {
+		req = httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDebugEntriesOnlyWithDebug(t *testing.T) {
+	_, db := newTestServer(t, minidb.Options{})
+	for _, debug := range []bool{false, true} {
+		rec := do(newMux(db, debug), "/debug/entries", "")
+		if got := rec.Code == 200; got != debug {
+			t.Errorf("debug=%v: /debug/entries returned %d", debug, rec.Code)
+		}
+	}
+}
+
+func TestSetThenGet(t *testing.T) {
+	h, _ := newTestServer(t, minidb.Options{})
+	if rec := do(h, "/set?key=a", "hello"); rec.Code != 200 {
+		t.Fatalf("/set = %d %s", rec.Code, rec.Body)
+	}
+	rec := do(h, "/get?key=a", "")
+	if body, _ := io.ReadAll(rec.Body); rec.Code != 200 || string(body) != "hello" {
+		t.Fatalf("/get = %d %q", rec.Code, body)
+	}
+}
+
+func TestETagDistinguishesWritesWithoutCRC(t *testing.T) {
+	for _, disableCRC := range []bool{false, true} {
+		db, err := minidb.OpenWithOptions(minidb.Options{
+			FilePrefix: filepath.Join(t.TempDir(), minidb.DefaultFilePrefix),
+			DisableCRC: disableCRC,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		seen := make(map[string]string)
+		for _, v := range []string{"aaaa", "bbbb", "aaaa"} {
+			if err := db.Put("k", v); err != nil {
+				t.Fatal(err)
+			}
+			info, err := db.KeyInfo("k")
+			if err != nil {
+				t.Fatal(err)
+			}
+			etag := etagFor(info)
+			if prev, ok := seen[etag]; ok {
+				t.Fatalf("DisableCRC=%v: %q and %q share ETag %s", disableCRC, prev, v, etag)
+			}
+			seen[etag] = v
+		}
+	}
+}
+
+func TestSetB64(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		status int
+		want   string // 写入成功后 /get 的结果
+	}{
+		{name: "std encoding", target: "/setb64?key=k&value=AP8%3D", status: 200, want: "\x00\xff"},
+		{name: "url encoding", target: "/setb64?key=k&value=_w%3D%3D", status: 200, want: "\xff"},
+		{name: "body", target: "/setb64?key=k", body: "aGVsbG8=", status: 200, want: "hello"},
+		{name: "invalid", target: "/setb64?key=k&value=!!", status: 400},
+		{name: "missing key", target: "/setb64?value=AA==", status: 400},
+		{name: "empty value", target: "/setb64?key=k&value=", status: 400},
+		{name: "empty value allowed", target: "/setb64?key=k&value=&allowempty=1", status: 200, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, db := newTestServer(t, minidb.Options{})
+			rec := do(h, tt.target, tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.status)
+			}
+			v, err := db.Get("k")
+			if tt.status != 200 {
+				if err == nil {
+					t.Fatalf("rejected request stored %q", v)
+				}
+				return
+			}
+			if err != nil || v != tt.want {
+				t.Fatalf("Get = %q, %v, want %q", v, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyEndpoint(t *testing.T) {
+	h, db := newTestServer(t, minidb.Options{})
+	for _, k := range []string{"a", "b"} {
+		if err := db.Put(k, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec := do(h, "/verify", "")
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("/verify = %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var last verifyLine
+	for dec := json.NewDecoder(rec.Body); dec.More(); {
+		if err := dec.Decode(&last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if last.Done == nil || last.Done.Records != 2 || last.Done.Corrupt != 0 {
+		t.Fatalf("last line = %+v, want done with 2 clean records", last)
+	}
+}
+
+func TestScanEndpoint(t *testing.T) {
+	h, db := newTestServer(t, minidb.Options{})
+	for _, k := range []string{"user:3", "user:1", "item:1", "user:2"} {
+		if err := db.Put(k, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		target string
+		status int
+		want   string
+	}{
+		{"/scan?prefix=user:&limit=2", 200, `{"keys":["user:1","user:2"],"next":"user:2"}`},
+		{"/scan?prefix=user:&limit=2&after=user:2", 200, `{"keys":["user:3"],"next":""}`},
+		{"/scan", 200, `{"keys":["item:1","user:1","user:2","user:3"],"next":""}`},
+		{"/scan?limit=0", 400, ""},
+		{"/scan?limit=x", 400, ""},
+	}
+	for _, tt := range tests {
+		rec := do(h, tt.target, "")
+		if rec.Code != tt.status {
+			t.Errorf("%s = %d, want %d", tt.target, rec.Code, tt.status)
+			continue
+		}
+		if got := strings.TrimSpace(rec.Body.String()); tt.status == 200 && got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestSetEmptyValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"missing value", "/set?key=k", 400},
+		{"empty value", "/set?key=k&value=", 400},
+		{"explicit empty", "/set?key=k&value=&allowempty=1", 200},
+		{"missing value allowed", "/set?key=k&allowempty=1", 200},
+		{"setnx missing value", "/setnx?key=k", 400},
+		{"setnx explicit empty", "/setnx?key=k&allowempty=1", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, db := newTestServer(t, minidb.Options{})
+			rec := do(h, tt.target, "")
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.status)
+			}
+			v, err := db.Get("k")
+			if tt.status != 200 {
+				if err == nil {
+					t.Fatalf("rejected request stored %q", v)
+				}
+				return
+			}
+			if err != nil || v != "" {
+				t.Fatalf("Get = %q, %v, want an empty value", v, err)
+			}
+		})
+	}
+}
+
+func TestGetGzip(t *testing.T) {
+	h, db := newTestServer(t, minidb.Options{})
+	large, small := strings.Repeat("compressible ", gzipMinSize), "small"
+	if err := db.Put("large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("small", small); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key, accept string
+		gzipped     bool
+	}{
+		{"large", "gzip, deflate", true},
+		{"large", "", false},
+		{"large", "gzip;q=0", false},
+		{"small", "gzip", false},
+	}
+	for _, tt := range tests {
+		rec := do(h, "/get?key="+tt.key, "", "Accept-Encoding", tt.accept)
+		if rec.Code != 200 {
+			t.Fatalf("%s with %q = %d", tt.key, tt.accept, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Encoding") == "gzip"; got != tt.gzipped {
+			t.Fatalf("%s with %q: Content-Encoding = %q", tt.key, tt.accept, rec.Header().Get("Content-Encoding"))
+		}
+		var body io.Reader = rec.Body
+		if tt.gzipped {
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = zr
+		}
+		got, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := db.Get(tt.key); string(got) != want {
+			t.Fatalf("%s with %q: body has %d bytes, want %d", tt.key, tt.accept, len(got), len(want))
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	h, db := newTestServer(t, minidb.Options{})
+	want := map[string]string{"a": "text", "b": "\xff\x00binary", "c": ""}
+	for k, v := range want {
+		if err := db.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("deleted", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Del("deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := do(h, "/export", "")
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("/export = %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	got := make(map[string]string)
+	for _, l := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		var line exportLine
+		if err := json.Unmarshal([]byte(l), &line); err != nil {
+			t.Fatalf("line %q: %v", l, err)
+		}
+		if line.Base64 {
+			raw, err := base64.StdEncoding.DecodeString(line.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			line.Value = string(raw)
+		}
+		got[line.Key] = line.Value
+	}
+	if len(got) != len(want) {
+		t.Fatalf("exported %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("exported %s = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestMeta(t *testing.T) {
+	h, db := newTestServer(t, minidb.Options{})
+	before := time.Now().Truncate(time.Second)
+	for _, kv := range [][2]string{{"a", "hello"}, {"b", "hi"}} {
+		if err := db.Put(kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := do(h, "/meta?key=a", "")
+	if rec.Code != 200 {
+		t.Fatalf("/meta = %d %s", rec.Code, rec.Body)
+	}
+	var info minidb.KeyInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	// 第一条记录紧跟在文件头之后，占用记录头、key 和 value
+	want := minidb.KeyInfo{Key: "a", ValueSize: 5, Offset: minidb.FileHeaderSize, Size: minidb.HeaderSize + 1 + 5}
+	if info.Key != want.Key || info.ValueSize != want.ValueSize || info.Offset != want.Offset || info.Size != want.Size {
+		t.Fatalf("/meta = %+v, want %+v", info, want)
+	}
+	if info.Timestamp.Before(before) || info.Timestamp.After(time.Now()) || info.CRC == 0 {
+		t.Fatalf("/meta timestamp %v, crc %x", info.Timestamp, info.CRC)
+	}
+	if strings.Contains(rec.Body.String(), "hello") {
+		t.Fatalf("/meta returned the value: %s", rec.Body)
+	}
+
+	rec = do(h, "/meta?key=b&key=missing&key=a", "")
+	var infos []minidb.KeyInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != 200 || len(infos) != 2 || infos[0].Key != "b" || infos[1].Key != "a" || infos[1].Offset != info.Offset {
+		t.Fatalf("multi-key /meta = %d %s", rec.Code, rec.Body)
+	}
+
+	for target, status := range map[string]int{"/meta": 400, "/meta?key=missing": 404} {
+		if rec := do(h, target, ""); rec.Code != status {
+			t.Errorf("%s = %d, want %d", target, rec.Code, status)
+		}
+	}
+}
+
+func TestSetValueTooLarge(t *testing.T) {
+	huge := strings.Repeat("x", maxValueSize+1)
+	tests := []struct {
+		name         string
+		target, body string
+	}{
+		{"query", "/set?key=k&value=" + huge, ""},
+		{"body", "/set?key=k", huge},
+		{"setnx body", "/setnx?key=k", huge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, db := newTestServer(t, minidb.Options{})
+			if rec := do(h, tt.target, tt.body); rec.Code != 413 {
+				t.Fatalf("status = %d, want 413", rec.Code)
+			}
+			if _, err := db.Get("k"); !errors.Is(err, minidb.ErrKeyNotFound) {
+				t.Fatalf("Get after 413 = %v, want ErrKeyNotFound", err)
+			}
+		})
+	}
+	h, _ := newTestServer(t, minidb.Options{})
+	if rec := do(h, "/set?key=k", huge[1:]); rec.Code != 200 {
+		t.Fatalf("value of exactly maxValueSize = %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	h, _ := newTestServer(t, minidb.Options{})
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	h = accessLog(h)
+	do(h, "/set?key=user%3A1&value=secret", "")
+	do(h, "/get?key=missing", "")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines: %q", len(lines), buf.String())
+	}
+	for i, want := range []string{`GET /set key="user:1" status=200 latency=`, `GET /get key="missing" status=404 latency=`} {
+		if !strings.Contains(lines[i], want) {
+			t.Errorf("line %d = %q, want it to contain %q", i, lines[i], want)
+		}
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Fatalf("access log leaked the value: %q", buf.String())
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	h, db := newTestServer(t, minidb.Options{})
+	accept := []string{"Accept", "application/json"}
+	tests := []struct {
+		name   string
+		rec    *httptest.ResponseRecorder
+		status int
+		want   apiError
+	}{
+		{"not found", do(h, "/get?key=missing", "", accept...), 404, apiError{"not found or error", "KEY_NOT_FOUND"}},
+		{"bad request", do(h, "/set", "", accept...), 400, apiError{errKeyRequired.Error(), "KEY_REQUIRED"}},
+		{"unmapped", func() *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(accept[0], accept[1])
+			httpError(rec, req, errors.New("disk on fire"), 500)
+			return rec
+		}(), 500, apiError{"disk on fire", "INTERNAL_SERVER_ERROR"}},
+		{"closed", func() *httptest.ResponseRecorder {
+			db.Close()
+			return do(h, "/del?key=k", "", accept...)
+		}(), 500, apiError{minidb.ErrClosed.Error(), "CLOSED"}},
+	}
+	for _, tt := range tests {
+		if tt.rec.Code != tt.status || tt.rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: %d %q, want %d application/json", tt.name, tt.rec.Code, tt.rec.Header().Get("Content-Type"), tt.status)
+			continue
+		}
+		var got apiError
+		if err := json.Unmarshal(tt.rec.Body.Bytes(), &got); err != nil || got != tt.want {
+			t.Errorf("%s: body %s, want %+v", tt.name, tt.rec.Body, tt.want)
+		}
+	}
+
+	// 默认仍然是纯文本
+	if rec := do(h, "/set", ""); rec.Code != 400 || strings.TrimSpace(rec.Body.String()) != errKeyRequired.Error() {
+		t.Fatalf("plain text error = %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestGetDefault(t *testing.T) {
+	h, db := newTestServer(t, minidb.Options{})
+	if err := db.Put("a", "present"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target string
+		status int
+		want   string
+	}{
+		{"/get?key=a", 200, "present"},
+		{"/get?key=a&default=x", 200, "present"},
+		{"/get?key=missing", 404, ""},
+		{"/get?key=missing&default=x", 200, "x"},
+		{"/get?key=missing&default=", 200, ""},
+	}
+	for _, tt := range tests {
+		rec := do(h, tt.target, "")
+		if rec.Code != tt.status {
+			t.Errorf("%s = %d, want %d", tt.target, rec.Code, tt.status)
+			continue
+		}
+		if tt.status == 200 && rec.Body.String() != tt.want {
+			t.Errorf("%s = %q, want %q", tt.target, rec.Body, tt.want)
+		}
+	}
+}
+
+func TestDebugEntries(t *testing.T) {
+	h, db := newTestServer(t, minidb.Options{})
+	if err := db.Put("a", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("b", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Del("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	type page struct {
+		Entries []minidb.EntryInfo `json:"entries"`
+		Next    int64              `json:"next"`
+	}
+	get := func(target string) page {
+		t.Helper()
+		rec := do(h, target, "")
+		var p page
+		if rec.Code != 200 {
+			t.Fatalf("%s = %d %s", target, rec.Code, rec.Body)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	first := get("/debug/entries?limit=2")
+	second := get(fmt.Sprintf("/debug/entries?offset=%d&limit=2", first.Next))
+	got := append(first.Entries, second.Entries...)
+	want := []struct {
+		key, typ  string
+		offset    int64
+		valueSize uint32
+	}{
+		{"a", "data", minidb.FileHeaderSize, 5},
+		{"b", "data", minidb.FileHeaderSize + minidb.HeaderSize + 1 + 5, 1},
+		{"a", "tombstone", minidb.FileHeaderSize + 2*minidb.HeaderSize + 1 + 5 + 1 + 1, 0},
+	}
+	if len(got) != len(want) || first.Next != want[2].offset || second.Next != 0 {
+		t.Fatalf("pages = %+v, %+v", first, second)
+	}
+	for i, w := range want {
+		e := got[i]
+		if e.Key != w.key || e.Type != w.typ || e.Offset != w.offset || e.ValueSize != w.valueSize || !e.CRCValid || e.Timestamp.IsZero() {
+			t.Errorf("entry %d = %+v, want %+v", i, e, w)
+		}
+	}
+
+	for _, target := range []string{"/debug/entries?limit=0", "/debug/entries?offset=-1", "/debug/entries?offset=3"} {
+		if rec := do(h, target, ""); rec.Code != 400 {
+			t.Errorf("%s = %d, want 400", target, rec.Code)
+		}
+	}
+}
+
+func TestRawIngestRoundTrip(t *testing.T) {
+	for _, opts := range []minidb.Options{{}, {ChunkSize: 8}} {
+		leader, src := newTestServer(t, opts)
+		follower, dst := newTestServer(t, opts)
+		values := map[string]string{"a": "hello", "b": strings.Repeat("long value ", 10), "c": "\x00\xff"}
+		for k, v := range values {
+			if err := src.Put(k, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for k, v := range values {
+			raw := do(leader, "/raw?key="+k, "")
+			if raw.Code != 200 {
+				t.Fatalf("/raw?key=%s = %d", k, raw.Code)
+			}
+			if rec := do(follower, "/ingest", raw.Body.String()); rec.Code != 200 {
+				t.Fatalf("/ingest %s = %d %s", k, rec.Code, rec.Body)
+			}
+			if got, err := dst.Get(k); err != nil || got != v {
+				t.Fatalf("ChunkSize=%d: follower Get(%q) = %q, %v, want %q", opts.ChunkSize, k, got, err, v)
+			}
+			// 记录原样写入，时间戳和 CRC 与源库相同
+			want, _ := src.KeyInfo(k)
+			got, _ := dst.KeyInfo(k)
+			if !got.Timestamp.Equal(want.Timestamp) || got.CRC != want.CRC || got.Size != want.Size {
+				t.Fatalf("follower KeyInfo(%q) = %+v, want %+v", k, got, want)
+			}
+		}
+
+		if rec := do(leader, "/raw?key=missing", ""); rec.Code != 404 {
+			t.Fatalf("/raw of a missing key = %d", rec.Code)
+		}
+		if rec := do(follower, "/ingest", "garbage"); rec.Code != 400 {
+			t.Fatalf("/ingest of garbage = %d", rec.Code)
+		}
+	}
+
+	// 写入错误与 /set 一致: 超过 MaxFileSize 的记录返回 413
+	leader, src := newTestServer(t, minidb.Options{})
+	small, _ := newTestServer(t, minidb.Options{MaxFileSize: 64})
+	if err := src.Put("big", strings.Repeat("x", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(small, "/ingest", do(leader, "/raw?key=big", "").Body.String()); rec.Code != 413 {
+		t.Fatalf("/ingest of a record larger than MaxFileSize = %d %s, want 413", rec.Code, rec.Body)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	dir := t.TempDir()
+	db, err := minidb.OpenWithOptions(minidb.Options{FilePrefix: filepath.Join(dir, minidb.DefaultFilePrefix)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := newMux(db, false)
+	if rec := do(h, "/healthz", ""); rec.Code != 200 {
+		t.Fatalf("/healthz = %d %s", rec.Code, rec.Body)
+	}
+	if err := os.Remove(filepath.Join(dir, minidb.DBFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(h, "/healthz", ""); rec.Code != 503 {
+		t.Fatalf("/healthz after removing the data file = %d, want 503", rec.Code)
+	}
+}
+
+// readCountingFS 统计从数据文件读取的字节数
+type readCountingFS struct {
+	minidb.FileSystem
+	n int64
+}
+
+type readCountingFile struct {
+	minidb.Storage
+	n *int64
+}
+
+func (fs *readCountingFS) OpenFile(name string, flag int) (minidb.Storage, error) {
+	f, err := fs.FileSystem.OpenFile(name, flag)
+	if err != nil || filepath.Base(name) != minidb.DBFileName {
+		return f, err
+	}
+	return readCountingFile{f, &fs.n}, nil
+}
+
+func (f readCountingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.Storage.ReadAt(p, off)
+	*f.n += int64(n)
+	return n, err
+}
+
+func TestCheckpointSkipsFullScan(t *testing.T) {
+	dir := t.TempDir()
+	opts := minidb.Options{FilePrefix: filepath.Join(dir, minidb.DefaultFilePrefix)}
+	db, err := minidb.OpenWithOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), strings.Repeat("v", 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stat, err := os.Stat(filepath.Join(dir, minidb.DBFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 不关闭 db 直接以只读方式再打开一次，相当于在这一刻崩溃后重启
+	scanned := func() int64 {
+		t.Helper()
+		fs := &readCountingFS{FileSystem: minidb.OSFS}
+		ro := opts
+		ro.ReadOnly, ro.FS = true, fs
+		db, err := minidb.OpenWithOptions(ro)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if n := db.Stats().Keys; n != 1000 {
+			t.Fatalf("reopened with %d keys", n)
+		}
+		return fs.n
+	}
+	if n := scanned(); n < stat.Size()/2 {
+		t.Fatalf("reopen before /checkpoint read %d of %d bytes, want a full scan", n, stat.Size())
+	}
+	if rec := do(newMux(db, false), "/checkpoint", ""); rec.Code != 200 {
+		t.Fatalf("/checkpoint = %d %s", rec.Code, rec.Body)
+	}
+	if n := scanned(); n > stat.Size()/10 {
+		t.Fatalf("reopen after /checkpoint read %d of %d bytes, want the hint file to be used", n, stat.Size())
+	}
+}
+
+// TestRotateEndpoint /rotate 之后的写入进入新分段，之前的分段保持不变
+func TestRotateEndpoint(t *testing.T) {
+	h, db := newTestServer(t, minidb.Options{})
+	if rec := do(h, "/set?key=a", "1"); rec.Code != 200 {
+		t.Fatalf("/set = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(h, "/rotate", ""); rec.Code != 200 || rec.Body.String() != "OK" {
+		t.Fatalf("/rotate = %d %s", rec.Code, rec.Body)
+	}
+	before := db.Segments()
+	if len(before) != 2 || before[0].Active || !before[1].Active {
+		t.Fatalf("segments after /rotate %+v", before)
+	}
+	if rec := do(h, "/set?key=b", "2"); rec.Code != 200 {
+		t.Fatalf("/set = %d %s", rec.Code, rec.Body)
+	}
+	after := db.Segments()
+	if len(after) != 2 || after[0] != before[0] || after[1].Size <= before[1].Size {
+		t.Fatalf("segments after /set %+v, before %+v", after, before)
+	}
+}
+
+func TestMaintenanceEndpoint(t *testing.T) {
+	h, _ := newTestServer(t, minidb.Options{})
+	if rec := do(h, "/set?key=a", "1"); rec.Code != 200 {
+		t.Fatalf("/set = %d %s", rec.Code, rec.Body)
+	}
+	steps := []struct {
+		target, body string
+		wantCode     int
+		wantBody     string
+	}{
+		{"/maintenance", "", 200, "off"},
+		{"/maintenance?on=1", "", 200, "on"},
+		{"/maintenance", "", 200, "on"},
+		{"/set?key=a", "2", 503, ""},
+		{"/del?key=a", "", 503, ""},
+		{"/get?key=a", "", 200, "1"},
+		{"/maintenance?on=yes", "", 400, ""},
+		{"/maintenance?on=0", "", 200, "off"},
+		{"/set?key=a", "2", 200, "OK"},
+		{"/get?key=a", "", 200, "2"},
+	}
+	for _, s := range steps {
+		rec := do(h, s.target, s.body)
+		if rec.Code != s.wantCode || (s.wantBody != "" && rec.Body.String() != s.wantBody) {
+			t.Fatalf("%s = %d %q, want %d %q", s.target, rec.Code, rec.Body, s.wantCode, s.wantBody)
+		}
+	}
+}
+
+func TestDelPrefix(t *testing.T) {
+	h, db := newTestServer(t, minidb.Options{})
+	for _, k := range []string{"tmp:1", "tmp:2", "keep"} {
+		if err := db.Put(k, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rec := do(h, "/delprefix", ""); rec.Code != 400 {
+		t.Fatalf("/delprefix without a prefix = %d, want 400", rec.Code)
+	}
+	if rec := do(h, "/delprefix?prefix=tmp:", ""); rec.Code != 200 || rec.Body.String() != "OK 2" {
+		t.Fatalf("/delprefix = %d %q, want OK 2", rec.Code, rec.Body)
+	}
+	for k, want := range map[string]int{"tmp:1": 404, "tmp:2": 404, "keep": 200} {
+		if rec := do(h, "/get?key="+k, ""); rec.Code != want {
+			t.Errorf("/get?key=%s = %d, want %d", k, rec.Code, want)
+		}
+	}
+}
+
+func TestHotKeysEndpoint(t *testing.T) {
+	h, db := newTestServer(t, minidb.Options{HotKeys: 8})
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Put(k, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		do(h, "/get?key=b", "")
+	}
+	do(h, "/get?key=a", "")
+
+	rec := do(h, "/stats/hotkeys?limit=2", "")
+	var keys []minidb.HotKey
+	if err := json.Unmarshal(rec.Body.Bytes(), &keys); rec.Code != 200 || err != nil {
+		t.Fatalf("/stats/hotkeys = %d %s, %v", rec.Code, rec.Body, err)
+	}
+	if len(keys) != 2 || keys[0].Key != "b" || keys[0].Reads != 20 || keys[1].Key != "a" {
+		t.Fatalf("/stats/hotkeys?limit=2 = %+v, want b then a", keys)
+	}
+	if rec := do(h, "/stats/hotkeys?limit=0", ""); rec.Code != 400 {
+		t.Fatalf("/stats/hotkeys?limit=0 = %d, want 400", rec.Code)
+	}
+	disabled, _ := newTestServer(t, minidb.Options{})
+	if rec := do(disabled, "/stats/hotkeys", ""); rec.Code != 404 {
+		t.Fatalf("/stats/hotkeys without -hot-keys = %d, want 404", rec.Code)
+	}
+}
+
+func TestSetNXConcurrent(t *testing.T) {
+	h, _ := newTestServer(t, minidb.Options{})
+	const workers = 20
+	codes := make(chan int, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes <- do(h, "/setnx?key=lock", fmt.Sprintf("owner-%d", i)).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	count := map[int]int{}
+	for c := range codes {
+		count[c]++
+	}
+	if count[200] != 1 || count[409] != workers-1 {
+		t.Fatalf("/setnx status counts = %v, want one 200 and %d 409", count, workers-1)
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	h, _ := newTestServer(t, minidb.Options{})
+	rec := do(h, "/version", "")
+	var got struct {
+		Engine    string `json:"engine"`
+		Format    int    `json:"format"`
+		MaxFormat int    `json:"max_format"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); rec.Code != 200 || err != nil {
+		t.Fatalf("/version = %d %s, %v", rec.Code, rec.Body, err)
+	}
+	if got.Engine != minidb.EngineVersion || got.Format != minidb.FormatVersion || got.MaxFormat != minidb.FormatVersion {
+		t.Fatalf("/version = %+v, want engine %s and format %d for a new database", got, minidb.EngineVersion, minidb.FormatVersion)
+	}
+}
@@ -0,0 +1,106 @@
+package minidb
+
+import "hash/maphash"
+
+// ==========================================
+// 15. 布隆过滤器 (Bloom Filter)
+// ==========================================
+
+// 每个 key 占用的位数和哈希函数个数，误判率约 1%
+const (
+	bloomBitsPerKey  = 10
+	bloomHashes      = 7
+	bloomInitialKeys = 1 << 16
+)
+
+// bloomIndex 在索引前面加一层布隆过滤器，确定不存在的 key 不再查索引。
+// 过滤器不支持删除，删除的 key 只会增加误判；写满后追加一个容量翻倍的新过滤器，不需要重建。
+// 单个数据文件时 mapIndex 本身的未命中已经是 O(1)，主要收益在 HashedIndex 的哈希冲突链
+// 以及以后按 Segment 各自维护过滤器
+type bloomIndex struct {
+	index
+	seed    maphash.Seed
+	filters []*bloomFilter
+}
+
+func newBloomIndex(idx index) *bloomIndex {
+	return &bloomIndex{index: idx, seed: maphash.MakeSeed()}
+}
+
+func (b *bloomIndex) mayContain(hash uint64) bool {
+	for _, f := range b.filters {
+		if f.test(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *bloomIndex) get(key string) (recordPos, bool) {
+	if !b.mayContain(maphash.String(b.seed, key)) {
+		return recordPos{}, false
+	}
+	return b.index.get(key)
+}
+
+func (b *bloomIndex) set(key string, pos recordPos) (recordPos, bool) {
+	old, replaced := b.index.set(key, pos)
+	if !replaced {
+		n := len(b.filters)
+		if n == 0 || b.filters[n-1].full() {
+			capacity := bloomInitialKeys
+			if n > 0 {
+				capacity = b.filters[n-1].capacity * 2
+			}
+			b.filters = append(b.filters, newBloomFilter(capacity))
+		}
+		b.filters[len(b.filters)-1].add(maphash.String(b.seed, key))
+	}
+	return old, replaced
+}
+
+func (b *bloomIndex) memoryBytes() int64 {
+	n := b.index.memoryBytes()
+	for _, f := range b.filters {
+		n += int64(len(f.bits)) * 8
+	}
+	return n
+}
+
+type bloomFilter struct {
+	bits     []uint64
+	count    int
+	capacity int
+}
+
+func newBloomFilter(capacity int) *bloomFilter {
+	return &bloomFilter{
+		bits:     make([]uint64, (capacity*bloomBitsPerKey+63)/64),
+		capacity: capacity,
+	}
+}
+
+func (f *bloomFilter) full() bool { return f.count >= f.capacity }
+
+// add 和 test 用同一个 64 位哈希的高低两半组合出 bloomHashes 个位置
+func (f *bloomFilter) add(hash uint64) {
+	m := uint64(len(f.bits) * 64)
+	h1, h2 := hash&0xffffffff, hash>>32
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.count++
+}
+
+func (f *bloomFilter) test(hash uint64) bool {
+	m := uint64(len(f.bits) * 64)
+	h1, h2 := hash&0xffffffff, hash>>32
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package minidb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"testing"
+)
+
+// TestBloomNoFalseNegatives 写入的 key 跨越多个过滤器 (第一个写满后追加)，每一个都必须能查到
+func TestBloomNoFalseNegatives(t *testing.T) {
+	const keys = bloomInitialKeys*3 + 100
+	b := newBloomIndex(make(mapIndex))
+	for i := 0; i < keys; i++ {
+		b.set(fmt.Sprintf("key-%d", i), recordPos{offset: int64(i)})
+	}
+	if len(b.filters) < 2 {
+		t.Fatalf("%d filters, want the first to fill up", len(b.filters))
+	}
+	for i := 0; i < keys; i++ {
+		if pos, ok := b.get(fmt.Sprintf("key-%d", i)); !ok || pos.offset != int64(i) {
+			t.Fatalf("get(key-%d) = %+v, %v", i, pos, ok)
+		}
+	}
+
+	// 误判率只做粗略检查，每个过滤器约 1%，多个过滤器叠加后仍应远低于 10%
+	var fp int
+	const probes = 100000
+	for i := 0; i < probes; i++ {
+		if b.mayContain(maphash.String(b.seed, fmt.Sprintf("missing-%d", i))) {
+			fp++
+		}
+	}
+	if fp > probes/10 {
+		t.Errorf("%d of %d missing keys passed the filter", fp, probes)
+	}
+}
+
+// TestBloomFilterDB 覆盖 BulkLoad、Put、覆盖写、删除 和重新打开 (loadIndexes) 之后的查找
+func TestBloomFilterDB(t *testing.T) {
+	for _, opts := range []Options{{BloomFilter: true}, {BloomFilter: true, HashedIndex: true}} {
+		db := openTestDB(t, opts)
+		var buf bytes.Buffer
+		for i := 0; i < 500; i++ {
+			buf.Write(NewEntry([]byte(fmt.Sprintf("bulk-%d", i)), []byte("b")).EncodeOrder(db.order))
+		}
+		if err := db.BulkLoad(&buf); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 500; i++ {
+			if err := db.Put(fmt.Sprintf("put-%d", i), "v1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 500; i += 2 {
+			if err := db.Put(fmt.Sprintf("put-%d", i), "v2"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 500; i += 5 {
+			if err := db.Del(fmt.Sprintf("put-%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		check := func(db *MiniDB) {
+			t.Helper()
+			for i := 0; i < 500; i++ {
+				key, want := fmt.Sprintf("put-%d", i), "v1"
+				if i%2 == 0 {
+					want = "v2"
+				}
+				got, err := db.Get(key)
+				if i%5 == 0 {
+					if !errors.Is(err, ErrKeyNotFound) || db.Exists(key) {
+						t.Fatalf("HashedIndex=%v: deleted %s: Get = %q, %v", opts.HashedIndex, key, got, err)
+					}
+					continue
+				}
+				if err != nil || got != want || !db.Exists(key) {
+					t.Fatalf("HashedIndex=%v: Get(%s) = %q, %v, want %q", opts.HashedIndex, key, got, err, want)
+				}
+				if got, err := db.Get(fmt.Sprintf("bulk-%d", i)); err != nil || got != "b" {
+					t.Fatalf("HashedIndex=%v: Get(bulk-%d) = %q, %v", opts.HashedIndex, i, got, err)
+				}
+			}
+		}
+		check(db)
+		check(reopen(t, db))
+	}
+}
@@ -0,0 +1,123 @@
+package minidb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ==========================================
+// 16. 批量导入 (Bulk Load)
+// ==========================================
+
+var ErrNotEmpty = errors.New("database is not empty")
+
+const bulkBufferSize = 1 << 20
+
+// BulkLoad 把 r 中连续的编码记录 (Entry.EncodeOrder 的输出，字节序与本库相同，GetRaw 导出的记录也可以)
+// 顺序写入空数据库，全程只加一次锁，写入经过缓冲，比逐条 Put 快得多。
+// 只能用于空库的初始导入；任何一条记录不完整或校验失败都会回滚到导入前的空库
+func (db *MiniDB) BulkLoad(r io.Reader) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return db.update(func() error {
+		if db.offset != FileHeaderSize || db.indexes.len() > 0 {
+			return ErrNotEmpty
+		}
+
+		start := db.offset
+		if err := db.bulkLoad(r); err != nil {
+			db.file.Truncate(start)
+			db.offset = start
+			db.indexes = db.newIndex(0)
+			db.versions = make(map[string][]recordPos)
+			db.deleted = make(map[string]deletedPos)
+			db.cache.purge()
+			db.recent.purge()
+			db.deadBytes = 0
+			db.tombstones, db.tombstoneBytes = 0, 0
+			db.deadEntries = 0
+			return err
+		}
+		return nil
+	})
+}
+
+func (db *MiniDB) bulkLoad(r io.Reader) error {
+	br := bufio.NewReaderSize(r, bulkBufferSize)
+	bw := bufio.NewWriterSize(db.file, bulkBufferSize)
+	header := make([]byte, HeaderSize)
+	offset := db.offset
+	chainStart := int64(-1)
+	var seq uint64
+	// 索引等数据全部刷到文件后再建立，HashedIndex 需要从文件中核对 key
+	var records []batchRecord
+
+	for {
+		if _, err := io.ReadFull(br, header); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%w: truncated record at offset %d", ErrDataCorrupted, offset)
+		}
+		crc, _, kSize, vSize, flags := DecodeHeaderOrder(header, db.order)
+		if kSize == 0 {
+			return ErrEmptyKey
+		}
+		if flags&(FlagBatch|FlagValueRef) != 0 {
+			return fmt.Errorf("%w: unsupported record flags %#x at offset %d", ErrIncompatibleFormat, flags, offset)
+		}
+		if err := db.checkMeta(flags&FlagMeta != 0); err != nil {
+			return err
+		}
+		if err := db.checkCompressed(flags&FlagCompressed != 0); err != nil {
+			return err
+		}
+		if err := db.checkSequence(flags&FlagSequence != 0); err != nil {
+			return err
+		}
+
+		body := make([]byte, int64(kSize)+int64(vSize))
+		if _, err := io.ReadFull(br, body); err != nil {
+			return fmt.Errorf("%w: truncated record at offset %d", ErrDataCorrupted, offset)
+		}
+		if db.checksum(header, body) != crc {
+			return &CorruptionError{Offset: offset, Key: string(body[:kSize])}
+		}
+		if _, err := bw.Write(header); err != nil {
+			return err
+		}
+		if _, err := bw.Write(body); err != nil {
+			return err
+		}
+
+		if chainStart < 0 {
+			chainStart, seq = offset, db.recordSeq(flags, body[kSize:])
+		}
+		offset += HeaderSize + int64(kSize) + int64(vSize)
+		if flags&FlagChunked == 0 || flags&FlagTombstone != 0 {
+			records = append(records, batchRecord{
+				key:       string(body[:kSize]),
+				pos:       recordPos{offset: chainStart, size: offset - chainStart},
+				tombstone: flags&FlagTombstone != 0,
+				seq:       seq,
+			})
+			chainStart = -1
+		}
+	}
+	if chainStart >= 0 {
+		return fmt.Errorf("%w: incomplete chunked value at offset %d", ErrDataCorrupted, chainStart)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	db.bytesWritten += offset - db.offset
+	db.offset = offset
+	for _, r := range records {
+		db.applyRecord(r)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package minidb
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// BenchmarkBulkLoad 比较 BulkLoad 和循环 Put 导入 100 万个键值对的耗时
+func BenchmarkBulkLoad(b *testing.B) {
+	const n = 1000000
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%07d", i)
+	}
+	b.Run("put", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			db := openTestDB(b, Options{})
+			b.StartTimer()
+			for _, k := range keys {
+				if err := db.Put(k, "value"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("bulk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			db := openTestDB(b, Options{})
+			// 编码不计入导入时间，调用方通常直接转发已编码的流
+			var buf bytes.Buffer
+			for _, k := range keys {
+				buf.Write(NewEntry([]byte(k), []byte("value")).EncodeOrder(db.order))
+			}
+			b.StartTimer()
+			if err := db.BulkLoad(&buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package minidb
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// ==========================================
+// 12. 读缓存 (Cache)
+// ==========================================
+
+// lruCache 缓存最近读取的 value，容量按条数计算。
+// 写入和删除通过 setIndex/removeIndex 让对应的 key 失效。nil 表示不启用缓存
+type lruCache struct {
+	mu    sync.Mutex
+	cap   int
+	ll    *list.List // 从新到旧
+	items map[string]*list.Element
+}
+
+type cacheItem struct {
+	key   string
+	value string
+}
+
+func newLRUCache(capacity int) *lruCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &lruCache{cap: capacity, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) get(key string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*cacheItem).value, true
+}
+
+func (c *lruCache) add(key, value string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		e.Value.(*cacheItem).value = value
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&cacheItem{key: key, value: value})
+	if c.ll.Len() > c.cap {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheItem).key)
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.ll.Remove(e)
+		delete(c.items, key)
+	}
+}
+
+func (c *lruCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// recentWrites 保存最近 K 次 Put 写入的 value，写完紧接着读同一个 key 时不用再 ReadAt。
+// 环形缓冲按写入顺序淘汰，修改都在 db.mu 写锁下进行，读取持有读锁，因此不需要自己的锁。
+// 同一个 key 在环中可能占多个槽位，只有最新的槽位被淘汰时才移除。nil 表示不启用
+type recentWrites struct {
+	ring  []string // 各槽位写入的 key，"" 表示空槽
+	next  int
+	items map[string]recentItem
+	hits  atomic.Int64
+}
+
+type recentItem struct {
+	value string
+	slot  int
+}
+
+func newRecentWrites(n int) *recentWrites {
+	if n <= 0 {
+		return nil
+	}
+	return &recentWrites{ring: make([]string, n), items: make(map[string]recentItem, n)}
+}
+
+func (r *recentWrites) get(key string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	it, ok := r.items[key]
+	if ok {
+		r.hits.Add(1)
+	}
+	return it.value, ok
+}
+
+func (r *recentWrites) add(key, value string) {
+	if r == nil {
+		return
+	}
+	if old := r.ring[r.next]; old != "" {
+		if it, ok := r.items[old]; ok && it.slot == r.next {
+			delete(r.items, old)
+		}
+	}
+	r.ring[r.next] = key
+	r.items[key] = recentItem{value: value, slot: r.next}
+	r.next = (r.next + 1) % len(r.ring)
+}
+
+func (r *recentWrites) remove(key string) {
+	if r == nil {
+		return
+	}
+	delete(r.items, key)
+}
+
+func (r *recentWrites) purge() {
+	if r == nil {
+		return
+	}
+	clear(r.ring)
+	clear(r.items)
+}
+
+func (r *recentWrites) hitCount() int64 {
+	if r == nil {
+		return 0
+	}
+	return r.hits.Load()
+}
@@ -0,0 +1,98 @@
+package minidb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGetWithSource(t *testing.T) {
+	db := openTestDB(t, Options{CacheSize: 2})
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Put(k, k+"1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	steps := []struct {
+		op        func() error
+		key, want string
+		fromCache bool
+	}{
+		{nil, "a", "a1", false},
+		{nil, "a", "a1", true},
+		{func() error { return db.Put("a", "a2") }, "a", "a2", false},
+		{nil, "a", "a2", true},
+		// 容量为 2，读过 b、c 之后 a 被淘汰
+		{nil, "b", "b1", false},
+		{nil, "c", "c1", false},
+		{nil, "a", "a2", false},
+		{nil, "c", "c1", true},
+	}
+	for i, s := range steps {
+		if s.op != nil {
+			if err := s.op(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		v, fromCache, err := db.GetWithSource(s.key)
+		if err != nil || v != s.want || fromCache != s.fromCache {
+			t.Fatalf("step %d: GetWithSource(%q) = %q, %v, %v, want %q, %v", i, s.key, v, fromCache, err, s.want, s.fromCache)
+		}
+	}
+
+	if err := db.Del("c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, fromCache, err := db.GetWithSource("c"); !errors.Is(err, ErrKeyNotFound) || fromCache {
+		t.Fatalf("GetWithSource after Del = %v, %v", fromCache, err)
+	}
+
+	uncached := openTestDB(t, Options{})
+	if err := uncached.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, fromCache, err := uncached.GetWithSource("a"); err != nil || fromCache {
+			t.Fatalf("read %d without a cache: fromCache = %v, %v", i, fromCache, err)
+		}
+	}
+}
+
+func TestRecentWrites(t *testing.T) {
+	fs := &countingFS{FileSystem: OSFS}
+	db := openTestDB(t, Options{RecentWrites: 3, FS: fs})
+	steps := []struct {
+		op        func() error
+		key, want string
+		hit       bool // 是否由最近写入缓冲返回，不读文件
+	}{
+		{func() error { return db.Put("a", "1") }, "a", "1", true},
+		{func() error { return db.Put("a", "2") }, "a", "2", true},
+		// a 占了两个槽位，再写一个 key 淘汰的是 a 较旧的槽位
+		{func() error { return db.Put("b", "1") }, "a", "2", true},
+		{func() error { return db.Put("c", "1") }, "b", "1", true},
+		// 容量为 3，写入 d 后 a 最新的槽位被覆盖
+		{func() error { return db.Put("d", "1") }, "a", "2", false},
+		{func() error { return db.Del("c") }, "c", "", false},
+		{nil, "d", "1", true},
+	}
+	for i, s := range steps {
+		if s.op != nil {
+			if err := s.op(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hits, reads := db.Stats().RecentWriteHits, fs.reads.Load()
+		v, err := db.Get(s.key)
+		if s.want == "" {
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("step %d: Get(%q) after Del = %q, %v", i, s.key, v, err)
+			}
+		} else if err != nil || v != s.want {
+			t.Fatalf("step %d: Get(%q) = %q, %v, want %q", i, s.key, v, err, s.want)
+		}
+		hit := db.Stats().RecentWriteHits == hits+1
+		if hit != s.hit || (hit && fs.reads.Load() != reads) {
+			t.Fatalf("step %d: Get(%q) hit = %v with %d reads, want hit %v", i, s.key, hit, fs.reads.Load()-reads, s.hit)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package minidb
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// ==========================================
+// 17. 按需压缩 (Compression)
+// ==========================================
+
+// compress 对超过 CompressThreshold 的 value 做 flate 压缩，只有压缩后确实变小才使用，
+// 小 value 和已经压缩过的数据 (图片、压缩包) 原样保存，不浪费读取时的 CPU。
+// 版本 4 之前的数据文件不认识 FlagCompressed，不压缩
+func (db *MiniDB) compress(value []byte) ([]byte, bool) {
+	if db.opts.CompressThreshold <= 0 || len(value) <= db.opts.CompressThreshold || db.version < 4 {
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(value)
+	if err := w.Close(); err != nil || buf.Len() >= len(value) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+func decompress(value []byte) ([]byte, error) {
+	return io.ReadAll(flate.NewReader(bytes.NewReader(value)))
+}
+
+// checkCompressed 确认当前数据文件可以写入压缩记录。调用方需持有写锁
+func (db *MiniDB) checkCompressed(hasCompressed bool) error {
+	if hasCompressed && db.version < 4 {
+		return fmt.Errorf("%w: compressed records require format version 4, run Merge to upgrade", ErrIncompatibleFormat)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package minidb
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// TestCompressMixedValues 在同一个文件中混合写入小 value、可压缩和不可压缩的大 value，
+// 只有超过阈值且压缩后变小的 value 带 FlagCompressed，读取时按标记位决定是否解压
+func TestCompressMixedValues(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	values := map[string]struct {
+		value      string
+		compressed bool
+	}{
+		"tiny":           {"aaaaaaaa", false},
+		"at threshold":   {strings.Repeat("a", 256), false},
+		"compressible":   {strings.Repeat("abcd", 1024), true},
+		"incompressible": {string(random), false},
+		"empty":          {"", false},
+	}
+
+	for _, opts := range []Options{{CompressThreshold: 256}, {CompressThreshold: 256, ValueLogThreshold: 16}} {
+		db := openTestDB(t, opts)
+		for k, v := range values {
+			if err := db.Put(k, v.value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check := func(stage string) {
+			t.Helper()
+			for k, v := range values {
+				if got, err := db.Get(k); err != nil || got != v.value {
+					t.Fatalf("%s: Get(%q) = %d bytes, %v, want %d bytes", stage, k, len(got), err, len(v.value))
+				}
+				pos, _ := db.indexes.get(k)
+				_, flags, err := db.valueSegments(pos)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := flags&FlagCompressed != 0; got != v.compressed {
+					t.Fatalf("%s: %q stored compressed = %v, want %v", stage, k, got, v.compressed)
+				}
+				if n, err := db.ValueSize(k); err != nil || n != int64(len(v.value)) {
+					t.Fatalf("%s: ValueSize(%q) = %d, %v", stage, k, n, err)
+				}
+				if len(v.value) > 8 {
+					if part, err := db.GetRange(k, 4, 4); err != nil || string(part) != v.value[4:8] {
+						t.Fatalf("%s: GetRange(%q) = %q, %v", stage, k, part, err)
+					}
+				}
+			}
+		}
+		name := fmt.Sprintf("value log=%v", opts.ValueLogThreshold > 0)
+		check(name + " written")
+		db = reopen(t, db)
+		check(name + " reopened")
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		check(name + " merged")
+	}
+}
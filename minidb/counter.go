@@ -0,0 +1,170 @@
+package minidb
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// ==========================================
+// 19. 计数器与写合并 (Counter)
+// ==========================================
+
+// 计数器的 value 保存为十进制整数字符串，与 Put 写入的普通 value 没有区别。
+// 开启 CoalesceInterval 后，对已存在 key 的 Incr 只在内存中累加，按间隔把所有变化的计数器
+// 作为一个批次写入，热点计数器每个周期只落盘一条记录。Get 返回累加后的值；GetRange、KeyInfo 等
+// 读取磁盘上记录的操作先把这个 key 尚未落盘的增量写入 (见 settleCounter)，看到的值与 Get 一致。
+// Scan 只返回 key，计数器在第一次 Incr 时就已写入，不受影响。尚未落盘的增量在进程崩溃时丢失，Close 前会全部写入
+var ErrNotInteger = errors.New("value is not an integer")
+
+// Incr 把 key 的值加上 delta 并返回新值，key 不存在时从 0 开始，已有的值不是整数时返回 ErrNotInteger。
+// 计数器写入时不保留 PutWithMeta 的元数据
+func (db *MiniDB) Incr(key string, delta int64) (int64, error) {
+	if db.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if key == "" {
+		return 0, ErrEmptyKey
+	}
+	if db.opts.CoalesceInterval > 0 {
+		if n, ok, err := db.coalesce(key, delta); ok || err != nil {
+			return n, err
+		}
+	}
+
+	var n int64
+	err := db.update(func() error {
+		cur, err := db.counter(key)
+		if err != nil {
+			return err
+		}
+		n = cur + delta
+		return db.writeBatch([]batchOp{{key: key, value: []byte(strconv.FormatInt(n, 10))}})
+	})
+	return n, err
+}
+
+// coalesce 在内存中累加已存在的计数器。ok 为 false 表示 key 还不存在，需要直接写入，
+// 保证 Exists 和 Scan 能看到新建的计数器
+func (db *MiniDB) coalesce(key string, delta int64) (n int64, ok bool, err error) {
+	if db.maintMode.Load() {
+		return 0, false, ErrMaintenanceMode
+	}
+	if err := db.enter(); err != nil {
+		return 0, false, err
+	}
+	defer db.inflight.Done()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, exists := db.indexes.get(key); !exists {
+		return 0, false, nil
+	}
+	cur, err := db.counter(key)
+	if err != nil {
+		return 0, false, err
+	}
+	db.pending[key] = cur + delta
+	db.cache.remove(key)
+	db.hot.write(key)
+	return cur + delta, true, nil
+}
+
+// counter 返回 key 当前的整数值 (包括尚未落盘的增量)，key 不存在时为 0。调用方需持有写锁
+func (db *MiniDB) counter(key string) (int64, error) {
+	if n, ok := db.pending[key]; ok {
+		return n, nil
+	}
+	pos, ok := db.indexes.get(key)
+	if !ok {
+		return 0, nil
+	}
+	value, _, cerr, err := db.readValue(key, pos)
+	if err != nil {
+		return 0, err
+	}
+	if cerr != nil {
+		return 0, cerr
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	return n, nil
+}
+
+// FlushCounters 立即把所有尚未落盘的计数器写入数据文件
+func (db *MiniDB) FlushCounters() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	return db.update(db.flushCounters)
+}
+
+// flushCounters 把尚未落盘的计数器作为一个批次写入。调用方需持有写锁
+func (db *MiniDB) flushCounters() error {
+	if len(db.pending) == 0 {
+		return nil
+	}
+	ops := make([]batchOp, 0, len(db.pending))
+	for key, n := range db.pending {
+		ops = append(ops, batchOp{key: key, value: []byte(strconv.FormatInt(n, 10))})
+	}
+	if err := db.writeBatch(ops); err != nil {
+		return err
+	}
+	clear(db.pending)
+	return nil
+}
+
+// flushCounter 只写入 key 的计数器，供需要读出 key 当前 value 再改写的操作使用。调用方需持有写锁
+func (db *MiniDB) flushCounter(key string) error {
+	n, ok := db.pending[key]
+	if !ok {
+		return nil
+	}
+	return db.writeBatch([]batchOp{{key: key, value: []byte(strconv.FormatInt(n, 10))}})
+}
+
+// settleCounter 在读取 key 在磁盘上的记录之前写入它尚未落盘的增量，之后记录的 value、长度、
+// 时间戳和 CRC 都与 Get 看到的一致。这些增量已经返回给了 Incr 的调用方，写入不受维护模式限制。
+// 调用方需已通过 enter 登记，且不能持有锁
+func (db *MiniDB) settleCounter(key string) error {
+	db.mu.RLock()
+	_, ok := db.pending[key]
+	db.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return db.commit(func() error { return db.flushCounter(key) })
+}
+
+// settleCounters 与 settleCounter 相同，写入所有计数器尚未落盘的增量
+func (db *MiniDB) settleCounters() error {
+	db.mu.RLock()
+	n := len(db.pending)
+	db.mu.RUnlock()
+	if n == 0 {
+		return nil
+	}
+	return db.commit(db.flushCounters)
+}
+
+// counterLoop 按 CoalesceInterval 定期写入合并后的计数器
+func (db *MiniDB) counterLoop() {
+	ticker := time.NewTicker(db.opts.CoalesceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			if err := db.FlushCounters(); err != nil && !errors.Is(err, ErrClosed) {
+				log.Printf("Warn: Flush counters failed: %v", err)
+			}
+		}
+	}
+}
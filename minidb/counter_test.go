@@ -0,0 +1,116 @@
+package minidb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCoalescedIncrWritesFewRecords(t *testing.T) {
+	db := openTestDB(t, Options{CoalesceInterval: time.Hour})
+	if _, err := db.Incr("hits", 1); err != nil {
+		t.Fatal(err)
+	}
+	before := db.offset
+	for i := 0; i < 1000; i++ {
+		if _, err := db.Incr("hits", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.offset != before {
+		t.Fatalf("coalesced Incr wrote %d bytes before the flush", db.offset-before)
+	}
+	if err := db.FlushCounters(); err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err := db.Entries(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 第一次 Incr 直接写入，之后 1000 次合并成一条记录
+	if len(entries) != 2 {
+		t.Fatalf("%d records on disk after 1001 increments, want 2", len(entries))
+	}
+	db = reopen(t, db)
+	if v, err := db.Get("hits"); err != nil || v != "1001" {
+		t.Fatalf("Get after reopen = %q, %v", v, err)
+	}
+}
+
+func TestReadsSeePendingCounter(t *testing.T) {
+	tests := []struct {
+		name string
+		read func(db *MiniDB) (string, error)
+	}{
+		{"Get", func(db *MiniDB) (string, error) { return db.Get("n") }},
+		{"GetRange", func(db *MiniDB) (string, error) {
+			v, err := db.GetRange("n", 0, 10)
+			return string(v), err
+		}},
+		{"GetWithMeta", func(db *MiniDB) (string, error) {
+			v, _, err := db.GetWithMeta("n")
+			return v, err
+		}},
+		{"ValueSize", func(db *MiniDB) (string, error) {
+			n, err := db.ValueSize("n")
+			return fmt.Sprint(n), err
+		}},
+		{"KeyInfo", func(db *MiniDB) (string, error) {
+			info, err := db.KeyInfo("n")
+			return fmt.Sprint(info.ValueSize), err
+		}},
+		{"GetRaw", func(db *MiniDB) (string, error) {
+			raw, err := db.GetRaw("n")
+			if err != nil {
+				return "", err
+			}
+			_, _, kSize, _, _ := DecodeHeaderOrder(raw, db.order)
+			return string(raw[HeaderSize+kSize:]), nil
+		}},
+		{"History", func(db *MiniDB) (string, error) {
+			h, err := db.History("n")
+			return fmt.Sprint(len(h)), err
+		}},
+	}
+	want := map[string]string{"ValueSize": "2", "KeyInfo": "2", "History": "1"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, Options{CoalesceInterval: time.Hour})
+			if err := db.Put("n", "1"); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				if _, err := db.Incr("n", 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w, ok := want[tt.name]
+			if !ok {
+				w = "11"
+			}
+			if got, err := tt.read(db); err != nil || got != w {
+				t.Fatalf("%s = %q, %v, want %q", tt.name, got, err, w)
+			}
+		})
+	}
+}
+
+func TestChangedSinceSeesPendingCounter(t *testing.T) {
+	db := openTestDB(t, Options{CoalesceInterval: time.Hour})
+	// 磁盘上的记录是一小时前写入的
+	e := NewEntry([]byte("n"), []byte("1"))
+	e.Timestamp = uint32(time.Now().Add(-time.Hour).Unix())
+	if err := db.AppendRaw(db.encode(e)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Incr("n", 1); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := db.ChangedSince(time.Now().Add(-time.Minute))
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("ChangedSince = %v, %v, want the incremented counter", keys, err)
+	}
+	if v, err := db.Get("n"); err != nil || v != "2" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+}
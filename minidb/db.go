@@ -0,0 +1,1654 @@
+package minidb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ==========================================
+// 2. 存储引擎实现 (Storage Engine)
+// ==========================================
+
+// CorruptPolicy 决定 Get 读到 CRC 校验失败的数据时如何处理
+type CorruptPolicy int
+
+const (
+	FailOnCorrupt CorruptPolicy = iota // 返回 ErrDataCorrupted (默认)
+	ReturnStale                        // 照常返回 value，并标记数据已损坏
+	DeleteCorrupt                      // 写入删除标记并返回 ErrDataCorrupted
+)
+
+// VerifyMode 决定 Open 时发现的损坏记录超过 MaxCorruptRecords 后如何处理。
+// 加载时总会校验每条记录的 CRC，损坏的记录总是被跳过
+type VerifyMode int
+
+const (
+	VerifyWarn    VerifyMode = iota // 只记录日志 (默认)
+	VerifyFail                      // 拒绝打开，返回 ErrTooManyCorrupt
+	VerifySalvage                   // 正常打开后立即 Merge，只保留校验通过的记录
+)
+
+type Options struct {
+	MergeRateLimit int64         // Merge 拷贝数据的速率上限 (bytes/sec)，0 表示不限速
+	ChunkSize      int           // 超过该大小的 value 拆成多个分块写入，0 表示不分块
+	CorruptPolicy  CorruptPolicy // 读到损坏数据时的处理策略
+
+	// value 超过该大小时记录头和 value 分两次写入，省掉编码整条记录时的大块分配和拷贝，0 表示关闭
+	VectoredWriteThreshold int
+
+	// 被覆盖或删除的记录 (含删除标记) 累计达到该条数时也触发自动 Merge，不经过 MergePolicy，
+	// 适合大量小 value 覆盖写、字节比例涨得慢的场景，0 表示不按条数触发
+	AutoMergeDeadCount int
+
+	AutoMergeInterval time.Duration // 后台自动 Merge 的检查间隔，0 表示关闭
+	MergeWindowStart  time.Duration // 允许自动 Merge 的时间窗口 (距当天 0 点)，
+	MergeWindowEnd    time.Duration // Start == End 表示全天都允许
+	MergePolicy       MergePolicy   // 自动 Merge 前的检查，nil 表示每次都执行
+	MergeTimeout      time.Duration // 单次 Merge 的最长耗时，超时后放弃并保留原文件，0 表示不限制
+	// Merge 拷贝缓冲和去重表可以使用的内存上限，超出后大记录分段拷贝、去重表不再增长，0 表示不限制。
+	// 索引快照和位置映射与 key 数量成正比，不受它约束，只计入 Stats.MergeMemoryBytes
+	MergeMemoryLimit int64
+
+	StrictCheckpoint   bool          // 写 hint 文件时 fsync 数据文件、hint 文件和目录
+	CheckpointInterval time.Duration // 定期写 hint 文件的间隔，0 表示只在 Merge 和 Close 时写
+	CheckpointWrites   int           // 每成功写入多少次在后台写一次 hint 文件，0 表示不按写入次数触发
+
+	ExpectedKeys int   // 预计的 key 数量，用于预分配索引，没有 hint 文件时可以减少加载过程中的扩容
+	MaxKeys      int   // 索引中 key 数量上限，超出后写入新 key 返回 ErrTooManyKeys，0 表示不限制
+	MaxValueSize int   // 单个 value 的最大字节数，超出返回 ErrValueTooLarge，0 表示不限制
+	MinFreeDisk  int64 // 写入后数据文件所在磁盘的剩余空间不能低于该值，否则返回 ErrLowDiskSpace，0 表示不检查
+	MaxBatchSize int   // Apply 和事务提交的记录总大小 (按未压缩计算) 上限，超出返回 ErrBatchTooLarge，0 表示不限制
+	MaxFileSize  int64 // 数据文件大小上限，写入会超出时淘汰最旧的 key 并 Merge，只适合缓存场景，0 表示不限制
+
+	// 活跃分段达到该大小后在下一次写入前开始新的分段文件，Merge 的输出也按它切分，见 Segments。
+	// 设置后数据文件在 Open 时转为分段存储，之后不再设置也保持分段。0 表示使用单个数据文件
+	MaxSegmentSize int64
+
+	FS FileSystem // 数据文件所在的文件系统，nil 表示使用本地文件系统 OSFS
+
+	// 文件名为 FilePrefix.Extension，hint、value log 等文件为 FilePrefix.hint 等，
+	// merge 临时文件为数据文件名加 .merge。同一目录下放多个库时使用不同的前缀，空值使用默认的 minidb.data
+	FilePrefix string
+	Extension  string
+
+	KeepVersions int // 每个 key 保留的版本数 (包括最新版本)，Merge 时不会回收，<= 1 表示只保留最新版本
+	// Del 之后在该时间内可以用 Undelete 恢复，期间 Merge 会保留被删除的值，0 表示关闭
+	DeleteGracePeriod time.Duration
+	SortedMerge       bool // Merge 时按 key 的顺序 (见 KeyComparator) 写出，合并后的文件内容是确定的
+	// key 的排序规则，返回值与 strings.Compare 含义相同，例如按数值比较让 "2" 排在 "10" 前面。
+	// 用于 Scan、ChangedSince 和 SortedMerge，必须与数据一起保持不变，否则 Scan 的分页游标会失效。nil 表示按字节序
+	KeyComparator func(a, b string) int
+
+	HealthCheckInterval time.Duration // 定期检查数据文件是否被删除或替换，0 表示关闭
+
+	ReadOnly     bool          // 只读打开，所有写操作返回 ErrReadOnly
+	TailInterval time.Duration // 只读模式下定期读取其他进程追加的新记录，0 表示不跟随
+
+	Preload bool // Open 时顺序读一遍数据文件预热系统页缓存，启动变慢但首批 Get 不用等冷盘
+
+	// HashedIndex 让内存索引只保存 key 的哈希，读取时再到磁盘上核对完整的 key。
+	// 适合 key 很长、数量很多的场景，代价是每次查找多一次磁盘读，Scan 和 Merge 也会变慢
+	HashedIndex bool
+
+	// DirectReads 只让读取使用 O_DIRECT 绕过系统页缓存，写入仍经过页缓存，由 fsync 落盘 (仅 Linux，未设置 FS 时生效)
+	DirectReads bool
+
+	CacheSize    int // 读缓存保存的 value 条数，0 表示不缓存
+	RecentWrites int // 保存最近多少次 Put 的 value，写完立即读同一个 key 时不读文件，0 表示关闭
+	HotKeys      int // 统计读写次数的 key 数量上限，HotKeys 返回其中访问最多的，0 表示不统计
+
+	CoalesceInterval time.Duration // Incr 在内存中合并同一个计数器的增量，按该间隔批量落盘，0 表示每次直接写入
+
+	CompressThreshold int // 超过该大小且压缩后确实变小的 value 压缩保存，0 表示不压缩
+
+	BloomFilter bool // 在索引前加一层布隆过滤器，Get 和 Exists 遇到确定不存在的 key 直接返回
+
+	// 每隔多少次写入核对一次数据文件长度与内存中记录的 offset，发现不一致 (例如文件被外部截断) 后
+	// 拒绝所有写入并返回 ErrStateDivergence。0 表示使用 defaultOffsetCheckInterval，负数表示关闭
+	OffsetCheckInterval int
+	// 核对时发现文件被其他进程追加了完整的记录，就把它们重放进索引并从新的末尾继续写入，而不是拒绝写入。
+	// 需要在每次写入前都核对时把 OffsetCheckInterval 设为 1；追加的数据不完整或文件变短时仍返回 ErrStateDivergence
+	AdoptExternalAppends bool
+
+	SyncPolicy   SyncPolicy // 写入的 fsync 策略，SyncAlways 下并发写入通过组提交共享 fsync
+	WriteRetries int        // 写入遇到 EINTR、EAGAIN 等临时错误时的重试次数，每次重试前截掉写了一半的数据并退避
+
+	VerifyOnOpen      VerifyMode // 损坏记录超过阈值时的处理方式
+	MaxCorruptRecords int        // 允许的损坏记录数，超过后按 VerifyOnOpen 处理
+
+	// 数据文件为空或不存在、但 hint 文件或 value log 非空时拒绝打开并返回 ErrSuspectedDataLoss，
+	// 而不是当作新库打开。确认数据可以丢弃时删除这些文件后再打开
+	RefuseEmptyDataFile bool
+
+	LittleEndian bool // 新建的数据文件使用小端字节序，已有文件始终按文件头中的标记读写
+
+	// 新建的数据文件不计算也不校验 CRC，省下读写两端的 CPU，只适合纯缓存等可以容忍静默损坏的场景。
+	// 与 LittleEndian 一样记录在文件头中，已有文件始终按文件头处理
+	DisableCRC bool
+
+	Quarantine bool // 启动时把 CRC 校验失败的原始记录复制到隔离文件，Merge 丢弃后仍可事后分析
+
+	// 每次写入分配单调递增的序号保存在记录中，同一秒内的写入也能区分先后，重放和 AppendRaw 时
+	// 序号较小的记录不会覆盖同一个 key 较新的记录。需要版本 5 的数据文件，旧文件 Merge 后才生效
+	Sequence bool
+
+	ValueLogThreshold int // 超过该大小的 value 写入单独的 value log，Merge 时一般只重写数据文件中的引用 (见 ValueLogGCRatio)，0 表示全部内联
+	// Merge 时把超过该大小、内容相同的内联 value 移到 value log 中只保存一份，各个 key 只保留引用，0 表示不去重
+	DedupThreshold int
+
+	// Merge 时估算 value log 中已被覆盖和删除的字节占比，达到该值才把仍被引用的 value 拷贝到新的 value log，
+	// 否则 value log 原样保留，Merge 只重写数据文件。0 表示 0.5，大于 1 表示从不回收
+	ValueLogGCRatio float64
+
+	CloseTimeout time.Duration // Close 等待进行中的读写完成的最长时间，0 表示使用 defaultCloseTimeout
+}
+
+var DefaultOptions = Options{}
+
+var (
+	ErrKeyNotFound        = errors.New("key not found")
+	ErrDataCorrupted      = errors.New("data corrupted")
+	ErrMergeInProgress    = errors.New("merge already in progress")
+	ErrMergeUnsupported   = errors.New("merge is not supported for a database opened from a file handle")
+	ErrMergeTimeout       = errors.New("merge timed out")
+	ErrIncompatibleFormat = errors.New("incompatible data file format")
+	ErrTooManyKeys        = errors.New("too many keys")
+	ErrReadOnly           = errors.New("database is read-only")
+	ErrEmptyKey           = errors.New("key must not be empty")
+	ErrMetaTooLarge       = errors.New("metadata too large")
+	ErrValueTooLarge      = errors.New("value too large")
+	ErrTooManyCorrupt     = errors.New("too many corrupted records")
+	ErrClosed             = errors.New("database is closed")
+	ErrMaintenanceMode    = errors.New("database is in maintenance mode")
+	ErrStateDivergence    = errors.New("data file size diverged from in-memory state")
+	ErrLowDiskSpace       = errors.New("not enough free disk space")
+	ErrSuspectedDataLoss  = errors.New("data file is empty but other files of the database are not")
+)
+
+// CorruptionError 描述一条损坏的记录，errors.Is(err, ErrDataCorrupted) 对它成立。
+// Expected 和 Actual 都为 0 表示记录结构不完整，而不是 CRC 不匹配
+type CorruptionError struct {
+	Offset   int64
+	Key      string
+	Expected uint32 // header 中保存的 CRC
+	Actual   uint32 // 按实际内容重新计算的 CRC
+	ValueLog bool   // Offset 是 value log 中的位置
+}
+
+func (e *CorruptionError) Error() string {
+	where := "offset"
+	if e.ValueLog {
+		where = "value log offset"
+	}
+	if e.Expected == 0 && e.Actual == 0 {
+		return fmt.Sprintf("data corrupted: key %q at %s %d: truncated record", e.Key, where, e.Offset)
+	}
+	return fmt.Sprintf("data corrupted: key %q at %s %d: crc mismatch (expected %08x, actual %08x)",
+		e.Key, where, e.Offset, e.Expected, e.Actual)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrDataCorrupted
+}
+
+// singleReadLimit 以内的记录 Get 只需要一次 ReadAt
+const singleReadLimit = 64 * 1024
+
+// deletedPos 是一个仍可恢复的删除: 被删除的最新记录、删除标记及删除时间
+type deletedPos struct {
+	pos  recordPos
+	tomb recordPos
+	at   time.Time
+}
+
+// recordPos 记录 key 对应的记录在数据文件中的位置，分块 value 的 size 为整条链的长度
+type recordPos struct {
+	offset int64
+	size   int64
+}
+
+type MiniDB struct {
+	mu         sync.RWMutex
+	opts       Options
+	fs         FileSystem
+	file       Storage // 当前数据文件，只在写锁内替换，读取期间必须一直持有读锁
+	vlog       Storage // value log，未开启且文件不存在时为 nil
+	names      fileNames
+	dataFile   string // 数据文件名，OpenFile 传入的文件和 OpenMerged 的视图不一定是 names.data
+	external   bool   // 数据文件由调用方通过 OpenFile 传入或由 OpenSnapshot 打开，没有对应的 hint 文件
+	indexes    index
+	cache      *lruCache
+	recent     *recentWrites
+	hot        *hotKeys
+	versions   map[string][]recordPos // 保留的历史版本，从新到旧
+	deleted    map[string]deletedPos  // DeleteGracePeriod 内可以恢复的已删除 key
+	pending    map[string]int64       // CoalesceInterval 下尚未落盘的计数器
+	offset     int64
+	vlogOffset int64
+	version    uint16 // 数据文件的格式版本，版本 1 的文件在 Merge 升级前不能写入元数据
+	order      binary.ByteOrder
+	noCRC      bool        // 文件头带有 FileFlagNoCRC，记录不计算也不校验 CRC
+	merging    atomic.Bool // 是否有 Merge 正在执行
+	maintMode  atomic.Bool // 维护模式下拒绝所有写入，读取和 Merge 不受影响
+	gsync      *groupSync
+	closeCh    chan struct{}
+	ckptCh     chan struct{} // noteWrite 通知 checkpointLoop 写 hint 文件
+	mergeCh    chan struct{} // noteDead 通知 autoMerge 失效记录达到 AutoMergeDeadCount
+	now        func() time.Time
+	diskFree   func(dir string) (int64, error)
+	failPoint  func(name string) error // 测试中注入故障，见 injectFault
+
+	drainMu  sync.Mutex
+	closed   bool           // Close 之后新的读写直接返回 ErrClosed
+	inflight sync.WaitGroup // 进行中的读写，Close 等它们结束后再关闭文件
+
+	hintMu sync.Mutex // writeHint 只持有读锁，多个调用共用同一个临时文件，需要串行
+
+	loadDuration   time.Duration          // 启动时构建索引的耗时
+	corruptRecords int                    // 启动时因 CRC 校验失败跳过的记录数
+	deadBytes      int64                  // 数据文件中已被覆盖、删除或损坏的字节数
+	tombstones     int                    // 数据文件中的删除标记条数，Merge 后只剩保留期内和拷贝期间写入的
+	tombstoneBytes int64                  // 删除标记占用的字节数，已计入 deadBytes
+	deadEntries    int                    // 数据文件中被覆盖、删除的记录和删除标记的条数
+	mergeMemory    int64                  // 上次 Merge 估算的临时内存峰值
+	evicting       bool                   // 正在写入淘汰用的删除标记，不检查 MaxFileSize
+	newestWins     bool                   // OpenMerged 的合并视图，同一个 key 按序号或时间戳而不是文件中的位置决定新旧
+	removed        map[string]batchRecord // newestWins 加载期间已被删除的 key 的删除标记，加载完成后清空
+	seq            uint64                 // 最近分配或重放到的最大写入序号
+	bytesWritten   int64                  // 本次启动以来写入磁盘的总字节数 (包括 Merge)
+	writeCount     int                    // 用于按 OffsetCheckInterval 抽样核对文件长度
+	ckptWrites     int                    // 上次触发 CheckpointWrites 以来的写入次数
+	diverged       error                  // 核对失败后保存的错误，之后的写入都直接返回它
+
+	diskFreeAt    int64     // 上次 statfs 得到的剩余空间
+	diskWrittenAt int64     // 上次 statfs 时的 bytesWritten，之后写入的字节从剩余空间中扣除
+	diskCheckedAt time.Time // 上次 statfs 的时间
+}
+
+func Open() (*MiniDB, error) {
+	return OpenWithOptions(DefaultOptions)
+}
+
+func OpenWithOptions(opts Options) (*MiniDB, error) {
+	return open(opts, newFileNames(opts.FilePrefix, opts.Extension).data, nil)
+}
+
+// OpenFile 使用调用方已经打开的数据文件 (例如 supervisor 通过文件描述符传入的文件)，
+// 而不是按名字打开 DBFileName，Close 时一并关闭 f
+func OpenFile(f *os.File) (*MiniDB, error) {
+	return OpenFileWithOptions(f, DefaultOptions)
+}
+
+// OpenFileWithOptions 与 OpenFile 相同。f 需要以读写方式打开 (只读时设置 ReadOnly)，不要求 O_APPEND。
+// 库没有可以替换的文件名，不读写 hint 文件，Merge 返回 ErrMergeUnsupported；opts.FS 对 f 不起作用。
+// 也不知道 value log 在哪里：设置 ValueLogThreshold 或 DedupThreshold 时返回 ErrValueLogUnsupported，
+// f 中已有的引用读取时返回 ErrValueLogMissing。同理不支持分段，设置 MaxSegmentSize 时返回 ErrSegmentsUnsupported
+func OpenFileWithOptions(f *os.File, opts Options) (*MiniDB, error) {
+	if opts.ValueLogThreshold > 0 || opts.DedupThreshold > 0 {
+		return nil, ErrValueLogUnsupported
+	}
+	if opts.MaxSegmentSize > 0 {
+		return nil, ErrSegmentsUnsupported
+	}
+	return open(opts, f.Name(), fdFile{osFile{f}})
+}
+
+// OpenSnapshot 以只读模式打开任意路径的数据文件 (例如备份或拷贝出来的 minidb.data)，
+// 与正在运行的库互不影响。不会读取当前目录下的 hint 文件 (path 就是 minidb.data 时也一样)，总是全量扫描建立索引。
+// value log 按库的命名规则从 path 推算 (other/minidb.data 对应 other/minidb.vlog)，
+// 拷贝快照时需要一起拷贝，不存在时读到保存在其中的 value 返回 ErrValueLogMissing
+func OpenSnapshot(path string) (*MiniDB, error) {
+	file, err := OSFS.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	db, err := open(snapshotOptions(path), path, file)
+	if err != nil {
+		file.Close()
+	}
+	return db, err
+}
+
+// snapshotOptions 返回只读打开 path 的选项，FilePrefix 和 Extension 取自 path，
+// value log 等同一个库的其他文件都在 path 旁边，而不是当前目录下的默认文件
+func snapshotOptions(path string) Options {
+	ext := filepath.Ext(path)
+	return Options{ReadOnly: true, FilePrefix: strings.TrimSuffix(path, ext), Extension: strings.TrimPrefix(ext, ".")}
+}
+
+// open 打开 dataFile，file 不为 nil 时直接使用调用方传入的文件
+func open(opts Options, dataFile string, file Storage) (*MiniDB, error) {
+	db := &MiniDB{
+		opts:     opts,
+		fs:       opts.FS,
+		names:    newFileNames(opts.FilePrefix, opts.Extension),
+		dataFile: dataFile,
+		external: file != nil,
+		versions: make(map[string][]recordPos),
+		deleted:  make(map[string]deletedPos),
+		pending:  make(map[string]int64),
+		cache:    newLRUCache(opts.CacheSize),
+		recent:   newRecentWrites(opts.RecentWrites),
+		gsync:    newGroupSync(),
+		closeCh:  make(chan struct{}),
+		ckptCh:   make(chan struct{}, 1),
+		mergeCh:  make(chan struct{}, 1),
+		now:      time.Now,
+		diskFree: diskFree,
+	}
+	if _, ok := file.(*mergedStorage); ok {
+		db.newestWins, db.removed = true, make(map[string]batchRecord)
+	}
+	if db.fs == nil {
+		db.fs = OSFS
+		if opts.DirectReads {
+			db.fs = directReadFS{}
+		}
+	}
+	if !opts.ReadOnly && db.hasHint() {
+		if err := db.recoverMerge(); err != nil {
+			return nil, err
+		}
+	}
+	if file == nil && !opts.ReadOnly {
+		if err := db.upgradeLegacy(); err != nil {
+			return nil, err
+		}
+	}
+	if file == nil {
+		if err := db.openData(); err != nil {
+			return nil, err
+		}
+	} else if err := db.initStorage(file); err != nil {
+		return nil, err
+	}
+	if err := db.openValueLog(); err != nil {
+		db.file.Close()
+		return nil, err
+	}
+	db.indexes = db.newIndex(opts.ExpectedKeys)
+
+	if err := db.loadIndexes(); err != nil {
+		return nil, err
+	}
+	if err := db.verifyOnOpen(); err != nil {
+		db.file.Close()
+		return nil, err
+	}
+	db.removed = nil
+	// 重放出的内容可能还在页缓存中 (上次进程退出前没有 fsync)，先整体落盘，DurableOffset 从文件长度开始
+	if !opts.ReadOnly {
+		if err := db.file.Sync(); err != nil {
+			db.file.Close()
+			return nil, err
+		}
+		db.gsync.synced = db.offset
+	}
+	if opts.MaxSegmentSize > 0 && !opts.ReadOnly {
+		if _, err := db.enableSegments(); err != nil {
+			db.file.Close()
+			return nil, err
+		}
+	}
+
+	if opts.Sequence && db.version < 5 && !opts.ReadOnly {
+		log.Printf("Warn: Sequence numbers require format version 5 (file is version %d), run Merge to upgrade", db.version)
+	}
+	// 加载完成后才开始统计，重放的记录不算写入
+	db.hot = newHotKeys(opts.HotKeys)
+
+	if opts.Preload {
+		db.preload()
+	}
+
+	if opts.AutoMergeInterval > 0 || opts.AutoMergeDeadCount > 0 {
+		go db.autoMerge()
+	}
+	if !opts.ReadOnly && (opts.CheckpointInterval > 0 || opts.CheckpointWrites > 0) {
+		go db.checkpointLoop()
+	}
+	if opts.HealthCheckInterval > 0 {
+		go db.healthLoop()
+	}
+	if !opts.ReadOnly && opts.CoalesceInterval > 0 {
+		go db.counterLoop()
+	}
+	if opts.ReadOnly && opts.TailInterval > 0 {
+		go db.tailLoop()
+	}
+
+	return db, nil
+}
+
+// openData 打开数据: 有分段清单时按清单打开所有分段，否则打开单个数据文件
+func (db *MiniDB) openData() error {
+	s, err := db.openSegments()
+	if err != nil {
+		return err
+	}
+	if s != nil {
+		return db.initStorage(s)
+	}
+	return db.initFile()
+}
+
+func (db *MiniDB) initFile() error {
+	flag := os.O_CREATE | os.O_RDWR | os.O_APPEND
+	if db.opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := db.fs.OpenFile(db.dataFile, flag)
+	if err != nil {
+		return err
+	}
+	return db.initStorage(file)
+}
+
+// initStorage 读取或写入 file 的文件头并作为当前数据文件
+func (db *MiniDB) initStorage(file Storage) error {
+	var err error
+	db.file = file
+	if db.offset, err = file.Size(); err != nil {
+		return err
+	}
+
+	if db.offset == 0 && !db.opts.ReadOnly {
+		if err := db.checkEmptyDataFile(); err != nil {
+			return err
+		}
+		db.order = binary.BigEndian
+		if db.opts.LittleEndian {
+			db.order = binary.LittleEndian
+		}
+		db.noCRC = db.opts.DisableCRC
+		n, err := file.Write(db.fileHeader())
+		if err != nil {
+			return err
+		}
+		db.offset = int64(n)
+		db.version = FormatVersion
+		return nil
+	}
+
+	header := make([]byte, FileHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return ErrIncompatibleFormat
+	}
+	if err := CheckFileHeader(header); err != nil {
+		return err
+	}
+	db.version = binary.BigEndian.Uint16(header[4:6])
+	db.order = FileByteOrder(header)
+	db.noCRC = binary.BigEndian.Uint16(header[6:8])&FileFlagNoCRC != 0
+	return nil
+}
+
+// checkEmptyDataFile 在把空数据文件初始化为新库之前调用，开启 RefuseEmptyDataFile 时
+// 确认同一个库的 hint 文件和 value log 也都为空，否则数据文件很可能被外部工具截断或删除了
+func (db *MiniDB) checkEmptyDataFile() error {
+	if !db.opts.RefuseEmptyDataFile || !db.hasHint() {
+		return nil
+	}
+	for _, name := range []string{db.names.hint, db.names.vlog} {
+		f, err := db.fs.OpenFile(name, os.O_RDONLY)
+		if err != nil {
+			continue
+		}
+		size, err := f.Size()
+		f.Close()
+		if err == nil && size > 0 {
+			return fmt.Errorf("%w: %s is empty but %s has %d bytes", ErrSuspectedDataLoss, db.dataFile, name, size)
+		}
+	}
+	return nil
+}
+
+// hasHint 判断数据文件是否有对应的 hint 文件和 merge 文件，快照和 OpenFile 传入的文件都没有
+func (db *MiniDB) hasHint() bool {
+	return db.dataFile == db.names.data && !db.external
+}
+
+// fileHeader 返回与当前数据文件相同字节序和标记的文件头，Merge 写出的新文件沿用它
+func (db *MiniDB) fileHeader() []byte {
+	flags := uint16(0)
+	if db.order == binary.LittleEndian {
+		flags |= FileFlagLittleEndian
+	}
+	if db.noCRC {
+		flags |= FileFlagNoCRC
+	}
+	return encodeFileHeader(flags)
+}
+
+// encode 按数据文件的字节序编码记录，关闭 CRC 的文件跳过计算
+func (db *MiniDB) encode(e *Entry) []byte {
+	return e.encode(db.order, !db.noCRC)
+}
+
+// encodeBuffers 与 encode 相同，value 超过 VectoredWriteThreshold 时直接引用 e.Value 而不拷贝，
+// 返回的多段依次写入即为完整记录
+func (db *MiniDB) encodeBuffers(e *Entry) [][]byte {
+	if db.opts.VectoredWriteThreshold <= 0 || len(e.Value) <= db.opts.VectoredWriteThreshold {
+		return [][]byte{db.encode(e)}
+	}
+	return [][]byte{e.encodeHeader(db.order, !db.noCRC), e.Value}
+}
+
+// checksum 计算记录应有的 CRC，关闭 CRC 的文件中始终为 0，所有校验路径都必须使用它
+func (db *MiniDB) checksum(header, payload []byte) uint32 {
+	if db.noCRC {
+		return 0
+	}
+	return Checksum(header, payload)
+}
+
+// verifyOnOpen 按 VerifyOnOpen 处理加载时发现的损坏记录
+func (db *MiniDB) verifyOnOpen() error {
+	if db.corruptRecords <= db.opts.MaxCorruptRecords {
+		return nil
+	}
+	summary := fmt.Sprintf("%d corrupted records (limit %d), %d dead bytes",
+		db.corruptRecords, db.opts.MaxCorruptRecords, db.deadBytes)
+
+	switch db.opts.VerifyOnOpen {
+	case VerifyFail:
+		return fmt.Errorf("%w: %s", ErrTooManyCorrupt, summary)
+	case VerifySalvage:
+		if !db.opts.ReadOnly {
+			log.Printf("Warn: %s, salvaging valid records by merge", summary)
+			return db.Merge()
+		}
+	}
+	log.Printf("Warn: %s", summary)
+	return nil
+}
+
+// preload 顺序读取整个数据文件并丢弃内容，只为让操作系统把它装进页缓存。
+// 预热失败不影响正常使用，只记录日志
+func (db *MiniDB) preload() {
+	start := time.Now()
+	n, err := io.Copy(io.Discard, io.NewSectionReader(db.file, 0, db.offset))
+	if err != nil {
+		log.Printf("Warn: Preload data file failed: %v", err)
+		return
+	}
+	log.Printf("Preloaded %d bytes of data file, took %v", n, time.Since(start))
+}
+
+func (db *MiniDB) loadIndexes() error {
+	log.Println("Loading indexes from disk...")
+	start := time.Now()
+
+	var offset int64 = FileHeaderSize
+	// hint 文件不记录历史版本和可恢复的删除，需要它们时全量扫描；快照没有对应的 hint 文件
+	if db.opts.KeepVersions <= 1 && db.opts.DeleteGracePeriod <= 0 && db.hasHint() {
+		if hintOffset, ok := db.loadHint(); ok {
+			log.Printf("Loaded %d keys from hint file, replaying from offset %d", db.indexes.len(), hintOffset)
+			offset = hintOffset
+		}
+	}
+	tail, err := db.replay(offset, db.offset)
+	if err != nil {
+		return err
+	}
+	// 崩溃时写了一半的记录、分块链或批次都在文件尾部，截掉后新的写入才不会被误拼接。
+	// 只读模式下文件可能正在被其他进程追加，留到下次 Tail 时再读
+	if tail < db.offset {
+		if db.opts.ReadOnly {
+			db.offset = tail
+		} else {
+			db.truncateTail(tail)
+		}
+	}
+
+	db.loadDuration = time.Since(start)
+	log.Printf("Index loaded. Total keys: %d, corrupted records: %d, took %v",
+		db.indexes.len(), db.corruptRecords, db.loadDuration)
+	return nil
+}
+
+// replay 顺序重放 [offset, end) 之间的记录并更新索引，
+// 返回最后一条完整记录 (包括完整的分块链和批次) 之后的位置
+func (db *MiniDB) replay(offset, end int64) (int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(db.file, offset, end-offset))
+
+	// 正在拼接的分块链：分块总是连续写入，被其他 key 打断说明链不完整。序号只在第一块中
+	chainStart, chainKey := int64(-1), ""
+	var chainSeq uint64
+	// 正在重放的批量写入：批次内的记录全部读完后才一起生效，不完整的批次整体丢弃
+	batchStart, batchEnd := int64(-1), int64(0)
+	var batch []batchRecord
+
+	for {
+		header := make([]byte, HeaderSize)
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		crc, ts, kSize, vSize, flags := DecodeHeaderOrder(header, db.order)
+
+		payloadSize := int64(kSize) + int64(vSize)
+		// 长度字段声称的大小超出了文件末尾，不能按它分配内存或切分 payload。
+		// 后面还有完整的记录说明是长度字段损坏而不是尾部没写完，截断会丢掉这些记录
+		if offset+HeaderSize+payloadSize > end {
+			if db.recordAfter(offset, end) {
+				return offset, &CorruptionError{Offset: offset}
+			}
+			break
+		}
+		payload := make([]byte, payloadSize)
+		_, err = io.ReadFull(reader, payload)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		recordSize := HeaderSize + payloadSize
+		if actual := db.checksum(header, payload); actual != crc {
+			cerr := &CorruptionError{Offset: offset, Key: string(payload[:kSize]), Expected: crc, Actual: actual}
+			log.Printf("Warn: %v, skipping...", cerr)
+			if db.opts.Quarantine && !db.opts.ReadOnly {
+				db.quarantine(offset, header, payload)
+			}
+			db.corruptRecords++
+			if batchStart >= 0 {
+				db.deadBytes += offset - batchStart
+				batchStart, batch, chainStart = -1, nil, -1
+			} else if chainStart >= 0 {
+				db.deadBytes += offset - chainStart
+				chainStart = -1
+			}
+			db.deadBytes += recordSize
+		} else if flags&FlagBatch != 0 {
+			if batchStart >= 0 {
+				db.deadBytes += offset - batchStart
+			}
+			batchStart, batch = offset, nil
+			batchEnd = offset + recordSize + int64(db.order.Uint64(payload[kSize:]))
+		} else if kSize == 0 {
+			// 空 key 的记录无法寻址，只可能来自旧版本或外部工具，直接跳过
+			log.Printf("Warn: Empty key at offset %d, skipping...", offset)
+			if chainStart >= 0 {
+				db.deadBytes += offset - chainStart
+				chainStart = -1
+			}
+			db.deadBytes += recordSize
+		} else {
+			key := string(payload[:kSize])
+			if chainStart >= 0 && key != chainKey {
+				db.deadBytes += offset - chainStart
+				chainStart = -1
+			}
+			start, seq := offset, db.recordSeq(flags, payload[kSize:])
+			if chainStart >= 0 {
+				start, seq = chainStart, chainSeq
+			}
+			if flags&FlagChunked != 0 {
+				if chainStart < 0 {
+					chainStart, chainKey, chainSeq = offset, key, seq
+				}
+			} else {
+				chainStart = -1
+				r := batchRecord{
+					key:       key,
+					pos:       recordPos{offset: start, size: offset + recordSize - start},
+					tombstone: flags&FlagTombstone != 0,
+					ts:        ts,
+					seq:       seq,
+				}
+				if batchStart >= 0 {
+					batch = append(batch, r)
+				} else {
+					db.applyRecord(r)
+				}
+			}
+		}
+
+		offset += recordSize
+		if batchStart >= 0 && offset >= batchEnd {
+			for _, r := range batch {
+				db.applyRecord(r)
+			}
+			db.deadBytes += batchMarkerSize
+			batchStart, batch = -1, nil
+		}
+	}
+
+	if batchStart >= 0 {
+		return batchStart, nil
+	}
+	if chainStart >= 0 {
+		return chainStart, nil
+	}
+	return offset, nil
+}
+
+// quarantine 把一条损坏的记录原样追加到隔离文件，格式为 [Offset 8][Length 4][Raw]。
+// 没有 hint 文件时每次启动都会重新扫描到同一条记录，隔离文件中可能出现重复的 offset
+func (db *MiniDB) quarantine(offset int64, header, payload []byte) {
+	f, err := db.fs.OpenFile(db.names.quarantine, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		log.Printf("Warn: Open quarantine file failed: %v", err)
+		return
+	}
+	defer f.Close()
+
+	buf := binary.BigEndian.AppendUint64(nil, uint64(offset))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(header)+len(payload)))
+	buf = append(append(buf, header...), payload...)
+	if _, err := f.Write(buf); err != nil {
+		log.Printf("Warn: Write quarantine file failed: %v", err)
+	}
+}
+
+func (db *MiniDB) truncateTail(offset int64) {
+	log.Printf("Warn: Incomplete write at offset %d, truncating %d bytes", offset, db.offset-offset)
+	if err := db.file.Truncate(offset); err != nil {
+		log.Printf("Warn: Truncate incomplete record failed: %v", err)
+		return
+	}
+	db.offset = offset
+}
+
+// recordAfter 报告 (offset, end) 之间是否还能找到一条完整且校验通过的记录。
+// 只在 offset 处的记录超出文件末尾时调用，逐字节尝试，没有 CRC 时只能按结构判断
+func (db *MiniDB) recordAfter(offset, end int64) bool {
+	r := bufio.NewReader(io.NewSectionReader(db.file, offset+1, end-offset-1))
+	for pos := offset + 1; pos+HeaderSize <= end; pos++ {
+		header, err := r.Peek(HeaderSize)
+		if err != nil {
+			return false
+		}
+		crc, _, kSize, vSize, flags := DecodeHeaderOrder(header, db.order)
+		size := int64(kSize) + int64(vSize)
+		if kSize > 0 && flags < FlagSequence<<1 && (crc == 0) == db.noCRC && pos+HeaderSize+size <= end {
+			payload := make([]byte, size)
+			if _, err := db.file.ReadAt(payload, pos+HeaderSize); err == nil && db.checksum(header, payload) == crc {
+				return true
+			}
+		}
+		r.Discard(1)
+	}
+	return false
+}
+
+// applyRecord 把重放得到的一条完整记录应用到索引
+func (db *MiniDB) applyRecord(r batchRecord) {
+	if db.superseded(r) {
+		return
+	}
+	if r.tombstone {
+		at := db.now()
+		if r.ts != 0 {
+			at = time.Unix(int64(r.ts), 0)
+		}
+		db.tombstone(r.key, r.pos, at)
+		return
+	}
+	db.setIndex(r.key, r.pos)
+}
+
+func (db *MiniDB) Put(key string, value string) error {
+	_, err := db.put(key, []byte(value), nil, false)
+	return err
+}
+
+// PutNX 只在 key 不存在时写入，返回是否写入了。检查和写入在同一次写锁内完成，
+// 并发对同一个 key 的 PutNX 只有一个返回 true，可以用来实现锁和幂等插入
+func (db *MiniDB) PutNX(key, value string) (bool, error) {
+	return db.put(key, []byte(value), nil, true)
+}
+
+// PutWithMeta 写入 value 的同时附带一小段调用方自定义的元数据 (最多 MaxMetaSize 字节)，
+// 例如内容类型或软删除标记，通过 GetWithMeta 读取。版本 1 的数据文件需要先 Merge 升级
+func (db *MiniDB) PutWithMeta(key, value string, meta []byte) error {
+	if len(meta) > MaxMetaSize {
+		return ErrMetaTooLarge
+	}
+	_, err := db.put(key, []byte(value), meta, false)
+	return err
+}
+
+// KV 是 PutBatch 中的一个键值对
+type KV struct {
+	Key   string
+	Value string
+}
+
+// PutBatch 按顺序写入 pairs，整批只获取一次写锁 (SyncAlways 下也只等一次 fsync)，
+// 大量写入时比循环调用 Put 少了每次加锁和 fsync 的开销。与 Apply 不同，它不是原子的：
+// 遇到第一个错误就停止并返回该错误，之前的键值对已经写入，重启后也保留
+func (db *MiniDB) PutBatch(pairs []KV) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	// 超出 MaxFileSize 时 update 会淘汰后重试，从没写完的那一对继续
+	done := 0
+	return db.update(func() error {
+		for ; done < len(pairs); done++ {
+			key, value := pairs[done].Key, []byte(pairs[done].Value)
+			if err := db.checkPut(key, value); err != nil {
+				return err
+			}
+			if _, err := db.putLocked(key, value, nil, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// put 写入一个 key，nx 为 true 时 key 已存在则什么都不写，返回值表示是否写入
+func (db *MiniDB) put(key string, value, meta []byte, nx bool) (bool, error) {
+	if db.opts.ReadOnly {
+		return false, ErrReadOnly
+	}
+	if err := db.checkPut(key, value); err != nil {
+		return false, err
+	}
+
+	wrote := false
+	err := db.update(func() error {
+		var err error
+		wrote, err = db.putLocked(key, value, meta, nx)
+		return err
+	})
+	return wrote, err
+}
+
+// checkPut 检查不需要持锁就能确定的写入参数
+func (db *MiniDB) checkPut(key string, value []byte) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+	if db.opts.MaxValueSize > 0 && len(value) > db.opts.MaxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// putLocked 写入一条记录并更新索引，返回是否写入。调用方需持有写锁
+func (db *MiniDB) putLocked(key string, value, meta []byte, nx bool) (bool, error) {
+	if err := db.checkMeta(len(meta) > 0); err != nil {
+		return false, err
+	}
+
+	_, exists := db.indexes.get(key)
+	if exists && nx {
+		return false, nil
+	}
+	// 覆盖已有 key 不会增加索引大小，始终允许
+	if !exists && db.opts.MaxKeys > 0 && db.indexes.len() >= db.opts.MaxKeys {
+		return false, ErrTooManyKeys
+	}
+
+	size := int64(HeaderSize + len(key) + len(meta) + len(value))
+	if err := db.checkDiskSpace(size); err != nil {
+		return false, err
+	}
+	if err := db.checkFileSize(size); err != nil {
+		return false, err
+	}
+	entries, err := db.encodeEntries([]byte(key), value, meta)
+	if err != nil {
+		return false, err
+	}
+	start := db.offset
+	for _, entry := range entries {
+		n, err := db.write(db.encodeBuffers(entry)...)
+		if err != nil {
+			// 回滚写了一半的分块链，避免重启时被误拼接
+			db.file.Truncate(start)
+			db.offset = start
+			return false, err
+		}
+		db.offset += int64(n)
+	}
+
+	db.bytesWritten += db.offset - start
+	db.setIndex(key, recordPos{offset: start, size: db.offset - start})
+	db.recent.add(key, string(value))
+	return true, nil
+}
+
+// write 把 bufs 依次追加到数据文件末尾，失败时截掉写了一半的数据，保证文件长度仍为 db.offset。
+// 临时错误按 WriteRetries 退避重试。db.offset 由调用方推进，调用方需持有写锁
+func (db *MiniDB) write(bufs ...[]byte) (int, error) {
+	backoff := time.Millisecond
+	for attempt := 0; ; attempt++ {
+		n, err := writeBuffers(db.file, bufs)
+		if err == nil {
+			return n, nil
+		}
+		if terr := db.file.Truncate(db.offset); terr != nil {
+			return 0, err
+		}
+		if attempt >= db.opts.WriteRetries || !isRetriable(err) {
+			return 0, err
+		}
+		log.Printf("Warn: Write failed (%v), retrying in %v", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// writeBuffers 依次写入 bufs。普通文件没有 writev，net.Buffers 对它同样是逐段 Write
+func writeBuffers(w io.Writer, bufs [][]byte) (int, error) {
+	total := 0
+	for _, buf := range bufs {
+		n, err := w.Write(buf)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// isRetriable 判断写入错误是否是临时的，重试可能成功
+func isRetriable(err error) bool {
+	if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+		return true
+	}
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
+
+// setIndex 更新索引，被覆盖的旧记录按 KeepVersions 保留为历史版本，其余计入 deadBytes
+func (db *MiniDB) setIndex(key string, pos recordPos) {
+	db.hot.write(key)
+	db.cache.remove(key)
+	db.recent.remove(key)
+	delete(db.pending, key)
+	delete(db.deleted, key)
+	if old, ok := db.indexes.set(key, pos); ok {
+		keep := max(db.opts.KeepVersions-1, 0)
+		versions := append([]recordPos{old}, db.versions[key]...)
+		for len(versions) > keep {
+			db.deadBytes += versions[len(versions)-1].size
+			db.noteDead(1)
+			versions = versions[:len(versions)-1]
+		}
+		if len(versions) > 0 {
+			db.versions[key] = versions
+		}
+	}
+}
+
+func (db *MiniDB) removeIndex(key string) (recordPos, bool) {
+	db.hot.write(key)
+	db.cache.remove(key)
+	db.recent.remove(key)
+	delete(db.pending, key)
+	old, ok := db.indexes.remove(key)
+	if ok {
+		db.deadBytes += old.size
+		db.noteDead(1)
+	}
+	for _, v := range db.versions[key] {
+		db.deadBytes += v.size
+	}
+	db.noteDead(len(db.versions[key]))
+	delete(db.versions, key)
+	return old, ok
+}
+
+// tombstone 应用 tomb 处的删除标记，at 为删除时间。
+// 开启 DeleteGracePeriod 时记住被删除的最新值，供 Undelete 恢复
+func (db *MiniDB) tombstone(key string, tomb recordPos, at time.Time) {
+	old, ok := db.removeIndex(key)
+	db.deadBytes += tomb.size
+	db.tombstones++
+	db.tombstoneBytes += tomb.size
+	db.noteDead(1)
+	if ok && db.opts.DeleteGracePeriod > 0 {
+		db.deleted[key] = deletedPos{pos: old, tomb: tomb, at: at}
+	}
+}
+
+// History 返回 key 保留的所有版本的写入时间，从新到旧，只读取记录头
+func (db *MiniDB) History(key string) ([]time.Time, error) {
+	if err := db.enter(); err != nil {
+		return nil, err
+	}
+	defer db.inflight.Done()
+	if err := db.settleCounter(key); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	pos, ok := db.indexes.get(key)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	var history []time.Time
+	header := make([]byte, HeaderSize)
+	for _, v := range append([]recordPos{pos}, db.versions[key]...) {
+		if _, err := db.file.ReadAt(header, v.offset); err != nil {
+			return nil, err
+		}
+		_, ts, _, _, _ := DecodeHeaderOrder(header, db.order)
+		history = append(history, time.Unix(int64(ts), 0))
+	}
+	return history, nil
+}
+
+// checkMeta 确认当前数据文件可以写入元数据。调用方需持有写锁
+func (db *MiniDB) checkMeta(hasMeta bool) error {
+	if hasMeta && db.version < 2 {
+		return fmt.Errorf("%w: metadata requires format version 2, run Merge to upgrade", ErrIncompatibleFormat)
+	}
+	return nil
+}
+
+// splitEntries 按 ChunkSize 把大 value 拆成多个连续的 Entry，
+// 除最后一块外都带 FlagChunked 标记。有元数据时放在 value 前面，所有分块都带 FlagMeta；序号再放在元数据前面
+func (db *MiniDB) splitEntries(key, value, meta []byte) []*Entry {
+	var flags uint8
+	if len(meta) > 0 {
+		value = append(append([]byte{byte(len(meta))}, meta...), value...)
+		flags = FlagMeta
+	}
+	value, seqFlag := db.stamp(value)
+	flags |= seqFlag
+
+	size := db.opts.ChunkSize
+	if size <= 0 || len(value) <= size {
+		entry := NewEntry(key, value)
+		entry.Flags |= flags
+		return []*Entry{entry}
+	}
+
+	var entries []*Entry
+	for len(value) > size {
+		entry := NewEntry(key, value[:size])
+		entry.Flags |= FlagChunked | flags
+		entries = append(entries, entry)
+		value = value[size:]
+	}
+	entry := NewEntry(key, value)
+	entry.Flags |= flags
+	return append(entries, entry)
+}
+
+func (db *MiniDB) Get(key string) (string, error) {
+	value, _, err := db.GetChecked(key)
+	return value, err
+}
+
+// GetChecked 与 Get 相同，额外返回 value 是否在 CRC 校验失败的情况下
+// 按 ReturnStale 策略返回
+func (db *MiniDB) GetChecked(key string) (string, bool, error) {
+	value, stale, _, err := db.get(key)
+	return value, stale, err
+}
+
+// GetOrDefault 返回 key 对应的 value，key 不存在时返回 def 和 nil。
+// 数据损坏、已关闭等其他错误原样返回，不会被默认值掩盖
+func (db *MiniDB) GetOrDefault(key, def string) (string, error) {
+	value, err := db.Get(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return def, nil
+	}
+	return value, err
+}
+
+// GetWithSource 与 Get 相同，额外返回 value 是否来自读缓存，用于观察缓存命中情况
+func (db *MiniDB) GetWithSource(key string) (string, bool, error) {
+	value, _, fromCache, err := db.get(key)
+	return value, fromCache, err
+}
+
+// GetWithMeta 返回 value 和 PutWithMeta 写入的元数据，没有元数据时 meta 为 nil。
+// 不经过读缓存，读到损坏的记录时直接返回 CorruptionError
+func (db *MiniDB) GetWithMeta(key string) (string, []byte, error) {
+	if err := db.enter(); err != nil {
+		return "", nil, err
+	}
+	defer db.inflight.Done()
+	if err := db.settleCounter(key); err != nil {
+		return "", nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	pos, ok := db.indexes.get(key)
+	if !ok {
+		return "", nil, ErrKeyNotFound
+	}
+	value, meta, cerr, err := db.readValue(key, pos)
+	if err != nil {
+		return "", nil, err
+	}
+	if cerr != nil {
+		return "", nil, cerr
+	}
+	return string(value), meta, nil
+}
+
+// Exists 只查内存索引，不读取数据文件。关闭后总是返回 false
+func (db *MiniDB) Exists(key string) bool {
+	if db.enter() != nil {
+		return false
+	}
+	defer db.inflight.Done()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	_, ok := db.indexes.get(key)
+	return ok
+}
+
+func (db *MiniDB) get(key string) (value string, stale, fromCache bool, err error) {
+	if err := db.enter(); err != nil {
+		return "", false, false, err
+	}
+	defer db.inflight.Done()
+	db.hot.read(key)
+
+	db.mu.RLock()
+	if n, ok := db.pending[key]; ok {
+		db.mu.RUnlock()
+		return strconv.FormatInt(n, 10), false, false, nil
+	}
+	if v, ok := db.recent.get(key); ok {
+		db.mu.RUnlock()
+		return v, false, true, nil
+	}
+	if v, ok := db.cache.get(key); ok {
+		db.mu.RUnlock()
+		return v, false, true, nil
+	}
+	pos, ok := db.indexes.get(key)
+	if !ok {
+		db.mu.RUnlock()
+		return "", false, false, ErrKeyNotFound
+	}
+	raw, _, cerr, err := db.readValue(key, pos)
+	// 持有读锁时写入缓存，不会和并发的 Put 交错而缓存旧值
+	if err == nil && cerr == nil {
+		value = string(raw)
+		db.cache.add(key, value)
+	}
+	db.mu.RUnlock()
+
+	if err != nil {
+		return "", false, false, err
+	}
+	if cerr == nil {
+		return value, false, false, nil
+	}
+
+	switch db.opts.CorruptPolicy {
+	case ReturnStale:
+		log.Printf("Warn: Serving corrupted value: %v", cerr)
+		return string(raw), true, false, nil
+	case DeleteCorrupt:
+		// 与 Del 一样经过 update，维护模式下不写入，SyncAlways 时等删除标记落盘
+		err := db.update(func() error {
+			if cur, ok := db.indexes.get(key); ok && cur == pos {
+				return db.del(key)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Warn: Delete corrupted key %q failed: %v", key, err)
+			break
+		}
+		log.Printf("Warn: Deleted corrupted key %q at offset %d", key, cerr.Offset)
+	}
+	return "", false, false, cerr
+}
+
+// readValue 读取 pos 处的完整 value (包括分块链) 和元数据，cerr 非空表示其中有 CRC 校验失败的记录，
+// 指向第一条损坏的记录
+func (db *MiniDB) readValue(key string, pos recordPos) (value, meta []byte, cerr *CorruptionError, err error) {
+	stored, flags, cerr, err := db.readStored(key, pos)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if flags&FlagSequence != 0 {
+		if len(stored) < seqSize {
+			return nil, nil, nil, &CorruptionError{Offset: pos.offset, Key: key}
+		}
+		stored = stored[seqSize:]
+	}
+	value = stored
+	if flags&FlagMeta != 0 {
+		if len(stored) == 0 || len(stored) < 1+int(stored[0]) {
+			return nil, nil, nil, &CorruptionError{Offset: pos.offset, Key: key}
+		}
+		n := 1 + int(stored[0])
+		value, meta = stored[n:], stored[1:n]
+	}
+	// 引用本身损坏时不再去读 value log
+	if flags&FlagValueRef != 0 && cerr == nil {
+		if value, cerr, err = db.readValueLog(key, pos.offset, value); err != nil || cerr != nil {
+			return nil, nil, cerr, err
+		}
+	}
+	if flags&FlagCompressed != 0 && cerr == nil {
+		if value, err = decompress(value); err != nil {
+			return nil, nil, &CorruptionError{Offset: pos.offset, Key: key}, nil
+		}
+	}
+	return value, meta, cerr, nil
+}
+
+// readStored 读取 pos 处记录中保存的原始 value 以及第一条记录的标记位。
+// 记录不超过 singleReadLimit 时一次 ReadAt 读出整条记录，否则逐条读取
+func (db *MiniDB) readStored(key string, pos recordPos) (value []byte, flags uint8, cerr *CorruptionError, err error) {
+	if pos.size > singleReadLimit {
+		return db.readValueChunks(key, pos)
+	}
+
+	buf := make([]byte, pos.size)
+	if err := readFull(db.file, buf, pos.offset, key); err != nil {
+		return nil, 0, nil, err
+	}
+
+	for off := int64(0); off < pos.size; {
+		if pos.size-off < HeaderSize {
+			return nil, 0, nil, &CorruptionError{Offset: pos.offset + off, Key: key}
+		}
+		crc, _, kSize, vSize, f := DecodeHeaderOrder(buf[off:], db.order)
+		end := off + HeaderSize + int64(kSize) + int64(vSize)
+		if end > pos.size {
+			return nil, 0, nil, &CorruptionError{Offset: pos.offset + off, Key: key}
+		}
+		if off == 0 {
+			flags = f
+		}
+		if actual := db.checksum(buf[off:off+HeaderSize], buf[off+HeaderSize:end]); actual != crc && cerr == nil {
+			cerr = &CorruptionError{Offset: pos.offset + off, Key: key, Expected: crc, Actual: actual}
+		}
+
+		// 单条记录直接复用读缓冲，避免再拷贝一次
+		if off == 0 && end == pos.size {
+			return buf[HeaderSize+int64(kSize):], flags, cerr, nil
+		}
+		value = append(value, buf[off+HeaderSize+int64(kSize):end]...)
+		off = end
+	}
+	return value, flags, cerr, nil
+}
+
+// readValueChunks 逐条读取 pos 处的分块链。记录头中的长度来自磁盘，文件在建立索引之后损坏时
+// 可能是任意值，分配之前先确认记录不超出索引记下的范围和文件末尾，否则返回 CorruptionError。
+// 不按 MaxValueSize 检查，调小它之后以前写入的大 value 仍然可以读取
+func (db *MiniDB) readValueChunks(key string, pos recordPos) (value []byte, first uint8, cerr *CorruptionError, err error) {
+	limit := min(pos.offset+pos.size, db.offset)
+	offset := pos.offset
+	for i := 0; ; i++ {
+		header := make([]byte, HeaderSize)
+		if err := readFull(db.file, header, offset, key); err != nil {
+			return nil, 0, nil, err
+		}
+
+		crc, _, kSize, vSize, flags := DecodeHeaderOrder(header, db.order)
+		if i == 0 {
+			first = flags
+		}
+		if offset+HeaderSize+int64(kSize)+int64(vSize) > limit {
+			return nil, 0, nil, &CorruptionError{Offset: offset, Key: key}
+		}
+
+		body := make([]byte, int64(kSize)+int64(vSize))
+		if err := readFull(db.file, body, offset+HeaderSize, key); err != nil {
+			return nil, 0, nil, err
+		}
+
+		if actual := db.checksum(header, body); actual != crc && cerr == nil {
+			cerr = &CorruptionError{Offset: offset, Key: key, Expected: crc, Actual: actual}
+		}
+
+		value = append(value, body[kSize:]...)
+		if flags&FlagChunked == 0 {
+			break
+		}
+		offset += HeaderSize + int64(kSize) + int64(vSize)
+	}
+
+	return value, first, cerr, nil
+}
+
+// readFull 从 file 的 offset 处读满 buf。文件在建立索引之后被截断时只能读到一部分，
+// 这时返回指明 key 和位置的 CorruptionError，而不是裸的 io.EOF 或半截数据
+func readFull(file Storage, buf []byte, offset int64, key string) error {
+	n, err := file.ReadAt(buf, offset)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || errors.Is(err, io.EOF) {
+		return &CorruptionError{Offset: offset, Key: key}
+	}
+	return err
+}
+
+// GetRaw 返回 key 对应的完整编码记录 (header + key + value，分块 value 包含整条链)，
+// 用于把数据原样复制到从库。记录按本库的字节序编码，从库的字节序必须相同。
+// 保存在 value log 中的 value 只导出引用，从库的 AppendRaw 会拒绝
+func (db *MiniDB) GetRaw(key string) ([]byte, error) {
+	if err := db.enter(); err != nil {
+		return nil, err
+	}
+	defer db.inflight.Done()
+	if err := db.settleCounter(key); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	pos, ok := db.indexes.get(key)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	raw := make([]byte, pos.size)
+	if _, err := db.file.ReadAt(raw, pos.offset); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// AppendRaw 原样追加 GetRaw 导出的编码记录，保留原有的时间戳和 CRC。
+// 数据会先整体校验，任何一条记录不完整或校验失败都不会写入
+func (db *MiniDB) AppendRaw(data []byte) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	var pos int64
+	hasMeta, hasCompressed, hasSeq := false, false, false
+	for pos < int64(len(data)) {
+		if int64(len(data))-pos < HeaderSize {
+			return ErrDataCorrupted
+		}
+		crc, _, kSize, vSize, flags := DecodeHeaderOrder(data[pos:], db.order)
+		end := pos + HeaderSize + int64(kSize) + int64(vSize)
+		if end > int64(len(data)) || db.checksum(data[pos:pos+HeaderSize], data[pos+HeaderSize:end]) != crc {
+			return ErrDataCorrupted
+		}
+		if end == int64(len(data)) && flags&FlagChunked != 0 {
+			return ErrDataCorrupted
+		}
+		if kSize == 0 {
+			return ErrEmptyKey
+		}
+		// 引用指向的 value 只存在于导出方的 value log 中
+		if flags&FlagValueRef != 0 {
+			return fmt.Errorf("%w: record refers to a value log", ErrIncompatibleFormat)
+		}
+		hasMeta = hasMeta || flags&FlagMeta != 0
+		hasCompressed = hasCompressed || flags&FlagCompressed != 0
+		hasSeq = hasSeq || flags&FlagSequence != 0
+		pos = end
+	}
+
+	return db.update(func() error {
+		if err := db.checkMeta(hasMeta); err != nil {
+			return err
+		}
+		if err := db.checkCompressed(hasCompressed); err != nil {
+			return err
+		}
+		if err := db.checkSequence(hasSeq); err != nil {
+			return err
+		}
+		if err := db.checkDiskSpace(int64(len(data))); err != nil {
+			return err
+		}
+		if err := db.checkFileSize(int64(len(data))); err != nil {
+			return err
+		}
+
+		start := db.offset
+		n, err := db.write(data)
+		if err != nil {
+			return err
+		}
+		db.offset += int64(n)
+		db.bytesWritten += int64(n)
+
+		// 带序号的记录比索引中同一个 key 的记录旧时不会覆盖它
+		chainStart := int64(-1)
+		var seq uint64
+		for pos = 0; pos < int64(len(data)); {
+			_, _, kSize, vSize, flags := DecodeHeaderOrder(data[pos:], db.order)
+			key := string(data[pos+HeaderSize : pos+HeaderSize+int64(kSize)])
+			if chainStart < 0 {
+				chainStart = start + pos
+				seq = db.recordSeq(flags, data[pos+HeaderSize+int64(kSize):pos+HeaderSize+int64(kSize)+int64(vSize)])
+			}
+			pos += HeaderSize + int64(kSize) + int64(vSize)
+			if flags&FlagTombstone != 0 || flags&FlagChunked == 0 {
+				db.applyRecord(batchRecord{
+					key:       key,
+					pos:       recordPos{offset: chainStart, size: start + pos - chainStart},
+					tombstone: flags&FlagTombstone != 0,
+					seq:       seq,
+				})
+				chainStart = -1
+			}
+		}
+		return nil
+	})
+}
+
+func (db *MiniDB) Del(key string) error {
+	return db.update(func() error {
+		return db.del(key)
+	})
+}
+
+// DeletePrefix 删除所有以 prefix 开头的 key 并返回删除的数量，prefix 为空时清空整个库。
+// 所有删除标记作为一个批次写入，重启后不会只删掉其中一部分
+func (db *MiniDB) DeletePrefix(prefix string) (int, error) {
+	var n int
+	err := db.update(func() error {
+		var ops []batchOp
+		db.indexes.each(func(key string, _ recordPos) {
+			if strings.HasPrefix(key, prefix) {
+				ops = append(ops, batchOp{key: key, tombstone: true})
+			}
+		})
+		if err := db.writeBatch(ops); err != nil {
+			return err
+		}
+		n = len(ops)
+		return nil
+	})
+	return n, err
+}
+
+// Rename 把 oldKey 的 value 移到 newKey 下 (newKey 已存在时被覆盖)，
+// 新记录和 oldKey 的删除标记作为一个批次写入，重启后不会只剩其中一半
+func (db *MiniDB) Rename(oldKey, newKey string) error {
+	return db.update(func() error {
+		pos, ok := db.indexes.get(oldKey)
+		if !ok {
+			return ErrKeyNotFound
+		}
+		if newKey == "" {
+			return ErrEmptyKey
+		}
+		if oldKey == newKey {
+			return nil
+		}
+		if err := db.flushCounter(oldKey); err != nil {
+			return err
+		}
+		pos, _ = db.indexes.get(oldKey)
+		value, meta, cerr, err := db.readValue(oldKey, pos)
+		if err != nil {
+			return err
+		}
+		if cerr != nil {
+			return cerr
+		}
+		return db.writeBatch([]batchOp{
+			{key: newKey, value: value, meta: meta},
+			{key: oldKey, tombstone: true},
+		})
+	})
+}
+
+// CompactKey 重新写入 key 的最新 value，并丢弃它所有保留的历史版本，旧记录在下次 Merge 时回收。
+// 删除标记和新记录作为一个批次写入，重启重放时历史版本同样会被清掉
+func (db *MiniDB) CompactKey(key string) error {
+	return db.update(func() error {
+		if err := db.flushCounter(key); err != nil {
+			return err
+		}
+		pos, ok := db.indexes.get(key)
+		if !ok {
+			return ErrKeyNotFound
+		}
+		value, meta, cerr, err := db.readValue(key, pos)
+		if err != nil {
+			return err
+		}
+		if cerr != nil {
+			return cerr
+		}
+		return db.writeBatch([]batchOp{
+			{key: key, tombstone: true},
+			{key: key, value: value, meta: meta},
+		})
+	})
+}
+
+// del 追加一条删除标记，保证重启后 key 不会被旧记录恢复。调用方需持有写锁
+func (db *MiniDB) del(key string) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if _, ok := db.indexes.get(key); !ok {
+		return nil
+	}
+
+	value, flags := db.stamp(nil)
+	entry := NewEntry([]byte(key), value)
+	entry.Flags |= FlagTombstone | flags
+	n, err := db.write(db.encode(entry))
+	if err != nil {
+		return err
+	}
+	tomb := recordPos{offset: db.offset, size: int64(n)}
+	db.offset += int64(n)
+	db.bytesWritten += int64(n)
+
+	db.tombstone(key, tomb, db.now())
+	return nil
+}
+
+// Undelete 恢复 DeleteGracePeriod 内被删除的 key，把删除前的值和元数据重新写入一次。
+// 没有可恢复的值 (未删除、已超过期限或之后又被写入) 时返回 ErrKeyNotFound
+func (db *MiniDB) Undelete(key string) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	return db.update(func() error {
+		d, ok := db.deleted[key]
+		if !ok || db.now().Sub(d.at) > db.opts.DeleteGracePeriod {
+			return ErrKeyNotFound
+		}
+		value, meta, cerr, err := db.readValue(key, d.pos)
+		if err != nil {
+			return err
+		}
+		if cerr != nil {
+			return cerr
+		}
+		return db.writeBatch([]batchOp{{key: key, value: value, meta: meta}})
+	})
+}
+
+// defaultCloseTimeout 是 CloseTimeout 为 0 时 Close 等待进行中读写的时间
+const defaultCloseTimeout = 5 * time.Second
+
+// enter 登记一次进行中的读写，返回 nil 时调用方必须在结束后调用 db.inflight.Done
+func (db *MiniDB) enter() error {
+	db.drainMu.Lock()
+	defer db.drainMu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.inflight.Add(1)
+	return nil
+}
+
+// drain 拒绝新的读写并等待进行中的读写结束，超时后不再等待。已经关闭过时返回 false
+func (db *MiniDB) drain() bool {
+	db.drainMu.Lock()
+	if db.closed {
+		db.drainMu.Unlock()
+		return false
+	}
+	db.closed = true
+	db.drainMu.Unlock()
+
+	timeout := db.opts.CloseTimeout
+	if timeout <= 0 {
+		timeout = defaultCloseTimeout
+	}
+	done := make(chan struct{})
+	go func() {
+		db.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Warn: Close timed out after %v waiting for in-flight operations", timeout)
+	}
+	return true
+}
+
+// Close 先等待进行中的 Put、Get 等操作结束 (最多 CloseTimeout)，之后的调用返回 ErrClosed。
+// 重复调用 Close 什么也不做
+func (db *MiniDB) Close() {
+	if !db.drain() {
+		return
+	}
+	close(db.closeCh)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.opts.ReadOnly {
+		if err := db.flushCounters(); err != nil {
+			log.Printf("Flush counters failed: %v", err)
+		}
+		if err := db.writeHint(db.opts.StrictCheckpoint); err != nil {
+			log.Printf("Write hint file failed: %v", err)
+		}
+	}
+	db.file.Close()
+	if db.vlog != nil {
+		db.vlog.Close()
+	}
+}
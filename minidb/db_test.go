@@ -0,0 +1,1764 @@
+package minidb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 引擎通过标准库 log 输出加载、Merge 等信息，测试中不需要
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// openTestDB 在临时目录中打开一个数据库，测试结束时自动关闭
+func openTestDB(t testing.TB, opts Options) *MiniDB {
+	t.Helper()
+	if opts.FilePrefix == "" {
+		opts.FilePrefix = filepath.Join(t.TempDir(), DefaultFilePrefix)
+	}
+	db, err := OpenWithOptions(opts)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// reopen 关闭 db 并用同样的选项重新打开
+func reopen(t testing.TB, db *MiniDB) *MiniDB {
+	t.Helper()
+	opts := db.opts
+	db.Close()
+	db, err := OpenWithOptions(opts)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestCloseTwice(t *testing.T) {
+	db := openTestDB(t, Options{})
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db.Close()
+	if _, err := db.Get("a"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Get after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestReadsAfterClose(t *testing.T) {
+	db := openTestDB(t, Options{})
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	tests := []struct {
+		name string
+		read func() error
+	}{
+		{"Get", func() error { _, err := db.Get("a"); return err }},
+		{"KeyInfo", func() error { _, err := db.KeyInfo("a"); return err }},
+		{"History", func() error { _, err := db.History("a"); return err }},
+		{"ValueSize", func() error { _, err := db.ValueSize("a"); return err }},
+		{"ChangedSince", func() error { _, err := db.ChangedSince(time.Time{}); return err }},
+		{"Scan", func() error { _, _, err := db.Scan("", "", 0); return err }},
+	}
+	for _, tt := range tests {
+		if err := tt.read(); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s after Close = %v, want ErrClosed", tt.name, err)
+		}
+	}
+	if db.Exists("a") {
+		t.Error("Exists after Close = true, want false")
+	}
+}
+
+func TestGetOrDefault(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		setup   func(t *testing.T, db *MiniDB)
+		want    string
+		wantErr error
+	}{
+		{name: "present", key: "a", want: "1"},
+		{name: "missing", key: "nope", want: "def"},
+		{name: "closed", key: "a", setup: func(t *testing.T, db *MiniDB) { db.Close() }, wantErr: ErrClosed},
+		{name: "corrupted", key: "a", setup: func(t *testing.T, db *MiniDB) {
+			f, err := os.OpenFile(db.names.data, os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err := f.WriteAt([]byte("X"), db.offset-1); err != nil {
+				t.Fatal(err)
+			}
+		}, wantErr: ErrDataCorrupted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, Options{})
+			if err := db.Put("a", "1"); err != nil {
+				t.Fatal(err)
+			}
+			if tt.setup != nil {
+				tt.setup(t, db)
+			}
+			got, err := db.GetOrDefault(tt.key, "def")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GetOrDefault = %q, %v, want error %v", got, err, tt.wantErr)
+			}
+			if tt.wantErr == nil && got != tt.want {
+				t.Fatalf("GetOrDefault = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenSnapshotIgnoresLiveHint(t *testing.T) {
+	t.Chdir(t.TempDir())
+	live, err := Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.Put("a", "1")
+	live.Close() // 写出 minidb.hint
+
+	other := openTestDB(t, Options{FilePrefix: "other"})
+	other.Put("b", "22222")
+	other.Close()
+	data, err := os.ReadFile("other." + DefaultExtension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(DBFileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := OpenSnapshot(DBFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	if _, err := snap.Get("a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(a) = %v, want ErrKeyNotFound", err)
+	}
+	if v, err := snap.Get("b"); err != nil || v != "22222" {
+		t.Fatalf("Get(b) = %q, %v", v, err)
+	}
+}
+
+func TestOpenSnapshotUsesItsOwnValueLog(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, dir := range []string{"other", "lone"} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 两个库的 value 长度相同，引用指向各自 value log 中相同的位置
+	vlogOpts := func(prefix string) Options {
+		return Options{FilePrefix: prefix, ValueLogThreshold: 4}
+	}
+	live := openTestDB(t, vlogOpts(DefaultFilePrefix))
+	live.Put("k", strings.Repeat("L", 64))
+	live.Close()
+	other := openTestDB(t, vlogOpts(filepath.Join("other", DefaultFilePrefix)))
+	other.Put("k", strings.Repeat("O", 64))
+	other.Close()
+	data, err := os.ReadFile(filepath.Join("other", DBFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("lone", DBFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr error
+	}{
+		{name: "live", path: DBFileName, want: strings.Repeat("L", 64)},
+		{name: "value log next to the snapshot", path: filepath.Join("other", DBFileName), want: strings.Repeat("O", 64)},
+		{name: "copied without its value log", path: filepath.Join("lone", DBFileName), wantErr: ErrValueLogMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snap, err := OpenSnapshot(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer snap.Close()
+			v, err := snap.Get("k")
+			if !errors.Is(err, tt.wantErr) || v != tt.want {
+				t.Fatalf("Get = %q, %v, want %q, %v", v, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	// a 目录下的库把 value 存在 value log 中，当前目录下另有一个同样开启 value log 的库
+	vlogOpts := Options{ValueLogThreshold: 4}
+	writeDB(t, ".", vlogOpts, []KV{{"k", strings.Repeat("L", 64)}})
+	refs := writeDB(t, "a", vlogOpts, []KV{{"k", strings.Repeat("A", 64)}})
+
+	tests := []struct {
+		name    string
+		path    string // 空表示新建的临时文件
+		opts    Options
+		openErr error
+		getErr  error
+	}{
+		{name: "new file"},
+		{name: "value log option", opts: vlogOpts, openErr: ErrValueLogUnsupported},
+		{name: "dedup option", opts: Options{DedupThreshold: 4}, openErr: ErrValueLogUnsupported},
+		{name: "existing refs", path: refs, getErr: ErrValueLogMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f *os.File
+			var err error
+			if tt.path == "" {
+				f, err = os.CreateTemp(t.TempDir(), "fd")
+			} else {
+				f, err = os.OpenFile(tt.path, os.O_RDWR, 0)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, err := OpenFileWithOptions(f, tt.opts)
+			if !errors.Is(err, tt.openErr) {
+				t.Fatalf("open = %v, want %v", err, tt.openErr)
+			}
+			if err != nil {
+				f.Close()
+				return
+			}
+			defer db.Close()
+
+			if tt.path == "" {
+				if err := db.Put("k", "v"); err != nil {
+					t.Fatal(err)
+				}
+				if err := db.Merge(); !errors.Is(err, ErrMergeUnsupported) {
+					t.Fatalf("Merge = %v, want ErrMergeUnsupported", err)
+				}
+				// 通过新的句柄重新加载
+				name := f.Name()
+				db.Close()
+				if f, err = os.OpenFile(name, os.O_RDWR, 0); err != nil {
+					t.Fatal(err)
+				}
+				if db, err = OpenFile(f); err != nil {
+					t.Fatal(err)
+				}
+				defer db.Close()
+			}
+			v, err := db.Get("k")
+			if !errors.Is(err, tt.getErr) || (err == nil && v != "v") {
+				t.Fatalf("Get = %q, %v, want %v", v, err, tt.getErr)
+			}
+		})
+	}
+}
+
+// corruptLastByte 改写数据文件的最后一个字节，即最后一条记录 value 的末尾
+func corruptLastByte(t *testing.T, db *MiniDB) {
+	t.Helper()
+	f, err := os.OpenFile(db.names.data, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("X"), db.offset-1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorruptPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     CorruptPolicy
+		want       string
+		wantStale  bool
+		wantErr    error
+		wantKeptOK bool // 重新打开后 key 是否还在
+		maintMode  bool
+	}{
+		{name: "FailOnCorrupt", policy: FailOnCorrupt, wantErr: ErrDataCorrupted, wantKeptOK: true},
+		{name: "ReturnStale", policy: ReturnStale, want: "hellX", wantStale: true, wantKeptOK: true},
+		{name: "DeleteCorrupt", policy: DeleteCorrupt, wantErr: ErrDataCorrupted},
+		// 维护模式冻结所有写入，包括读取时删除损坏的 key
+		{name: "DeleteCorrupt in maintenance mode", policy: DeleteCorrupt, wantErr: ErrDataCorrupted, wantKeptOK: true, maintMode: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, Options{CorruptPolicy: tt.policy})
+			if err := db.Put("other", "ok"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put("k", "hello"); err != nil {
+				t.Fatal(err)
+			}
+			corruptLastByte(t, db)
+			db.SetMaintenanceMode(tt.maintMode)
+
+			got, stale, err := db.GetChecked("k")
+			if !errors.Is(err, tt.wantErr) || got != tt.want || stale != tt.wantStale {
+				t.Fatalf("GetChecked = %q, %v, %v, want %q, %v, %v", got, stale, err, tt.want, tt.wantStale, tt.wantErr)
+			}
+
+			db = reopen(t, db)
+			if _, ok := db.indexes.get("k"); ok != tt.wantKeptOK {
+				t.Fatalf("key present after reopen = %v, want %v", ok, tt.wantKeptOK)
+			}
+			if v, err := db.Get("other"); err != nil || v != "ok" {
+				t.Fatalf("Get(other) = %q, %v", v, err)
+			}
+		})
+	}
+}
+
+// rawRecord 手工编码一条记录，kSize 和 vSize 可以与实际内容不符
+func rawRecord(kSize, vSize uint32, flags uint8, payload []byte) []byte {
+	buf := make([]byte, HeaderSize, HeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[8:12], kSize)
+	binary.BigEndian.PutUint32(buf[12:16], vSize)
+	buf[16] = flags
+	buf = append(buf, payload...)
+	binary.BigEndian.PutUint32(buf[0:4], Checksum(buf[:HeaderSize], buf[HeaderSize:]))
+	return buf
+}
+
+func TestAppendRawRejectsBadLengths(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"kSize+vSize wraps uint32", rawRecord(0xFFFFFFFF, 2, 0, []byte("x"))},
+		{"vSize past end", rawRecord(1, 100, 0, []byte("kv"))},
+		{"short header", []byte{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, Options{})
+			if err := db.Put("a", "1"); err != nil {
+				t.Fatal(err)
+			}
+			before := db.offset
+
+			if err := db.AppendRaw(tt.data); !errors.Is(err, ErrDataCorrupted) {
+				t.Fatalf("AppendRaw = %v, want ErrDataCorrupted", err)
+			}
+			if db.offset != before {
+				t.Fatalf("offset moved from %d to %d", before, db.offset)
+			}
+
+			db = reopen(t, db)
+			if v, err := db.Get("a"); err != nil || v != "1" {
+				t.Fatalf("Get after reopen = %q, %v", v, err)
+			}
+		})
+	}
+}
+
+func TestReplayOversizedLengthAtTail(t *testing.T) {
+	db := openTestDB(t, Options{})
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	opts := db.opts
+	db.Close()
+
+	f, err := os.OpenFile(newFileNames(opts.FilePrefix, opts.Extension).data, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(rawRecord(0xFFFFFFFF, 2, 0, []byte("x"))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err = OpenWithOptions(opts)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+	if v, err := db.Get("a"); err != nil || v != "1" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+}
+
+func TestPutBatchStopsAtFirstError(t *testing.T) {
+	db := openTestDB(t, Options{})
+	err := db.PutBatch([]KV{{"a", "1"}, {"b", "2"}, {"", "3"}, {"c", "4"}})
+	if !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("PutBatch = %v, want ErrEmptyKey", err)
+	}
+	db = reopen(t, db)
+	for k, want := range map[string]string{"a": "1", "b": "2"} {
+		if v, err := db.Get(k); err != nil || v != want {
+			t.Fatalf("Get(%q) = %q, %v, want %q", k, v, err, want)
+		}
+	}
+	if _, err := db.Get("c"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(c) after the failing pair = %v, want ErrKeyNotFound", err)
+	}
+}
+
+// BenchmarkPutBatch 比较 PutBatch 和循环 Put 写入 10 万个键值对的耗时
+func BenchmarkPutBatch(b *testing.B) {
+	const n = 100000
+	pairs := make([]KV, n)
+	for i := range pairs {
+		pairs[i] = KV{fmt.Sprintf("key-%06d", i), "value"}
+	}
+	b.Run("loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			db := openTestDB(b, Options{})
+			b.StartTimer()
+			for _, p := range pairs {
+				if err := db.Put(p.Key, p.Value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			db := openTestDB(b, Options{})
+			b.StartTimer()
+			if err := db.PutBatch(pairs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkVectoredWrite 比较 4MB value 整条编码写入和记录头、value 分开写入的分配和吞吐
+func BenchmarkVectoredWrite(b *testing.B) {
+	value := strings.Repeat("v", 4<<20)
+	for _, threshold := range []int{0, 64 << 10} {
+		b.Run(fmt.Sprintf("threshold=%d", threshold), func(b *testing.B) {
+			db := openTestDB(b, Options{VectoredWriteThreshold: threshold})
+			b.SetBytes(int64(len(value)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.Put("k", value); err != nil {
+					b.Fatal(err)
+				}
+				// 定期 Merge 回收旧版本，数据文件不会随 b.N 无限增长
+				if i%64 == 63 {
+					b.StopTimer()
+					if err := db.Merge(); err != nil {
+						b.Fatal(err)
+					}
+					b.StartTimer()
+				}
+			}
+			b.StopTimer()
+			db = reopen(b, db)
+			if v, err := db.Get("k"); err != nil || v != value {
+				b.Fatalf("Get after vectored writes = %d bytes, %v", len(v), err)
+			}
+		})
+	}
+}
+
+func TestDirectReads(t *testing.T) {
+	db := openTestDB(t, Options{DirectReads: true})
+	// value 跨越 4KB 块边界，读取需要按块对齐后截取
+	want := map[string]string{"a": "1", "b": strings.Repeat("x", 5000), "c": "3"}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Put(k, want[k]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, reload := range []bool{false, true} {
+		if reload {
+			db = reopen(t, db)
+		}
+		for k, v := range want {
+			if got, err := db.Get(k); err != nil || got != v {
+				t.Fatalf("reload=%v: Get(%q) = %d bytes, %v, want %d bytes", reload, k, len(got), err, len(v))
+			}
+		}
+	}
+}
+
+func TestChunkedValues(t *testing.T) {
+	const chunk = 16
+	db := openTestDB(t, Options{ChunkSize: chunk})
+	want := make(map[string]string)
+	for _, n := range []int{0, chunk - 1, chunk, chunk + 1, 1000} {
+		key := fmt.Sprintf("v%d", n)
+		want[key] = strings.Repeat("x", n)
+		if err := db.PutWithMeta(key, want[key], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want["meta"] = strings.Repeat("m", 3*chunk)
+	if err := db.PutWithMeta("meta", want["meta"], []byte("content-type")); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for k, v := range want {
+			if got, err := db.Get(k); err != nil || got != v {
+				t.Fatalf("%s: Get(%q) = %d bytes, %v, want %d bytes", stage, k, len(got), err, len(v))
+			}
+		}
+		// 每条记录的 value 都不超过 ChunkSize
+		entries, _, err := db.Entries(0, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if e.ValueSize > chunk {
+				t.Fatalf("%s: record at %d holds %d bytes", stage, e.Offset, e.ValueSize)
+			}
+		}
+	}
+	check("written")
+	db = reopen(t, db)
+	check("reopened")
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check("merged")
+
+	// 分块链写到一半崩溃时，这条记录整体丢弃，读到的仍是之前的 value
+	if err := db.Put("v1000", strings.Repeat("y", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	info, err := os.Stat(db.names.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(db.names.data, info.Size()-500); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(db.names.hint)
+	db = openTestDB(t, db.opts)
+	check("torn chain")
+}
+
+func TestMaxKeys(t *testing.T) {
+	db := openTestDB(t, Options{MaxKeys: 3})
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Put(k, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	steps := []struct {
+		name string
+		op   func() error
+		want error
+	}{
+		{"new key", func() error { return db.Put("d", "1") }, ErrTooManyKeys},
+		{"overwrite", func() error { return db.Put("a", "2") }, nil},
+		{"setnx new key", func() error { _, err := db.PutNX("d", "1"); return err }, ErrTooManyKeys},
+		{"batch with a new key", func() error { return db.Apply([]Op{{Key: "a", Value: "3"}, {Key: "d", Value: "1"}}) }, ErrTooManyKeys},
+		{"batch replacing a key", func() error { return db.Apply([]Op{{Key: "c", Delete: true}, {Key: "d", Value: "1"}}) }, nil},
+		{"new key after delete", func() error {
+			if err := db.Del("b"); err != nil {
+				return err
+			}
+			return db.Put("e", "1")
+		}, nil},
+		{"full again", func() error { return db.Put("f", "1") }, ErrTooManyKeys},
+	}
+	for _, s := range steps {
+		if err := s.op(); !errors.Is(err, s.want) {
+			t.Fatalf("%s: %v, want %v", s.name, err, s.want)
+		}
+	}
+	if v, _ := db.Get("a"); v != "2" {
+		t.Fatalf("rejected batch was partly applied: a = %q", v)
+	}
+	if n := db.Stats().Keys; n != 3 {
+		t.Fatalf("%d keys, want 3", n)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	// 重放时删除时间取自记录头中的时间戳，时钟从当前时间开始
+	now := time.Now()
+	db := openTestDB(t, Options{DeleteGracePeriod: time.Hour})
+	db.now = func() time.Time { return now }
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Put(k, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []string{"a", "b"} {
+		if err := db.Del(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("b", "again"); err != nil {
+		t.Fatal(err)
+	}
+
+	tombstones := func() int {
+		t.Helper()
+		entries, _, err := db.Entries(0, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, e := range entries {
+			if e.Type == "tombstone" {
+				n++
+			}
+		}
+		return n
+	}
+	check := func(stage string, wantTombstones int) {
+		t.Helper()
+		if _, err := db.Get("a"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("%s: Get(a) = %v, want ErrKeyNotFound", stage, err)
+		}
+		for k, want := range map[string]string{"b": "again", "c": "v"} {
+			if v, err := db.Get(k); err != nil || v != want {
+				t.Fatalf("%s: Get(%q) = %q, %v, want %q", stage, k, v, err, want)
+			}
+		}
+		if n := tombstones(); n != wantTombstones {
+			t.Fatalf("%s: %d tombstones in the data file, want %d", stage, n, wantTombstones)
+		}
+	}
+	check("written", 2)
+	db.Close()
+	os.Remove(db.names.hint)
+	db = openTestDB(t, db.opts)
+	db.now = func() time.Time { return now }
+	check("replayed", 2)
+
+	// 期限内 Merge 保留 a 的删除标记和旧值，b 已被重新写入，它的删除标记没有用了
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check("merged within grace period", 1)
+	now = now.Add(2 * time.Hour)
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check("merged after grace period", 0)
+	if err := db.Undelete("a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Undelete after the tombstone was dropped = %v", err)
+	}
+	db = reopen(t, db)
+	check("reopened", 0)
+}
+
+func TestUndelete(t *testing.T) {
+	tests := []struct {
+		name  string
+		grace time.Duration
+		// after 在删除 a 之后执行，elapsed 为距删除经过的时间
+		after   func(t *testing.T, db *MiniDB) *MiniDB
+		elapsed time.Duration
+		wantErr error
+	}{
+		{name: "within grace period", grace: time.Hour, elapsed: 59 * time.Minute},
+		{name: "after reopen", grace: time.Hour, after: func(t *testing.T, db *MiniDB) *MiniDB {
+			return reopen(t, db)
+		}},
+		{name: "after merge", grace: time.Hour, after: func(t *testing.T, db *MiniDB) *MiniDB {
+			if err := db.Merge(); err != nil {
+				t.Fatal(err)
+			}
+			return reopen(t, db)
+		}},
+		{name: "grace period expired", grace: time.Hour, elapsed: 61 * time.Minute, wantErr: ErrKeyNotFound},
+		{name: "rewritten", grace: time.Hour, after: func(t *testing.T, db *MiniDB) *MiniDB {
+			if err := db.Put("a", "new"); err != nil {
+				t.Fatal(err)
+			}
+			return db
+		}, wantErr: ErrKeyNotFound},
+		{name: "soft delete disabled", wantErr: ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 重放时删除时间取自记录头中的时间戳，时钟从当前时间开始
+			now := time.Now()
+			clock := func() time.Time { return now }
+			db := openTestDB(t, Options{DeleteGracePeriod: tt.grace})
+			db.now = clock
+			if err := db.PutWithMeta("a", "old", []byte("m")); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Del("a"); err != nil {
+				t.Fatal(err)
+			}
+			if tt.after != nil {
+				db = tt.after(t, db)
+				db.now = clock
+			}
+			now = now.Add(tt.elapsed)
+
+			err := db.Undelete("a")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Undelete = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// 恢复出的值和元数据与删除前相同，并且重新打开后仍然存在
+			for _, stage := range []string{"restored", "reopened"} {
+				if stage == "reopened" {
+					db = reopen(t, db)
+				}
+				if v, meta, err := db.GetWithMeta("a"); err != nil || v != "old" || string(meta) != "m" {
+					t.Fatalf("%s: %q, %q, %v", stage, v, meta, err)
+				}
+			}
+		})
+	}
+	if err := openTestDB(t, Options{DeleteGracePeriod: time.Hour}).Undelete("never"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Undelete of a key that was never written = %v", err)
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	db := openTestDB(t, Options{})
+	for _, k := range []string{"a", "b"} {
+		if err := db.Put(k, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.SetMaintenanceMode(true)
+	if !db.InMaintenanceMode() {
+		t.Fatal("InMaintenanceMode = false after SetMaintenanceMode(true)")
+	}
+
+	writes := []struct {
+		name string
+		op   func() error
+	}{
+		{"Put", func() error { return db.Put("a", "2") }},
+		{"PutWithMeta", func() error { return db.PutWithMeta("a", "2", []byte("m")) }},
+		{"PutBatch", func() error { return db.PutBatch([]KV{{"c", "1"}}) }},
+		{"Del", func() error { return db.Del("a") }},
+		{"DeletePrefix", func() error { _, err := db.DeletePrefix("a"); return err }},
+		{"Rename", func() error { return db.Rename("a", "z") }},
+		{"AppendRaw", func() error { return db.AppendRaw(NewEntry([]byte("c"), []byte("1")).EncodeOrder(db.order)) }},
+		{"Txn", func() error {
+			tx := db.Begin()
+			tx.Set("c", "1")
+			return tx.Commit()
+		}},
+	}
+	for _, w := range writes {
+		if err := w.op(); !errors.Is(err, ErrMaintenanceMode) {
+			t.Errorf("%s in maintenance mode = %v, want ErrMaintenanceMode", w.name, err)
+		}
+	}
+
+	// 读取和 Merge 照常工作，被拒绝的写入没有留下任何痕迹
+	want := map[string]string{"a": "1", "b": "1"}
+	if got := dump(t, db); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("reads in maintenance mode = %v, want %v", got, want)
+	}
+	if !db.Exists("a") || db.Exists("c") {
+		t.Fatal("Exists in maintenance mode reports a rejected write")
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge in maintenance mode: %v", err)
+	}
+
+	db.SetMaintenanceMode(false)
+	if err := db.Put("c", "1"); err != nil {
+		t.Fatalf("Put after leaving maintenance mode: %v", err)
+	}
+
+	// 维护模式下也能正常关闭，关闭前的数据完整保留，重新打开后不再处于维护模式
+	db.SetMaintenanceMode(true)
+	db = reopen(t, db)
+	want["c"] = "1"
+	if got := dump(t, db); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("after closing in maintenance mode = %v, want %v", got, want)
+	}
+	if db.InMaintenanceMode() {
+		t.Fatal("maintenance mode survived a reopen")
+	}
+}
+
+func TestOffsetDivergence(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval int
+		// wantFail 为截断之后第几次 Put 发现不一致，0 表示不检查
+		wantFail int
+	}{
+		{"every write", 1, 1},
+		{"sampled", 4, 2},
+		{"disabled", -1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, Options{OffsetCheckInterval: tt.interval})
+			for _, k := range []string{"a", "b"} {
+				if err := db.Put(k, "1"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// 外部截掉最后一条记录，db.offset 不知情
+			if err := os.Truncate(db.names.data, db.offset-5); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 1; i <= 4; i++ {
+				err := db.Put(fmt.Sprintf("k%d", i), "1")
+				if tt.wantFail == 0 || i < tt.wantFail {
+					if err != nil {
+						t.Fatalf("Put %d after truncation = %v, want it to pass the sampling", i, err)
+					}
+					continue
+				}
+				if !errors.Is(err, ErrStateDivergence) {
+					t.Fatalf("Put %d after truncation = %v, want ErrStateDivergence", i, err)
+				}
+			}
+			if tt.wantFail == 0 {
+				return
+			}
+			// 发现之后所有写入都被拒绝，之前完整的记录仍然可读
+			if err := db.Del("a"); !errors.Is(err, ErrStateDivergence) {
+				t.Fatalf("Del after divergence = %v", err)
+			}
+			if v, err := db.Get("a"); err != nil || v != "1" {
+				t.Fatalf("Get(a) after divergence = %q, %v", v, err)
+			}
+		})
+	}
+}
+
+// TestAdoptExternalAppends 其他进程追加的完整记录被重放进索引，新的写入接在其后；
+// 不完整的追加或未开启 AdoptExternalAppends 时仍拒绝写入
+func TestAdoptExternalAppends(t *testing.T) {
+	tests := []struct {
+		name    string
+		adopt   bool
+		partial bool // 外部追加的最后一条记录只写了一半
+	}{
+		{name: "adopted", adopt: true},
+		{name: "partial", adopt: true, partial: true},
+		{name: "disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, Options{OffsetCheckInterval: 1, AdoptExternalAppends: tt.adopt})
+			if err := db.Put("a", "1"); err != nil {
+				t.Fatal(err)
+			}
+			data := append(NewEntry([]byte("ext1"), []byte("x")).EncodeOrder(db.order),
+				NewEntry([]byte("a"), []byte("2")).EncodeOrder(db.order)...)
+			if tt.partial {
+				data = data[:len(data)-3]
+			}
+			f, err := os.OpenFile(db.names.data, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			err = db.Put("b", "1")
+			if !tt.adopt || tt.partial {
+				if !errors.Is(err, ErrStateDivergence) {
+					t.Fatalf("Put after external append = %v, want ErrStateDivergence", err)
+				}
+				if v, err := db.Get("a"); err != nil || v != "1" {
+					t.Fatalf("Get(a) after divergence = %q, %v", v, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{"a": "2", "b": "1", "ext1": "x"}
+			for _, reload := range []bool{false, true} {
+				if reload {
+					db = reopen(t, db)
+				}
+				if got := dump(t, db); !maps.Equal(got, want) {
+					t.Fatalf("reload=%v: %v, want %v", reload, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDisableCRC(t *testing.T) {
+	db := openTestDB(t, Options{DisableCRC: true})
+	want := map[string]string{"a": "1", "b": strings.Repeat("x", 1000), "c": ""}
+	for k, v := range want {
+		if err := db.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Del("c"); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "c")
+
+	check := func(stage string) {
+		t.Helper()
+		header := make([]byte, FileHeaderSize)
+		if _, err := db.file.ReadAt(header, 0); err != nil {
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint16(header[6:8])&FileFlagNoCRC == 0 {
+			t.Fatalf("%s: file header flags %x, want FileFlagNoCRC", stage, header[6:8])
+		}
+		// 所有记录的 CRC 字段都是 0
+		crc := make([]byte, 4)
+		for _, k := range []string{"a", "b"} {
+			pos, _ := db.indexes.get(k)
+			if _, err := db.file.ReadAt(crc, pos.offset); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(crc, make([]byte, 4)) {
+				t.Fatalf("%s: CRC of %q is %x, want 0", stage, k, crc)
+			}
+		}
+		if got := dump(t, db); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s: %v, want %v", stage, got, want)
+		}
+		if db.corruptRecords != 0 {
+			t.Fatalf("%s: %d records reported corrupt", stage, db.corruptRecords)
+		}
+	}
+	check("written")
+	// 已有文件按文件头处理，与重新打开时的选项无关
+	opts := db.opts
+	db.Close()
+	opts.DisableCRC = false
+	db = openTestDB(t, opts)
+	check("reopened without the option")
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check("merged")
+
+	// 反过来，带 CRC 的已有文件即使设置了 DisableCRC 也照常校验
+	db = openTestDB(t, Options{})
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	opts = db.opts
+	db.Close()
+	opts.DisableCRC = true
+	db = openTestDB(t, opts)
+	if db.noCRC {
+		t.Fatal("DisableCRC applied to an existing file with CRCs")
+	}
+	if v, err := db.Get("a"); err != nil || v != "1" {
+		t.Fatalf("Get(a) = %q, %v", v, err)
+	}
+}
+
+// BenchmarkDisableCRC 比较内存文件系统上开关 CRC 时小 value 和 4KB value 的 Put+Get 耗时
+func BenchmarkDisableCRC(b *testing.B) {
+	for _, size := range []int{100, 4 << 10} {
+		for _, noCRC := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%d/nocrc=%v", size, noCRC), func(b *testing.B) {
+				db := openTestDB(b, Options{FS: NewMemFS(), FilePrefix: DefaultFilePrefix, DisableCRC: noCRC})
+				value := strings.Repeat("v", size)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					key := fmt.Sprintf("k%d", i%1000)
+					if err := db.Put(key, value); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := db.Get(key); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestGetAfterTruncation(t *testing.T) {
+	big := strings.Repeat("x", 2*singleReadLimit)
+	tests := []struct {
+		name  string
+		opts  Options
+		value string
+		// cut 返回截断的文件和截断后的长度，pos 为 "k" 的记录位置
+		cut func(db *MiniDB, pos recordPos) (string, int64)
+	}{
+		{"inside value", Options{}, "value", func(db *MiniDB, pos recordPos) (string, int64) {
+			return db.names.data, pos.offset + pos.size - 2
+		}},
+		{"inside header", Options{}, "value", func(db *MiniDB, pos recordPos) (string, int64) {
+			return db.names.data, pos.offset + HeaderSize/2
+		}},
+		{"inside chunk chain", Options{ChunkSize: 4096}, big, func(db *MiniDB, pos recordPos) (string, int64) {
+			return db.names.data, pos.offset + pos.size/2
+		}},
+		{"inside value log", Options{ValueLogThreshold: 16}, big, func(db *MiniDB, pos recordPos) (string, int64) {
+			return db.names.vlog, db.vlogOffset - 10
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, tt.opts)
+			if err := db.Put("a", "1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put("k", tt.value); err != nil {
+				t.Fatal(err)
+			}
+			// 重新打开清空缓存，索引建立之后再从外部截断
+			db = reopen(t, db)
+			pos, _ := db.indexes.get("k")
+			name, size := tt.cut(db, pos)
+			if err := os.Truncate(name, size); err != nil {
+				t.Fatal(err)
+			}
+
+			v, err := db.Get("k")
+			var cerr *CorruptionError
+			if !errors.As(err, &cerr) || cerr.Key != "k" {
+				t.Fatalf("Get after truncation = %d bytes, %v, want a CorruptionError for k", len(v), err)
+			}
+			if v, err := db.Get("a"); err != nil || v != "1" {
+				t.Fatalf("Get(a) = %q, %v", v, err)
+			}
+		})
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   int
+		left   []string
+	}{
+		{"user:", 3, []string{"order:1", "user", "users:1"}},
+		{"users:", 1, []string{"order:1", "user", "user:1", "user:2", "user:3"}},
+		{"nope:", 0, []string{"order:1", "user", "user:1", "user:2", "user:3", "users:1"}},
+		{"", 6, nil},
+	}
+	for _, hashed := range []bool{false, true} {
+		for _, tt := range tests {
+			db := openTestDB(t, Options{HashedIndex: hashed})
+			for _, k := range []string{"user:1", "user:2", "user:3", "users:1", "user", "order:1"} {
+				if err := db.Put(k, "v"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			n, err := db.DeletePrefix(tt.prefix)
+			if err != nil || n != tt.want {
+				t.Fatalf("hashed=%v: DeletePrefix(%q) = %d, %v, want %d", hashed, tt.prefix, n, err, tt.want)
+			}
+			for _, stage := range []string{"deleted", "reopened"} {
+				if stage == "reopened" {
+					db = reopen(t, db)
+				}
+				left := slices.Sorted(maps.Keys(dump(t, db)))
+				if !slices.Equal(left, tt.left) {
+					t.Fatalf("hashed=%v %s: DeletePrefix(%q) left %v, want %v", hashed, stage, tt.prefix, left, tt.left)
+				}
+			}
+		}
+	}
+}
+
+func TestFilePrefixesShareDirectory(t *testing.T) {
+	dir := t.TempDir()
+	optsA := Options{FilePrefix: filepath.Join(dir, "users"), ValueLogThreshold: 16}
+	optsB := Options{FilePrefix: filepath.Join(dir, "orders"), Extension: "db", ValueLogThreshold: 16}
+	a, b := openTestDB(t, optsA), openTestDB(t, optsB)
+	big := strings.Repeat("x", 100)
+	for i := 0; i < 10; i++ {
+		if err := a.Put(fmt.Sprintf("k%d", i), "user"+big); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(fmt.Sprintf("k%d", i), "order"+big); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, db := range []*MiniDB{a, b} {
+		if err := db.Del("k0"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+	b.Close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{"orders.db", "orders.hint", "orders.vlog", "users.data", "users.hint", "users.vlog"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("files in the shared directory = %v, want %v", names, want)
+	}
+
+	for _, tt := range []struct {
+		opts  Options
+		value string
+	}{{optsA, "user" + big}, {optsB, "order" + big}} {
+		db := openTestDB(t, tt.opts)
+		got := dump(t, db)
+		if len(got) != 9 {
+			t.Fatalf("%s: %d keys after reopen, want 9", tt.opts.FilePrefix, len(got))
+		}
+		for k, v := range got {
+			if v != tt.value {
+				t.Fatalf("%s: %s = %q, want the value written to this database", tt.opts.FilePrefix, k, v)
+			}
+		}
+	}
+}
+
+func TestPutNXConcurrent(t *testing.T) {
+	db := openTestDB(t, Options{})
+	const workers = 50
+	for round := 0; round < 5; round++ {
+		var wg sync.WaitGroup
+		won := make(chan string, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(owner string) {
+				defer wg.Done()
+				ok, err := db.PutNX("lock", owner)
+				if err != nil {
+					t.Error(err)
+				}
+				if ok {
+					won <- owner
+				}
+			}(fmt.Sprintf("owner-%d-%d", round, i))
+		}
+		wg.Wait()
+		close(won)
+		var winners []string
+		for w := range won {
+			winners = append(winners, w)
+		}
+		if len(winners) != 1 {
+			t.Fatalf("round %d: %d goroutines acquired the key, want exactly 1", round, len(winners))
+		}
+		if v, err := db.Get("lock"); err != nil || v != winners[0] {
+			t.Fatalf("round %d: Get(lock) = %q, %v, want the winner %q", round, v, err, winners[0])
+		}
+		// 删除后 key 重新可以被插入
+		if err := db.Del("lock"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	base := time.Now().Truncate(time.Second).Add(-time.Hour)
+	at := func(i int) time.Time { return base.Add(time.Duration(i) * time.Minute) }
+	for _, keep := range []int{0, 1, 3, 10} {
+		t.Run(fmt.Sprint(keep), func(t *testing.T) {
+			db := openTestDB(t, Options{KeepVersions: keep})
+			// 写入带指定时间戳的记录，每个版本间隔一分钟
+			for i := 0; i < 5; i++ {
+				e := NewEntry([]byte("k"), []byte(fmt.Sprint(i)))
+				e.Timestamp = uint32(at(i).Unix())
+				if err := db.AppendRaw(e.EncodeOrder(db.order)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := []time.Time{at(4)}
+			for i := 3; i >= 0 && len(want) < keep; i-- {
+				want = append(want, at(i))
+			}
+
+			for _, stage := range []string{"written", "merged", "reopened"} {
+				switch stage {
+				case "merged":
+					if err := db.Merge(); err != nil {
+						t.Fatal(err)
+					}
+				case "reopened":
+					db = reopen(t, db)
+				}
+				got, err := db.History("k")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != len(want) {
+					t.Fatalf("%s: History = %v, want %v", stage, got, want)
+				}
+				for i := range got {
+					if !got[i].Equal(want[i]) {
+						t.Fatalf("%s: History = %v, want %v", stage, got, want)
+					}
+				}
+			}
+			if _, err := db.History("missing"); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("History(missing) = %v", err)
+			}
+		})
+	}
+}
+
+// countingFS 统计对数据文件的 ReadAt 次数
+type countingFS struct {
+	FileSystem
+	reads atomic.Int64
+}
+
+type countingFile struct {
+	Storage
+	reads *atomic.Int64
+}
+
+func (fs *countingFS) OpenFile(name string, flag int) (Storage, error) {
+	f, err := fs.FileSystem.OpenFile(name, flag)
+	if err != nil {
+		return nil, err
+	}
+	return countingFile{f, &fs.reads}, nil
+}
+
+func (f countingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.reads.Add(1)
+	return f.Storage.ReadAt(p, off)
+}
+
+// BenchmarkGet 报告每次 Get 的 ReadAt 次数，singleReadLimit 以内的记录只需要一次
+func BenchmarkGet(b *testing.B) {
+	for _, size := range []int{100, 4 << 10, singleReadLimit, 1 << 20} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			fs := &countingFS{FileSystem: OSFS}
+			db := openTestDB(b, Options{FS: fs})
+			for i := 0; i < 100; i++ {
+				if err := db.Put(fmt.Sprintf("k%d", i), strings.Repeat("v", size)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			fs.reads.Store(0)
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(fmt.Sprintf("k%d", i%100)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(fs.reads.Load())/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestCorruptionErrorFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		value    string
+		last     int // 最后一条记录中的 value 字节数
+		valueLog bool
+	}{
+		{"single record", Options{}, "value", 5, false},
+		{"last chunk", Options{ChunkSize: 4}, "0123456789", 2, false},
+		{"value log", Options{ValueLogThreshold: 4}, "in the value log", 16, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, tt.opts)
+			for _, k := range []string{"a", "k", "z"} {
+				if err := db.Put(k, tt.value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// 损坏 k 的最后一个字节，在数据文件中是它的最后一个分块，在 value log 中是第二条记录
+			file, name := db.file, db.names.data
+			info, err := db.KeyInfo("k")
+			if err != nil {
+				t.Fatal(err)
+			}
+			end := info.Offset + info.Size
+			if tt.valueLog {
+				file, name = db.vlog, db.names.vlog
+				end = 2 * int64(HeaderSize+len("k")+len(tt.value))
+			}
+			start := end - int64(HeaderSize+len("k")+tt.last)
+			header := make([]byte, HeaderSize)
+			if _, err := file.ReadAt(header, start); err != nil {
+				t.Fatal(err)
+			}
+			corruptFileByte(t, name, end-1)
+
+			_, err = db.Get("k")
+			var cerr *CorruptionError
+			if !errors.As(err, &cerr) || !errors.Is(err, ErrDataCorrupted) {
+				t.Fatalf("Get = %v, want a CorruptionError", err)
+			}
+			want := CorruptionError{Offset: start, Key: "k", Expected: db.order.Uint32(header), ValueLog: tt.valueLog}
+			if cerr.Offset != want.Offset || cerr.Key != want.Key || cerr.Expected != want.Expected || cerr.ValueLog != want.ValueLog ||
+				cerr.Actual == cerr.Expected {
+				t.Fatalf("Get error = %+v, want %+v with a different actual CRC", *cerr, want)
+			}
+			if v, err := db.Get("z"); err != nil || v != tt.value {
+				t.Fatalf("Get(z) = %q, %v", v, err)
+			}
+			if tt.valueLog {
+				return
+			}
+
+			// 加载时跳过损坏记录，日志中给出同样的位置和 CRC
+			db.Close()
+			os.Remove(db.names.hint)
+			var buf strings.Builder
+			log.SetOutput(&buf)
+			db = openTestDB(t, db.opts)
+			log.SetOutput(io.Discard)
+			if !strings.Contains(buf.String(), cerr.Error()) {
+				t.Fatalf("load log %q does not mention %q", buf.String(), cerr.Error())
+			}
+		})
+	}
+}
+
+func TestPreload(t *testing.T) {
+	db := openTestDB(t, Options{})
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("k%d", i), strings.Repeat("v", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := db.opts
+	db.Close()
+	info, err := os.Stat(db.names.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Preload = true
+	for _, hint := range []bool{true, false} {
+		if !hint {
+			os.Remove(db.names.hint)
+		}
+		var buf strings.Builder
+		log.SetOutput(&buf)
+		db = openTestDB(t, opts)
+		log.SetOutput(io.Discard)
+		if want := fmt.Sprintf("Preloaded %d bytes", info.Size()); !strings.Contains(buf.String(), want) {
+			t.Fatalf("hint=%v: open log %q, want %q", hint, buf.String(), want)
+		}
+		for i := 0; i < 100; i++ {
+			if v, err := db.Get(fmt.Sprintf("k%d", i)); err != nil || v != strings.Repeat("v", i) {
+				t.Fatalf("hint=%v: Get(k%d) = %q, %v", hint, i, v, err)
+			}
+		}
+		db.Close()
+	}
+}
+
+func TestRename(t *testing.T) {
+	db := openTestDB(t, Options{})
+	if err := db.PutWithMeta("old", "value", []byte("m")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("taken", "overwritten"); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		from, to string
+		want     error
+	}{
+		{"missing", "x", ErrKeyNotFound},
+		{"old", "", ErrEmptyKey},
+		{"old", "old", nil},
+		{"old", "new", nil},
+		{"new", "taken", nil},
+	}
+	for _, s := range steps {
+		if err := db.Rename(s.from, s.to); !errors.Is(err, s.want) {
+			t.Fatalf("Rename(%q, %q) = %v, want %v", s.from, s.to, err, s.want)
+		}
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		v, meta, err := db.GetWithMeta("taken")
+		if err != nil || v != "value" || string(meta) != "m" {
+			t.Fatalf("%s: GetWithMeta(taken) = %q, %q, %v", stage, v, meta, err)
+		}
+		for _, k := range []string{"old", "new"} {
+			if _, err := db.Get(k); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("%s: Get(%q) = %v, want ErrKeyNotFound", stage, k, err)
+			}
+		}
+	}
+	check("renamed")
+	db = reopen(t, db)
+	check("reopened")
+	db.Close()
+	os.Remove(db.names.hint)
+	db = openTestDB(t, db.opts)
+	check("replayed")
+
+	// 批次写到一半崩溃时两条记录都不生效
+	if err := db.Rename("taken", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	info, err := os.Stat(db.names.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(db.names.data, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(db.names.hint)
+	db = openTestDB(t, db.opts)
+	check("torn batch")
+}
+
+func TestQuarantine(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		db := openTestDB(t, Options{})
+		var bad []KeyInfo
+		for i := 0; i < 4; i++ {
+			key := fmt.Sprintf("k%d", i)
+			if err := db.Put(key, "value"); err != nil {
+				t.Fatal(err)
+			}
+			if i%2 == 1 {
+				info, _ := db.KeyInfo(key)
+				bad = append(bad, info)
+			}
+		}
+		opts := db.opts
+		db.Close()
+		for _, info := range bad {
+			corruptFileByte(t, db.names.data, info.Offset+info.Size-1)
+		}
+		data, err := os.ReadFile(db.names.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(db.names.hint)
+		opts.Quarantine = enabled
+		db = openTestDB(t, opts)
+		// Merge 丢弃损坏的记录后，隔离文件中仍保留原样的字节
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := os.ReadFile(db.names.quarantine)
+		if !enabled {
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("quarantine file written without the option: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []byte
+		for _, info := range bad {
+			want = binary.BigEndian.AppendUint64(want, uint64(info.Offset))
+			want = binary.BigEndian.AppendUint32(want, uint32(info.Size))
+			want = append(want, data[info.Offset:info.Offset+info.Size]...)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("quarantine file = %x, want %x", got, want)
+		}
+	}
+}
+
+func TestEmptyKey(t *testing.T) {
+	db := openTestDB(t, Options{})
+	ops := map[string]func() error{
+		"Put":         func() error { return db.Put("", "v") },
+		"PutNX":       func() error { _, err := db.PutNX("", "v"); return err },
+		"PutWithMeta": func() error { return db.PutWithMeta("", "v", []byte("m")) },
+		"PutBatch":    func() error { return db.PutBatch([]KV{{"", "v"}}) },
+		"Apply":       func() error { return db.Apply([]Op{{Key: "a", Value: "v"}, {Key: "", Value: "v"}}) },
+		"Incr":        func() error { _, err := db.Incr("", 1); return err },
+		"AppendRaw":   func() error { return db.AppendRaw(NewEntry(nil, []byte("v")).EncodeOrder(db.order)) },
+	}
+	for name, op := range ops {
+		if err := op(); !errors.Is(err, ErrEmptyKey) {
+			t.Errorf("%s with an empty key = %v, want ErrEmptyKey", name, err)
+		}
+	}
+	if n := db.Stats().Keys; n != 0 {
+		t.Fatalf("%d keys after rejected writes", n)
+	}
+
+	// 其他程序写入的空 key 记录在加载时跳过，不进入索引
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	f, err := os.OpenFile(db.names.data, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(NewEntry(nil, []byte("v")).EncodeOrder(db.order)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	os.Remove(db.names.hint)
+	db = openTestDB(t, db.opts)
+	keys, _, err := db.Scan("", "", 0)
+	if err != nil || fmt.Sprint(keys) != "[a]" {
+		t.Fatalf("Scan = %v, %v, want [a]", keys, err)
+	}
+	if _, err := db.Get(""); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(\"\") = %v, want ErrKeyNotFound", err)
+	}
+	if err := db.Put("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.Stats().Keys; n != 2 {
+		t.Fatalf("%d keys after merge, want 2", n)
+	}
+}
+
+func TestMetaRoundTrip(t *testing.T) {
+	long := strings.Repeat("m", MaxMetaSize)
+	for _, opts := range []Options{{}, {ChunkSize: 4}, {ValueLogThreshold: 4}, {Sequence: true}} {
+		db := openTestDB(t, opts)
+		want := map[string][2]string{
+			"plain":   {"value", "text/plain"},
+			"longest": {"value", long},
+			"empty":   {"", "m"},
+			"none":    {"value", ""},
+		}
+		for k, vm := range want {
+			var meta []byte
+			if vm[1] != "" {
+				meta = []byte(vm[1])
+			}
+			if err := db.PutWithMeta(k, vm[0], meta); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 不带元数据的覆盖写入清除旧的元数据
+		if err := db.PutWithMeta("cleared", "old", []byte("m")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("cleared", "new"); err != nil {
+			t.Fatal(err)
+		}
+		want["cleared"] = [2]string{"new", ""}
+		if err := db.PutWithMeta("k", "v", []byte(long+"x")); !errors.Is(err, ErrMetaTooLarge) {
+			t.Fatalf("PutWithMeta with %d bytes of metadata = %v", len(long)+1, err)
+		}
+
+		for _, stage := range []string{"written", "reopened", "merged"} {
+			switch stage {
+			case "reopened":
+				db = reopen(t, db)
+			case "merged":
+				if err := db.Merge(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for k, vm := range want {
+				v, meta, err := db.GetWithMeta(k)
+				if err != nil || v != vm[0] || string(meta) != vm[1] {
+					t.Fatalf("%+v %s: GetWithMeta(%q) = %q, %q, %v, want %q, %q", opts, stage, k, v, meta, err, vm[0], vm[1])
+				}
+				if v, err := db.Get(k); err != nil || v != vm[0] {
+					t.Fatalf("%+v %s: Get(%q) = %q, %v", opts, stage, k, v, err)
+				}
+			}
+		}
+	}
+}
+
+func TestMetaRequiresFormatUpgrade(t *testing.T) {
+	db := openTestDB(t, Options{})
+	opts := db.opts
+	db.Close()
+	// 把空库的文件头改成版本 1
+	f, err := os.OpenFile(db.names.data, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0, 1}, 4); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db = openTestDB(t, opts)
+	if _, v := db.Version(); v != 1 {
+		t.Fatalf("format version = %d, want 1", v)
+	}
+	if err := db.PutWithMeta("k", "v", []byte("m")); !errors.Is(err, ErrIncompatibleFormat) {
+		t.Fatalf("PutWithMeta on a version 1 file = %v, want ErrIncompatibleFormat", err)
+	}
+	if err := db.Put("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if _, v := db.Version(); v != FormatVersion {
+		t.Fatalf("format version after Merge = %d, want %d", v, FormatVersion)
+	}
+	if err := db.PutWithMeta("k", "v", []byte("m")); err != nil {
+		t.Fatalf("PutWithMeta after upgrade = %v", err)
+	}
+}
+
+func TestVerifyOnOpen(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    VerifyMode
+		corrupt int
+		wantErr error
+		merged  bool // Open 之后损坏的记录已被 Merge 清除
+	}{
+		{"warn below", VerifyWarn, 1, nil, false},
+		{"warn above", VerifyWarn, 3, nil, false},
+		{"fail below", VerifyFail, 1, nil, false},
+		{"fail above", VerifyFail, 3, ErrTooManyCorrupt, false},
+		{"salvage below", VerifySalvage, 1, nil, false},
+		{"salvage above", VerifySalvage, 3, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, Options{})
+			for i := 0; i < 5; i++ {
+				if err := db.Put(fmt.Sprintf("k%d", i), "value"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := db.opts
+			db.Close()
+			for i := 0; i < tt.corrupt; i++ {
+				size := int64(HeaderSize + 2 + 5)
+				corruptFileByte(t, db.names.data, FileHeaderSize+int64(i+1)*size-1)
+			}
+			os.Remove(db.names.hint)
+			before, err := os.ReadFile(db.names.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opts.VerifyOnOpen, opts.MaxCorruptRecords = tt.mode, 2
+			db, err = OpenWithOptions(opts)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Open = %v, want %v", err, tt.wantErr)
+				}
+				if after, _ := os.ReadFile(opts.FilePrefix + "." + DefaultExtension); !bytes.Equal(before, after) {
+					t.Fatal("data file modified by a refused open")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if n := db.Stats().Keys; n != 5-tt.corrupt {
+				t.Fatalf("%d keys, want %d", n, 5-tt.corrupt)
+			}
+			if merged := db.Stats().DeadBytes == 0; merged != tt.merged {
+				t.Fatalf("merged on open = %v, want %v", merged, tt.merged)
+			}
+			if !tt.merged {
+				return
+			}
+			db.Close()
+			os.Remove(db.names.hint)
+			opts.VerifyOnOpen = VerifyFail
+			db = openTestDB(t, opts)
+			if n := db.Stats().CorruptRecords; n != 0 {
+				t.Fatalf("%d corrupt records after salvage", n)
+			}
+		})
+	}
+}
+
+func TestCompactKey(t *testing.T) {
+	db := openTestDB(t, Options{KeepVersions: 10})
+	for i := 0; i < 4; i++ {
+		if err := db.PutWithMeta("k", fmt.Sprintf("value%d", i), []byte("m")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("other", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CompactKey("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("CompactKey(missing) = %v", err)
+	}
+	if err := db.CompactKey("k"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 除两个 key 的最新记录外全部计入无效数据，包括原来的 4 个版本、删除标记和批次标记
+	record := int64(HeaderSize + len("k") + 2 + len("value3"))
+	for _, stage := range []string{"compacted", "replayed", "merged"} {
+		switch stage {
+		case "replayed":
+			db.Close()
+			os.Remove(db.names.hint)
+			db = openTestDB(t, db.opts)
+		case "merged":
+			if err := db.Merge(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		v, meta, err := db.GetWithMeta("k")
+		if err != nil || v != "value3" || string(meta) != "m" {
+			t.Fatalf("%s: GetWithMeta = %q, %q, %v", stage, v, meta, err)
+		}
+		if h, err := db.History("k"); err != nil || len(h) != 1 {
+			t.Fatalf("%s: History = %v, %v, want a single version", stage, h, err)
+		}
+		s := db.Stats()
+		if live := s.FileSize - FileHeaderSize - s.DeadBytes; live != record+HeaderSize+int64(len("other")+len("v")) {
+			t.Fatalf("%s: %d live bytes (stats %+v)", stage, live, s)
+		}
+	}
+}
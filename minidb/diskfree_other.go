@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package minidb
+
+import "errors"
+
+// diskFree 在不支持 statfs 的平台上不做检查
+func diskFree(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package minidb
+
+import "syscall"
+
+// diskFree 返回 dir 所在文件系统中普通用户可用的字节数
+func diskFree(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
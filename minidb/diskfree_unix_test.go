@@ -0,0 +1,84 @@
+//go:build linux || darwin || freebsd
+
+package minidb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMinFreeDisk(t *testing.T) {
+	const minFree = 1 << 20
+	tests := []struct {
+		name    string
+		free    int64 // diskFree 返回的剩余空间，0 表示用真实的 statfs
+		value   string
+		wantErr error
+	}{
+		{name: "real statfs below limit", value: "v", wantErr: ErrLowDiskSpace},
+		{name: "enough space", free: minFree + 1024, value: "v"},
+		{name: "write would cross limit", free: minFree + 1024, value: strings.Repeat("x", 1024), wantErr: ErrLowDiskSpace},
+		{name: "already below limit", free: minFree - 1, value: "v", wantErr: ErrLowDiskSpace},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{MinFreeDisk: minFree}
+			if tt.free == 0 {
+				opts.MinFreeDisk = 1 << 62
+			}
+			db := openTestDB(t, opts)
+			if tt.free != 0 {
+				db.diskFree = func(string) (int64, error) { return tt.free, nil }
+			}
+			offset := db.offset
+
+			err := db.Put("k", tt.value)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Put = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				return
+			}
+			if db.offset != offset {
+				t.Fatalf("offset = %d after a rejected write, want %d", db.offset, offset)
+			}
+			if err := db.Apply([]Op{{Key: "a", Value: tt.value}}); !errors.Is(err, ErrLowDiskSpace) {
+				t.Fatalf("Apply = %v, want ErrLowDiskSpace", err)
+			}
+			if err := db.AppendRaw(NewEntry([]byte("a"), []byte(tt.value)).EncodeOrder(db.order)); !errors.Is(err, ErrLowDiskSpace) {
+				t.Fatalf("AppendRaw = %v, want ErrLowDiskSpace", err)
+			}
+			if _, err := db.Get("k"); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("Get after rejected write = %v, want ErrKeyNotFound", err)
+			}
+		})
+	}
+}
+
+func TestMinFreeDiskEstimateRechecks(t *testing.T) {
+	db := openTestDB(t, Options{MinFreeDisk: 1 << 20})
+	free, calls := int64(1<<20+4096), 0
+	db.diskFree = func(string) (int64, error) {
+		calls++
+		return free, nil
+	}
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// 估算值还够时不重新 statfs
+	if err := db.Put("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("diskFree called %d times, want 1", calls)
+	}
+	// 其他进程释放了空间: 估算值不够时重新 statfs 后放行
+	free = 1 << 30
+	if err := db.Put("c", strings.Repeat("x", 8192)); err != nil {
+		t.Fatalf("Put after space was freed: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("diskFree called %d times, want 2", calls)
+	}
+}
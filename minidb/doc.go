@@ -0,0 +1,5 @@
+// Package minidb 是一个基于 Bitcask 模型的持久化 KV 存储引擎，
+// 可以直接作为库嵌入到其他 Go 程序中使用，用法见 ExampleOpen。
+//
+// 数据文件默认写在当前工作目录下的 minidb.data 中。
+package minidb
@@ -0,0 +1,76 @@
+package minidb
+
+import "time"
+
+// ==========================================
+// 26. 记录明细 (Entries)
+// ==========================================
+
+// EntryInfo 是数据文件中一条记录解码后的头部信息，用于调试时查看磁盘上的实际内容
+type EntryInfo struct {
+	Offset    int64     `json:"offset"`
+	Key       string    `json:"key"`
+	Type      string    `json:"type"`       // data、chunk (后面还有同 key 的分块)、tombstone 或 batch (批量写入的开始标记)
+	ValueSize uint32    `json:"value_size"` // 记录中保存的 value 长度，包括序号、元数据等前缀，压缩的 value 为压缩后的长度
+	Timestamp time.Time `json:"timestamp"`
+	Flags     uint8     `json:"flags"`
+	CRCValid  bool      `json:"crc_valid"`
+}
+
+// Entries 从 from 开始顺序解码最多 limit 条记录，from 必须是某条记录的起始位置，0 表示从第一条开始。
+// next 为下一页的起始位置，到达文件末尾时为 0。记录长度超出文件末尾时把它作为最后一条返回 (CRCValid 为 false)。
+// 持有读锁读取，limit 不宜过大
+func (db *MiniDB) Entries(from int64, limit int) (entries []EntryInfo, next int64, err error) {
+	if err := db.enter(); err != nil {
+		return nil, 0, err
+	}
+	defer db.inflight.Done()
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if from == 0 {
+		from = FileHeaderSize
+	}
+	if from < FileHeaderSize || from > db.offset || limit <= 0 {
+		return nil, 0, ErrInvalidRange
+	}
+
+	header := make([]byte, HeaderSize)
+	for off := from; off < db.offset; {
+		if len(entries) == limit {
+			return entries, off, nil
+		}
+		if err := readFull(db.file, header, off, ""); err != nil {
+			return nil, 0, err
+		}
+		crc, ts, kSize, vSize, flags := DecodeHeaderOrder(header, db.order)
+		e := EntryInfo{Offset: off, Type: entryType(flags), ValueSize: vSize, Timestamp: time.Unix(int64(ts), 0), Flags: flags}
+		end := off + HeaderSize + int64(kSize) + int64(vSize)
+		if end > db.offset {
+			return append(entries, e), 0, nil
+		}
+
+		payload := make([]byte, int64(kSize)+int64(vSize))
+		if err := readFull(db.file, payload, off+HeaderSize, ""); err != nil {
+			return nil, 0, err
+		}
+		e.Key = string(payload[:kSize])
+		e.CRCValid = db.checksum(header, payload) == crc
+		entries = append(entries, e)
+		off = end
+	}
+	return entries, 0, nil
+}
+
+func entryType(flags uint8) string {
+	switch {
+	case flags&FlagBatch != 0:
+		return "batch"
+	case flags&FlagTombstone != 0:
+		return "tombstone"
+	case flags&FlagChunked != 0:
+		return "chunk"
+	}
+	return "data"
+}
@@ -0,0 +1,218 @@
+package minidb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// ==========================================
+// 1. 数据协议定义 (Data Protocol)
+// ==========================================
+
+const (
+	HeaderSize         = 17
+	FileHeaderSize     = 8
+	FormatVersion      = 5 // 版本 2 新增 FlagMeta，版本 3 新增 FlagValueRef，版本 4 新增 FlagCompressed，版本 5 新增 FlagSequence
+	DBFileName         = "minidb.data"
+	QuarantineFileName = "minidb.quarantine"
+	MergeFileName      = "minidb.data.merge"
+	SegmentsFileName   = "minidb.segments"
+)
+
+// EngineVersion 是存储引擎的版本，与数据文件的格式版本 FormatVersion 分开演进
+const EngineVersion = "0.5.0"
+
+// 默认的文件名前缀和数据文件扩展名，对应上面的 DBFileName 等常量
+const (
+	DefaultFilePrefix = "minidb"
+	DefaultExtension  = "data"
+)
+
+// fileNames 是一个库用到的所有文件名，由 FilePrefix 和 Extension 决定，
+// 同一目录下前缀不同的库互不干扰。默认值与 DBFileName、HintFileName 等常量相同
+type fileNames struct {
+	data       string
+	merge      string
+	hint       string
+	vlog       string
+	vlogMerge  string // Merge 回收 value log 时写出的新 value log
+	quarantine string
+	segments   string // 分段清单，见 MaxSegmentSize
+	prefix     string
+	ext        string
+}
+
+func newFileNames(prefix, ext string) fileNames {
+	if prefix == "" {
+		prefix = DefaultFilePrefix
+	}
+	if ext == "" {
+		ext = DefaultExtension
+	}
+	data := prefix + "." + ext
+	return fileNames{
+		data:       data,
+		merge:      data + ".merge",
+		hint:       prefix + ".hint",
+		vlog:       prefix + ".vlog",
+		vlogMerge:  prefix + ".vlog.merge",
+		quarantine: prefix + ".quarantine",
+		segments:   prefix + ".segments",
+		prefix:     prefix,
+		ext:        ext,
+	}
+}
+
+// segment 返回编号为 id 的分段的文件名，第一个分段就是数据文件本身
+func (n fileNames) segment(id int) string {
+	return fmt.Sprintf("%s.%06d.%s", n.prefix, id, n.ext)
+}
+
+// 文件头: [Magic 4][Version 2][FileFlags 2]，文件头本身总是大端
+var FileMagic = []byte("MNDB")
+
+const (
+	// FileFlagLittleEndian 表示文件中的记录 (头部各字段和批次长度) 使用小端字节序，默认为大端
+	FileFlagLittleEndian uint16 = 1 << iota
+	// FileFlagNoCRC 表示文件中的记录不计算 CRC (字段为 0)，读取时也不校验，只适合可以丢失的缓存数据
+	FileFlagNoCRC
+)
+
+const (
+	FlagChunked    uint8 = 1 << iota // 分块写入的大 value，后面还有同 key 的分块
+	FlagTombstone                    // 删除标记，value 为空
+	FlagBatch                        // 批量写入的开始标记，value 为批次内后续记录的总长度
+	FlagMeta                         // value 以 [MetaLen 1][Meta] 开头，分块时只在第一块中
+	FlagValueRef                     // value (元数据之后) 是指向 value log 的引用
+	FlagCompressed                   // value (元数据之后，value log 中的也是) 经过 flate 压缩
+	FlagSequence                     // value 以 [Seq 8] 开头 (在元数据之前)，分块时只在第一块中
+)
+
+// MaxMetaSize 是每个 key 附带的元数据的最大长度
+const MaxMetaSize = 255
+
+type Entry struct {
+	Key       []byte
+	Value     []byte
+	KeySize   uint32
+	ValueSize uint32
+	Timestamp uint32 // 记录写入时间
+	CRC       uint32 // 校验码
+	Flags     uint8
+}
+
+func NewEntry(key, value []byte) *Entry {
+	return &Entry{
+		Key:       key,
+		Value:     value,
+		KeySize:   uint32(len(key)),
+		ValueSize: uint32(len(value)),
+		Timestamp: uint32(time.Now().Unix()),
+	}
+}
+
+// Encode 按大端字节序编码
+func (e *Entry) Encode() []byte {
+	return e.EncodeOrder(binary.BigEndian)
+}
+
+func (e *Entry) EncodeOrder(order binary.ByteOrder) []byte {
+	return e.encode(order, true)
+}
+
+// encode 编码记录，withCRC 为 false 时 CRC 字段保持为 0
+func (e *Entry) encode(order binary.ByteOrder, withCRC bool) []byte {
+	buf := make([]byte, HeaderSize+e.KeySize+e.ValueSize)
+
+	order.PutUint32(buf[4:8], e.Timestamp)
+	order.PutUint32(buf[8:12], e.KeySize)
+	order.PutUint32(buf[12:16], e.ValueSize)
+	buf[16] = e.Flags
+	copy(buf[HeaderSize:], e.Key)
+	copy(buf[HeaderSize+e.KeySize:], e.Value)
+
+	if withCRC {
+		crc := Checksum(buf[:HeaderSize], buf[HeaderSize:])
+		order.PutUint32(buf[0:4], crc)
+	}
+
+	return buf
+}
+
+// encodeHeader 只编码记录头和 key，value 由调用方单独写入，CRC 仍然覆盖 value
+func (e *Entry) encodeHeader(order binary.ByteOrder, withCRC bool) []byte {
+	buf := make([]byte, HeaderSize+e.KeySize)
+
+	order.PutUint32(buf[4:8], e.Timestamp)
+	order.PutUint32(buf[8:12], e.KeySize)
+	order.PutUint32(buf[12:16], e.ValueSize)
+	buf[16] = e.Flags
+	copy(buf[HeaderSize:], e.Key)
+
+	if withCRC {
+		crc := Checksum(buf[:HeaderSize], buf[HeaderSize:])
+		crc = crc32.Update(crc, crc32.IEEETable, e.Value)
+		order.PutUint32(buf[0:4], crc)
+	}
+	return buf
+}
+
+// Checksum 计算一条记录的 CRC，覆盖头部中 CRC 字段之后的所有字节 (时间戳、长度、标记位)
+// 以及 key 和 value。写入和所有校验路径都必须使用它，新增的头部字段也要放在这个区域内
+func Checksum(header, payload []byte) uint32 {
+	crc := crc32.ChecksumIEEE(header[4:HeaderSize])
+	return crc32.Update(crc, crc32.IEEETable, payload)
+}
+
+// DecodeHeader 按大端字节序解码记录头
+func DecodeHeader(buf []byte) (uint32, uint32, uint32, uint32, uint8) {
+	return DecodeHeaderOrder(buf, binary.BigEndian)
+}
+
+func DecodeHeaderOrder(buf []byte, order binary.ByteOrder) (uint32, uint32, uint32, uint32, uint8) {
+	crc := order.Uint32(buf[0:4])
+	ts := order.Uint32(buf[4:8])
+	kSize := order.Uint32(buf[8:12])
+	vSize := order.Uint32(buf[12:16])
+	return crc, ts, kSize, vSize, buf[16]
+}
+
+func EncodeFileHeader() []byte {
+	return EncodeFileHeaderOrder(binary.BigEndian)
+}
+
+func EncodeFileHeaderOrder(order binary.ByteOrder) []byte {
+	var flags uint16
+	if order == binary.LittleEndian {
+		flags |= FileFlagLittleEndian
+	}
+	return encodeFileHeader(flags)
+}
+
+func encodeFileHeader(flags uint16) []byte {
+	buf := make([]byte, FileHeaderSize)
+	copy(buf[0:4], FileMagic)
+	binary.BigEndian.PutUint16(buf[4:6], FormatVersion)
+	binary.BigEndian.PutUint16(buf[6:8], flags)
+	return buf
+}
+
+// FileByteOrder 返回文件头中声明的记录字节序，调用前需先通过 CheckFileHeader
+func FileByteOrder(buf []byte) binary.ByteOrder {
+	if binary.BigEndian.Uint16(buf[6:8])&FileFlagLittleEndian != 0 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+func CheckFileHeader(buf []byte) error {
+	if string(buf[0:4]) != string(FileMagic) {
+		return ErrIncompatibleFormat
+	}
+	if v := binary.BigEndian.Uint16(buf[4:6]); v < 1 || v > FormatVersion {
+		return ErrIncompatibleFormat
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package minidb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksumCoversHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		flip  int  // 改写的字节位置
+		value byte // 异或的值
+	}{
+		{"chunked flag", 16, FlagChunked},
+		{"tombstone flag", 16, FlagTombstone},
+		{"meta flag", 16, FlagMeta},
+		{"compressed flag", 16, FlagCompressed},
+		{"timestamp", 7, 1},
+		{"key", HeaderSize, 1},
+		{"value", HeaderSize + 1, 1},
+	}
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		for _, tt := range tests {
+			buf := NewEntry([]byte("k"), []byte("value")).EncodeOrder(order)
+			crc, _, _, _, _ := DecodeHeaderOrder(buf, order)
+			if Checksum(buf[:HeaderSize], buf[HeaderSize:]) != crc {
+				t.Fatalf("%v: checksum of an untouched record does not match", order)
+			}
+			buf[tt.flip] ^= tt.value
+			if Checksum(buf[:HeaderSize], buf[HeaderSize:]) == crc {
+				t.Errorf("%v %s: flipping byte %d not detected", order, tt.name, tt.flip)
+			}
+		}
+	}
+}
+
+// TestEncodeHeaderMatchesEncode 分开写入的记录头加 value 与整条编码的记录逐字节相同
+func TestEncodeHeaderMatchesEncode(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		for _, withCRC := range []bool{true, false} {
+			e := NewEntry([]byte("key"), bytes.Repeat([]byte("v"), 1000))
+			e.Flags |= FlagMeta
+			whole := e.encode(order, withCRC)
+			split := append(e.encodeHeader(order, withCRC), e.Value...)
+			if !bytes.Equal(whole, split) {
+				t.Errorf("%v crc=%v: split encoding differs from encode", order, withCRC)
+			}
+		}
+	}
+}
+
+func TestFlippedFlagFailsRead(t *testing.T) {
+	db := openTestDB(t, Options{})
+	if err := db.Put("k", "value"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(db.names.data, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte{FlagMeta}, FileHeaderSize+16); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Get("k"); !errors.Is(err, ErrDataCorrupted) {
+		t.Fatalf("Get = %v, want ErrDataCorrupted", err)
+	}
+}
+
+func TestByteOrderCrossRead(t *testing.T) {
+	e := NewEntry([]byte("key"), []byte("value"))
+	e.Flags = FlagMeta
+	be, le := e.EncodeOrder(binary.BigEndian), e.EncodeOrder(binary.LittleEndian)
+	if string(be) != string(e.Encode()) {
+		t.Fatal("Encode is not the big-endian encoding")
+	}
+	for _, c := range []struct {
+		order binary.ByteOrder
+		buf   []byte
+	}{{binary.BigEndian, be}, {binary.LittleEndian, le}} {
+		_, ts, kSize, vSize, flags := DecodeHeaderOrder(c.buf, c.order)
+		if ts != e.Timestamp || kSize != 3 || vSize != 5 || flags != FlagMeta {
+			t.Fatalf("%v: decoded %d %d %d %d", c.order, ts, kSize, vSize, flags)
+		}
+	}
+	if _, _, kSize, _, _ := DecodeHeaderOrder(le, binary.BigEndian); kSize == 3 {
+		t.Fatal("little-endian header decodes the same with either order")
+	}
+
+	// 字节序记录在文件头中，已有文件不论 LittleEndian 选项如何都按文件头读写
+	dir := t.TempDir()
+	files := map[bool]string{}
+	for _, little := range []bool{false, true} {
+		sub := filepath.Join(dir, fmt.Sprint(little))
+		if err := os.Mkdir(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+		db := openTestDB(t, Options{FilePrefix: filepath.Join(sub, DefaultFilePrefix), LittleEndian: little, ChunkSize: 4})
+		if err := db.Apply([]Op{{Key: "shared", Value: fmt.Sprint(little)}, {Key: fmt.Sprint(little), Value: "chunked value"}}); err != nil {
+			t.Fatal(err)
+		}
+		opts := db.opts
+		opts.LittleEndian = !little
+		db.Close()
+		os.Remove(db.names.hint)
+		db = openTestDB(t, opts)
+		if err := db.Put("after", "reopen"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		db = reopen(t, db)
+		if (db.order == binary.LittleEndian) != little {
+			t.Fatalf("LittleEndian=%v file reopened as %v", little, db.order)
+		}
+		for k, v := range map[string]string{"shared": fmt.Sprint(little), fmt.Sprint(little): "chunked value", "after": "reopen"} {
+			if got, err := db.Get(k); err != nil || got != v {
+				t.Fatalf("LittleEndian=%v: Get(%q) = %q, %v", little, k, got, err)
+			}
+		}
+		files[little] = db.names.data
+		db.Close()
+	}
+
+	// OpenMerged 按第一个文件的字节序解码，字节序不同的文件拒绝打开
+	if view, err := OpenMerged(files[false], files[true]); !errors.Is(err, ErrIncompatibleFormat) {
+		if err == nil {
+			view.Close()
+		}
+		t.Fatalf("OpenMerged with mixed byte orders = %v, want ErrIncompatibleFormat", err)
+	}
+}
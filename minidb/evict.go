@@ -0,0 +1,104 @@
+package minidb
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// ==========================================
+// 23. 容量淘汰 (Eviction)
+// ==========================================
+
+// 设置 Options.MaxFileSize 后数据文件作为有上限的磁盘缓存使用：写入会让文件超出上限时，
+// 先按记录时间戳从旧到新删除 key (写入删除标记)，再 Merge 回收空间，然后重试这次写入。
+// 每次淘汰到存活数据不超过上限的 evictTargetPercent，留出余量，避免每次写入都触发 Merge
+var ErrFileFull = errors.New("data file size limit reached")
+
+const evictTargetPercent = 75
+
+// checkFileSize 在写入 n 字节之前确认数据文件不会超过 MaxFileSize。
+// 超出时返回 ErrFileFull，由 update 淘汰后重试；淘汰全部 key 也放不下时返回 ErrValueTooLarge。调用方需持有写锁
+func (db *MiniDB) checkFileSize(n int64) error {
+	if db.opts.MaxFileSize <= 0 || db.evicting || db.offset+n <= db.opts.MaxFileSize {
+		return nil
+	}
+	if FileHeaderSize+n > db.opts.MaxFileSize {
+		return ErrValueTooLarge
+	}
+	return ErrFileFull
+}
+
+// evict 删除最旧的 key 直到存活数据不超过 MaxFileSize 的 evictTargetPercent，再 Merge 回收空间。
+// 并发的写入同时触发时，后来的发现文件已经缩小就直接返回
+func (db *MiniDB) evict() error {
+	limit := db.opts.MaxFileSize * evictTargetPercent / 100
+
+	db.mu.Lock()
+	if db.offset <= limit {
+		db.mu.Unlock()
+		return nil
+	}
+	type aged struct {
+		key string
+		pos recordPos
+		ts  uint32
+	}
+	var items []aged
+	var readErr error
+	header := make([]byte, HeaderSize)
+	db.indexes.each(func(key string, pos recordPos) {
+		if _, err := db.file.ReadAt(header, pos.offset); err != nil {
+			readErr = err
+			return
+		}
+		_, ts, _, _, _ := DecodeHeaderOrder(header, db.order)
+		items = append(items, aged{key, pos, ts})
+	})
+	if readErr != nil {
+		db.mu.Unlock()
+		return readErr
+	}
+	// 时间戳只精确到秒，同一秒内按写入位置
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].ts != items[j].ts {
+			return items[i].ts < items[j].ts
+		}
+		return items[i].pos.offset < items[j].pos.offset
+	})
+
+	live := db.offset - FileHeaderSize - db.deadBytes
+	var ops []batchOp
+	for _, it := range items {
+		if live <= limit-FileHeaderSize {
+			break
+		}
+		ops = append(ops, batchOp{key: it.key, tombstone: true})
+		live -= it.pos.size
+	}
+	// 删除标记本身会让文件暂时超出上限，随后的 Merge 会把它们回收
+	db.evicting = true
+	err := db.writeBatch(ops)
+	db.evicting = false
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Printf("Evicted %d oldest keys to stay under MaxFileSize %d", len(ops), db.opts.MaxFileSize)
+
+	for {
+		err := db.Merge()
+		if !errors.Is(err, ErrMergeInProgress) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+		// 正在进行的 Merge 结束后可能已经回收了足够的空间
+		db.mu.RLock()
+		done := db.offset <= limit
+		db.mu.RUnlock()
+		if done {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvictOldestKeys(t *testing.T) {
+	const maxSize = 4096
+	db := openTestDB(t, Options{MaxFileSize: maxSize})
+	value := strings.Repeat("v", 100)
+	// 时间戳只精确到秒，同一秒内的先后在 Merge 重排记录后无法区分，这里每个 key 相差一秒。
+	// backdated 最后写入但时间戳最旧，淘汰按时间戳而不是文件中的位置
+	base := time.Now().Add(-time.Hour)
+	put := func(key string, ts time.Time) error {
+		e := NewEntry([]byte(key), []byte(value))
+		e.Timestamp = uint32(ts.Unix())
+		return db.AppendRaw(e.EncodeOrder(db.order))
+	}
+	if err := put("k000", base); err != nil {
+		t.Fatal(err)
+	}
+	if err := put("backdated", base.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 100; i++ {
+		var err error
+		if key := fmt.Sprintf("k%03d", i); i < 90 {
+			err = put(key, base.Add(time.Duration(i)*time.Second))
+		} else {
+			// 最后几个 key 用普通 Put 写入，时间戳为当前时间，仍然比之前的都新
+			err = db.Put(key, value)
+		}
+		if err != nil {
+			t.Fatalf("write k%03d: %v", i, err)
+		}
+		if db.offset > maxSize {
+			t.Fatalf("data file is %d bytes after writing k%03d, limit %d", db.offset, i, maxSize)
+		}
+	}
+
+	for _, stage := range []string{"filled", "reopened"} {
+		if stage == "reopened" {
+			db = reopen(t, db)
+		}
+		if _, err := db.Get("backdated"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("%s: Get(backdated) = %v, want it evicted first", stage, err)
+		}
+		// 留下的是最新写入的一段连续的 key
+		kept := dump(t, db)
+		if len(kept) == 0 || len(kept) >= 100 {
+			t.Fatalf("%s: %d keys kept", stage, len(kept))
+		}
+		for i := 0; i < 100; i++ {
+			_, ok := kept[fmt.Sprintf("k%03d", i)]
+			if want := i >= 100-len(kept); ok != want {
+				t.Fatalf("%s: k%03d kept = %v, want the newest %d keys", stage, i, ok, len(kept))
+			}
+		}
+	}
+
+	if err := db.Put("huge", strings.Repeat("h", maxSize)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Put of a value larger than MaxFileSize = %v, want ErrValueTooLarge", err)
+	}
+	if _, err := db.Get("k099"); err != nil {
+		t.Fatalf("Get(k099) after the rejected write: %v", err)
+	}
+}
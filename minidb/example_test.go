@@ -0,0 +1,32 @@
+package minidb_test
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"minikv/minidb"
+)
+
+func ExampleOpen() {
+	// 数据文件写在当前工作目录下，示例换到临时目录中运行
+	dir, err := os.MkdirTemp("", "minidb-example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	db, err := minidb.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("language", "golang")
+	val, _ := db.Get("language")
+	fmt.Println(val)
+	// Output: golang
+}
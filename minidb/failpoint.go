@@ -0,0 +1,22 @@
+package minidb
+
+// ==========================================
+// 24. 故障注入 (Fail Points)
+// ==========================================
+
+// 故障注入点，名字作为参数传给 MiniDB.failPoint
+const (
+	fpBeforeSync        = "before-sync"         // 数据已写入文件、fsync 之前
+	fpMergeBeforeRename = "merge-before-rename" // merge 文件已 fsync、rename 覆盖旧数据文件之前
+	fpMergeAfterRename  = "merge-after-rename"  // rename 之后、切换文件句柄和索引之前
+)
+
+// injectFault 调用 db.failPoint。failPoint 只供测试使用，生产环境为 nil，每个实例单独设置，
+// 并行的测试互不影响。测试中设置它可以在上面的位置确定性地注入错误：
+// 调用方像在该位置崩溃一样直接返回错误，不做额外清理，之后应丢弃这个实例重新 Open 验证恢复结果
+func (db *MiniDB) injectFault(name string) error {
+	if db.failPoint == nil {
+		return nil
+	}
+	return db.failPoint(name)
+}
@@ -0,0 +1,133 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var errInjected = errors.New("injected fault")
+
+// setFailPoint 让 db 在 name 处的故障注入点返回 errInjected
+func setFailPoint(db *MiniDB, name string) {
+	db.failPoint = func(at string) error {
+		if at == name {
+			return errInjected
+		}
+		return nil
+	}
+}
+
+// crash 模拟进程崩溃: 不写 hint，丢掉没有 fsync 的数据，只关闭文件句柄。
+// Merge 在 rename 之后失败时磁盘上已经是整体 fsync 过的新文件，比 DurableOffset 记录的旧文件短
+func crash(t *testing.T, db *MiniDB) {
+	t.Helper()
+	durable := db.DurableOffset()
+	db.drain()
+	db.file.Close()
+	if db.vlog != nil {
+		db.vlog.Close()
+	}
+	info, err := os.Stat(db.names.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if durable < info.Size() {
+		if err := os.Truncate(db.names.data, durable); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// dump 返回库中所有 key 的当前值
+func dump(t *testing.T, db *MiniDB) map[string]string {
+	t.Helper()
+	keys, _, err := db.Scan("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := make(map[string]string, len(keys))
+	for _, k := range keys {
+		v, err := db.Get(k)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", k, err)
+		}
+		state[k] = v
+	}
+	return state
+}
+
+func TestFailPointsLeaveStateUnchanged(t *testing.T) {
+	tests := []struct {
+		name  string
+		point string
+		op    func(db *MiniDB) error
+		vlog  bool // value 存入 value log，Merge 同时回收 value log
+		segs  bool // 分段存储，Merge 写出多个新分段
+	}{
+		{"put before sync", fpBeforeSync, func(db *MiniDB) error { return db.Put("k1", "changed") }, false, false},
+		{"delete before sync", fpBeforeSync, func(db *MiniDB) error { return db.Del("k2") }, false, false},
+		{"merge before rename", fpMergeBeforeRename, (*MiniDB).Merge, false, false},
+		{"merge after rename", fpMergeAfterRename, (*MiniDB).Merge, false, false},
+		{"value log gc before rename", fpMergeBeforeRename, (*MiniDB).Merge, true, false},
+		{"value log gc after rename", fpMergeAfterRename, (*MiniDB).Merge, true, false},
+		{"segments before rename", fpMergeBeforeRename, (*MiniDB).Merge, false, true},
+		{"segments after rename", fpMergeAfterRename, (*MiniDB).Merge, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 故障注入点属于各自的实例，子测试可以并行
+			t.Parallel()
+			opts := Options{SyncPolicy: SyncAlways}
+			format := "%d"
+			if tt.vlog {
+				opts.ValueLogThreshold = 4
+				format = "value-%d"
+			}
+			if tt.segs {
+				opts.MaxSegmentSize = 64
+			}
+			db := openTestDB(t, opts)
+			for i := 0; i < 20; i++ {
+				if err := db.Put(fmt.Sprintf("k%d", i%5), fmt.Sprintf(format, i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Del("k4"); err != nil {
+				t.Fatal(err)
+			}
+			want := dump(t, db)
+			opts = db.opts
+
+			setFailPoint(db, tt.point)
+			if err := tt.op(db); !errors.Is(err, errInjected) {
+				t.Fatalf("op = %v, want the injected fault", err)
+			}
+			crash(t, db)
+
+			db = openTestDB(t, opts)
+			if db.corruptRecords != 0 {
+				t.Fatalf("%d corrupted records after recovery", db.corruptRecords)
+			}
+			got := dump(t, db)
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("state after recovery = %v, want %v", got, want)
+			}
+			if _, err := os.Stat(db.names.merge); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("merge file left behind: %v", err)
+			}
+			if _, err := os.Stat(db.names.vlogMerge); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("new value log left behind: %v", err)
+			}
+			// 没有提交的新分段和已经被替换的旧分段都要被删除
+			if files, _ := filepath.Glob(db.names.prefix + "*." + db.names.ext); len(files) != len(db.Segments()) {
+				t.Fatalf("data files on disk %v, segments %+v", files, db.Segments())
+			}
+			if err := db.Put("after", "1"); err != nil {
+				t.Fatalf("Put after recovery: %v", err)
+			}
+		})
+	}
+}
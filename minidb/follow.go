@@ -0,0 +1,106 @@
+package minidb
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// ==========================================
+// 10. 只读跟随 (Follower)
+// ==========================================
+
+// Tail 读取数据文件中上次之后由其他进程追加的完整记录并更新索引，只能在只读模式下使用。
+// 尾部还没写完的记录会留到下一次 Tail；如果主库 Merge 替换了数据文件或分段，则重新打开并全量加载
+func (db *MiniDB) Tail() error {
+	if !db.opts.ReadOnly {
+		return errors.New("tail requires read-only mode")
+	}
+
+	if err := db.CheckHealth(); errors.Is(err, ErrFileReplaced) {
+		return db.reopen()
+	}
+	// 主库开始的新分段接在末尾，分段被 Merge 替换时与数据文件被替换一样重新打开
+	added, replaced, err := db.followSegments()
+	if err != nil {
+		return err
+	}
+	if replaced {
+		return db.reopen()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, name := range added {
+		if err := db.file.(*segmentedStorage).open(db.fs, name, true); err != nil {
+			return err
+		}
+	}
+
+	// 主库可能在跟随开始后才创建 value log
+	if db.vlog == nil {
+		if err := db.openValueLog(); err != nil {
+			return err
+		}
+	}
+
+	size, err := db.file.Size()
+	if err != nil {
+		return err
+	}
+	if size <= db.offset {
+		return nil
+	}
+	tail, err := db.replay(db.offset, size)
+	if err != nil {
+		return err
+	}
+	db.offset = tail
+	return nil
+}
+
+// reopen 关闭旧的文件句柄，重新打开数据文件并重建索引
+func (db *MiniDB) reopen() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	log.Println("Data file replaced, reopening...")
+	db.file.Close()
+	if db.vlog != nil {
+		db.vlog.Close()
+		db.vlog = nil
+	}
+	db.indexes = db.newIndex(db.indexes.len())
+	db.cache.purge()
+	db.recent.purge()
+	db.versions = make(map[string][]recordPos)
+	db.deleted = make(map[string]deletedPos)
+	db.deadBytes, db.corruptRecords = 0, 0
+	db.tombstones, db.tombstoneBytes = 0, 0
+	db.deadEntries = 0
+
+	if err := db.openData(); err != nil {
+		return err
+	}
+	if err := db.openValueLog(); err != nil {
+		return err
+	}
+	return db.loadIndexes()
+}
+
+func (db *MiniDB) tailLoop() {
+	ticker := time.NewTicker(db.opts.TailInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			if err := db.Tail(); err != nil {
+				log.Printf("Tail failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package minidb
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTailFollowsWriter(t *testing.T) {
+	for _, opts := range []Options{{}, {ValueLogThreshold: 8}} {
+		writer := openTestDB(t, opts)
+		if err := writer.Put("a", "1"); err != nil {
+			t.Fatal(err)
+		}
+		ro := writer.opts
+		ro.ReadOnly = true
+		reader := openTestDB(t, ro)
+
+		check := func(stage string, want map[string]string) {
+			t.Helper()
+			if err := reader.Tail(); err != nil {
+				t.Fatalf("%s: Tail = %v", stage, err)
+			}
+			for k, v := range want {
+				got, err := reader.Get(k)
+				if v == "" {
+					if !errors.Is(err, ErrKeyNotFound) {
+						t.Fatalf("%s: Get(%q) = %q, %v, want ErrKeyNotFound", stage, k, got, err)
+					}
+					continue
+				}
+				if err != nil || got != v {
+					t.Fatalf("%s: Get(%q) = %q, %v, want %q", stage, k, got, err, v)
+				}
+			}
+		}
+		long := strings.Repeat("L", 100)
+		if err := writer.Put("b", long); err != nil {
+			t.Fatal(err)
+		}
+		check("put", map[string]string{"a": "1", "b": long})
+		if err := writer.Del("a"); err != nil {
+			t.Fatal(err)
+		}
+		check("deleted", map[string]string{"a": "", "b": long})
+		// Merge 替换了数据文件，跟随者重新打开并全量加载
+		if err := writer.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Put("c", "3"); err != nil {
+			t.Fatal(err)
+		}
+		check("merged", map[string]string{"a": "", "b": long, "c": "3"})
+
+		// 尾部还没写完的记录留到下一次 Tail
+		e := NewEntry([]byte("d"), []byte("4"))
+		record := e.EncodeOrder(writer.order)
+		writer.Close()
+		f, err := os.OpenFile(writer.names.data, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Write(record[:HeaderSize]); err != nil {
+			t.Fatal(err)
+		}
+		check("partial record", map[string]string{"c": "3", "d": ""})
+		if _, err := f.Write(record[HeaderSize:]); err != nil {
+			t.Fatal(err)
+		}
+		check("completed record", map[string]string{"c": "3", "d": "4"})
+	}
+}
+
+func TestTailRequiresReadOnly(t *testing.T) {
+	db := openTestDB(t, Options{})
+	if err := db.Tail(); err == nil {
+		t.Fatal("Tail on a writable DB succeeded")
+	}
+}
@@ -0,0 +1,89 @@
+package minidb
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ==========================================
+// 7. 健康检查 (Health Check)
+// ==========================================
+
+var ErrFileReplaced = errors.New("data file was removed or replaced on disk")
+
+// CheckHealth 确认当前打开的数据文件句柄仍然对应磁盘上的同一个文件，
+// 防止运行期间数据文件被误删或替换后，写入全部落到一个已经不可见的文件里
+func (db *MiniDB) CheckHealth() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// 分段存储只检查接受写入的活跃分段
+	file := db.file
+	if s, ok := file.(*segmentedStorage); ok {
+		file = s.active().file
+	}
+	f, ok := file.(interface {
+		Name() string
+		Stat() (os.FileInfo, error)
+	})
+	if !ok {
+		return nil
+	}
+	opened, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	onDisk, err := os.Stat(f.Name())
+	if err != nil || !os.SameFile(opened, onDisk) {
+		return ErrFileReplaced
+	}
+	return nil
+}
+
+// diskCheckInterval 内不重复 statfs，期间用上次的结果减去之后写入的字节数估算剩余空间
+const diskCheckInterval = time.Second
+
+// checkDiskSpace 在写入 n 字节之前确认磁盘剩余空间不会低于 MinFreeDisk，
+// 避免写满磁盘后在 ENOSPC 时留下写了一半的记录。估算值不够时立即重新 statfs。调用方需持有写锁
+func (db *MiniDB) checkDiskSpace(n int64) error {
+	if db.opts.MinFreeDisk <= 0 {
+		return nil
+	}
+	now := db.now()
+	free := db.diskFreeAt - (db.bytesWritten - db.diskWrittenAt)
+	if now.Sub(db.diskCheckedAt) >= diskCheckInterval || free-n < db.opts.MinFreeDisk {
+		var err error
+		free, err = db.diskFree(filepath.Dir(db.dataFile))
+		if errors.Is(err, errors.ErrUnsupported) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		db.diskFreeAt, db.diskWrittenAt, db.diskCheckedAt = free, db.bytesWritten, now
+	}
+	if free-n < db.opts.MinFreeDisk {
+		return ErrLowDiskSpace
+	}
+	return nil
+}
+
+// healthLoop 按 HealthCheckInterval 定期检查数据文件，发现异常时告警
+func (db *MiniDB) healthLoop() {
+	ticker := time.NewTicker(db.opts.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			if err := db.CheckHealth(); err != nil {
+				log.Printf("Error: Health check failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package minidb
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestCheckHealth(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, db *MiniDB)
+		want   error
+	}{
+		{"untouched", func(t *testing.T, db *MiniDB) {}, nil},
+		// Merge 通过 rename 替换数据文件，同时换用新的句柄
+		{"merged", func(t *testing.T, db *MiniDB) {
+			if err := db.Merge(); err != nil {
+				t.Fatal(err)
+			}
+		}, nil},
+		{"removed", func(t *testing.T, db *MiniDB) {
+			if err := os.Remove(db.names.data); err != nil {
+				t.Fatal(err)
+			}
+		}, ErrFileReplaced},
+		{"replaced", func(t *testing.T, db *MiniDB) {
+			other := db.names.data + ".other"
+			if err := os.WriteFile(other, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(other, db.names.data); err != nil {
+				t.Fatal(err)
+			}
+		}, ErrFileReplaced},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, Options{})
+			if err := db.Put("k", "v"); err != nil {
+				t.Fatal(err)
+			}
+			tt.change(t, db)
+			if err := db.CheckHealth(); !errors.Is(err, tt.want) {
+				t.Fatalf("CheckHealth = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package minidb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// ==========================================
+// 5. 索引快照 (Hint File)
+// ==========================================
+
+// Hint 文件格式:
+// [Magic 4][DataOffset 8][DeadBytes 8][Tombstones 4][TombstoneBytes 8][LastSeq 8][DeadEntries 4][Count 4]
+// + Count * [KeySize 4][Offset 8][Size 8][Key] + [CRC 4]
+// DataOffset 记录快照对应的数据文件位置，启动时只需重放其后的记录。
+// 旧格式仍可读取：MNH3 没有 DeadEntries，MNH2 也没有 LastSeq，MNDH 也没有删除标记的两个字段，缺少的统计从 0 开始
+const (
+	HintFileName     = "minidb.hint"
+	hintHeaderSize   = 48
+	hintHeaderSizeV3 = 44
+	hintHeaderSizeV2 = 36
+	hintHeaderSizeV1 = 24
+	hintItemSize     = 20
+)
+
+var (
+	hintMagic   = []byte("MNH4")
+	hintMagicV3 = []byte("MNH3")
+	hintMagicV2 = []byte("MNH2")
+	hintMagicV1 = []byte("MNDH")
+)
+
+// Checkpoint 把当前内存索引写入 hint 文件，下次 Open 时可以跳过全量扫描
+func (db *MiniDB) Checkpoint() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.writeHint(db.opts.StrictCheckpoint)
+}
+
+// SyncCheckpoint 与 Checkpoint 相同，但不论 StrictCheckpoint 如何设置都会 fsync 数据文件和 hint 文件，
+// 返回后下次 Open 一定可以从 hint 文件快速加载。写入期间持有读锁，hint 记录的位置与已写入的数据一致
+func (db *MiniDB) SyncCheckpoint() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.writeHint(true)
+}
+
+// writeHint 先写临时文件再 rename，保证 hint 文件要么是旧的要么是完整的新快照。
+// strict 时会先 fsync 数据文件和临时文件，hint 永远不会指向未落盘的数据
+func (db *MiniDB) writeHint(strict bool) error {
+	if strict {
+		if db.vlog != nil {
+			if err := db.vlog.Sync(); err != nil {
+				return err
+			}
+		}
+		if err := db.file.Sync(); err != nil {
+			return err
+		}
+	}
+	// 快照和 OpenFile 传入的文件没有对应的 hint 文件，不能覆盖当前目录下其他库的 hint
+	if !db.hasHint() {
+		return nil
+	}
+
+	buf := make([]byte, hintHeaderSize)
+	copy(buf[0:4], hintMagic)
+	binary.BigEndian.PutUint64(buf[4:12], uint64(db.offset))
+	binary.BigEndian.PutUint64(buf[12:20], uint64(db.deadBytes))
+	binary.BigEndian.PutUint32(buf[20:24], uint32(db.tombstones))
+	binary.BigEndian.PutUint64(buf[24:32], uint64(db.tombstoneBytes))
+	binary.BigEndian.PutUint64(buf[32:40], db.seq)
+	binary.BigEndian.PutUint32(buf[40:44], uint32(db.deadEntries))
+	binary.BigEndian.PutUint32(buf[44:48], uint32(db.indexes.len()))
+	db.indexes.each(func(key string, pos recordPos) {
+		item := make([]byte, hintItemSize+len(key))
+		binary.BigEndian.PutUint32(item[0:4], uint32(len(key)))
+		binary.BigEndian.PutUint64(item[4:12], uint64(pos.offset))
+		binary.BigEndian.PutUint64(item[12:20], uint64(pos.size))
+		copy(item[hintItemSize:], key)
+		buf = append(buf, item...)
+	})
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	db.hintMu.Lock()
+	defer db.hintMu.Unlock()
+	tmpName := db.names.hint + ".tmp"
+	f, err := db.fs.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if strict {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return db.fs.Rename(tmpName, db.names.hint)
+}
+
+// loadHint 从 hint 文件恢复索引，返回需要继续重放的数据文件位置。
+// hint 不存在、损坏或超出数据文件长度 (过期) 时返回 false，调用方退回全量扫描
+func (db *MiniDB) loadHint() (int64, bool) {
+	buf, err := db.readAll(db.names.hint)
+	if err != nil {
+		return 0, false
+	}
+
+	var headerSize int
+	switch {
+	case len(buf) < 4:
+	case string(buf[0:4]) == string(hintMagic):
+		headerSize = hintHeaderSize
+	case string(buf[0:4]) == string(hintMagicV3):
+		headerSize = hintHeaderSizeV3
+	case string(buf[0:4]) == string(hintMagicV2):
+		headerSize = hintHeaderSizeV2
+	case string(buf[0:4]) == string(hintMagicV1):
+		headerSize = hintHeaderSizeV1
+	}
+	if headerSize == 0 || len(buf) < headerSize+4 {
+		log.Printf("Warn: Invalid hint file, falling back to full scan")
+		return 0, false
+	}
+	body := buf[:len(buf)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(buf[len(buf)-4:]) {
+		log.Printf("Warn: Corrupted hint file, falling back to full scan")
+		return 0, false
+	}
+
+	dataOffset := int64(binary.BigEndian.Uint64(body[4:12]))
+	if dataOffset < FileHeaderSize || dataOffset > db.offset {
+		log.Printf("Warn: Stale hint file (offset %d, file size %d), falling back to full scan", dataOffset, db.offset)
+		return 0, false
+	}
+
+	deadBytes := int64(binary.BigEndian.Uint64(body[12:20]))
+	var tombstones int
+	var tombstoneBytes int64
+	var seq uint64
+	var deadEntries int
+	if headerSize >= hintHeaderSizeV2 {
+		tombstones = int(binary.BigEndian.Uint32(body[20:24]))
+		tombstoneBytes = int64(binary.BigEndian.Uint64(body[24:32]))
+	}
+	if headerSize >= hintHeaderSizeV3 {
+		seq = binary.BigEndian.Uint64(body[32:40])
+	}
+	if headerSize == hintHeaderSize {
+		deadEntries = int(binary.BigEndian.Uint32(body[40:44]))
+	}
+	count := binary.BigEndian.Uint32(body[headerSize-4 : headerSize])
+	// 预分配的容量至少包括 hint 中的 key，之后重放的新 key 通常不多
+	indexes := db.newIndex(max(int(count), db.opts.ExpectedKeys))
+	pos := headerSize
+	for i := uint32(0); i < count; i++ {
+		if pos+hintItemSize > len(body) {
+			return 0, false
+		}
+		kSize := int(binary.BigEndian.Uint32(body[pos : pos+4]))
+		offset := int64(binary.BigEndian.Uint64(body[pos+4 : pos+12]))
+		size := int64(binary.BigEndian.Uint64(body[pos+12 : pos+20]))
+		if pos+hintItemSize+kSize > len(body) {
+			return 0, false
+		}
+		indexes.set(string(body[pos+hintItemSize:pos+hintItemSize+kSize]), recordPos{offset: offset, size: size})
+		pos += hintItemSize + kSize
+	}
+
+	db.indexes = indexes
+	db.deadBytes = deadBytes
+	db.tombstones, db.tombstoneBytes = tombstones, tombstoneBytes
+	db.seq = seq
+	db.deadEntries = deadEntries
+	return dataOffset, true
+}
+
+// checkpointLoop 按 CheckpointInterval 定期写入 hint 文件，并响应 noteWrite 按写入次数发出的通知
+func (db *MiniDB) checkpointLoop() {
+	var tick <-chan time.Time
+	if db.opts.CheckpointInterval > 0 {
+		ticker := time.NewTicker(db.opts.CheckpointInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-tick:
+		case <-db.ckptCh:
+		}
+		if err := db.Checkpoint(); err != nil {
+			log.Printf("Checkpoint failed: %v", err)
+		}
+	}
+}
+
+// noteWrite 在每次写入成功后调用，每满 CheckpointWrites 次通知 checkpointLoop 写一次 hint 文件。
+// 快照在后台写入，不阻塞当前写入；上一次还没写完时多次通知合并成一次。调用方需持有写锁
+func (db *MiniDB) noteWrite() {
+	if db.opts.CheckpointWrites <= 0 {
+		return
+	}
+	db.ckptWrites++
+	if db.ckptWrites < db.opts.CheckpointWrites {
+		return
+	}
+	db.ckptWrites = 0
+	select {
+	case db.ckptCh <- struct{}{}:
+	default:
+	}
+}
+
+func (db *MiniDB) readAll(name string) ([]byte, error) {
+	f, err := db.fs.OpenFile(name, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
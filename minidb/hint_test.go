@@ -0,0 +1,200 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentCheckpoints(t *testing.T) {
+	db := openTestDB(t, Options{})
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- db.Checkpoint()
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- db.SyncCheckpoint()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("checkpoint: %v", err)
+		}
+	}
+
+	db.Close()
+	db = openTestDB(t, db.opts)
+	if off, ok := db.loadHint(); !ok || off != db.offset {
+		t.Fatalf("loadHint = %d, %v, want %d", off, ok, db.offset)
+	}
+}
+
+func TestStrictHintNeverPointsPastData(t *testing.T) {
+	db := openTestDB(t, Options{StrictCheckpoint: true})
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SyncCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	synced := db.offset
+	if err := db.Put("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	// 模拟崩溃: hint 之后的写入没有落盘
+	if err := db.file.Truncate(synced); err != nil {
+		t.Fatal(err)
+	}
+	opts := db.opts
+	db.drain()
+	db.file.Close()
+
+	db = openTestDB(t, opts)
+	if off, ok := db.loadHint(); !ok || off > db.offset {
+		t.Fatalf("loadHint = %d, %v with data file of %d bytes", off, ok, db.offset)
+	}
+	if v, err := db.Get("a"); err != nil || v != "1" {
+		t.Fatalf("Get(a) = %q, %v", v, err)
+	}
+}
+
+func TestCheckpointWrites(t *testing.T) {
+	db := openTestDB(t, Options{CheckpointWrites: 10})
+	put := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if err := db.Put(fmt.Sprintf("k%d", i), "v"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(0, 9)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := os.Stat(db.names.hint); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("hint file after 9 of 10 writes: %v", err)
+	}
+
+	// 第 10 次写入后快照在后台写出
+	put(9, 10)
+	snapshot := db.offset
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if off, ok := db.loadHint(); ok && off == snapshot {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no hint snapshot after 10 writes")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// 快照之后再写几条，然后不经 Close 直接崩溃 (Close 会写新的快照)
+	put(10, 15)
+	opts := db.opts
+	db.drain()
+	db.file.Close()
+
+	// 破坏快照之前的一条记录：如果重新打开时全量扫描就会发现它，从快照加载则只重放之后的记录
+	f, err := os.OpenFile(db.names.data, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("X"), FileHeaderSize+HeaderSize); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db = openTestDB(t, opts)
+	if db.corruptRecords != 0 {
+		t.Fatalf("%d corrupt records found on reopen, want the snapshot to skip the scan", db.corruptRecords)
+	}
+	if n := db.Stats().Keys; n != 15 {
+		t.Fatalf("%d keys after reopen, want 15", n)
+	}
+	for i := 10; i < 15; i++ {
+		if v, err := db.Get(fmt.Sprintf("k%d", i)); err != nil || v != "v" {
+			t.Fatalf("Get(k%d) replayed from the tail = %q, %v", i, v, err)
+		}
+	}
+}
+
+// TestRefuseEmptyDataFile 数据文件被截空或删除、但 hint 文件或 value log 仍有内容时，开启 RefuseEmptyDataFile 拒绝打开
+func TestRefuseEmptyDataFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		damage  func(db *MiniDB) error
+		wantErr bool
+	}{
+		{"truncated", Options{RefuseEmptyDataFile: true}, func(db *MiniDB) error { return os.Truncate(db.names.data, 0) }, true},
+		{"removed", Options{RefuseEmptyDataFile: true}, func(db *MiniDB) error { return os.Remove(db.names.data) }, true},
+		{"value log only", Options{RefuseEmptyDataFile: true, ValueLogThreshold: 16}, func(db *MiniDB) error {
+			if err := os.Remove(db.names.hint); err != nil {
+				return err
+			}
+			return os.Truncate(db.names.data, 0)
+		}, true},
+		{"all files removed", Options{RefuseEmptyDataFile: true}, func(db *MiniDB) error {
+			if err := os.Remove(db.names.hint); err != nil {
+				return err
+			}
+			return os.Remove(db.names.data)
+		}, false},
+		{"disabled", Options{}, func(db *MiniDB) error { return os.Truncate(db.names.data, 0) }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, tt.opts)
+			if err := db.Put("k", strings.Repeat("v", 100)); err != nil {
+				t.Fatal(err)
+			}
+			opts, names := db.opts, db.names
+			db.Close()
+			if err := tt.damage(db); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := OpenWithOptions(opts)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer db.Close()
+				if n := db.Stats().Keys; n != 0 {
+					t.Fatalf("opened with %d keys, want an empty database", n)
+				}
+				return
+			}
+			if !errors.Is(err, ErrSuspectedDataLoss) {
+				if err == nil {
+					db.Close()
+				}
+				t.Fatalf("Open = %v, want ErrSuspectedDataLoss", err)
+			}
+			// 拒绝打开时不能初始化数据文件，否则再次打开就不会报错了
+			if info, err := os.Stat(names.data); err == nil && info.Size() != 0 {
+				t.Fatalf("refused open wrote %d bytes to the data file", info.Size())
+			}
+			if _, err := OpenWithOptions(opts); !errors.Is(err, ErrSuspectedDataLoss) {
+				t.Fatalf("second Open = %v, want ErrSuspectedDataLoss", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package minidb
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ==========================================
+// 20. 热点统计 (Hot Keys)
+// ==========================================
+
+var ErrHotKeysDisabled = errors.New("hot key tracking is disabled")
+
+// HotKey 是一个热点 key 的访问次数。Reads 和 Writes 从开始跟踪这个 key 时算起，
+// Error 是它替换掉的 key 遗留的计数，真实访问次数在 Reads+Writes 与 Reads+Writes+Error 之间
+type HotKey struct {
+	Key    string `json:"key"`
+	Reads  int64  `json:"reads"`
+	Writes int64  `json:"writes"`
+	Error  int64  `json:"error"`
+}
+
+// HotKeys 返回访问次数最多的 n 个 key，按次数从多到少排列，n <= 0 表示返回全部跟踪中的 key。
+// 需要开启 Options.HotKeys，否则返回 ErrHotKeysDisabled
+func (db *MiniDB) HotKeys(n int) ([]HotKey, error) {
+	if db.hot == nil {
+		return nil, ErrHotKeysDisabled
+	}
+	return db.hot.top(n), nil
+}
+
+// hotKeys 用 Space-Saving 算法统计访问最多的 key，最多跟踪 cap 个，内存与 key 总数无关。
+// 表满时新 key 替换计数最小的一个并继承它的计数，真正的热点 key 不会被冷 key 挤出。
+// 读在读锁下记录，自己加锁。nil 表示不统计
+type hotKeys struct {
+	mu    sync.Mutex
+	cap   int
+	items map[string]*hotCounter
+	heap  hotHeap // 按总计数的最小堆，表满时替换堆顶
+}
+
+type hotCounter struct {
+	HotKey
+	index int
+}
+
+func (c *hotCounter) count() int64 { return c.Reads + c.Writes + c.Error }
+
+func newHotKeys(capacity int) *hotKeys {
+	if capacity <= 0 {
+		return nil
+	}
+	return &hotKeys{cap: capacity, items: make(map[string]*hotCounter, capacity)}
+}
+
+func (h *hotKeys) read(key string)  { h.record(key, 1, 0) }
+func (h *hotKeys) write(key string) { h.record(key, 0, 1) }
+
+func (h *hotKeys) record(key string, reads, writes int64) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c, ok := h.items[key]
+	switch {
+	case ok:
+	case len(h.heap) < h.cap:
+		c = &hotCounter{HotKey: HotKey{Key: key}}
+		h.items[key] = c
+		heap.Push(&h.heap, c)
+	default:
+		c = h.heap[0]
+		delete(h.items, c.Key)
+		c.HotKey = HotKey{Key: key, Error: c.count()}
+		h.items[key] = c
+	}
+	c.Reads += reads
+	c.Writes += writes
+	heap.Fix(&h.heap, c.index)
+}
+
+func (h *hotKeys) top(n int) []HotKey {
+	h.mu.Lock()
+	keys := make([]HotKey, 0, len(h.heap))
+	for _, c := range h.heap {
+		keys = append(keys, c.HotKey)
+	}
+	h.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if ca, cb := a.Reads+a.Writes+a.Error, b.Reads+b.Writes+b.Error; ca != cb {
+			return ca > cb
+		}
+		return a.Key < b.Key
+	})
+	if n > 0 && n < len(keys) {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+type hotHeap []*hotCounter
+
+func (h hotHeap) Len() int           { return len(h) }
+func (h hotHeap) Less(i, j int) bool { return h[i].count() < h[j].count() }
+func (h hotHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hotHeap) Push(x any) {
+	c := x.(*hotCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *hotHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,43 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestHotKeys(t *testing.T) {
+	db := openTestDB(t, Options{HotKeys: 4})
+	if err := db.Put("hot", "v"); err != nil {
+		t.Fatal(err)
+	}
+	// 热点 key 的读取夹在大量只访问一次的冷 key 之间，表满后冷 key 相互替换，热点 key 不会被挤出
+	for i := 0; i < 100; i++ {
+		if _, err := db.Get("hot"); err != nil {
+			t.Fatal(err)
+		}
+		cold := fmt.Sprintf("cold-%d", i)
+		if err := db.Put(cold, "v"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get(cold); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	top, err := db.HotKeys(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 1 || top[0].Key != "hot" || top[0].Reads != 100 || top[0].Writes != 1 {
+		t.Fatalf("HotKeys(1) = %+v, want hot with 100 reads and 1 write", top)
+	}
+	all, _ := db.HotKeys(0)
+	if len(all) != 4 || len(db.hot.items) != 4 {
+		t.Fatalf("tracking %d keys (%d returned), want the capacity of 4", len(db.hot.items), len(all))
+	}
+
+	if _, err := openTestDB(t, Options{}).HotKeys(10); !errors.Is(err, ErrHotKeysDisabled) {
+		t.Fatalf("HotKeys without the option = %v, want ErrHotKeysDisabled", err)
+	}
+}
@@ -0,0 +1,233 @@
+package minidb
+
+import (
+	"hash/maphash"
+	"log"
+)
+
+// ==========================================
+// 11. 内存索引 (Index)
+// ==========================================
+
+// index 维护 key 到记录位置的映射，调用方负责加锁
+type index interface {
+	get(key string) (recordPos, bool)
+	// set 返回被覆盖的旧位置
+	set(key string, pos recordPos) (old recordPos, replaced bool)
+	remove(key string) (old recordPos, removed bool)
+	len() int
+	// each 遍历所有 key，顺序不确定
+	each(fn func(key string, pos recordPos))
+	// memoryBytes 估算索引占用的内存
+	memoryBytes() int64
+}
+
+// 每个索引项除 key 本身以外的估算开销: map 槽位、string 头和 recordPos
+const (
+	mapEntryOverhead  = 60
+	hashEntryOverhead = 35
+)
+
+// newIndex 按 size 预分配容量，避免加载大量 key 时反复扩容
+func (db *MiniDB) newIndex(size int) index {
+	var idx index = make(mapIndex, size)
+	if db.opts.HashedIndex {
+		idx = newHashIndex(db, size)
+	}
+	if db.opts.BloomFilter {
+		idx = newBloomIndex(idx)
+	}
+	// HashedIndex 为了省内存不保存 key，Scan 时再从磁盘读回并排序
+	if !db.opts.HashedIndex {
+		idx = newOrderedIndex(idx, db.opts.KeyComparator)
+	}
+	return idx
+}
+
+// mapIndex 是默认实现，直接保存完整的 key
+type mapIndex map[string]recordPos
+
+func (m mapIndex) get(key string) (recordPos, bool) {
+	pos, ok := m[key]
+	return pos, ok
+}
+
+func (m mapIndex) set(key string, pos recordPos) (recordPos, bool) {
+	old, ok := m[key]
+	m[key] = pos
+	return old, ok
+}
+
+func (m mapIndex) remove(key string) (recordPos, bool) {
+	old, ok := m[key]
+	if ok {
+		delete(m, key)
+	}
+	return old, ok
+}
+
+func (m mapIndex) len() int { return len(m) }
+
+func (m mapIndex) each(fn func(key string, pos recordPos)) {
+	for key, pos := range m {
+		fn(key, pos)
+	}
+}
+
+func (m mapIndex) memoryBytes() int64 {
+	n := int64(len(m)) * mapEntryOverhead
+	for key := range m {
+		n += int64(len(key))
+	}
+	return n
+}
+
+// hashIndex 只在内存中保存 key 的 64 位哈希，完整的 key 通过读取磁盘上的记录头来校验。
+// 哈希冲突的 key 放进 chains 逐个比较。每次查找多一次 ReadAt，换来长 key 场景下大幅减少的内存
+type hashIndex struct {
+	seed   maphash.Seed
+	db     *MiniDB // 通过 db.file 读取当前的数据文件
+	items  map[uint64]recordPos
+	chains map[uint64][]recordPos // 与 items 中哈希相同的其他 key
+	count  int
+}
+
+func newHashIndex(db *MiniDB, size int) *hashIndex {
+	return &hashIndex{
+		seed:   maphash.MakeSeed(),
+		db:     db,
+		items:  make(map[uint64]recordPos, size),
+		chains: make(map[uint64][]recordPos),
+	}
+}
+
+// keyAt 读取 offset 处记录的 key，记录头中的 key 长度超出文件末尾时返回 CorruptionError
+func (h *hashIndex) keyAt(offset int64) ([]byte, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := h.db.file.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	_, _, kSize, _, _ := DecodeHeaderOrder(header, h.db.order)
+	if offset+HeaderSize+int64(kSize) > h.db.offset {
+		return nil, &CorruptionError{Offset: offset}
+	}
+	key := make([]byte, kSize)
+	if _, err := h.db.file.ReadAt(key, offset+HeaderSize); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// match 判断 pos 处的记录是否属于 key，只需要一次 ReadAt
+func (h *hashIndex) match(key string, pos recordPos) bool {
+	buf := make([]byte, HeaderSize+len(key))
+	if _, err := h.db.file.ReadAt(buf, pos.offset); err != nil {
+		return false
+	}
+	_, _, kSize, _, _ := DecodeHeaderOrder(buf, h.db.order)
+	return int(kSize) == len(key) && string(buf[HeaderSize:]) == key
+}
+
+// find 返回 key 在候选列表中的下标，-1 表示 items 中的那个，-2 表示不存在
+func (h *hashIndex) find(hash uint64, key string) int {
+	if pos, ok := h.items[hash]; !ok {
+		return -2
+	} else if h.match(key, pos) {
+		return -1
+	}
+	for i, pos := range h.chains[hash] {
+		if h.match(key, pos) {
+			return i
+		}
+	}
+	return -2
+}
+
+func (h *hashIndex) get(key string) (recordPos, bool) {
+	hash := maphash.String(h.seed, key)
+	switch i := h.find(hash, key); i {
+	case -2:
+		return recordPos{}, false
+	case -1:
+		return h.items[hash], true
+	default:
+		return h.chains[hash][i], true
+	}
+}
+
+func (h *hashIndex) set(key string, pos recordPos) (recordPos, bool) {
+	hash := maphash.String(h.seed, key)
+	switch i := h.find(hash, key); i {
+	case -2:
+		if _, ok := h.items[hash]; ok {
+			h.chains[hash] = append(h.chains[hash], pos)
+		} else {
+			h.items[hash] = pos
+		}
+		h.count++
+		return recordPos{}, false
+	case -1:
+		old := h.items[hash]
+		h.items[hash] = pos
+		return old, true
+	default:
+		old := h.chains[hash][i]
+		h.chains[hash][i] = pos
+		return old, true
+	}
+}
+
+func (h *hashIndex) remove(key string) (recordPos, bool) {
+	hash := maphash.String(h.seed, key)
+	i := h.find(hash, key)
+	if i == -2 {
+		return recordPos{}, false
+	}
+	h.count--
+
+	chain := h.chains[hash]
+	var old recordPos
+	if i == -1 {
+		old = h.items[hash]
+		if len(chain) == 0 {
+			delete(h.items, hash)
+			return old, true
+		}
+		// 把冲突链上的最后一个提到 items 中
+		h.items[hash] = chain[len(chain)-1]
+	} else {
+		old = chain[i]
+		chain[i] = chain[len(chain)-1]
+	}
+	if len(chain) == 1 {
+		delete(h.chains, hash)
+	} else {
+		h.chains[hash] = chain[:len(chain)-1]
+	}
+	return old, true
+}
+
+func (h *hashIndex) len() int { return h.count }
+
+// memoryBytes 不包含 key 本身，冲突链只额外多出 slice 头
+func (h *hashIndex) memoryBytes() int64 {
+	return int64(h.count)*hashEntryOverhead + int64(len(h.chains))*24
+}
+
+// each 需要从磁盘读回每个 key，比 mapIndex 慢得多
+func (h *hashIndex) each(fn func(key string, pos recordPos)) {
+	visit := func(pos recordPos) {
+		key, err := h.keyAt(pos.offset)
+		if err != nil {
+			log.Printf("Warn: Read key at offset %d failed: %v", pos.offset, err)
+			return
+		}
+		fn(string(key), pos)
+	}
+	for hash, pos := range h.items {
+		visit(pos)
+		for _, p := range h.chains[hash] {
+			visit(p)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package minidb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// BenchmarkIndexMemory 加载 100 万个 100 字节的 key，比较完整 key 索引和 HashedIndex 的堆内存占用
+func BenchmarkIndexMemory(b *testing.B) {
+	const keys = 1000000
+	dir := b.TempDir()
+	opts := Options{FilePrefix: filepath.Join(dir, DefaultFilePrefix)}
+	db := openTestDB(b, opts)
+	var buf bytes.Buffer
+	pad := strings.Repeat("k", 92)
+	for i := 0; i < keys; i++ {
+		buf.Write(NewEntry([]byte(fmt.Sprintf("%s%08d", pad, i)), []byte("v")).EncodeOrder(db.order))
+	}
+	if err := db.BulkLoad(&buf); err != nil {
+		b.Fatal(err)
+	}
+	db.Close()
+
+	heap := func() uint64 {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+	for _, hashed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("hashed=%v", hashed), func(b *testing.B) {
+			opts := opts
+			opts.ReadOnly, opts.HashedIndex = true, hashed
+			var total uint64
+			for i := 0; i < b.N; i++ {
+				before := heap()
+				db := openTestDB(b, opts)
+				total += heap() - before
+				if n := db.Stats().Keys; n != keys {
+					b.Fatalf("loaded %d keys", n)
+				}
+				db.Close()
+			}
+			b.ReportMetric(float64(total)/float64(b.N)/(1<<20), "heap-MB")
+			b.ReportMetric(0, "ns/op")
+		})
+	}
+}
+
+// BenchmarkLoadPresized 比较没有 hint 文件时重放 100 万个 key 建立索引的耗时，
+// 以及用 ExpectedKeys 预分配索引后的耗时
+func BenchmarkLoadPresized(b *testing.B) {
+	const keys = 1000000
+	dir := b.TempDir()
+	opts := Options{FilePrefix: filepath.Join(dir, DefaultFilePrefix)}
+	db := openTestDB(b, opts)
+	var buf bytes.Buffer
+	for i := 0; i < keys; i++ {
+		buf.Write(NewEntry([]byte(fmt.Sprintf("key-%07d", i)), []byte("v")).EncodeOrder(db.order))
+	}
+	if err := db.BulkLoad(&buf); err != nil {
+		b.Fatal(err)
+	}
+	db.Close()
+	if err := os.Remove(db.names.hint); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, expected := range []int{0, keys} {
+		b.Run(fmt.Sprintf("expected=%d", expected), func(b *testing.B) {
+			opts := opts
+			opts.ReadOnly, opts.ExpectedKeys = true, expected
+			for i := 0; i < b.N; i++ {
+				db := openTestDB(b, opts)
+				if n := db.Stats().Keys; n != keys {
+					b.Fatalf("loaded %d keys", n)
+				}
+				db.Close()
+			}
+		})
+	}
+}
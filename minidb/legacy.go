@@ -0,0 +1,113 @@
+package minidb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+)
+
+// ==========================================
+// 27. 旧格式升级 (Legacy Upgrade)
+// ==========================================
+
+// legacyHeaderSize 是最早的格式 (版本 0) 的记录头: [CRC 4][Timestamp 4][KeySize 4][ValueSize 4]。
+// 版本 0 的文件没有文件头，记录头没有标记位，删除只发生在内存中，文件里的每条记录都是写入
+const legacyHeaderSize = 16
+
+// upgradeLegacy 在打开数据文件之前检查它是否是版本 0 的文件，是的话按原顺序把每条记录
+// 重写成当前格式 (保留时间戳) 到临时文件，fsync 后 rename 覆盖原文件。
+// 重写过程中崩溃时原文件保持不变，下次 Open 会重新升级
+func (db *MiniDB) upgradeLegacy() error {
+	f, err := db.fs.OpenFile(db.dataFile, os.O_RDONLY)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil || size == 0 {
+		return err
+	}
+	magic := make([]byte, len(FileMagic))
+	if _, err := f.ReadAt(magic, 0); err == nil && bytes.Equal(magic, FileMagic) {
+		return nil
+	}
+
+	tmpName := db.dataFile + ".upgrade"
+	tmp, err := db.fs.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	n, err := db.rewriteLegacy(f, size, tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = db.fs.Rename(tmpName, db.dataFile)
+	}
+	if err != nil {
+		db.fs.Remove(tmpName)
+		return err
+	}
+	log.Printf("Upgraded %s from format version 0: %d records", db.dataFile, n)
+	return nil
+}
+
+// rewriteLegacy 把版本 0 的记录逐条转成当前格式写入 w，返回写入的记录数。
+// 第一条记录校验失败说明 r 根本不是版本 0 的文件；之后校验失败的记录与当年一样跳过，
+// 不完整的记录说明文件已损坏，两种情况都不写入任何东西
+func (db *MiniDB) rewriteLegacy(r io.ReaderAt, size int64, w io.Writer) (int, error) {
+	br := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(encodeFileHeader(0)); err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, legacyHeaderSize)
+	count := 0
+	for offset := int64(0); offset < size; {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return 0, fmt.Errorf("%w: truncated version 0 record at offset %d", ErrIncompatibleFormat, offset)
+		}
+		crc := binary.BigEndian.Uint32(header[0:4])
+		ts := binary.BigEndian.Uint32(header[4:8])
+		kSize := binary.BigEndian.Uint32(header[8:12])
+		vSize := binary.BigEndian.Uint32(header[12:16])
+		recordSize := legacyHeaderSize + int64(kSize) + int64(vSize)
+		if offset+recordSize > size {
+			return 0, fmt.Errorf("%w: truncated version 0 record at offset %d", ErrIncompatibleFormat, offset)
+		}
+		payload := make([]byte, recordSize-legacyHeaderSize)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return 0, err
+		}
+
+		actual := crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, payload)
+		switch {
+		case actual != crc && offset == 0:
+			return 0, ErrIncompatibleFormat
+		case actual != crc:
+			log.Printf("Warn: Corrupted version 0 record at offset %d, skipping...", offset)
+		case kSize > 0:
+			e := NewEntry(payload[:kSize], payload[kSize:])
+			e.Timestamp = ts
+			if _, err := bw.Write(e.Encode()); err != nil {
+				return 0, err
+			}
+			count++
+		}
+		offset += recordSize
+	}
+	return count, bw.Flush()
+}
@@ -0,0 +1,94 @@
+package minidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// legacyRecord 按版本 0 的格式编码一条记录
+func legacyRecord(ts uint32, key, value string) []byte {
+	buf := make([]byte, legacyHeaderSize, legacyHeaderSize+len(key)+len(value))
+	binary.BigEndian.PutUint32(buf[4:8], ts)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(key)))
+	binary.BigEndian.PutUint32(buf[12:16], uint32(len(value)))
+	buf = append(append(buf, key...), value...)
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+func TestUpgradeLegacy(t *testing.T) {
+	corrupt := legacyRecord(3, "c", "bad")
+	corrupt[len(corrupt)-1] ^= 0xFF
+
+	tests := []struct {
+		name    string
+		data    [][]byte
+		want    map[string]string
+		wantErr error
+	}{
+		{
+			name: "last write wins",
+			data: [][]byte{legacyRecord(1, "a", "1"), legacyRecord(2, "b", "2"), legacyRecord(3, "a", "3")},
+			want: map[string]string{"a": "3", "b": "2"},
+		},
+		{
+			name: "corrupt record skipped",
+			data: [][]byte{legacyRecord(1, "a", "1"), corrupt, legacyRecord(4, "d", "4")},
+			want: map[string]string{"a": "1", "d": "4"},
+		},
+		{
+			name:    "truncated record",
+			data:    [][]byte{legacyRecord(1, "a", "1"), legacyRecord(2, "b", "22")[:17]},
+			wantErr: ErrIncompatibleFormat,
+		},
+		{
+			name:    "not a data file",
+			data:    [][]byte{[]byte(strings.Repeat("x", 40))},
+			wantErr: ErrIncompatibleFormat,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix := filepath.Join(t.TempDir(), DefaultFilePrefix)
+			path := prefix + "." + DefaultExtension
+			var raw []byte
+			for _, r := range tt.data {
+				raw = append(raw, r...)
+			}
+			if err := os.WriteFile(path, raw, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := OpenWithOptions(Options{FilePrefix: prefix})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("open = %v, want %v", err, tt.wantErr)
+				}
+				if got, _ := os.ReadFile(path); string(got) != string(raw) {
+					t.Fatal("data file modified by a failed upgrade")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer db.Close()
+			if db.version != FormatVersion {
+				t.Fatalf("version = %d, want %d", db.version, FormatVersion)
+			}
+			for k, want := range tt.want {
+				if v, err := db.Get(k); err != nil || v != want {
+					t.Fatalf("Get(%q) = %q, %v, want %q", k, v, err, want)
+				}
+			}
+			if n := db.indexes.len(); n != len(tt.want) {
+				t.Fatalf("%d keys, want %d", n, len(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,964 @@
+package minidb
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+// ==========================================
+// 3. 数据合并 (Compaction)
+// ==========================================
+
+// Merge 把所有存活的记录重写到一个新的数据文件中并替换旧文件。
+// 拷贝期间不持有锁，读写照常访问旧文件；最后在写锁内把拷贝期间追加的记录原样补到新文件末尾，
+// 再切换文件和索引，读者只在这一步被短暂阻塞。分段存储按 MaxSegmentSize 把输出切成多个新分段，一起替换所有旧分段
+func (db *MiniDB) Merge() error {
+	return db.merge(nil)
+}
+
+// MergeFilter 与 Merge 相同，但只保留 keep 返回 true 的 key，其余 key 连同历史版本和可恢复的删除一起
+// 不拷贝到新文件，一次完成删除和回收，不需要先写删除标记。keep 在拷贝开始时对当时的每个 key 调用一次，
+// 拷贝期间新写入的记录总是保留
+func (db *MiniDB) MergeFilter(keep func(key string) bool) error {
+	return db.merge(keep)
+}
+
+// TryMerge 同步占用 Merge 标记后在后台执行 Merge，结果从返回的 channel 中取得。
+// 已有 Merge 在执行时直接返回 ErrMergeInProgress，不会像先调用 IsMerging 再 go Merge() 那样两个请求都通过检查
+func (db *MiniDB) TryMerge() (<-chan error, error) {
+	if err := db.claimMerge(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- db.runMerge(nil, FileHeaderSize, 0)
+	}()
+	return done, nil
+}
+
+// merge 实现 Merge 和 MergeFilter，keep 为 nil 表示保留所有 key
+func (db *MiniDB) merge(keep func(key string) bool) error {
+	if err := db.claimMerge(); err != nil {
+		return err
+	}
+	return db.runMerge(keep, FileHeaderSize, 0)
+}
+
+// claimMerge 检查能否 Merge 并设置 merging 标记，成功后必须调用 runMerge
+func (db *MiniDB) claimMerge() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.external {
+		return ErrMergeUnsupported
+	}
+	if !db.merging.CompareAndSwap(false, true) {
+		return ErrMergeInProgress
+	}
+	return nil
+}
+
+// runMerge 执行 Merge，结束时清除 claimMerge 设置的 merging 标记。
+// hi 为 0 时重写全部数据；否则只合并分段存储中 [lo, hi) 范围内的只读分段 (lo、hi 为分段的起点)，
+// 范围之外的分段原样保留，之后的分段在地址空间中整体前移
+func (db *MiniDB) runMerge(keep func(key string) bool, lo, hi int64) error {
+	defer db.merging.Store(false)
+	// Close 需要等拷贝结束，否则旧文件会在读取过程中被关闭
+	if err := db.enter(); err != nil {
+		return err
+	}
+	defer db.inflight.Done()
+
+	log.Println("Starting merge process...")
+
+	mergeFile, err := db.fs.OpenFile(db.names.merge, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer mergeFile.Close()
+	// 替换数据文件之前任何失败都删除写了一半的 merge 文件，原文件保持不变
+	swapped := false
+	defer func() {
+		if !swapped {
+			mergeFile.Close()
+			db.fs.Remove(db.names.merge)
+		}
+	}()
+
+	// 整体 Merge 重写全部数据，只拷贝索引中存活的记录，不存在需要被删除标记遮蔽的更老的数据，
+	// 所有删除标记都可以直接丢弃。分段合并只拷贝范围内的记录，删除标记见 spanTombstones
+	partial := hi > 0
+	inSpan := func(pos recordPos) bool {
+		return !partial || pos.offset >= lo && pos.offset < hi
+	}
+	type item struct {
+		key      string
+		pos      recordPos
+		versions []recordPos
+	}
+	db.mu.RLock()
+	file, order := db.file, db.order
+	vlog, vlogEnd := db.vlog, db.vlogOffset
+	mergeEnd, deadBefore := db.offset, db.deadBytes
+	tombsBefore, tombBytesBefore := db.tombstones, db.tombstoneBytes
+	deadEntriesBefore := db.deadEntries
+	if partial {
+		mergeEnd = hi
+	}
+	items := make([]item, 0, db.indexes.len())
+	// dropped 是 keep 排除的 key，拷贝之后从索引中移除；outside 是分段合并时范围内没有记录的 key
+	dropped := make(map[string]struct{})
+	outside := 0
+	db.indexes.each(func(key string, pos recordPos) {
+		if keep != nil && !keep(key) {
+			dropped[key] = struct{}{}
+			return
+		}
+		versions := db.versions[key]
+		if !inSpan(pos) && !slices.ContainsFunc(versions, inSpan) {
+			outside++
+			return
+		}
+		items = append(items, item{key, pos, slices.Clone(versions)})
+	})
+	count := db.indexes.len()
+	// 仍在 DeleteGracePeriod 内的删除连同删除标记一起保留，过期的在这里回收
+	type graceItem struct {
+		key string
+		d   deletedPos
+	}
+	var graces []graceItem
+	for key, d := range db.deleted {
+		if keep != nil && !keep(key) {
+			continue
+		}
+		if db.now().Sub(d.at) <= db.opts.DeleteGracePeriod && (inSpan(d.pos) || inSpan(d.tomb)) {
+			graces = append(graces, graceItem{key, d})
+		}
+	}
+	db.mu.RUnlock()
+	seg, segmented := file.(*segmentedStorage)
+
+	// HashedIndex 遍历时需要从磁盘读回 key，读取失败的 key 会被跳过
+	if len(items)+len(dropped)+outside != count {
+		return fmt.Errorf("merge: read %d of %d keys from index", len(items)+len(dropped)+outside, count)
+	}
+
+	// 分段合并保留范围内仍在遮蔽更早分段中旧记录的删除标记，保留期内的删除标记随 graces 拷贝
+	var tombs []spanTomb
+	var span spanStats
+	if partial {
+		graceTombs := make(map[int64]bool, len(graces))
+		for _, g := range graces {
+			graceTombs[g.d.tomb.offset] = true
+		}
+		if tombs, span, err = spanTombstones(file, order, lo, hi, graceTombs); err != nil {
+			return err
+		}
+	}
+	if db.opts.SortedMerge {
+		sort.Slice(items, func(i, j int) bool { return db.compareKeys(items[i].key, items[j].key) < 0 })
+	}
+
+	// value log 中失效数据达到 ValueLogGCRatio 时一起回收。新 value log 在 merge 文件之后创建，
+	// 失败时先于 merge 文件删除，崩溃后按 merge 文件是否还在决定新 value log 的去留，见 recoverValueLogMerge
+	// 分段合并只重写部分引用，不能据此回收 value log
+	var gc *valueLogGC
+	if vlog != nil && vlogEnd > 0 && !partial {
+		positions := make([]recordPos, 0, len(items)+len(graces))
+		for _, it := range items {
+			positions = append(append(positions, it.pos), it.versions...)
+		}
+		for _, g := range graces {
+			positions = append(positions, g.d.pos)
+		}
+		if gc, err = db.startValueLogGC(file, vlog, vlogEnd, positions); err != nil {
+			return err
+		}
+	}
+	if gc != nil {
+		defer gc.file.Close()
+		defer func() {
+			if !swapped {
+				gc.file.Close()
+				db.fs.Remove(db.names.vlogMerge)
+			}
+		}()
+	}
+	// appendShared 写入去重共享的 value，回收时写到新 value log
+	appendShared := func(value []byte) ([]byte, error) {
+		if gc != nil {
+			return gc.append(value)
+		}
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return db.appendValueLog(nil, value)
+	}
+
+	// 分段存储写出一组新分段，merge 文件留到提交时写入新的清单
+	var out mergeOutput = mergeFile
+	var sw *segmentWriter
+	var newOffset int64
+	if segmented {
+		// 分段合并之外的分段保持原来的文件头，新分段与它们一致
+		header := db.fileHeader()
+		if partial {
+			header = seg.header
+		}
+		sw, err = newSegmentWriter(db, seg, header, lo)
+		defer func() {
+			if !swapped {
+				sw.remove()
+			}
+		}()
+		if err != nil {
+			return err
+		}
+		out, newOffset = sw, lo
+	} else {
+		n, err := mergeFile.Write(db.fileHeader())
+		if err != nil {
+			return err
+		}
+		newOffset = int64(n)
+	}
+	var written int64
+	limiter := newRateLimiter(db.opts.MergeRateLimit)
+	var deadline time.Time
+	if db.opts.MergeTimeout > 0 {
+		deadline = time.Now().Add(db.opts.MergeTimeout)
+	}
+
+	// remap 记录每条拷贝过的记录在新文件中的位置，去重改写过的记录长度会变化
+	remap := make(map[int64]recordPos, len(items))
+	seen := make(map[[sha256.Size]byte][]byte)
+	buf := mergeBuffer(db.opts.MergeMemoryLimit)
+	maxSeen := -1
+	if limit := db.opts.MergeMemoryLimit; limit > 0 {
+		maxSeen = int(max(limit-int64(len(buf)), 0) / mergeSeenBytes)
+	}
+
+	expired := func() error {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			log.Printf("Merge aborted after %v, keeping the original data file", db.opts.MergeTimeout)
+			return ErrMergeTimeout
+		}
+		return nil
+	}
+
+	// copyChain 把 off 处的一条分块链整条拷贝到 merge 文件，返回链之后的位置。
+	// 回收 value log 时引用 value log 的记录 (很小) 整条读入内存改写引用，其余记录按缓冲大小分段拷贝，
+	// 大记录不会整条读入内存。locked 表示在写锁内补拷贝期间追加的记录，不限速也不检查超时
+	copyChain := func(key string, off int64, locked bool) (int64, error) {
+		if gc != nil {
+			header := buf[:HeaderSize]
+			if _, err := file.ReadAt(header, off); err != nil {
+				return 0, fmt.Errorf("merge: read key %q at offset %d: %w", key, off, err)
+			}
+			if _, _, _, _, flags := DecodeHeaderOrder(header, order); flags&FlagValueRef != 0 {
+				raw, err := db.readChain(file, key, off)
+				if err != nil {
+					return 0, fmt.Errorf("merge: read key %q at offset %d: %w", key, off, err)
+				}
+				moved, err := gc.rewrite(key, raw, buf)
+				if err != nil {
+					return 0, err
+				}
+				n, err := out.Write(raw)
+				if err != nil {
+					return 0, err
+				}
+				newOffset += int64(n)
+				written += int64(n)
+				if !locked {
+					limiter.wait(n + int(moved))
+					if err := expired(); err != nil {
+						return 0, err
+					}
+				}
+				return off + int64(n), nil
+			}
+		}
+
+		oldOffset := off
+		for {
+			header := buf[:HeaderSize]
+			if _, err := file.ReadAt(header, oldOffset); err != nil {
+				return 0, fmt.Errorf("merge: read key %q at offset %d: %w", key, oldOffset, err)
+			}
+			_, _, kSize, vSize, flags := DecodeHeaderOrder(header, order)
+			size := HeaderSize + int64(kSize) + int64(vSize)
+
+			// 按缓冲大小分段拷贝，大记录不会整条读入内存
+			for off, end := oldOffset, oldOffset+size; off < end; {
+				chunk := buf[:min(int64(len(buf)), end-off)]
+				if _, err := file.ReadAt(chunk, off); err != nil {
+					return 0, fmt.Errorf("merge: read key %q at offset %d: %w", key, oldOffset, err)
+				}
+				n, err := out.Write(chunk)
+				if err != nil {
+					return 0, err
+				}
+
+				off += int64(n)
+				newOffset += int64(n)
+				written += int64(n)
+				if locked {
+					continue
+				}
+				limiter.wait(n)
+				if err := expired(); err != nil {
+					return 0, err
+				}
+			}
+			oldOffset += size
+			if flags&FlagChunked == 0 {
+				return oldOffset, nil
+			}
+		}
+	}
+
+	// copyRecord 把 pos 处的记录 (分块链整条) 连续拷贝到 merge 文件。
+	// 读取失败时整个 Merge 放弃，不能让这个 key 从新文件中悄悄消失。
+	// 开始前先检查超时，去重改写的小记录不经过下面按块拷贝的循环
+	copyRecord := func(key string, pos recordPos) error {
+		if err := expired(); err != nil {
+			return err
+		}
+		if sw != nil {
+			if err := sw.reserve(pos.size); err != nil {
+				return err
+			}
+		}
+		start := newOffset
+		defer func() { remap[pos.offset] = recordPos{offset: start, size: newOffset - start} }()
+
+		// 有内存上限时超过拷贝缓冲的记录不参与去重，去重需要把整条记录读入内存
+		if db.opts.DedupThreshold > 0 && (maxSeen < 0 || pos.size <= int64(len(buf))) {
+			record, ok, err := db.dedupRecord(file, key, pos, seen, maxSeen < 0 || len(seen) < maxSeen, appendShared)
+			if err != nil {
+				return fmt.Errorf("merge: dedup key %q at offset %d: %w", key, pos.offset, err)
+			}
+			if ok {
+				n, err := out.Write(record)
+				if err != nil {
+					return err
+				}
+				newOffset += int64(n)
+				written += int64(n)
+				limiter.wait(n)
+				return nil
+			}
+		}
+
+		_, err := copyChain(key, pos.offset, false)
+		return err
+	}
+
+	// 分段合并只拷贝范围内的记录，范围外的留在原来的分段中
+	copySpan := func(key string, pos recordPos) error {
+		if !inSpan(pos) {
+			return nil
+		}
+		return copyRecord(key, pos)
+	}
+	for _, it := range items {
+		// 历史版本按从旧到新的顺序写入，重启时重放顺序不变
+		for i := len(it.versions) - 1; i >= 0; i-- {
+			if err := copySpan(it.key, it.versions[i]); err != nil {
+				return err
+			}
+		}
+		if err := copySpan(it.key, it.pos); err != nil {
+			return err
+		}
+	}
+	for _, g := range graces {
+		for _, pos := range []recordPos{g.d.pos, g.d.tomb} {
+			if err := copySpan(g.key, pos); err != nil {
+				return err
+			}
+		}
+	}
+	for _, t := range tombs {
+		if err := copyRecord(t.key, t.pos); err != nil {
+			return err
+		}
+	}
+
+	// merge 文件要在替换数据文件之前落盘，否则 rename 之后崩溃会留下内容不完整的数据文件。
+	// 新 value log 先于引用它的 merge 文件落盘。大部分数据在加锁之前 fsync，锁内只需要再 fsync 拷贝期间追加的部分
+	syncMerge := func() error {
+		if gc != nil {
+			if err := gc.file.Sync(); err != nil {
+				return err
+			}
+		}
+		return out.Sync()
+	}
+	if err := syncMerge(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 拷贝期间追加的记录 (包括删除标记和批次标记) 原样补到新文件末尾，重放结果不变。
+	// 回收 value log 时逐条拷贝，其中的引用同样改写到新 value log。
+	// 分段合并时它们在范围之后的分段中，不需要拷贝，随这些分段一起前移
+	tailBase, tailEnd := newOffset, db.offset
+	if partial {
+		tailEnd = mergeEnd
+	}
+	if tailEnd > mergeEnd && gc != nil {
+		for off := mergeEnd; off < tailEnd; {
+			if off, err = copyChain("", off, true); err != nil {
+				return fmt.Errorf("merge: copy records written during merge: %w", err)
+			}
+		}
+		if err := syncMerge(); err != nil {
+			return err
+		}
+	} else if tailEnd > mergeEnd {
+		for off := mergeEnd; off < tailEnd; {
+			chunk := buf[:min(int64(len(buf)), tailEnd-off)]
+			if _, err := file.ReadAt(chunk, off); err != nil {
+				return fmt.Errorf("merge: read records written during merge: %w", err)
+			}
+			n, err := out.Write(chunk)
+			if err != nil {
+				return err
+			}
+			off += int64(n)
+			newOffset += int64(n)
+			written += int64(n)
+		}
+		if err := out.Sync(); err != nil {
+			return err
+		}
+	}
+	db.bytesWritten += written
+	if gc != nil {
+		db.bytesWritten += gc.offset
+	}
+	move := func(pos recordPos) (recordPos, bool) {
+		if pos.offset < lo {
+			return pos, true
+		}
+		if pos.offset >= mergeEnd {
+			return recordPos{offset: pos.offset - mergeEnd + tailBase, size: pos.size}, true
+		}
+		moved, ok := remap[pos.offset]
+		return moved, ok
+	}
+
+	// 按当前索引计算新位置，拷贝期间被覆盖或删除的 key 以当前状态为准。
+	// 新索引要等数据文件替换后才能建立，HashedIndex 需要从新文件中核对 key。
+	// 被 keep 排除且拷贝期间没有重新写入的 key 不在新文件中，同时清掉它们的缓存。
+	// 拷贝期间覆盖这些 key 时旧记录已计入 deadBytes，Merge 后的统计会略微偏大
+	type moved struct {
+		key string
+		pos recordPos
+	}
+	live := make([]moved, 0, db.indexes.len())
+	var lost error
+	removed := 0
+	// 分段合并按范围内存活记录的变化修正统计，被拷贝的其余记录 (删除标记、保留期内的删除) 仍是失效数据
+	var liveBefore, liveAfter int64
+	countLive := func(pos, newPos recordPos) {
+		if partial && inSpan(pos) {
+			liveBefore += pos.size
+			liveAfter += newPos.size
+		}
+	}
+	db.indexes.each(func(key string, pos recordPos) {
+		newPos, ok := move(pos)
+		if _, drop := dropped[key]; drop && !ok {
+			db.cache.remove(key)
+			db.recent.remove(key)
+			removed++
+			return
+		}
+		if !ok && lost == nil {
+			lost = fmt.Errorf("merge: key %q at offset %d was not copied", key, pos.offset)
+		}
+		countLive(pos, newPos)
+		live = append(live, moved{key, newPos})
+	})
+	if lost == nil && len(live)+removed != db.indexes.len() {
+		lost = fmt.Errorf("merge: read %d of %d keys from index", len(live)+removed, db.indexes.len())
+	}
+	if lost != nil {
+		return lost
+	}
+	db.mergeMemory = int64(len(items)+len(live))*mergeItemBytes + int64(len(remap))*mergeRemapBytes +
+		int64(len(seen))*mergeSeenBytes + int64(len(buf))
+	newVersions := make(map[string][]recordPos, len(db.versions))
+	for key, versions := range db.versions {
+		_, drop := dropped[key]
+		for _, v := range versions {
+			newPos, ok := move(v)
+			if !ok && drop {
+				continue
+			}
+			if !ok {
+				return fmt.Errorf("merge: version of key %q at offset %d was not copied", key, v.offset)
+			}
+			countLive(v, newPos)
+			newVersions[key] = append(newVersions[key], newPos)
+		}
+	}
+
+	// 替换前确认 merge 文件 (或新分段) 的长度与记账一致，否则之后的写入位置和索引都会错位
+	if sw != nil {
+		if partial {
+			sw.trim()
+		}
+		err = sw.check(newOffset)
+	} else {
+		err = checkSize(mergeFile, newOffset)
+	}
+	if err != nil {
+		return err
+	}
+
+	// 删除标记只在还可能有更早的文件保存着该 key 的旧记录时才需要保留。Merge 重写全部数据，
+	// 按内存索引拷贝，被删除 key 的旧记录不会被拷贝，删除标记总是可以丢弃，
+	// 只有 DeleteGracePeriod 内需要 Undelete 的连同旧值一起保留
+	newDeleted := make(map[string]deletedPos, len(db.deleted))
+	var retained int64
+	var retainedTombs int
+	var retainedTombBytes int64
+	for key, d := range db.deleted {
+		if db.now().Sub(d.at) > db.opts.DeleteGracePeriod {
+			continue
+		}
+		pos, ok := move(d.pos)
+		tomb, tombOK := move(d.tomb)
+		if !ok || !tombOK {
+			continue
+		}
+		newDeleted[key] = deletedPos{pos: pos, tomb: tomb, at: d.at}
+		if d.tomb.offset < mergeEnd {
+			retained += pos.size + tomb.size
+			retainedTombs++
+			retainedTombBytes += tomb.size
+		}
+	}
+
+	// 先删除旧 hint，避免替换数据文件后崩溃留下指向旧文件的快照。
+	// merge 文件直接 rename 覆盖数据文件，任何时刻磁盘上都有一个完整的数据文件；
+	// rename 失败时旧句柄和索引都没有动过，merge 文件由上面的 defer 删除。
+	// 旧句柄在写锁内关闭：Get、GetRange 等读取在持有读锁期间完成，不会读到已关闭的句柄；
+	// 锁外使用句柄的只有持有 merging 标记的 Verify 和组提交的 fsync (epoch 变化后忽略旧句柄上的错误)。
+	// 分段存储改为把新清单写进 merge 文件后 rename 覆盖清单，旧分段在切换后关闭并删除
+	db.fs.Remove(db.names.hint)
+	if err := db.injectFault(fpMergeBeforeRename); err != nil {
+		return err
+	}
+	from, to := 0, 0
+	if sw != nil {
+		from, to = 0, len(seg.names())
+		if partial {
+			from, to = seg.span(lo, hi)
+		}
+		err = sw.commit(mergeFile, from, to)
+	} else {
+		err = db.fs.Rename(db.names.merge, db.names.data)
+	}
+	if err != nil {
+		return fmt.Errorf("merge: replace data file: %w", err)
+	}
+	swapped = true
+	if err := db.injectFault(fpMergeAfterRename); err != nil {
+		return err
+	}
+	if gc != nil {
+		if err := db.fs.Rename(db.names.vlogMerge, db.names.vlog); err != nil {
+			return fmt.Errorf("merge: replace value log: %w", err)
+		}
+	}
+
+	var newFile Storage
+	if sw == nil {
+		if newFile, err = db.fs.OpenFile(db.names.data, os.O_RDWR|os.O_APPEND); err != nil {
+			return err
+		}
+	}
+	if gc != nil {
+		newVlog, err := db.fs.OpenFile(db.names.vlog, os.O_RDWR|os.O_APPEND)
+		if err == nil {
+			if err = checkSize(newVlog, gc.offset); err != nil {
+				newVlog.Close()
+			}
+		}
+		if err != nil {
+			if newFile != nil {
+				newFile.Close()
+			}
+			return err
+		}
+		db.vlog.Close()
+		db.vlog, db.vlogOffset = newVlog, gc.offset
+	}
+	if sw != nil {
+		seg.header = sw.header
+		db.removeSegments(seg.replace(from, to, sw.parts, newOffset-mergeEnd))
+	} else {
+		db.file.Close()
+		db.file = newFile
+	}
+	db.indexes = db.newIndex(len(live))
+	for _, m := range live {
+		db.indexes.set(m.key, m.pos)
+	}
+	db.versions = newVersions
+	db.deleted = newDeleted
+	if partial {
+		// 范围之后的分段整体前移，活跃分段中还没有 fsync 的写入要先落盘，DurableOffset 才能直接取新的末尾
+		db.offset += newOffset - mergeEnd
+		if err := seg.Sync(); err != nil {
+			return err
+		}
+		db.resetSync(db.offset)
+		// 范围内除存活记录以外拷贝过的记录 (保留期内的删除、仍需保留的删除标记) 都是失效数据
+		copiedTombs, copiedTombBytes := 0, int64(0)
+		countTomb := func(pos recordPos) {
+			if inSpan(pos) {
+				copiedTombs++
+				copiedTombBytes += remap[pos.offset].size
+			}
+		}
+		for _, g := range graces {
+			countTomb(g.d.tomb)
+		}
+		for _, t := range tombs {
+			countTomb(t.pos)
+		}
+		db.deadBytes += (newOffset - lo - liveAfter) - (mergeEnd - lo - liveBefore)
+		db.tombstones += copiedTombs - span.tombstones
+		db.tombstoneBytes += copiedTombBytes - span.tombstoneBytes
+		db.deadEntries += len(remap) - span.entries
+	} else {
+		db.offset = newOffset
+		db.version = FormatVersion
+		// 新文件在替换前已经整体 fsync 过
+		db.resetSync(newOffset)
+		// 拷贝期间新产生的失效数据以及保留的已删除记录仍留在新文件中
+		db.deadBytes += retained - deadBefore
+		db.tombstones += retainedTombs - tombsBefore
+		db.tombstoneBytes += retainedTombBytes - tombBytesBefore
+		// 保留的每个删除都包括旧记录和删除标记两条
+		db.deadEntries += 2*retainedTombs - deadEntriesBefore
+	}
+	if err := checkSize(db.file, db.offset); err != nil {
+		return err
+	}
+
+	if err := db.writeHint(db.opts.StrictCheckpoint); err != nil {
+		log.Printf("Write hint file after merge failed: %v", err)
+	}
+
+	if removed > 0 {
+		log.Printf("Merge dropped %d keys rejected by the filter", removed)
+	}
+	log.Printf("Merge complete. Reclaimed space. New file size: %d, estimated memory: %d", db.offset, db.mergeMemory)
+	return nil
+}
+
+// mergeOutput 是 Merge 写出的目标: merge 文件或分段存储的一组新分段
+type mergeOutput interface {
+	Write(p []byte) (int, error)
+	Sync() error
+}
+
+// Merge 临时内存的估算参数，只用于 Stats 和 MergeMemoryLimit，不追求精确
+const (
+	mergeBufferSize    = 1 << 20 // 拷贝缓冲的默认大小
+	minMergeBufferSize = 4 << 10
+	mergeItemBytes     = 64 // 索引快照中每个 key 的条目，key 与索引共享底层数据
+	mergeRemapBytes    = 48 // remap 中每条记录的位置
+	mergeSeenBytes     = 96 // 去重表中每个 value 的哈希和引用
+)
+
+// mergeBuffer 按 MergeMemoryLimit 分配拷贝缓冲，另一半留给去重表
+func mergeBuffer(limit int64) []byte {
+	size := int64(mergeBufferSize)
+	if limit > 0 {
+		size = min(size, max(limit/2, minMergeBufferSize))
+	}
+	return make([]byte, size)
+}
+
+// recoverMerge 处理上次 Merge 中途崩溃留下的 merge 文件。
+// Merge 用 rename 直接覆盖数据文件，merge 文件还在说明崩溃发生在替换之前，直接删除；
+// 数据文件不存在只可能是旧版本先删除数据文件再 rename 时崩溃，merge 文件是仅剩的数据，补上 rename。
+// 新 value log 要在 merge 文件被删除之前处理。分段存储的 Merge 用 merge 文件 rename 覆盖清单，
+// merge 文件还在同样说明没有提交，写了一半的新分段由 openSegments 按编号清理
+func (db *MiniDB) recoverMerge() error {
+	if err := db.recoverValueLogMerge(); err != nil {
+		return err
+	}
+	if f, err := db.fs.OpenFile(db.names.segments, os.O_RDONLY); err == nil {
+		f.Close()
+		if err := db.fs.Remove(db.names.merge); err == nil {
+			log.Printf("Warn: Removing stale merge file %s left by an interrupted merge", db.names.merge)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	mergeFile, err := db.fs.OpenFile(db.names.merge, os.O_RDONLY)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mergeFile.Close()
+
+	dataFile, err := db.fs.OpenFile(db.names.data, os.O_RDONLY)
+	if err == nil {
+		dataFile.Close()
+		log.Printf("Warn: Removing stale merge file %s left by an interrupted merge", db.names.merge)
+		return db.fs.Remove(db.names.merge)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	log.Printf("Warn: Data file missing, finishing interrupted merge from %s", db.names.merge)
+	db.fs.Remove(db.names.hint)
+	return db.fs.Rename(db.names.merge, db.names.data)
+}
+
+// checkSize 确认 f 的长度等于 offset
+func checkSize(f Storage, offset int64) error {
+	size, err := f.Size()
+	if err != nil {
+		return err
+	}
+	if size != offset {
+		return fmt.Errorf("merge: file size %d does not match offset %d", size, offset)
+	}
+	return nil
+}
+
+// rateLimiter 按照固定速率对拷贝进行限速，超出配额时 sleep 补齐
+type rateLimiter struct {
+	rate  int64
+	start time.Time
+	total int64
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+func (l *rateLimiter) wait(n int) {
+	if l.rate <= 0 {
+		return
+	}
+	l.total += int64(n)
+	expected := time.Duration(float64(l.total) / float64(l.rate) * float64(time.Second))
+	if elapsed := time.Since(l.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+// SetMaintenanceMode 开启后 Put、Del、事务提交等所有写入返回 ErrMaintenanceMode，
+// Get、Scan 和 Merge 照常工作，用于迁移或受控 Merge 前短暂冻结写入。已经在执行的写入不受影响
+func (db *MiniDB) SetMaintenanceMode(on bool) {
+	db.maintMode.Store(on)
+}
+
+func (db *MiniDB) InMaintenanceMode() bool {
+	return db.maintMode.Load()
+}
+
+func (db *MiniDB) IsMerging() bool {
+	return db.merging.Load()
+}
+
+// MergePolicy 决定自动 Merge 在维护窗口内是否真的需要执行，以及分段存储中合并哪些分段
+type MergePolicy interface {
+	ShouldMerge(stats Stats) bool
+	// SelectSegments 从只读分段 (从旧到新，不含活跃分段) 中挑出要合并的连续分段，返回空表示这次不合并。
+	// 挑出的分段不连续时合并第一个到最后一个之间的全部分段。没有分段的库不调用它，总是整体 Merge
+	SelectSegments(segments []Segment) []Segment
+}
+
+// MergePolicyFunc 把普通函数适配成 MergePolicy，分段存储中合并所有只读分段
+type MergePolicyFunc func(stats Stats) bool
+
+func (f MergePolicyFunc) ShouldMerge(stats Stats) bool { return f(stats) }
+
+func (f MergePolicyFunc) SelectSegments(segments []Segment) []Segment { return segments }
+
+// DeadRatioPolicy 在无效数据的比例和字节数都达到阈值时才 Merge
+type DeadRatioPolicy struct {
+	MinDeadRatio float64
+	MinDeadBytes int64
+}
+
+func (p DeadRatioPolicy) ShouldMerge(stats Stats) bool {
+	return stats.DeadRatio >= p.MinDeadRatio && stats.DeadBytes >= p.MinDeadBytes
+}
+
+func (p DeadRatioPolicy) SelectSegments(segments []Segment) []Segment { return segments }
+
+// SizeTieredPolicy 是分段存储默认的合并策略: 按分段中存活数据的大小分层，
+// 相邻分段的存活数据之比不超过 SizeRatio 的算作同一层，连续至少 MinSegments 个时合并其中总大小最小的一组。
+// 小分段先合并成大分段，失效数据多的分段存活数据变小后也会落到低层被合并，不必每次重写全部数据。
+// 存活数据达到 MaxSegmentSize 的分段不再参与
+type SizeTieredPolicy struct {
+	MinSegments    int     // 默认 4
+	SizeRatio      float64 // 默认 2
+	MaxSegmentSize int64   // 0 表示不限
+}
+
+// ShouldMerge 总是返回 true，是否合并由 SelectSegments 决定
+func (p SizeTieredPolicy) ShouldMerge(Stats) bool { return true }
+
+func (p SizeTieredPolicy) SelectSegments(segments []Segment) []Segment {
+	minSegments, ratio := p.MinSegments, p.SizeRatio
+	if minSegments <= 0 {
+		minSegments = 4
+	}
+	if ratio < 1 {
+		ratio = 2
+	}
+	live := func(s Segment) float64 { return float64(max(s.Size-FileHeaderSize-s.DeadBytes, 1)) }
+	full := func(s Segment) bool { return p.MaxSegmentSize > 0 && live(s) >= float64(p.MaxSegmentSize) }
+	var best []Segment
+	var bestSize int64
+	for i := 0; i < len(segments); {
+		if full(segments[i]) {
+			i++
+			continue
+		}
+		j, size := i+1, segments[i].Size
+		for ; j < len(segments) && !full(segments[j]); j++ {
+			a, b := live(segments[j-1]), live(segments[j])
+			if max(a, b) > ratio*min(a, b) {
+				break
+			}
+			size += segments[j].Size
+		}
+		if j-i >= minSegments && (best == nil || size < bestSize) {
+			best, bestSize = segments[i:j], size
+		}
+		i = j
+	}
+	return best
+}
+
+// AgePolicy 只合并最新记录早于 MinAge 的只读分段，最近写入的热数据所在的分段不参与 Merge，
+// 适合新数据经常被覆盖、老数据很少再变的场景。挑选满足条件的最长一段连续分段，其中有失效数据时才合并
+type AgePolicy struct {
+	MinAge time.Duration
+}
+
+// ShouldMerge 总是返回 true，是否合并由 SelectSegments 决定
+func (p AgePolicy) ShouldMerge(Stats) bool { return true }
+
+func (p AgePolicy) SelectSegments(segments []Segment) []Segment {
+	cutoff := time.Now().Add(-p.MinAge)
+	old := func(s Segment) bool { return !s.Newest.IsZero() && s.Newest.Before(cutoff) }
+	var best []Segment
+	for i := 0; i < len(segments); {
+		j := i
+		for j < len(segments) && old(segments[j]) {
+			j++
+		}
+		if j-i > len(best) {
+			best = segments[i:j]
+		}
+		i = j + 1
+	}
+	for _, s := range best {
+		if s.DeadBytes > 0 {
+			return best
+		}
+	}
+	return nil
+}
+
+// autoMerge 按 AutoMergeInterval 定期在维护窗口内触发 Merge，
+// 并响应 noteDead 在失效记录达到 AutoMergeDeadCount 时发出的通知
+func (db *MiniDB) autoMerge() {
+	var tick <-chan time.Time
+	if db.opts.AutoMergeInterval > 0 {
+		ticker := time.NewTicker(db.opts.AutoMergeInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-tick:
+			db.maybeAutoMerge(false)
+		case <-db.mergeCh:
+			db.maybeAutoMerge(true)
+		}
+	}
+}
+
+// maybeAutoMerge 在维护窗口内执行 Merge。byCount 表示由失效记录条数触发，条数本身就是判断条件，不再询问 MergePolicy，
+// 直接整体 Merge；分段存储按定时触发时只合并 MergePolicy (默认 SizeTieredPolicy) 挑选的分段。
+// 窗口外被跳过的通知不会丢失，之后的每次覆盖或删除都会再次通知
+func (db *MiniDB) maybeAutoMerge(byCount bool) {
+	if !db.inMergeWindow(db.now()) {
+		return
+	}
+	p := db.opts.MergePolicy
+	if !byCount && p != nil && !p.ShouldMerge(db.Stats()) {
+		return
+	}
+	var err error
+	if byCount || !db.segmented() {
+		err = db.Merge()
+	} else {
+		if p == nil {
+			p = SizeTieredPolicy{MaxSegmentSize: db.opts.MaxSegmentSize}
+		}
+		err = db.mergeSegments(p)
+	}
+	if err != nil && !errors.Is(err, ErrMergeInProgress) {
+		log.Printf("Auto merge failed: %v", err)
+	}
+}
+
+// noteDead 记录 n 条新失效的记录，累计达到 AutoMergeDeadCount 时通知 autoMerge。调用方需持有写锁
+func (db *MiniDB) noteDead(n int) {
+	db.deadEntries += n
+	if limit := db.opts.AutoMergeDeadCount; limit <= 0 || db.deadEntries < limit {
+		return
+	}
+	select {
+	case db.mergeCh <- struct{}{}:
+	default:
+	}
+}
+
+func (db *MiniDB) inMergeWindow(t time.Time) bool {
+	start, end := db.opts.MergeWindowStart, db.opts.MergeWindowEnd
+	if start == end {
+		return true
+	}
+
+	y, m, d := t.Date()
+	elapsed := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	if start < end {
+		return elapsed >= start && elapsed < end
+	}
+	// 窗口跨越午夜，例如 22:00 - 02:00
+	return elapsed >= start || elapsed < end
+}
@@ -0,0 +1,74 @@
+package minidb
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestGetDuringMerge 在反复 Merge 切换数据文件的同时并发读写，任何读都不能失败
+func TestGetDuringMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"default", Options{}},
+		{"read cache", Options{CacheSize: 16}},
+		{"chunked", Options{ChunkSize: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.FilePrefix = filepath.Join(t.TempDir(), "minidb")
+			db, err := OpenWithOptions(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(db.Close)
+			for i := 0; i < 50; i++ {
+				if err := db.Put(fmt.Sprintf("k%d", i), fmt.Sprintf("value-%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var stop atomic.Bool
+			var wg sync.WaitGroup
+			for r := 0; r < 8; r++ {
+				wg.Add(1)
+				go func(r int) {
+					defer wg.Done()
+					for i := r; !stop.Load(); i++ {
+						k := fmt.Sprintf("k%d", i%50)
+						v, err := db.Get(k)
+						if err != nil || v != fmt.Sprintf("value-%d", i%50) {
+							t.Errorf("Get(%q) = %q, %v", k, v, err)
+							return
+						}
+					}
+				}(r)
+			}
+			// 写入方制造垃圾记录，让每次 Merge 都真正换掉文件
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; !stop.Load(); i++ {
+					if err := db.Put("churn", strings.Repeat("x", i%100)); err != nil {
+						t.Errorf("Put: %v", err)
+						return
+					}
+				}
+			}()
+
+			for i := 0; i < 20; i++ {
+				if err := db.Merge(); err != nil {
+					t.Errorf("Merge: %v", err)
+					break
+				}
+			}
+			stop.Store(true)
+			wg.Wait()
+		})
+	}
+}
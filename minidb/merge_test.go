@@ -0,0 +1,560 @@
+package minidb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failRenameFS 让 rename 总是失败，其余操作交给 OSFS
+type failRenameFS struct {
+	FileSystem
+}
+
+var errRename = errors.New("rename failed")
+
+func (failRenameFS) Rename(oldName, newName string) error {
+	return errRename
+}
+
+func TestMergeRenameFailureKeepsData(t *testing.T) {
+	db := openTestDB(t, Options{FS: failRenameFS{OSFS}})
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("k%d", i%3), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := db.offset
+
+	if err := db.Merge(); !errors.Is(err, errRename) {
+		t.Fatalf("Merge = %v, want the rename error", err)
+	}
+	if db.offset != before {
+		t.Fatalf("offset = %d after failed merge, want %d", db.offset, before)
+	}
+	if err := db.Put("k3", "new"); err != nil {
+		t.Fatalf("Put after failed merge: %v", err)
+	}
+
+	db = reopen(t, db)
+	want := map[string]string{"k0": "9", "k1": "7", "k2": "8", "k3": "new"}
+	for k, v := range want {
+		if got, err := db.Get(k); err != nil || got != v {
+			t.Fatalf("Get(%q) = %q, %v, want %q", k, got, err, v)
+		}
+	}
+}
+
+func TestTryMergeClaimsSynchronously(t *testing.T) {
+	db := openTestDB(t, Options{})
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 持有写锁让后台 Merge 停在切换文件之前
+	db.mu.Lock()
+	done, err := db.TryMerge()
+	if err != nil {
+		db.mu.Unlock()
+		t.Fatal(err)
+	}
+	_, err2 := db.TryMerge()
+	err3 := db.Merge()
+	db.mu.Unlock()
+
+	if !errors.Is(err2, ErrMergeInProgress) || !errors.Is(err3, ErrMergeInProgress) {
+		t.Fatalf("concurrent merges = %v, %v, want ErrMergeInProgress", err2, err3)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("background merge: %v", err)
+	}
+	if v, err := db.Get("a"); err != nil || v != "1" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+}
+
+func TestMergeRateLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		rate int64 // bytes/sec，0 表示不限速
+	}{
+		{"unlimited", 0},
+		{"256KB/s", 256 << 10},
+		{"1MB/s", 1 << 20},
+	}
+	value := strings.Repeat("v", 4<<10)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, Options{MergeRateLimit: tt.rate})
+			for i := 0; i < 32; i++ {
+				if err := db.Put(fmt.Sprintf("k%d", i), value); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			start := time.Now()
+			if err := db.Merge(); err != nil {
+				t.Fatal(err)
+			}
+			elapsed := time.Since(start)
+			if tt.rate == 0 {
+				return
+			}
+			copied := db.offset - FileHeaderSize
+			if want := time.Duration(float64(copied) / float64(tt.rate) * float64(time.Second)); elapsed < want*9/10 {
+				t.Fatalf("merge of %d bytes took %v, want at least %v", copied, elapsed, want)
+			}
+		})
+	}
+}
+
+func TestMergeTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"raw copy", Options{}},
+		// 去重改写的记录不经过按块拷贝的循环，也要检查超时
+		{"dedup", Options{DedupThreshold: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.MergeTimeout = time.Nanosecond
+			db := openTestDB(t, tt.opts)
+			for i := 0; i < 100; i++ {
+				if err := db.Put(fmt.Sprintf("k%d", i), strings.Repeat("v", 64)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before := db.offset
+			if err := db.Merge(); !errors.Is(err, ErrMergeTimeout) {
+				t.Fatalf("Merge = %v, want ErrMergeTimeout", err)
+			}
+			if db.offset != before {
+				t.Fatalf("offset = %d after timed out merge, want %d", db.offset, before)
+			}
+			db = reopen(t, db)
+			if v, err := db.Get("k99"); err != nil || v != strings.Repeat("v", 64) {
+				t.Fatalf("Get = %q, %v", v, err)
+			}
+		})
+	}
+}
+
+func TestMergeWindow(t *testing.T) {
+	at := func(hour int) func() time.Time {
+		return func() time.Time { return time.Date(2024, 5, 1, hour, 30, 0, 0, time.Local) }
+	}
+	tests := []struct {
+		name       string
+		start, end time.Duration
+		hour       int
+		merged     bool
+	}{
+		{"always", 0, 0, 14, true},
+		{"inside", 2 * time.Hour, 4 * time.Hour, 3, true},
+		{"before", 2 * time.Hour, 4 * time.Hour, 1, false},
+		{"after", 2 * time.Hour, 4 * time.Hour, 4, false},
+		{"across midnight late", 22 * time.Hour, 2 * time.Hour, 23, true},
+		{"across midnight early", 22 * time.Hour, 2 * time.Hour, 1, true},
+		{"across midnight outside", 22 * time.Hour, 2 * time.Hour, 12, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, Options{MergeWindowStart: tt.start, MergeWindowEnd: tt.end})
+			db.now = at(tt.hour)
+			for i := 0; i < 10; i++ {
+				if err := db.Put("k", fmt.Sprint(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db.maybeAutoMerge(false)
+			if merged := db.Stats().DeadBytes == 0; merged != tt.merged {
+				t.Fatalf("merged at %02d:30 = %v, want %v", tt.hour, merged, tt.merged)
+			}
+		})
+	}
+}
+
+func TestSortedMerge(t *testing.T) {
+	reverse := func(a, b string) int { return strings.Compare(b, a) }
+	for _, cmp := range []func(a, b string) int{nil, reverse} {
+		var files [][]byte
+		// 同样的记录以两种顺序写入，Merge 后的文件应当完全相同
+		for _, order := range [][]int{{3, 0, 4, 1, 2}, {2, 4, 1, 0, 3}} {
+			db := openTestDB(t, Options{SortedMerge: true, KeyComparator: cmp})
+			for _, i := range order {
+				e := NewEntry([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+				e.Timestamp = 1700000000
+				if err := db.AppendRaw(e.EncodeOrder(db.order)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Merge(); err != nil {
+				t.Fatal(err)
+			}
+			entries, _, err := db.Entries(0, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, e := range entries {
+				keys = append(keys, e.Key)
+			}
+			want := []string{"k0", "k1", "k2", "k3", "k4"}
+			if cmp != nil {
+				want = []string{"k4", "k3", "k2", "k1", "k0"}
+			}
+			if fmt.Sprint(keys) != fmt.Sprint(want) {
+				t.Fatalf("merged entries = %v, want %v", keys, want)
+			}
+			data, err := os.ReadFile(db.names.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, data)
+		}
+		if !bytes.Equal(files[0], files[1]) {
+			t.Fatal("merged files differ with insertion order")
+		}
+	}
+}
+
+func TestMergeReadErrorIsReported(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		valueLog bool // 在 value log 中注入读错误
+	}{
+		{"raw copy", Options{}, false},
+		{"sorted", Options{SortedMerge: true}, false},
+		{"dedup", Options{DedupThreshold: 4}, false},
+		{"value log gc", Options{ValueLogThreshold: 4}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &faultFS{FileSystem: NewMemFS(), badOffset: -1}
+			tt.opts.FS, tt.opts.FilePrefix = fs, "fault/"+DefaultFilePrefix
+			db := openTestDB(t, tt.opts)
+			fs.name = db.names.data
+			if tt.valueLog {
+				fs.name = db.names.vlog
+			}
+			db = reopen(t, db)
+			want := make(map[string]string)
+			for i := 0; i < 20; i++ {
+				key := fmt.Sprintf("k%d", i%10)
+				want[key] = fmt.Sprintf("value-%02d", i)
+				if err := db.Put(key, want[key]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// 故障位于 k5 最新记录的 value 中 (value log 中为第 16 条记录)
+			info, err := db.KeyInfo("k5")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bad := info.Offset + info.Size - 1
+			if tt.valueLog {
+				bad = 16*int64(HeaderSize+len("k5")+len("value-15")) - 1
+			}
+			fs.set(bad, false)
+			if err := db.Merge(); !errors.Is(err, errFault) {
+				t.Fatalf("Merge = %v, want the injected read error", err)
+			}
+			fs.set(-1, false)
+			for k, v := range want {
+				if got, err := db.Get(k); err != nil || got != v {
+					t.Fatalf("Get(%q) after failed merge = %q, %v, want %q", k, got, err, v)
+				}
+			}
+			if err := db.Merge(); err != nil {
+				t.Fatal(err)
+			}
+			db = reopen(t, db)
+			if got := dump(t, db); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("after merge = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestOffsetConsistentAcrossMerges(t *testing.T) {
+	for _, opts := range []Options{{}, {ValueLogThreshold: 8}} {
+		// 每次写入都核对文件长度，偏移一旦与文件不一致写入就会返回 ErrStateDivergence
+		opts.OffsetCheckInterval = 1
+		db := openTestDB(t, opts)
+
+		const writers = 4
+		var wg sync.WaitGroup
+		var stop atomic.Bool
+		last := make([]map[string]string, writers)
+		errs := make(chan error, writers)
+		for w := 0; w < writers; w++ {
+			last[w] = make(map[string]string)
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; !stop.Load(); i++ {
+					key, value := fmt.Sprintf("w%d-k%d", w, i%10), fmt.Sprintf("value-%d-%d", w, i)
+					if err := db.Put(key, value); err != nil {
+						errs <- err
+						return
+					}
+					last[w][key] = value
+				}
+			}(w)
+		}
+		for i := 0; i < 20; i++ {
+			if err := db.Merge(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stop.Store(true)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("Put during merges: %v", err)
+		}
+
+		if size, err := db.file.Size(); err != nil || size != db.offset {
+			t.Fatalf("data file is %d bytes, offset %d, %v", size, db.offset, err)
+		}
+		if db.vlog != nil {
+			if size, err := db.vlog.Size(); err != nil || size != db.vlogOffset {
+				t.Fatalf("value log is %d bytes, offset %d, %v", size, db.vlogOffset, err)
+			}
+		}
+		db = reopen(t, db)
+		for _, m := range last {
+			for k, v := range m {
+				if got, err := db.Get(k); err != nil || got != v {
+					t.Fatalf("Get(%q) = %q, %v, want %q", k, got, err, v)
+				}
+			}
+		}
+	}
+}
+
+func TestOpenCleansUpPartialMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		// leave 在关闭的数据库目录里制造崩溃现场，data 是数据文件的内容
+		leave func(t *testing.T, db *MiniDB, data []byte)
+	}{
+		{"partial merge file", func(t *testing.T, db *MiniDB, data []byte) {
+			// 写到一半的 merge 文件: 完整的文件头加上半条记录
+			if err := os.WriteFile(db.names.merge, data[:FileHeaderSize+HeaderSize/2], 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"complete merge file", func(t *testing.T, db *MiniDB, data []byte) {
+			// 替换前崩溃时 merge 文件即使已经写完也不采用，数据文件仍是完整的
+			if err := os.WriteFile(db.names.merge, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"data file missing", func(t *testing.T, db *MiniDB, data []byte) {
+			if err := os.Rename(db.names.data, db.names.merge); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, Options{})
+			for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}} {
+				if err := db.Put(kv[0], kv[1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := db.opts
+			db.Close()
+			data, err := os.ReadFile(db.names.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.leave(t, db, data)
+			want := map[string]string{"a": "2", "b": "1"}
+
+			db = openTestDB(t, opts)
+			if _, err := os.Stat(db.names.merge); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("merge file still present after Open: %v", err)
+			}
+			if got := dump(t, db); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("state after Open = %v, want %v", got, want)
+			}
+			if db.corruptRecords != 0 {
+				t.Fatalf("%d corrupted records after Open", db.corruptRecords)
+			}
+			// 之后的 Merge 不受残留文件影响
+			if err := db.Merge(); err != nil {
+				t.Fatal(err)
+			}
+			if got := dump(t, reopen(t, db)); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("state after Merge = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMergeMemoryLimit(t *testing.T) {
+	const limit = 256 << 10
+	big := strings.Repeat("b", 32<<20)
+
+	t.Run("large value", func(t *testing.T) {
+		db := openTestDB(t, Options{MergeMemoryLimit: limit})
+		for _, v := range []string{"old", big} {
+			if err := db.Put("big", v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Put("small", "v"); err != nil {
+			t.Fatal(err)
+		}
+		// 32MB 的记录按缓冲分段拷贝，Merge 期间的总分配远小于 value 本身
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		runtime.ReadMemStats(&after)
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 8<<20 {
+			t.Fatalf("merge of a 32MB value allocated %d bytes under a %d byte limit", alloc, limit)
+		}
+		if m := db.Stats().MergeMemoryBytes; m > limit {
+			t.Fatalf("estimated merge memory %d exceeds the %d byte limit", m, limit)
+		}
+		if v, err := db.Get("big"); err != nil || v != big {
+			t.Fatalf("Get(big) after merge = %d bytes, %v", len(v), err)
+		}
+	})
+
+	t.Run("dedup table", func(t *testing.T) {
+		// 各不相同的 value 会让去重表一直增长，超过上限后不再记录新的 value
+		db := openTestDB(t, Options{MergeMemoryLimit: 64 << 10, DedupThreshold: 16})
+		want := make(map[string]string)
+		for i := 0; i < 5000; i++ {
+			k, v := fmt.Sprintf("k%d", i), fmt.Sprintf("distinct-value-%08d", i)
+			want[k] = v
+			if err := db.Put(k, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		// 索引快照和位置映射与 key 数量成正比，不受上限约束，其余部分不能超出上限
+		m := db.Stats().MergeMemoryBytes - int64(2*len(want))*mergeItemBytes - int64(len(want))*mergeRemapBytes
+		if m > 64<<10 {
+			t.Fatalf("copy buffer and dedup table estimated at %d bytes, limit %d", m, 64<<10)
+		}
+		if got := dump(t, reopen(t, db)); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatal("data changed by a memory-limited dedup merge")
+		}
+	})
+}
+
+// TestAutoMergeDeadCount 大量小 value 的覆盖写让失效字节占比很低，但失效条数达到 AutoMergeDeadCount 时仍会触发 Merge，
+// 且不经过 MergePolicy
+func TestAutoMergeDeadCount(t *testing.T) {
+	const limit = 50
+	never := MergePolicyFunc(func(Stats) bool { return false })
+	db := openTestDB(t, Options{AutoMergeDeadCount: limit, MergePolicy: never})
+	if err := db.Put("big", strings.Repeat("b", 64<<10)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < limit; i++ {
+		if err := db.Put("k", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 第一次写入 k 不算失效，此时还差一条
+	if s := db.Stats(); s.DeadEntries != limit-1 {
+		t.Fatalf("DeadEntries = %d, want %d", s.DeadEntries, limit-1)
+	}
+	// 失效条数随提示文件保留，重新打开后不会从零开始计数
+	db = reopen(t, db)
+	if s := db.Stats(); s.DeadEntries != limit-1 {
+		t.Fatalf("DeadEntries after reopen = %d, want %d", s.DeadEntries, limit-1)
+	}
+	before := db.Stats().FileSize
+	if err := db.Put("k", "last"); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.Stats().DeadEntries != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("no merge after %d dead entries: %+v", limit, db.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := db.Stats(); s.DeadBytes != 0 || s.FileSize >= before {
+		t.Fatalf("stats after auto merge = %+v, offset was %d", s, before)
+	}
+	if v, err := db.Get("k"); err != nil || v != "last" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+}
+
+// TestMergeFilter 只保留 keep 接受的 key，丢弃的 key 重新打开后也不会从旧记录中复活；
+// 拷贝期间重新写入的被丢弃 key 保留
+func TestMergeFilter(t *testing.T) {
+	for _, opts := range []Options{{}, {HashedIndex: true}, {SortedMerge: true}} {
+		fs := &syncHookFS{FileSystem: OSFS}
+		opts.FS = fs
+		db := openTestDB(t, opts)
+		fs.name = db.names.merge
+		want := make(map[string]string)
+		for i := 0; i < 20; i++ {
+			for _, prefix := range []string{"keep:", "tmp:"} {
+				key := fmt.Sprintf("%s%d", prefix, i)
+				for v := 0; v < 3; v++ {
+					if err := db.Put(key, fmt.Sprint(v)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if prefix == "keep:" {
+					want[key] = "2"
+				}
+			}
+		}
+		if _, err := db.Get("tmp:0"); err != nil {
+			t.Fatal(err)
+		}
+		fs.hook = func() {
+			if err := db.Put("tmp:during", "d"); err != nil {
+				t.Error(err)
+			}
+		}
+		want["tmp:during"] = "d"
+
+		keep := func(key string) bool { return strings.HasPrefix(key, "keep:") }
+		if err := db.MergeFilter(keep); err != nil {
+			t.Fatal(err)
+		}
+		if fs.hook != nil {
+			t.Fatal("merge file was never synced")
+		}
+		for _, reload := range []bool{false, true} {
+			if reload {
+				db = reopen(t, db)
+			}
+			if got := dump(t, db); !maps.Equal(got, want) {
+				t.Fatalf("%+v reload=%v: %v, want %v", opts, reload, got, want)
+			}
+			// 被缓存过的 key 也必须查不到
+			if v, err := db.Get("tmp:0"); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("%+v reload=%v: Get(tmp:0) = %q, %v", opts, reload, v, err)
+			}
+		}
+	}
+}
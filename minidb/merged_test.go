@@ -0,0 +1,100 @@
+package minidb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeDB 在 dir 下建一个库，依次执行 puts 后关闭，返回数据文件路径
+func writeDB(t *testing.T, dir string, opts Options, puts []KV) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	opts.FilePrefix = filepath.Join(dir, DefaultFilePrefix)
+	db := openTestDB(t, opts)
+	if err := db.PutBatch(puts); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	return filepath.Join(dir, DBFileName)
+}
+
+func TestOpenMergedNewestWins(t *testing.T) {
+	dir := t.TempDir()
+	seq := Options{Sequence: true}
+	// older 只写了一次 k，newer 写了更多次，k 的序号更大
+	older := writeDB(t, filepath.Join(dir, "older"), seq, []KV{{"k", "old"}, {"a", "1"}})
+	newer := writeDB(t, filepath.Join(dir, "newer"), seq, []KV{{"b", "2"}, {"c", "3"}, {"k", "new"}})
+
+	tests := []struct {
+		name  string
+		paths []string
+	}{
+		{"newer listed last", []string{older, newer}},
+		{"newer listed first", []string{newer, older}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			view, err := OpenMerged(tt.paths...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer view.Close()
+			for k, want := range map[string]string{"k": "new", "a": "1", "b": "2", "c": "3"} {
+				if v, err := view.Get(k); err != nil || v != want {
+					t.Errorf("Get(%q) = %q, %v, want %q", k, v, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenMergedValueLogs(t *testing.T) {
+	t.Chdir(t.TempDir())
+	opts := Options{ValueLogThreshold: 4}
+	// 当前目录下的库和两个输入的 value 长度相同，引用指向各自 value log 中相同的位置
+	writeDB(t, ".", opts, []KV{{"a", strings.Repeat("L", 64)}, {"b", strings.Repeat("L", 64)}})
+	first := writeDB(t, "first", opts, []KV{{"a", strings.Repeat("A", 64)}})
+	second := writeDB(t, "second", opts, []KV{{"b", strings.Repeat("B", 64)}})
+	data, err := os.ReadFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lone := filepath.Join("lone", DBFileName)
+	os.Mkdir("lone", 0755)
+	if err := os.WriteFile(lone, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		paths   []string
+		key     string
+		want    string
+		wantErr error
+	}{
+		{name: "first file", paths: []string{first, second}, key: "a", want: strings.Repeat("A", 64)},
+		{name: "second file", paths: []string{first, second}, key: "b", want: strings.Repeat("B", 64)},
+		{name: "missing value log", paths: []string{first, lone}, key: "b", wantErr: ErrValueLogMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			view, err := OpenMerged(tt.paths...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer view.Close()
+			if v, err := view.Get(tt.key); !errors.Is(err, tt.wantErr) || v != tt.want {
+				t.Fatalf("Get = %q, %v, want %q, %v", v, err, tt.want, tt.wantErr)
+			}
+			got, err := view.GetRange(tt.key, 0, 8)
+			if !errors.Is(err, tt.wantErr) || string(got) != tt.want[:min(8, len(tt.want))] {
+				t.Fatalf("GetRange = %q, %v", got, err)
+			}
+		})
+	}
+}
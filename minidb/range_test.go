@@ -0,0 +1,56 @@
+package minidb
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestGetRange(t *testing.T) {
+	tests := []struct {
+		name        string
+		off, length int64
+		want        string
+		wantErr     error
+	}{
+		{name: "middle", off: 2, length: 3, want: "234"},
+		{name: "past end is cut", off: 8, length: 10, want: "89"},
+		{name: "at end", off: 10, length: 1, want: ""},
+		{name: "beyond end", off: 11, length: 1, wantErr: ErrInvalidRange},
+		{name: "negative", off: -1, length: 1, wantErr: ErrInvalidRange},
+	}
+	for _, chunk := range []int{0, 4} {
+		db := openTestDB(t, Options{ChunkSize: chunk})
+		if err := db.Put("k", "0123456789"); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			got, err := db.GetRange("k", tt.off, tt.length)
+			if !errors.Is(err, tt.wantErr) || string(got) != tt.want {
+				t.Errorf("chunk %d %s: GetRange = %q, %v, want %q, %v", chunk, tt.name, got, err, tt.want, tt.wantErr)
+			}
+		}
+	}
+}
+
+func TestGetRangeCorruptLength(t *testing.T) {
+	db := openTestDB(t, Options{})
+	if err := db.Put("k", "0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(db.names.data, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte{0x7F, 0xFF, 0xFF, 0xFF}, FileHeaderSize+12); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.GetRange("k", 0, 1<<40); !errors.Is(err, ErrDataCorrupted) {
+		t.Fatalf("GetRange = %v, want ErrDataCorrupted", err)
+	}
+	if _, err := db.ValueSize("k"); !errors.Is(err, ErrDataCorrupted) {
+		t.Fatalf("ValueSize = %v, want ErrDataCorrupted", err)
+	}
+}
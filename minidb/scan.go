@@ -0,0 +1,218 @@
+package minidb
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==========================================
+// 8. 范围扫描 (Scan)
+// ==========================================
+
+// Scan 按 key 的顺序 (默认字典序，见 Options.KeyComparator) 返回以 prefix 开头、且排在游标 after 之后的最多 limit 个 key。
+// after 为空表示从头开始，next 为下一页的游标，没有更多数据时为空。服务端不保存任何分页状态。
+// 有序的 key 列表由 orderedIndex 维护，每页只需二分查找游标；HashedIndex 不在内存中保存 key，每页都要遍历并排序
+func (db *MiniDB) Scan(prefix, after string, limit int) (keys []string, next string, err error) {
+	if err := db.enter(); err != nil {
+		return nil, "", err
+	}
+	defer db.inflight.Done()
+
+	db.mu.RLock()
+	var matched []string
+	if o, ok := db.indexes.(*orderedIndex); ok {
+		// 多取一个 key 判断是否还有下一页，limit 为 0 时不限制
+		n := limit
+		if n > 0 {
+			n++
+		}
+		matched = o.page(prefix, after, n)
+	} else {
+		matched = make([]string, 0)
+		db.indexes.each(func(key string, _ recordPos) {
+			if strings.HasPrefix(key, prefix) && (after == "" || db.compareKeys(key, after) > 0) {
+				matched = append(matched, key)
+			}
+		})
+		db.sortKeys(matched)
+	}
+	db.mu.RUnlock()
+
+	if limit > 0 && len(matched) > limit {
+		matched = matched[:limit]
+		next = matched[limit-1]
+	}
+	return matched, next, nil
+}
+
+// ChangedSince 返回最新记录的写入时间晚于 ts 的所有 key，按 key 的顺序排列，用于增量同步。
+// 需要逐个读取记录头，代价与 key 的数量成正比。时间戳精度为秒
+func (db *MiniDB) ChangedSince(ts time.Time) ([]string, error) {
+	if err := db.enter(); err != nil {
+		return nil, err
+	}
+	defer db.inflight.Done()
+	if err := db.settleCounters(); err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var keys []string
+	var firstErr error
+	header := make([]byte, HeaderSize)
+	db.indexes.each(func(key string, pos recordPos) {
+		if firstErr != nil {
+			return
+		}
+		if _, err := db.file.ReadAt(header, pos.offset); err != nil {
+			firstErr = err
+			return
+		}
+		if _, written, _, _, _ := DecodeHeaderOrder(header, db.order); int64(written) > ts.Unix() {
+			keys = append(keys, key)
+		}
+	})
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	db.sortKeys(keys)
+	return keys, nil
+}
+
+// compareKeys 按 Options.KeyComparator 比较两个 key，没有设置时按字节序
+func (db *MiniDB) compareKeys(a, b string) int {
+	if db.opts.KeyComparator != nil {
+		return db.opts.KeyComparator(a, b)
+	}
+	return strings.Compare(a, b)
+}
+
+func (db *MiniDB) sortKeys(keys []string) {
+	if db.opts.KeyComparator == nil {
+		sort.Strings(keys)
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool { return db.opts.KeyComparator(keys[i], keys[j]) < 0 })
+}
+
+// orderedIndex 在索引外面维护 Scan 使用的有序 key 列表。写入时只把新 key 记进 added、
+// 删除的 key 记进 removed，下一次 Scan 时把新 key 排序后与已有列表归并，不需要每页对全部 key 重新排序。
+// 列表与索引共享 key 的字符串，每个 key 只多一个 string 头
+type orderedIndex struct {
+	index
+	compare  func(a, b string) int
+	bytewise bool // 按字节序排列，同一前缀的 key 连续
+
+	mu      sync.Mutex // Scan 只持有 db.mu 的读锁，并发的 Scan 都可能归并
+	keys    []string
+	added   map[string]struct{}
+	removed map[string]struct{} // 只包含 keys 中的 key
+}
+
+// newOrderedIndex 按 comparator 排序，nil 表示按字节序
+func newOrderedIndex(idx index, comparator func(a, b string) int) *orderedIndex {
+	o := &orderedIndex{
+		index:    idx,
+		compare:  comparator,
+		bytewise: comparator == nil,
+		added:    make(map[string]struct{}),
+		removed:  make(map[string]struct{}),
+	}
+	if o.bytewise {
+		o.compare = strings.Compare
+	}
+	return o
+}
+
+func (o *orderedIndex) set(key string, pos recordPos) (recordPos, bool) {
+	old, replaced := o.index.set(key, pos)
+	if !replaced {
+		o.mu.Lock()
+		o.added[key] = struct{}{}
+		o.mu.Unlock()
+	}
+	return old, replaced
+}
+
+func (o *orderedIndex) remove(key string) (recordPos, bool) {
+	old, removed := o.index.remove(key)
+	if removed {
+		o.mu.Lock()
+		delete(o.added, key)
+		if i := o.search(key); i < len(o.keys) && o.keys[i] == key {
+			o.removed[key] = struct{}{}
+		}
+		o.mu.Unlock()
+	}
+	return old, removed
+}
+
+func (o *orderedIndex) memoryBytes() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.index.memoryBytes() + int64(cap(o.keys)+len(o.added))*16
+}
+
+// search 返回 keys 中第一个不小于 key 的下标。调用方需持有 o.mu
+func (o *orderedIndex) search(key string) int {
+	return sort.Search(len(o.keys), func(i int) bool { return o.compare(o.keys[i], key) >= 0 })
+}
+
+// flush 把 added 和 removed 归并进 keys。调用方需持有 o.mu
+func (o *orderedIndex) flush() {
+	if len(o.added) == 0 && len(o.removed) == 0 {
+		return
+	}
+	added := make([]string, 0, len(o.added))
+	for key := range o.added {
+		added = append(added, key)
+	}
+	sort.Slice(added, func(i, j int) bool { return o.compare(added[i], added[j]) < 0 })
+
+	merged := make([]string, 0, len(o.keys)-len(o.removed)+len(added))
+	i := 0
+	for _, key := range o.keys {
+		if _, ok := o.removed[key]; ok {
+			continue
+		}
+		for ; i < len(added) && o.compare(added[i], key) < 0; i++ {
+			merged = append(merged, added[i])
+		}
+		merged = append(merged, key)
+	}
+	o.keys = append(merged, added[i:]...)
+	clear(o.added)
+	clear(o.removed)
+}
+
+// page 返回以 prefix 开头、排在 after 之后的最多 limit 个 key，limit <= 0 表示不限制
+func (o *orderedIndex) page(prefix, after string, limit int) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.flush()
+
+	start := 0
+	if after != "" {
+		start = sort.Search(len(o.keys), func(i int) bool { return o.compare(o.keys[i], after) > 0 })
+	}
+	// 按字节序时同一前缀的 key 连续排列，可以直接跳到前缀开始处，离开前缀后结束
+	if o.bytewise {
+		start = max(start, o.search(prefix))
+	}
+	keys := make([]string, 0)
+	for _, key := range o.keys[start:] {
+		if limit > 0 && len(keys) == limit {
+			break
+		}
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		} else if o.bytewise {
+			break
+		}
+	}
+	return keys
+}
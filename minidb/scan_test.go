@@ -0,0 +1,202 @@
+package minidb
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scanAll 用 Scan 逐页取出 prefix 下的所有 key
+func scanAll(t testing.TB, db *MiniDB, prefix string, limit int) []string {
+	t.Helper()
+	var all []string
+	after := ""
+	for {
+		keys, next, err := db.Scan(prefix, after, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, keys...)
+		if next == "" {
+			return all
+		}
+		after = next
+	}
+}
+
+func TestScanPagesMatchSortedKeys(t *testing.T) {
+	numeric := func(a, b string) int {
+		x, _ := strconv.Atoi(strings.TrimLeft(a, "ab"))
+		y, _ := strconv.Atoi(strings.TrimLeft(b, "ab"))
+		if x != y {
+			return x - y
+		}
+		return strings.Compare(a, b)
+	}
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"bytewise", Options{}},
+		{"comparator", Options{KeyComparator: numeric}},
+		{"hashed index", Options{HashedIndex: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, tt.opts)
+			rng := rand.New(rand.NewSource(1))
+			live := make(map[string]bool)
+			// 每轮写入和删除之间都翻页扫描一次，覆盖归并新 key、删除后重新写入等情况
+			for round := 0; round < 20; round++ {
+				for i := 0; i < 50; i++ {
+					key := fmt.Sprintf("%c%d", "ab"[rng.Intn(2)], rng.Intn(200))
+					if rng.Intn(3) == 0 {
+						if err := db.Del(key); err != nil {
+							t.Fatal(err)
+						}
+						delete(live, key)
+						continue
+					}
+					if err := db.Put(key, "v"); err != nil {
+						t.Fatal(err)
+					}
+					live[key] = true
+				}
+				for _, prefix := range []string{"", "a", "b1"} {
+					var want []string
+					for key := range live {
+						if strings.HasPrefix(key, prefix) {
+							want = append(want, key)
+						}
+					}
+					db.sortKeys(want)
+					if got := scanAll(t, db, prefix, 7); !slices.Equal(got, want) {
+						t.Fatalf("round %d prefix %q: Scan = %v, want %v", round, prefix, got, want)
+					}
+					// limit 为 0 时一次返回全部
+					if got, next, err := db.Scan(prefix, "", 0); err != nil || next != "" || !slices.Equal(got, want) {
+						t.Fatalf("round %d prefix %q: unlimited Scan = %v, %q, %v, want %v", round, prefix, got, next, err, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkScanPages 逐页扫描 10 万个 key，每页 100 个
+func BenchmarkScanPages(b *testing.B) {
+	db := openTestDB(b, Options{})
+	kvs := make([]KV, 100000)
+	for i := range kvs {
+		kvs[i] = KV{Key: fmt.Sprintf("key%06d", i), Value: "v"}
+	}
+	if err := db.PutBatch(kvs); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if n := len(scanAll(b, db, "", 100)); n != len(kvs) {
+			b.Fatalf("scanned %d keys", n)
+		}
+	}
+}
+
+func TestChangedSince(t *testing.T) {
+	db := openTestDB(t, Options{})
+	base := time.Unix(1700000000, 0)
+	write := func(key string, minute int) {
+		t.Helper()
+		e := NewEntry([]byte(key), []byte("v"))
+		e.Timestamp = uint32(base.Add(time.Duration(minute) * time.Minute).Unix())
+		if err := db.AppendRaw(e.EncodeOrder(db.order)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("c", 1)
+	write("a", 2)
+	write("b", 3)
+	write("d", 4)
+	write("a", 5) // 覆盖后按最新记录的时间
+	write("e", 6)
+	if err := db.Del("e"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		minute int
+		want   []string
+	}{
+		{0, []string{"a", "b", "c", "d"}},
+		{1, []string{"a", "b", "d"}},
+		{3, []string{"a", "d"}},
+		{4, []string{"a"}},
+		{5, nil},
+	}
+	for _, stage := range []string{"written", "merged", "reopened"} {
+		switch stage {
+		case "merged":
+			if err := db.Merge(); err != nil {
+				t.Fatal(err)
+			}
+		case "reopened":
+			db = reopen(t, db)
+		}
+		for _, tt := range tests {
+			got, err := db.ChangedSince(base.Add(time.Duration(tt.minute) * time.Minute))
+			if err != nil || !slices.Equal(got, tt.want) {
+				t.Fatalf("%s: ChangedSince(+%dm) = %v, %v, want %v", stage, tt.minute, got, err, tt.want)
+			}
+		}
+	}
+}
+
+// TestKeyComparatorNumeric 按数值比较时 "2" 排在 "10" 前面，Scan 分页、ChangedSince 和 SortedMerge 的输出都遵循同一顺序
+func TestKeyComparatorNumeric(t *testing.T) {
+	numeric := func(a, b string) int {
+		x, _ := strconv.Atoi(a)
+		y, _ := strconv.Atoi(b)
+		return x - y
+	}
+	db := openTestDB(t, Options{KeyComparator: numeric, SortedMerge: true})
+	for _, k := range []string{"10", "2", "100", "1", "20", "3"} {
+		if err := db.Put(k, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"1", "2", "3", "10", "20", "100"}
+	for _, stage := range []string{"written", "merged", "reopened"} {
+		switch stage {
+		case "merged":
+			if err := db.Merge(); err != nil {
+				t.Fatal(err)
+			}
+			entries, _, err := db.Entries(0, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, e := range entries {
+				keys = append(keys, e.Key)
+			}
+			if !slices.Equal(keys, want) {
+				t.Fatalf("merged file order = %v, want %v", keys, want)
+			}
+		case "reopened":
+			db = reopen(t, db)
+		}
+		if got := scanAll(t, db, "", 4); !slices.Equal(got, want) {
+			t.Fatalf("%s: Scan = %v, want %v", stage, got, want)
+		}
+		// 游标 "2" 之后按数值继续，不会跳到字节序中 "2" 之后的 "20"
+		if got, next, err := db.Scan("", "2", 2); err != nil || !slices.Equal(got, []string{"3", "10"}) || next != "10" {
+			t.Fatalf("%s: Scan after 2 = %v, %q, %v", stage, got, next, err)
+		}
+		if got, err := db.ChangedSince(time.Unix(0, 0)); err != nil || !slices.Equal(got, want) {
+			t.Fatalf("%s: ChangedSince = %v, %v, want %v", stage, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,820 @@
+package minidb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==========================================
+// 28. 数据分段 (Segments)
+// ==========================================
+
+// 设置 MaxSegmentSize 后数据保存在多个分段文件中，清单文件 (FilePrefix.segments) 按从旧到新的顺序列出它们。
+// 原来的数据文件是第一个分段，之后的分段命名为 FilePrefix.000001.data 等。各分段去掉文件头后首尾相接，
+// 构成与单个数据文件相同的地址空间 (拼接方式与合并视图一样)，索引和 hint 文件中的位置都是这个空间中的位置。
+// 只有最后一个分段 (活跃分段) 接受写入，达到上限后在下一次写入之前开始新的分段。
+// Merge 把输出按上限切成多个新分段，最后用 rename 替换清单，清单是哪些文件属于这个库的唯一依据
+
+var ErrSegmentsUnsupported = errors.New("segments are not supported for a database opened from a file handle")
+
+// manifest 是清单的内容，每行一项:
+//
+//	next <N>         下一个新分段的编号，编号从 N 开始的分段文件都是没有提交的残留
+//	segment <name>   属于这个库的分段，从旧到新
+//	obsolete <name>  已经被 Merge 替换、可能还没删除的旧分段
+//
+// 文件名不含目录，与清单在同一目录下
+type manifest struct {
+	next     int
+	segments []string
+	obsolete []string
+}
+
+func (m manifest) encode() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "next %d\n", m.next)
+	for _, name := range m.segments {
+		fmt.Fprintf(&buf, "segment %s\n", filepath.Base(name))
+	}
+	for _, name := range m.obsolete {
+		fmt.Fprintf(&buf, "obsolete %s\n", filepath.Base(name))
+	}
+	return buf.Bytes()
+}
+
+// readManifest 读取清单，文件名换成带目录的路径。没有清单时返回 os.ErrNotExist
+func (db *MiniDB) readManifest() (manifest, error) {
+	buf, err := db.readAll(db.names.segments)
+	if err != nil {
+		return manifest{}, err
+	}
+	dir := filepath.Dir(db.names.segments)
+	var m manifest
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		kind, value, _ := strings.Cut(line, " ")
+		switch kind {
+		case "next":
+			if m.next, err = strconv.Atoi(value); err == nil && m.next > 0 {
+				continue
+			}
+		case "segment":
+			m.segments = append(m.segments, filepath.Join(dir, value))
+			continue
+		case "obsolete":
+			m.obsolete = append(m.obsolete, filepath.Join(dir, value))
+			continue
+		}
+		return manifest{}, fmt.Errorf("%w: %s: invalid line %q", ErrIncompatibleFormat, db.names.segments, line)
+	}
+	if len(m.segments) == 0 || m.next == 0 {
+		return manifest{}, fmt.Errorf("%w: %s lists no segments", ErrIncompatibleFormat, db.names.segments)
+	}
+	return m, nil
+}
+
+// writeManifest 先写临时文件并 fsync，再 rename 覆盖清单
+func (db *MiniDB) writeManifest(m manifest) error {
+	tmp := db.names.segments + ".tmp"
+	f, err := db.fs.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(m.encode())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = db.fs.Rename(tmp, db.names.segments)
+	}
+	if err != nil {
+		db.fs.Remove(tmp)
+	}
+	return err
+}
+
+// segmentedStorage 把清单中的分段拼成一个 Storage: 开头是文件头，之后依次是每个分段去掉文件头后的数据。
+// 写入、截断和 fsync 只作用于活跃分段。parts 只在数据库写锁内改变，但 Merge 在锁外读取时
+// 也要访问它，所以另外由 mu 保护
+type segmentedStorage struct {
+	mu     sync.RWMutex
+	header []byte
+	parts  []segmentPart
+	next   int // 下一个新分段的编号
+	merges int // replace 的次数，Verify 据此发现两页之间分段被 Merge 替换
+
+	timesMu sync.Mutex
+	times   map[string]uint32 // 只读分段中最新记录的时间戳，见 newest
+}
+
+// segmentPart 是地址空间中从 base 开始的一个分段，size 为去掉文件头后的长度，只对只读分段有意义
+type segmentPart struct {
+	name string
+	file Storage
+	base int64
+	size int64
+}
+
+// openSegments 按清单打开所有分段，没有清单时返回 nil。读写模式下先删除上次没有提交的新分段和已经被替换的旧分段
+func (db *MiniDB) openSegments() (*segmentedStorage, error) {
+	m, err := db.readManifest()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !db.opts.ReadOnly {
+		db.removeStaleSegments(m)
+	}
+	s := &segmentedStorage{next: m.next}
+	for _, name := range m.segments {
+		if err := s.open(db.fs, name, db.opts.ReadOnly); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// open 打开 name 并接在最后，之前的活跃分段成为只读分段。所有分段的文件头必须相同，
+// 第一个分段的文件头由 initStorage 检查
+func (s *segmentedStorage) open(fs FileSystem, name string, readOnly bool) error {
+	flag := os.O_RDWR | os.O_APPEND
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := fs.OpenFile(name, flag)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, FileHeaderSize)
+	size, err := f.Size()
+	if err == nil {
+		_, err = f.ReadAt(header, 0)
+	}
+	if err != nil || (s.header != nil && !bytes.Equal(header, s.header)) {
+		f.Close()
+		return fmt.Errorf("%w: segment %s has a different file header", ErrIncompatibleFormat, name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	base := int64(FileHeaderSize)
+	if n := len(s.parts); n > 0 {
+		last := &s.parts[n-1]
+		if last.size, err = last.file.Size(); err != nil {
+			f.Close()
+			return err
+		}
+		last.size -= FileHeaderSize
+		base = last.base + last.size
+	} else {
+		s.header = header
+	}
+	s.parts = append(s.parts, segmentPart{name: name, file: f, base: base, size: size - FileHeaderSize})
+	return nil
+}
+
+// removeStaleSegments 删除清单中记下的旧分段，以及编号从 next 开始、Merge 或 Rotate 中途失败留下的新分段
+func (db *MiniDB) removeStaleSegments(m manifest) {
+	for _, name := range m.obsolete {
+		if db.fs.Remove(name) == nil {
+			log.Printf("Removed segment %s replaced by an earlier merge", name)
+		}
+	}
+	for id := m.next; ; id++ {
+		name := db.names.segment(id)
+		if db.fs.Remove(name) != nil {
+			return
+		}
+		log.Printf("Warn: Removed segment %s left by an interrupted merge or rotation", name)
+	}
+}
+
+// enableSegments 把单个数据文件转成只有一个分段的分段存储并写入清单，已经分段时直接返回。调用方需持有写锁
+func (db *MiniDB) enableSegments() (*segmentedStorage, error) {
+	if s, ok := db.file.(*segmentedStorage); ok {
+		return s, nil
+	}
+	if db.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if !db.hasHint() {
+		return nil, ErrSegmentsUnsupported
+	}
+	s := &segmentedStorage{header: make([]byte, FileHeaderSize), next: 1}
+	if _, err := db.file.ReadAt(s.header, 0); err != nil {
+		return nil, err
+	}
+	s.parts = []segmentPart{{name: db.dataFile, file: db.file, base: FileHeaderSize}}
+	if err := db.writeManifest(s.manifest()); err != nil {
+		return nil, err
+	}
+	db.file = s
+	log.Printf("Converted %s to segments, manifest %s", db.dataFile, db.names.segments)
+	return s, nil
+}
+
+// manifest 返回与当前分段一致的清单
+func (s *segmentedStorage) manifest() manifest {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m := manifest{next: s.next}
+	for _, p := range s.parts {
+		m.segments = append(m.segments, p.name)
+	}
+	return m
+}
+
+// allocate 分配一个新分段的编号
+func (s *segmentedStorage) allocate() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	return s.next - 1
+}
+
+// release 归还从 first 开始分配的编号，清理残留时按编号连续查找，中间不能留空
+func (s *segmentedStorage) release(first int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next = first
+}
+
+// rotate 结束活跃分段并开始一个新的分段，活跃分段中还没有记录时什么也不做。
+// 新分段在写入清单之前创建并 fsync 文件头，失败时删除。调用方需持有写锁
+func (db *MiniDB) rotate() error {
+	s, err := db.enableSegments()
+	if err != nil {
+		return err
+	}
+	active := s.active()
+	if db.offset == active.base {
+		return nil
+	}
+	if end := active.base + active.fileSize() - FileHeaderSize; end != db.offset {
+		return fmt.Errorf("%w: active segment ends at %d, offset %d", ErrStateDivergence, end, db.offset)
+	}
+	// 旧分段从此只读，先整体落盘
+	if err := active.file.Sync(); err != nil {
+		return err
+	}
+
+	id := s.allocate()
+	name := db.names.segment(id)
+	f, err := db.fs.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND|os.O_TRUNC)
+	if err != nil {
+		s.release(id)
+		return err
+	}
+	_, err = f.Write(s.header)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		m := s.manifest()
+		m.segments = append(m.segments, name)
+		err = db.writeManifest(m)
+	}
+	if err != nil {
+		f.Close()
+		db.fs.Remove(name)
+		s.release(id)
+		return err
+	}
+
+	s.mu.Lock()
+	s.parts[len(s.parts)-1].size = db.offset - active.base
+	s.parts = append(s.parts, segmentPart{name: name, file: f, base: db.offset})
+	s.mu.Unlock()
+	db.bytesWritten += FileHeaderSize
+	// 之前的写入都在旧分段中，已经随上面的 fsync 落盘
+	db.resetSync(db.offset)
+	log.Printf("Started segment %s at offset %d", name, db.offset)
+	return nil
+}
+
+// Rotate 结束当前活跃分段并开始写新的分段，之前的分段从此只读，可以在备份前安全复制。
+// 还没有分段的库先转为分段存储，活跃分段中还没有记录时什么也不做。Merge 期间返回 ErrMergeInProgress
+func (db *MiniDB) Rotate() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := db.enter(); err != nil {
+		return err
+	}
+	defer db.inflight.Done()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.merging.Load() {
+		return ErrMergeInProgress
+	}
+	return db.rotate()
+}
+
+// maybeRotate 在活跃分段达到 MaxSegmentSize 后、下一次写入之前开始新分段，一次写入 (包括批次和分块链)
+// 总在同一个分段中。Merge 期间不切换，由 Merge 写出的新分段决定边界，活跃分段可能暂时超出上限。
+// 切换失败只记录日志，继续写入当前分段。调用方需持有写锁
+func (db *MiniDB) maybeRotate() {
+	s, ok := db.file.(*segmentedStorage)
+	if !ok || db.opts.MaxSegmentSize <= 0 || db.merging.Load() {
+		return
+	}
+	if FileHeaderSize+db.offset-s.active().base < db.opts.MaxSegmentSize {
+		return
+	}
+	if err := db.rotate(); err != nil {
+		log.Printf("Warn: Start new segment failed: %v, writing to %s", err, s.active().name)
+	}
+}
+
+// active 返回活跃分段
+func (s *segmentedStorage) active() segmentPart {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.parts[len(s.parts)-1]
+}
+
+// fileSize 返回分段文件的实际长度 (含文件头)，读取失败时返回文件头长度
+func (p segmentPart) fileSize() int64 {
+	size, err := p.file.Size()
+	if err != nil {
+		return FileHeaderSize
+	}
+	return size
+}
+
+// find 返回 pos 所在的分段，last 表示它是活跃分段
+func (s *segmentedStorage) find(pos int64) (part segmentPart, last bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := sort.Search(len(s.parts), func(i int) bool { return s.parts[i].base > pos }) - 1
+	return s.parts[max(i, 0)], i >= len(s.parts)-1
+}
+
+func (s *segmentedStorage) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos < FileHeaderSize {
+			n += copy(p[n:], s.header[pos:])
+			continue
+		}
+		part, last := s.find(pos)
+		want := int64(len(p) - n)
+		if !last {
+			want = min(want, part.base+part.size-pos)
+		}
+		read, err := part.file.ReadAt(p[n:n+int(want)], FileHeaderSize+pos-part.base)
+		n += read
+		if err != nil && !(errors.Is(err, io.EOF) && int64(read) == want) {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *segmentedStorage) Write(p []byte) (int, error) { return s.active().file.Write(p) }
+func (s *segmentedStorage) Sync() error                 { return s.active().file.Sync() }
+
+func (s *segmentedStorage) Size() (int64, error) {
+	active := s.active()
+	size, err := active.file.Size()
+	return active.base + size - FileHeaderSize, err
+}
+
+// Truncate 只能截掉活跃分段中的数据，只读分段不会再改变
+func (s *segmentedStorage) Truncate(size int64) error {
+	active := s.active()
+	if size < active.base {
+		return fmt.Errorf("truncate to %d: before the active segment %s at %d", size, active.name, active.base)
+	}
+	return active.file.Truncate(FileHeaderSize + size - active.base)
+}
+
+func (s *segmentedStorage) Close() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var first error
+	for _, part := range s.parts {
+		if err := part.file.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// names 返回所有分段的文件名，从旧到新
+func (s *segmentedStorage) names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, len(s.parts))
+	for i, p := range s.parts {
+		names[i] = p.name
+	}
+	return names
+}
+
+// span 返回地址空间中从 lo 到 hi 的分段 parts[from:to]，lo 和 hi 都是分段的起点
+func (s *segmentedStorage) span(lo, hi int64) (from, to int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	from = sort.Search(len(s.parts), func(i int) bool { return s.parts[i].base >= lo })
+	to = sort.Search(len(s.parts), func(i int) bool { return s.parts[i].base >= hi })
+	return from, to
+}
+
+// replace 在写锁内把 parts[from:to] 换成 parts，之后的分段在地址空间中移动 delta，返回被替换的旧分段
+func (s *segmentedStorage) replace(from, to int, parts []segmentPart, delta int64) []segmentPart {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := slices.Clone(s.parts[from:to])
+	rest := slices.Clone(s.parts[to:])
+	for i := range rest {
+		rest[i].base += delta
+	}
+	s.parts = slices.Concat(s.parts[:from:from], parts, rest)
+	s.merges++
+	s.timesMu.Lock()
+	for _, p := range old {
+		delete(s.times, p.name)
+	}
+	s.timesMu.Unlock()
+	return old
+}
+
+// newest 返回只读分段中最新一条记录的时间，没有记录或读取失败时返回零值。
+// 第一次调用时扫描整个分段的记录头，只读分段不会再改变，结果按文件名缓存
+func (s *segmentedStorage) newest(p segmentPart, order binary.ByteOrder) time.Time {
+	s.timesMu.Lock()
+	defer s.timesMu.Unlock()
+	ts, ok := s.times[p.name]
+	if !ok {
+		err := scanRecords(p.file, order, FileHeaderSize, FileHeaderSize+p.size, func(_ string, _ recordPos, _ uint8, t uint32) {
+			ts = max(ts, t)
+		})
+		if err != nil {
+			log.Printf("Warn: Read timestamps of segment %s failed: %v", p.name, err)
+			return time.Time{}
+		}
+		if s.times == nil {
+			s.times = make(map[string]uint32)
+		}
+		s.times[p.name] = ts
+	}
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(ts), 0)
+}
+
+// segmentWriter 把 Merge 的输出写成一组新分段，每个分段 (含文件头) 不超过 MaxSegmentSize，
+// 超过上限的单条记录独占一个分段。拷贝期间追加的记录补在最后一个分段中，它随后成为活跃分段。
+// 写满的分段立即 fsync，失败时删除所有新分段并归还编号
+type segmentWriter struct {
+	db     *MiniDB
+	s      *segmentedStorage
+	header []byte
+	limit  int64
+	base   int64         // 第一个新分段在地址空间中的起点
+	parts  []segmentPart // 最后一个正在写入，size 随写入更新
+	first  int           // 第一个新分段的编号
+}
+
+// newSegmentWriter 从地址空间中的 base 开始写出新分段
+func newSegmentWriter(db *MiniDB, s *segmentedStorage, header []byte, base int64) (*segmentWriter, error) {
+	w := &segmentWriter{db: db, s: s, header: header, limit: db.opts.MaxSegmentSize, base: base, first: -1}
+	return w, w.create(base)
+}
+
+func (w *segmentWriter) create(base int64) error {
+	id := w.s.allocate()
+	if w.first < 0 {
+		w.first = id
+	}
+	name := w.db.names.segment(id)
+	f, err := w.db.fs.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	w.parts = append(w.parts, segmentPart{name: name, file: f, base: base})
+	_, err = f.Write(w.header)
+	return err
+}
+
+// reserve 在写入 n 字节的记录之前调用，当前分段已有数据且放不下时先开始新分段
+func (w *segmentWriter) reserve(n int64) error {
+	cur := w.parts[len(w.parts)-1]
+	if w.limit <= 0 || cur.size == 0 || FileHeaderSize+cur.size+n <= w.limit {
+		return nil
+	}
+	if err := cur.file.Sync(); err != nil {
+		return err
+	}
+	return w.create(cur.base + cur.size)
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	cur := &w.parts[len(w.parts)-1]
+	n, err := cur.file.Write(p)
+	cur.size += int64(n)
+	return n, err
+}
+
+// Sync fsync 正在写入的分段，之前的分段在写满时已经 fsync
+func (w *segmentWriter) Sync() error {
+	return w.parts[len(w.parts)-1].file.Sync()
+}
+
+// check 确认每个新分段的长度与记账一致，并且一直写到了地址空间中的 end
+func (w *segmentWriter) check(end int64) error {
+	for _, p := range w.parts {
+		if err := checkSize(p.file, FileHeaderSize+p.size); err != nil {
+			return fmt.Errorf("%s: %w", p.name, err)
+		}
+	}
+	last := w.base
+	if n := len(w.parts); n > 0 {
+		last = w.parts[n-1].base + w.parts[n-1].size
+	}
+	if last != end {
+		return fmt.Errorf("merge: segments end at %d, offset %d", last, end)
+	}
+	return nil
+}
+
+// trim 删除最后一个还没有写入记录的新分段。分段合并的输出夹在只读分段之间，不能留下空分段
+func (w *segmentWriter) trim() {
+	if n := len(w.parts); n > 0 && w.parts[n-1].size == 0 {
+		w.parts[n-1].file.Close()
+		w.db.fs.Remove(w.parts[n-1].name)
+		w.parts = w.parts[:n-1]
+	}
+}
+
+// commit 把替换了 parts[from:to] 的新清单写入 merge 文件并 fsync，再 rename 覆盖清单。
+// 与单个数据文件的 Merge 一样，merge 文件还在就说明没有提交，见 recoverMerge 和 recoverValueLogMerge
+func (w *segmentWriter) commit(mergeFile Storage, from, to int) error {
+	m := manifest{}
+	w.s.mu.RLock()
+	m.next = w.s.next
+	for i, p := range w.s.parts {
+		if i == from {
+			for _, np := range w.parts {
+				m.segments = append(m.segments, np.name)
+			}
+		}
+		if i >= from && i < to {
+			m.obsolete = append(m.obsolete, p.name)
+			continue
+		}
+		m.segments = append(m.segments, p.name)
+	}
+	w.s.mu.RUnlock()
+	if _, err := mergeFile.Write(m.encode()); err != nil {
+		return err
+	}
+	if err := mergeFile.Sync(); err != nil {
+		return err
+	}
+	return w.db.fs.Rename(w.db.names.merge, w.db.names.segments)
+}
+
+// remove 在 Merge 失败时关闭并删除所有新分段
+func (w *segmentWriter) remove() {
+	for _, p := range w.parts {
+		p.file.Close()
+		w.db.fs.Remove(p.name)
+	}
+	if w.first >= 0 {
+		w.s.release(w.first)
+	}
+}
+
+// removeSegments 关闭并删除被 Merge 替换的旧分段，删除失败的留在清单的 obsolete 中，下次打开时再删
+func (db *MiniDB) removeSegments(parts []segmentPart) {
+	for _, p := range parts {
+		p.file.Close()
+		if err := db.fs.Remove(p.name); err != nil {
+			log.Printf("Warn: Remove merged segment %s failed: %v", p.name, err)
+		}
+	}
+}
+
+// Segment 描述一个数据分段。没有分段的库把数据文件作为唯一的活跃分段
+type Segment struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`       // 文件长度，包括文件头
+	DeadBytes int64     `json:"dead_bytes"` // 不被索引和历史版本引用的字节数，包括删除标记和保留期内的删除
+	Newest    time.Time `json:"newest"`     // 最新一条记录的写入时间，活跃分段为零值
+	Active    bool      `json:"active"`     // 接受写入的最后一个分段
+}
+
+// Segments 按从旧到新的顺序返回所有分段
+func (db *MiniDB) Segments() []Segment {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	s, ok := db.file.(*segmentedStorage)
+	if !ok {
+		return []Segment{{Name: db.dataFile, Size: db.offset, DeadBytes: db.deadBytes, Active: true}}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	segments := make([]Segment, len(s.parts))
+	for i, p := range s.parts {
+		segments[i] = Segment{Name: p.name, Size: FileHeaderSize + p.size}
+		if i < len(s.parts)-1 {
+			segments[i].Newest = s.newest(p, db.order)
+		}
+	}
+	last := &segments[len(segments)-1]
+	last.Size, last.Active = FileHeaderSize+db.offset-s.parts[len(s.parts)-1].base, true
+
+	// 记录不会跨越分段，按起点归到所在的分段
+	live := make([]int64, len(s.parts))
+	count := func(pos recordPos) {
+		i := sort.Search(len(s.parts), func(i int) bool { return s.parts[i].base > pos.offset }) - 1
+		live[max(i, 0)] += pos.size
+	}
+	db.indexes.each(func(_ string, pos recordPos) { count(pos) })
+	for _, versions := range db.versions {
+		for _, v := range versions {
+			count(v)
+		}
+	}
+	for i := range segments {
+		segments[i].DeadBytes = segments[i].Size - FileHeaderSize - live[i]
+	}
+	return segments
+}
+
+// segmented 报告数据是否已经分段
+func (db *MiniDB) segmented() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	_, ok := db.file.(*segmentedStorage)
+	return ok
+}
+
+// bounds 返回分段 first 到 last (含) 在地址空间中的范围 [lo, hi)，last 必须是只读分段
+func (s *segmentedStorage) bounds(first, last string) (lo, hi int64, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := slices.IndexFunc(s.parts, func(p segmentPart) bool { return p.name == first })
+	j := slices.IndexFunc(s.parts, func(p segmentPart) bool { return p.name == last })
+	if i < 0 || j < i || j >= len(s.parts)-1 {
+		return 0, 0, false
+	}
+	return s.parts[i].base, s.parts[j+1].base, true
+}
+
+// mergeSegments 让 p 从只读分段中挑选一段连续的分段合并，范围之外的分段保持不变，没有挑中时什么也不做
+func (db *MiniDB) mergeSegments(p MergePolicy) error {
+	if err := db.claimMerge(); err != nil {
+		return err
+	}
+	// 持有 merging 标记期间分段只会在末尾增加
+	db.mu.RLock()
+	s, ok := db.file.(*segmentedStorage)
+	db.mu.RUnlock()
+	if !ok {
+		return db.runMerge(nil, FileHeaderSize, 0)
+	}
+	segments := db.Segments()
+	selected := p.SelectSegments(segments[:len(segments)-1])
+	if len(selected) == 0 {
+		db.merging.Store(false)
+		return nil
+	}
+	lo, hi, ok := s.bounds(selected[0].Name, selected[len(selected)-1].Name)
+	if !ok {
+		db.merging.Store(false)
+		return fmt.Errorf("merge: selected segments %s..%s are not read-only segments", selected[0].Name, selected[len(selected)-1].Name)
+	}
+	log.Printf("Merging %d segments %s..%s", len(selected), selected[0].Name, selected[len(selected)-1].Name)
+	return db.runMerge(nil, lo, hi)
+}
+
+// followSegments 在只读跟随时比较主库的清单和当前打开的分段。主库开始了新分段时返回它们的文件名；
+// 已有的分段被 Merge 替换，或者数据文件转成了分段，返回 replaced，需要重新打开
+func (db *MiniDB) followSegments() (added []string, replaced bool, err error) {
+	if !db.hasHint() {
+		return nil, false, nil
+	}
+	db.mu.RLock()
+	s, segmented := db.file.(*segmentedStorage)
+	db.mu.RUnlock()
+	m, err := db.readManifest()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, segmented, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if !segmented {
+		return nil, true, nil
+	}
+	names := s.names()
+	if len(m.segments) < len(names) || !slices.Equal(m.segments[:len(names)], names) {
+		return nil, true, nil
+	}
+	return m.segments[len(names):], false, nil
+}
+
+// spanStats 是分段合并范围内原有记录的统计，合并后据此修正 Stats
+type spanStats struct {
+	entries        int // 记录条数，分块链算一条，不含批次标记
+	tombstones     int
+	tombstoneBytes int64
+}
+
+// spanTomb 是分段合并需要保留的一个删除标记
+type spanTomb struct {
+	key string
+	pos recordPos
+}
+
+// scanRecords 顺序读取 [from, to) 之间的记录头和 key，value 不读入内存。
+// 分块链作为一条记录交给 fn (时间戳取第一块)，批次标记跳过
+func scanRecords(file Storage, order binary.ByteOrder, from, to int64, fn func(key string, pos recordPos, flags uint8, ts uint32)) error {
+	r := bufio.NewReader(io.NewSectionReader(file, from, to-from))
+	header := make([]byte, HeaderSize)
+	chainStart, chainTS := int64(-1), uint32(0)
+	for off := from; off < to; {
+		_, err := io.ReadFull(r, header)
+		_, ts, kSize, vSize, flags := DecodeHeaderOrder(header, order)
+		key := make([]byte, kSize)
+		if err == nil {
+			_, err = io.ReadFull(r, key)
+		}
+		if err == nil {
+			_, err = r.Discard(int(vSize))
+		}
+		if err != nil {
+			return fmt.Errorf("merge: read record at offset %d: %w", off, err)
+		}
+		start := off
+		if chainStart >= 0 {
+			start, ts = chainStart, chainTS
+		}
+		off += HeaderSize + int64(kSize) + int64(vSize)
+		switch {
+		case flags&FlagBatch != 0:
+		case flags&FlagChunked != 0:
+			chainStart, chainTS = start, ts
+		default:
+			chainStart = -1
+			fn(string(key), recordPos{offset: start, size: off - start}, flags, ts)
+		}
+	}
+	return nil
+}
+
+// spanTombstones 找出分段合并范围 [lo, hi) 中需要保留的删除标记: key 在范围内的最后一条记录是删除标记，
+// 并且更早的分段中还有这个 key 的记录，丢掉删除标记后重放时旧记录会复活。
+// 保留期内的删除标记 (graceTombs) 随 graces 拷贝，不在这里返回。同时统计范围内原有的记录
+func spanTombstones(file Storage, order binary.ByteOrder, lo, hi int64, graceTombs map[int64]bool) ([]spanTomb, spanStats, error) {
+	var span spanStats
+	last := make(map[string]spanTomb)
+	err := scanRecords(file, order, lo, hi, func(key string, pos recordPos, flags uint8, _ uint32) {
+		span.entries++
+		if flags&FlagTombstone != 0 {
+			span.tombstones++
+			span.tombstoneBytes += pos.size
+			if !graceTombs[pos.offset] {
+				last[key] = spanTomb{key, pos}
+				return
+			}
+		}
+		delete(last, key)
+	})
+	if err != nil || len(last) == 0 {
+		return nil, span, err
+	}
+	var tombs []spanTomb
+	err = scanRecords(file, order, FileHeaderSize, lo, func(key string, _ recordPos, _ uint8, _ uint32) {
+		if t, ok := last[key]; ok {
+			tombs = append(tombs, t)
+			delete(last, key)
+		}
+	})
+	sort.Slice(tombs, func(i, j int) bool { return tombs[i].pos.offset < tombs[j].pos.offset })
+	return tombs, span, err
+}
@@ -0,0 +1,530 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkSegments 确认 Segments 与磁盘上的文件一致、只读分段不超过 limit，并且各分段拼起来正好是 db.offset
+func checkSegments(t *testing.T, db *MiniDB, limit int64) []Segment {
+	t.Helper()
+	segs := db.Segments()
+	total := int64(FileHeaderSize)
+	for i, s := range segs {
+		info, err := os.Stat(s.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != s.Size {
+			t.Fatalf("segment %s is %d bytes on disk, Segments says %d", s.Name, info.Size(), s.Size)
+		}
+		if s.Active != (i == len(segs)-1) {
+			t.Fatalf("segment %d of %d: Active = %v", i, len(segs), s.Active)
+		}
+		if !s.Active && (s.Size > limit || s.Size <= FileHeaderSize) {
+			t.Fatalf("read-only segment %s is %d bytes, limit %d", s.Name, s.Size, limit)
+		}
+		total += s.Size - FileHeaderSize
+	}
+	if total != db.offset {
+		t.Fatalf("segments add up to %d bytes, offset %d", total, db.offset)
+	}
+	if files, _ := filepath.Glob(db.names.prefix + "*." + db.names.ext); len(files) != len(segs) {
+		t.Fatalf("data files on disk %v, segments %+v", files, segs)
+	}
+	return segs
+}
+
+// TestMergeSplitsSegments Merge 的输出按 MaxSegmentSize 切成多个分段，替换所有旧分段，
+// 索引指向新分段中的正确位置，重新打开后分段和数据都不变
+func TestMergeSplitsSegments(t *testing.T) {
+	const limit = 4096
+	db := openTestDB(t, Options{MaxSegmentSize: limit})
+	want := make(map[string]string)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			want[key] = strings.Repeat(fmt.Sprint(round), 100)
+			if err := db.Put(key, want[key]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 200; i += 4 {
+		key := fmt.Sprintf("key-%03d", i)
+		delete(want, key)
+		if err := db.Del(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 写入过程中活跃分段写满后自动开始新分段
+	before := checkSegments(t, db, limit+HeaderSize+110)
+	if len(before) < 10 {
+		t.Fatalf("%d segments before merge, want the writes to rotate", len(before))
+	}
+
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	after := checkSegments(t, db, limit)
+	// 150 个 key 各约 125 字节，至少需要 5 个分段
+	if len(after) < 5 || len(after) >= len(before) {
+		t.Fatalf("%d segments after merge, %d before", len(after), len(before))
+	}
+	for _, s := range before {
+		if _, err := os.Stat(s.Name); !os.IsNotExist(err) {
+			t.Fatalf("merged segment %s left behind: %v", s.Name, err)
+		}
+	}
+	if got := db.Stats().Segments; got != len(after) {
+		t.Fatalf("Stats.Segments = %d, want %d", got, len(after))
+	}
+
+	for _, reload := range []bool{false, true} {
+		if reload {
+			db = reopen(t, db)
+			if got := checkSegments(t, db, limit); fmt.Sprint(got) != fmt.Sprint(after) {
+				t.Fatalf("segments after reopen %+v, want %+v", got, after)
+			}
+		}
+		if got := dump(t, db); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("reload=%v: state = %v, want %v", reload, got, want)
+		}
+		if p, err := db.Verify(nil, nil); err != nil || p.Corrupt != 0 {
+			t.Fatalf("reload=%v: Verify = %+v, %v", reload, p, err)
+		}
+	}
+
+	// 新的写入追加在最后一个分段之后，写满后照常切换
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("new-%d", i), strings.Repeat("n", 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if segs := checkSegments(t, db, limit+HeaderSize+110); len(segs) <= len(after) {
+		t.Fatalf("%d segments after more writes, %d before", len(segs), len(after))
+	}
+	if got, err := db.Get("new-99"); err != nil || got != strings.Repeat("n", 100) {
+		t.Fatalf("Get(new-99) = %q, %v", got, err)
+	}
+}
+
+// TestFollowSegments 只读跟随者接上主库新开始的分段，主库 Merge 替换分段后重新打开
+func TestFollowSegments(t *testing.T) {
+	leader := openTestDB(t, Options{MaxSegmentSize: 512})
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := leader.Put(fmt.Sprintf("k%d", i%20), fmt.Sprintf("v%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(0, 20)
+	follower := openTestDB(t, Options{ReadOnly: true, FilePrefix: leader.opts.FilePrefix})
+
+	check := func(stage string) {
+		t.Helper()
+		if err := follower.Tail(); err != nil {
+			t.Fatalf("%s: Tail: %v", stage, err)
+		}
+		if got, want := dump(t, follower), dump(t, leader); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s: follower = %v, leader %v", stage, got, want)
+		}
+	}
+	put(20, 100)
+	if len(leader.Segments()) < 3 {
+		t.Fatalf("%d segments, want the writes to rotate", len(leader.Segments()))
+	}
+	check("rotated")
+	if err := leader.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	put(100, 110)
+	check("merged")
+}
+
+// TestSegmentsWritesDuringMerge 拷贝期间追加的记录补到最后一个新分段中，之后继续写入它
+func TestSegmentsWritesDuringMerge(t *testing.T) {
+	fs := &syncHookFS{FileSystem: OSFS}
+	db := openTestDB(t, Options{FS: fs, MaxSegmentSize: 1 << 20})
+	// 还没有切换过分段，Merge 写出的第一个新分段编号为 1
+	fs.name = db.names.segment(1)
+	for i := 0; i < 3; i++ {
+		if err := db.Put("k", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.hook = func() {
+		for k, v := range map[string]string{"during": "d", "k": "x"} {
+			if err := db.Put(k, v); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if fs.hook != nil {
+		t.Fatal("new segment was never synced")
+	}
+	if err := db.Put("after", "a"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"k": "x", "during": "d", "after": "a"}
+	for _, reload := range []bool{false, true} {
+		if reload {
+			db = reopen(t, db)
+		}
+		if got := dump(t, db); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("reload=%v: state = %v, want %v", reload, got, want)
+		}
+		checkSegments(t, db, 1<<20)
+	}
+}
+
+// TestRotate 切换后新的写入进入新分段，旧分段的内容不再改变，重新打开后数据不变
+func TestRotate(t *testing.T) {
+	db := openTestDB(t, Options{})
+	for k, v := range map[string]string{"a": "1", "b": "2"} {
+		if err := db.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	segs := checkSegments(t, db, db.offset)
+	if len(segs) != 2 || segs[1].Size != FileHeaderSize {
+		t.Fatalf("segments after rotate %+v, want an empty second segment", segs)
+	}
+	// 新分段中还没有记录，再次切换什么也不做
+	if err := db.Rotate(); err != nil || len(db.Segments()) != 2 {
+		t.Fatalf("second Rotate = %v, %d segments", err, len(db.Segments()))
+	}
+	old, err := os.ReadFile(segs[0].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("a", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Del("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	now := checkSegments(t, db, db.offset)
+	if now[0].Name != segs[0].Name || now[0].Size != segs[0].Size || now[1].Size <= FileHeaderSize {
+		t.Fatalf("segments after writes %+v, want them all in %s", now, segs[1].Name)
+	}
+	if got, err := os.ReadFile(segs[0].Name); err != nil || string(got) != string(old) {
+		t.Fatalf("rotated segment changed: %v", err)
+	}
+
+	want := map[string]string{"a": "changed", "c": "3"}
+	for _, reload := range []bool{false, true} {
+		if reload {
+			db = reopen(t, db)
+		}
+		if got := dump(t, db); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("reload=%v: state = %v, want %v", reload, got, want)
+		}
+	}
+
+	db.merging.Store(true)
+	if err := db.Rotate(); !errors.Is(err, ErrMergeInProgress) {
+		t.Fatalf("Rotate during merge = %v, want ErrMergeInProgress", err)
+	}
+	db.merging.Store(false)
+}
+
+// selectPolicy 按函数挑选分段
+type selectPolicy func(segments []Segment) []Segment
+
+func (f selectPolicy) ShouldMerge(Stats) bool                      { return true }
+func (f selectPolicy) SelectSegments(segments []Segment) []Segment { return f(segments) }
+
+// TestMergeSelectedSegments 自动 Merge 只合并 MergePolicy 挑出的分段，之前和之后的分段原样保留，
+// 范围内遮蔽更早分段的删除标记被保留，不需要的被丢弃，不依赖 hint 重新打开后数据和统计都不变
+func TestMergeSelectedSegments(t *testing.T) {
+	var offered []Segment
+	policy := selectPolicy(func(segments []Segment) []Segment {
+		offered = segments
+		return segments[1:3]
+	})
+	db := openTestDB(t, Options{MergePolicy: policy})
+	steps := [][]string{
+		{"gone", "x", "a", "1", "b", "1"},
+		{"a", "2", "gone", "", "c", "1"},
+		{"a", "3", "c", "", "d", "1"},
+		{"b", "2", "e", "1"},
+		{"f", "1"},
+	}
+	for i, step := range steps {
+		if i > 0 {
+			if err := db.Rotate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for j := 0; j < len(step); j += 2 {
+			var err error
+			if step[j+1] == "" {
+				err = db.Del(step[j])
+			} else {
+				err = db.Put(step[j], step[j+1])
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	before := checkSegments(t, db, db.offset)
+
+	db.maybeAutoMerge(false)
+	if fmt.Sprint(offered) != fmt.Sprint(before[:4]) {
+		t.Fatalf("policy was offered %+v, want the read-only segments %+v", offered, before[:4])
+	}
+	after := checkSegments(t, db, db.offset)
+	if len(after) != 4 || after[0] != before[0] || after[2] != before[3] ||
+		after[3].Name != before[4].Name || after[3].Size != before[4].Size {
+		t.Fatalf("segments after merge %+v, before %+v", after, before)
+	}
+	for _, s := range before[1:3] {
+		if _, err := os.Stat(s.Name); !os.IsNotExist(err) || s.Name == after[1].Name {
+			t.Fatalf("merged segment %s left behind: %v", s.Name, err)
+		}
+	}
+	// 合并后只剩 a=3、d=1 和遮蔽 seg0 中 gone 的删除标记，c 的删除标记不再需要
+	if after[1].Size >= before[1].Size+before[2].Size-FileHeaderSize || after[1].DeadBytes == 0 {
+		t.Fatalf("merged segment %+v, replaced %+v", after[1], before[1:3])
+	}
+	stats := db.Stats()
+
+	want := map[string]string{"a": "3", "b": "2", "d": "1", "e": "1", "f": "1"}
+	for _, reload := range []bool{false, true} {
+		if reload {
+			os.Remove(db.names.hint)
+			db = reopen(t, db)
+			if got := checkSegments(t, db, db.offset); fmt.Sprint(got) != fmt.Sprint(after) {
+				t.Fatalf("segments after reopen %+v, want %+v", got, after)
+			}
+			got := db.Stats()
+			if got.DeadBytes != stats.DeadBytes || got.Tombstones != stats.Tombstones || got.DeadEntries != stats.DeadEntries {
+				t.Fatalf("replayed stats %+v, after merge %+v", got, stats)
+			}
+		}
+		if got := dump(t, db); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("reload=%v: state = %v, want %v", reload, got, want)
+		}
+		if p, err := db.Verify(nil, nil); err != nil || p.Corrupt != 0 {
+			t.Fatalf("reload=%v: Verify = %+v, %v", reload, p, err)
+		}
+	}
+	if err := db.Put("g", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("g"); err != nil || got != "1" {
+		t.Fatalf("Get(g) = %q, %v", got, err)
+	}
+}
+
+// TestSizeTieredPolicy 挑出存活数据大小相近、至少 MinSegments 个的连续分段中总大小最小的一组，跳过已经写满的分段
+func TestSizeTieredPolicy(t *testing.T) {
+	seg := func(live int64) Segment {
+		return Segment{Name: fmt.Sprint(live), Size: FileHeaderSize + live + 10, DeadBytes: 10}
+	}
+	p := SizeTieredPolicy{MinSegments: 3, MaxSegmentSize: 1000}
+	cases := []struct {
+		lives []int64
+		want  []int64
+	}{
+		{[]int64{100, 120, 90}, []int64{100, 120, 90}},
+		{[]int64{100, 120}, nil},
+		{[]int64{1000, 100, 120, 90, 1000}, []int64{100, 120, 90}},
+		// 400 与 100 相差超过 SizeRatio，分成两层，选总大小小的一层
+		{[]int64{500, 600, 450, 100, 120, 90}, []int64{100, 120, 90}},
+		{[]int64{100, 1000, 120, 90}, nil},
+	}
+	for _, c := range cases {
+		var segments, want []Segment
+		for _, l := range c.lives {
+			segments = append(segments, seg(l))
+		}
+		for _, l := range c.want {
+			want = append(want, seg(l))
+		}
+		if got := p.SelectSegments(segments); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("SelectSegments(%v) = %v, want %v", c.lives, got, want)
+		}
+	}
+}
+
+// TestAgePolicy 只合并最新记录早于 MinAge 的只读分段，最近写入的分段即使有失效数据也原样保留
+func TestAgePolicy(t *testing.T) {
+	db := openTestDB(t, Options{MergePolicy: AgePolicy{MinAge: time.Hour}})
+	now := time.Now()
+	put := func(age time.Duration, kv ...string) {
+		for i := 0; i < len(kv); i += 2 {
+			e := NewEntry([]byte(kv[i]), []byte(kv[i+1]))
+			e.Timestamp = uint32(now.Add(-age).Unix())
+			if err := db.AppendRaw(e.EncodeOrder(db.order)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(3*time.Hour, "a", "1", "b", "1", "a", "2")
+	put(2*time.Hour, "b", "2", "c", "1")
+	put(0, "c", "2", "d", "1", "d", "2")
+	put(0, "e", "1")
+	before := checkSegments(t, db, db.offset)
+	for i, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, 0, 0} {
+		if got := before[i].Newest.Unix(); got != now.Add(-age).Unix() {
+			t.Fatalf("segment %d: Newest = %v, want %v", i, before[i].Newest, now.Add(-age))
+		}
+	}
+	if !before[4].Newest.IsZero() {
+		t.Fatalf("active segment: Newest = %v", before[4].Newest)
+	}
+
+	db.maybeAutoMerge(false)
+	after := checkSegments(t, db, db.offset)
+	if len(after) != 4 || after[1].Name != before[2].Name || after[1].Size != before[2].Size ||
+		after[2].Name != before[3].Name || after[2].Size != before[3].Size {
+		t.Fatalf("segments after merge %+v, before %+v", after, before)
+	}
+	// 合并后的分段只剩 a=2 和 b=2 (c=1 已经被最近的分段覆盖)，最新记录是两小时前的 b=2
+	if after[0].Name == before[0].Name || after[0].Size >= before[0].Size+before[1].Size-FileHeaderSize ||
+		after[0].Newest.Unix() != now.Add(-2*time.Hour).Unix() {
+		t.Fatalf("merged segment %+v, replaced %+v", after[0], before[:2])
+	}
+	// 剩下的老分段中没有可以回收的数据，不再合并
+	db.maybeAutoMerge(false)
+	if got := db.Segments(); fmt.Sprint(got) != fmt.Sprint(after) {
+		t.Fatalf("segments after second merge %+v, want %+v", got, after)
+	}
+
+	want := map[string]string{"a": "2", "b": "2", "c": "2", "d": "2", "e": "1"}
+	for _, reload := range []bool{false, true} {
+		if reload {
+			os.Remove(db.names.hint)
+			db = reopen(t, db)
+		}
+		if got := dump(t, db); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("reload=%v: state = %v, want %v", reload, got, want)
+		}
+	}
+}
+
+// writeSegments 按 steps 写入并在每一步之后 Rotate，value 为空表示删除
+func writeSegments(t *testing.T, db *MiniDB, steps [][]string) {
+	t.Helper()
+	for _, step := range steps {
+		for j := 0; j < len(step); j += 2 {
+			var err error
+			if step[j+1] == "" {
+				err = db.Del(step[j])
+			} else {
+				err = db.Put(step[j], step[j+1])
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestMergeSegmentsMasksOlderSegments 合并中间的分段时，只有遮蔽着更早分段中旧记录的删除标记被保留，
+// 不依赖 hint 重放后被删除的 key 不会复活，范围内先写入后删除的 key 不留下任何记录
+func TestMergeSegmentsMasksOlderSegments(t *testing.T) {
+	db := openTestDB(t, Options{})
+	writeSegments(t, db, [][]string{
+		{"k1", "old", "k4", "old", "k5", "old"},
+		{"k3", "1", "k4", ""},
+		{"k1", "", "k2", "1", "k2", "", "k3", "", "k4", "new"},
+		{"k5", ""},
+	})
+	mid := selectPolicy(func(segments []Segment) []Segment { return segments[1:3] })
+	if err := db.mergeSegments(mid); err != nil {
+		t.Fatal(err)
+	}
+	segs := checkSegments(t, db, db.offset)
+	if len(segs) != 4 {
+		t.Fatalf("segments after merge %+v", segs)
+	}
+	// 合并后的分段中只有 k4=new 和 k1 的删除标记
+	data, err := os.ReadFile(segs[1].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"k2", "k3"} {
+		if strings.Contains(string(data), key) {
+			t.Fatalf("merged segment still has records of %s", key)
+		}
+	}
+	if !strings.Contains(string(data), "k1") || !strings.Contains(string(data), "new") {
+		t.Fatalf("merged segment lost the tombstone of k1 or k4=new")
+	}
+
+	want := map[string]string{"k4": "new"}
+	for _, reload := range []bool{false, true} {
+		if reload {
+			os.Remove(db.names.hint)
+			db = reopen(t, db)
+		}
+		if got := dump(t, db); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("reload=%v: state = %v, want %v", reload, got, want)
+		}
+	}
+}
+
+// TestMergeSegmentsTombstoneStats 合并部分分段时更早的分段中还有 key 的删除标记保留并继续计入统计，
+// 没有的被回收；整体 Merge 重写全部数据，删除标记全部回收
+func TestMergeSegmentsTombstoneStats(t *testing.T) {
+	db := openTestDB(t, Options{})
+	writeSegments(t, db, [][]string{
+		{"a", "1", "b", "1"},
+		{"a", "", "c", "1", "c", ""},
+	})
+	before := db.Stats()
+	if before.Tombstones != 2 {
+		t.Fatalf("Tombstones = %d before merge, want 2", before.Tombstones)
+	}
+	second := selectPolicy(func(segments []Segment) []Segment { return segments[1:2] })
+	if err := db.mergeSegments(second); err != nil {
+		t.Fatal(err)
+	}
+	// 只剩 a 的删除标记，两个删除标记的 key 一样长
+	stats := db.Stats()
+	if stats.Tombstones != 1 || stats.TombstoneBytes != before.TombstoneBytes/2 {
+		t.Fatalf("after merging segments: %d tombstones, %d bytes; before %d, %d",
+			stats.Tombstones, stats.TombstoneBytes, before.Tombstones, before.TombstoneBytes)
+	}
+	os.Remove(db.names.hint)
+	db = reopen(t, db)
+	if got := db.Stats(); got.Tombstones != stats.Tombstones || got.TombstoneBytes != stats.TombstoneBytes || got.DeadBytes != stats.DeadBytes {
+		t.Fatalf("replayed stats %+v, after merge %+v", got, stats)
+	}
+	if _, err := db.Get("a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(a) after replay = %v, want ErrKeyNotFound", err)
+	}
+
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.Stats(); stats.Tombstones != 0 || stats.TombstoneBytes != 0 || stats.DeadBytes != 0 {
+		t.Fatalf("after full merge: %+v", stats)
+	}
+}
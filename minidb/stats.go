@@ -0,0 +1,147 @@
+package minidb
+
+import "time"
+
+// ==========================================
+// 4. 运行统计 (Stats)
+// ==========================================
+
+type Stats struct {
+	Keys           int           `json:"keys"`
+	FileSize       int64         `json:"file_size"`
+	LoadDuration   time.Duration `json:"load_duration_ns"`
+	CorruptRecords int           `json:"corrupt_records"`
+
+	DeadBytes          int64   `json:"dead_bytes"`
+	DeadRatio          float64 `json:"dead_ratio"`          // 无效数据占数据文件的比例，用于判断是否需要 Merge
+	BytesWritten       int64   `json:"bytes_written"`       // 本次启动以来写入磁盘的总字节数
+	WriteAmplification float64 `json:"write_amplification"` // BytesWritten / 有效数据字节数
+
+	Tombstones     int   `json:"tombstones"`      // 数据文件中的删除标记条数，Merge 时回收
+	TombstoneBytes int64 `json:"tombstone_bytes"` // 删除标记占用的字节数，包含在 DeadBytes 中
+	DeadEntries    int   `json:"dead_entries"`    // 被覆盖、删除的记录和删除标记的条数，用于 AutoMergeDeadCount
+
+	IndexMemoryBytes int64 `json:"index_memory_bytes"` // 内存索引占用的估算值
+	RecentWriteHits  int64 `json:"recent_write_hits"`  // Get 直接从最近写入缓冲返回的次数
+	MergeMemoryBytes int64 `json:"merge_memory_bytes"` // 上次 Merge 估算的临时内存峰值
+	Segments         int   `json:"segments"`           // 数据分段的个数，没有分段时为 1
+}
+
+func (db *MiniDB) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stats := Stats{
+		Keys:           db.indexes.len(),
+		FileSize:       db.offset,
+		LoadDuration:   db.loadDuration,
+		CorruptRecords: db.corruptRecords,
+		DeadBytes:      db.deadBytes,
+		BytesWritten:   db.bytesWritten,
+		Tombstones:     db.tombstones,
+		TombstoneBytes: db.tombstoneBytes,
+		DeadEntries:    db.deadEntries,
+
+		IndexMemoryBytes: db.indexes.memoryBytes(),
+		RecentWriteHits:  db.recent.hitCount(),
+		MergeMemoryBytes: db.mergeMemory,
+		Segments:         1,
+	}
+	if s, ok := db.file.(*segmentedStorage); ok {
+		stats.Segments = len(s.names())
+	}
+	if dataBytes := db.offset - FileHeaderSize; dataBytes > 0 {
+		stats.DeadRatio = float64(db.deadBytes) / float64(dataBytes)
+		if liveBytes := dataBytes - db.deadBytes; liveBytes > 0 {
+			stats.WriteAmplification = float64(db.bytesWritten) / float64(liveBytes)
+		}
+	}
+	return stats
+}
+
+// IndexMemoryBytes 估算内存索引占用的字节数 (key 长度加每项的固定开销)，整个索引常驻内存，
+// 可以据此估算机器需要的内存
+func (db *MiniDB) IndexMemoryBytes() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.indexes.memoryBytes()
+}
+
+// Version 返回引擎版本和当前数据文件头中记录的格式版本。旧格式的文件在 Merge 之前保持原来的版本，
+// 依赖新格式的功能 (例如 Sequence) 在此之前不会生效
+func (db *MiniDB) Version() (engineVersion string, formatVersion int) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return EngineVersion, int(db.version)
+}
+
+// KeyInfo 描述一个 key 的最新记录，不包含 value 本身
+type KeyInfo struct {
+	Key       string    `json:"key"`
+	Timestamp time.Time `json:"timestamp"`
+	ValueSize int64     `json:"value_size"`    // value 保存的长度 (压缩时为压缩后的长度)，不包括元数据和序号
+	Offset    int64     `json:"offset"`        // 记录 (分块链) 在数据文件中的起始位置
+	Size      int64     `json:"size"`          // 记录在磁盘上占用的字节数
+	CRC       uint32    `json:"crc"`           // 第一条记录的 CRC，每次写入都会变化
+	Seq       uint64    `json:"seq,omitempty"` // 写入序号，没有开启 Sequence 时为 0
+}
+
+// KeyInfo 只读取记录头，不读取 value
+func (db *MiniDB) KeyInfo(key string) (KeyInfo, error) {
+	if err := db.enter(); err != nil {
+		return KeyInfo{}, err
+	}
+	defer db.inflight.Done()
+	if err := db.settleCounter(key); err != nil {
+		return KeyInfo{}, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	pos, ok := db.indexes.get(key)
+	if !ok {
+		return KeyInfo{}, ErrKeyNotFound
+	}
+	info := KeyInfo{Key: key, Offset: pos.offset, Size: pos.size}
+
+	header := make([]byte, HeaderSize)
+	for off := pos.offset; off < pos.offset+pos.size; {
+		if _, err := db.file.ReadAt(header, off); err != nil {
+			return KeyInfo{}, err
+		}
+		crc, ts, kSize, vSize, flags := DecodeHeaderOrder(header, db.order)
+		if off == pos.offset {
+			info.Timestamp = time.Unix(int64(ts), 0)
+			info.CRC = crc
+			valueOff := off + HeaderSize + int64(kSize)
+			if flags&FlagSequence != 0 {
+				info.Seq = db.seqAt(key, pos)
+				info.ValueSize -= seqSize
+				valueOff += seqSize
+			}
+			if flags&FlagMeta != 0 {
+				metaLen := make([]byte, 1)
+				if _, err := db.file.ReadAt(metaLen, valueOff); err != nil {
+					return KeyInfo{}, err
+				}
+				info.ValueSize -= 1 + int64(metaLen[0])
+			}
+			if flags&FlagValueRef != 0 {
+				// 引用在记录的最后
+				ref := make([]byte, valueRefSize)
+				if _, err := db.file.ReadAt(ref, pos.offset+pos.size-valueRefSize); err != nil {
+					return KeyInfo{}, err
+				}
+				_, _, size, err := db.valueLogValue(key, pos.offset, ref)
+				if err != nil {
+					return KeyInfo{}, err
+				}
+				info.ValueSize += size - valueRefSize
+			}
+		}
+		info.ValueSize += int64(vSize)
+		off += HeaderSize + int64(kSize) + int64(vSize)
+	}
+	return info, nil
+}
@@ -0,0 +1,256 @@
+package minidb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadStatsCountCorruptRecords(t *testing.T) {
+	db := openTestDB(t, Options{})
+	var corrupt []int64
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 1 {
+			info, err := db.KeyInfo(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			corrupt = append(corrupt, info.Offset+info.Size-1)
+		}
+	}
+	opts := db.opts
+	db.Close()
+	for _, off := range corrupt {
+		corruptFileByte(t, db.names.data, off)
+	}
+	// 没有 hint 时才会逐条重放并校验
+	os.Remove(db.names.hint)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	db = openTestDB(t, opts)
+	log.SetOutput(io.Discard)
+
+	stats := db.Stats()
+	if stats.CorruptRecords != 2 || stats.Keys != 4 || stats.LoadDuration <= 0 {
+		t.Fatalf("Stats = %+v, want 2 corrupt records, 4 keys and a load duration", stats)
+	}
+	if !strings.Contains(buf.String(), "Total keys: 4, corrupted records: 2, took ") {
+		t.Fatalf("load log = %q", buf.String())
+	}
+}
+
+func TestDeadRatioAndWriteAmplification(t *testing.T) {
+	db := openTestDB(t, Options{})
+	const record = HeaderSize + 2 + 1 // key "kN"，value "v"
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(stage string, dead, written, live int64) {
+		t.Helper()
+		s := db.Stats()
+		ratio := float64(dead) / float64(s.FileSize-FileHeaderSize)
+		amp := float64(written) / float64(live)
+		if s.DeadBytes != dead || s.BytesWritten != written || s.DeadRatio != ratio || s.WriteAmplification != amp {
+			t.Fatalf("%s: Stats = %+v, want dead %d (ratio %v), written %d (amplification %v)", stage, s, dead, ratio, written, amp)
+		}
+	}
+	check("fresh", 0, 10*record, 10*record)
+
+	for i := 0; i < 5; i++ {
+		if err := db.Put("k0", "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("overwritten", 5*record, 15*record, 10*record)
+	if err := db.Del("k9"); err != nil {
+		t.Fatal(err)
+	}
+	const tombstone = HeaderSize + 2
+	check("deleted", 6*record+tombstone, 15*record+tombstone, 9*record)
+
+	// Merge 只写入存活的记录，无效数据清零，写入量累加
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check("merged", 0, 24*record+tombstone, 9*record)
+
+	data, err := json.Marshal(db.Stats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"dead_ratio":0`, `"write_amplification":`} {
+		if !strings.Contains(string(data), field) {
+			t.Fatalf("/stats JSON %s has no %s", data, field)
+		}
+	}
+}
+
+func TestIndexMemoryBytes(t *testing.T) {
+	const n, keyLen = 100, 50
+	tests := []struct {
+		name   string
+		opts   Options
+		perKey int64 // 每个新 key 增加的估算值
+	}{
+		// 完整 key 的索引，外加 Scan 用的有序列表中的一个 string 头
+		{"map", Options{}, keyLen + mapEntryOverhead + 16},
+		{"hashed", Options{HashedIndex: true}, hashEntryOverhead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, tt.opts)
+			empty := db.IndexMemoryBytes()
+			put := func(i int) {
+				t.Helper()
+				if err := db.Put(fmt.Sprintf("%0*d", keyLen, i), "v"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < n; i++ {
+				put(i)
+			}
+			full := db.IndexMemoryBytes()
+			if got := full - empty; got != n*tt.perKey {
+				t.Fatalf("%d keys added %d bytes, want %d", n, got, n*tt.perKey)
+			}
+			// 覆盖写入不增加索引
+			put(0)
+			if got := db.IndexMemoryBytes(); got != full {
+				t.Fatalf("overwrite changed the estimate from %d to %d", full, got)
+			}
+			if got := db.Stats().IndexMemoryBytes; got != full {
+				t.Fatalf("Stats().IndexMemoryBytes = %d, want %d", got, full)
+			}
+			for i := 0; i < n/2; i++ {
+				if err := db.Del(fmt.Sprintf("%0*d", keyLen, i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := db.IndexMemoryBytes(); got >= full {
+				t.Fatalf("deleting half the keys left the estimate at %d (was %d)", got, full)
+			}
+		})
+	}
+}
+
+func TestTombstoneStats(t *testing.T) {
+	// 删除标记只有记录头和 key
+	tombSize := func(keys ...string) int64 {
+		var n int64
+		for _, k := range keys {
+			n += HeaderSize + int64(len(k))
+		}
+		return n
+	}
+	check := func(t *testing.T, db *MiniDB, stage string, n int, bytes int64) {
+		t.Helper()
+		s := db.Stats()
+		if s.Tombstones != n || s.TombstoneBytes != bytes {
+			t.Fatalf("%s: %d tombstones of %d bytes, want %d of %d", stage, s.Tombstones, s.TombstoneBytes, n, bytes)
+		}
+		if s.TombstoneBytes > s.DeadBytes {
+			t.Fatalf("%s: tombstone bytes %d not counted in dead bytes %d", stage, s.TombstoneBytes, s.DeadBytes)
+		}
+	}
+
+	t.Run("dropped at merge", func(t *testing.T) {
+		fs := &syncHookFS{FileSystem: OSFS}
+		db := openTestDB(t, Options{FS: fs})
+		fs.name = db.names.merge
+		for _, k := range []string{"a", "bb", "ccc"} {
+			if err := db.Put(k, "v"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, k := range []string{"a", "bb"} {
+			if err := db.Del(k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check(t, db, "deleted", 2, tombSize("a", "bb"))
+		db = reopen(t, db)
+		check(t, db, "loaded from hint", 2, tombSize("a", "bb"))
+		db.Close()
+		os.Remove(db.names.hint)
+		db = openTestDB(t, db.opts)
+		fs.name = db.names.merge
+		check(t, db, "replayed", 2, tombSize("a", "bb"))
+
+		// 只有一个数据文件时 Merge 按索引重写，被删除 key 的旧记录不会被拷贝，删除标记全部丢弃；
+		// Merge 期间新写入的删除标记追加在新文件末尾，仍然计数
+		fs.hook = func() {
+			if err := db.Del("ccc"); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		if fs.hook != nil {
+			t.Fatal("merge file was never synced")
+		}
+		check(t, db, "merged", 1, tombSize("ccc"))
+		check(t, reopen(t, db), "reopened after merge", 1, tombSize("ccc"))
+	})
+
+	t.Run("kept within grace period", func(t *testing.T) {
+		// 重放时删除时间取自记录头中的时间戳，时钟从当前时间开始
+		now := time.Now()
+		db := openTestDB(t, Options{DeleteGracePeriod: time.Hour})
+		db.now = func() time.Time { return now }
+		for _, k := range []string{"a", "bb"} {
+			if err := db.Put(k, "v"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Del(k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, "merged within grace period", 2, tombSize("a", "bb"))
+		now = now.Add(2 * time.Hour)
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, "merged after grace period", 0, 0)
+	})
+}
+
+func TestVersion(t *testing.T) {
+	for _, opts := range []Options{{}, {LittleEndian: true}} {
+		db := openTestDB(t, opts)
+		for _, stage := range []string{"created", "reopened"} {
+			if stage == "reopened" {
+				db = reopen(t, db)
+			}
+			header := make([]byte, FileHeaderSize)
+			if _, err := db.file.ReadAt(header, 0); err != nil {
+				t.Fatal(err)
+			}
+			engine, format := db.Version()
+			if engine != EngineVersion || engine == "" {
+				t.Fatalf("%s: engine version %q, want %q", stage, engine, EngineVersion)
+			}
+			// 文件头中的版本总是大端
+			if onDisk := int(binary.BigEndian.Uint16(header[4:6])); format != onDisk || format != FormatVersion {
+				t.Fatalf("%s: format version %d, file header says %d, want %d", stage, format, onDisk, FormatVersion)
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package minidb
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ==========================================
+// 6. 存储抽象 (Storage)
+// ==========================================
+
+// Storage 是引擎对单个文件的全部依赖，Write 总是追加到末尾。
+// 通过 Options.FS 注入其他实现 (内存、远端存储、故障注入等)
+type Storage interface {
+	io.ReaderAt
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Size() (int64, error)
+	Close() error
+}
+
+// FileSystem 负责按名字打开、替换和删除 Storage，flag 与 os.OpenFile 含义相同
+type FileSystem interface {
+	OpenFile(name string, flag int) (Storage, error)
+	Rename(oldName, newName string) error
+	Remove(name string) error
+}
+
+// OSFS 是基于本地文件系统的默认实现
+var OSFS FileSystem = osFS{}
+
+type osFS struct{}
+
+type osFile struct {
+	*os.File
+}
+
+func (osFS) OpenFile(name string, flag int) (Storage, error) {
+	f, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+// Rename 完成后 fsync 所在目录，保证 rename 本身也已落盘
+func (osFS) Rename(oldName, newName string) error {
+	if err := os.Rename(oldName, newName); err != nil {
+		return err
+	}
+	d, err := os.Open(filepath.Dir(newName))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// directReadFS 读取文件时绕过系统页缓存 (O_DIRECT)，写入仍是普通的缓冲写入。
+// 只在 Linux 上生效，其他平台或不支持 O_DIRECT 的文件系统上退回普通读取
+type directReadFS struct {
+	osFS
+}
+
+func (fs directReadFS) OpenFile(name string, flag int) (Storage, error) {
+	f, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return openDirect(osFile{f}, name, flag), nil
+}
+
+func (f osFile) Size() (int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// fdFile 是 OpenFile 传入的文件，不一定以 O_APPEND 打开，Write 前先定位到文件末尾
+type fdFile struct {
+	osFile
+}
+
+func (f fdFile) Write(p []byte) (int, error) {
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+// NewMemFS 返回一个纯内存的 FileSystem，数据不会持久化
+func NewMemFS() FileSystem {
+	return &memFS{files: make(map[string]*memFile)}
+}
+
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+func (fs *memFS) OpenFile(name string, flag int) (Storage, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, ok := fs.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		f = &memFile{}
+		fs.files[name] = f
+	}
+	if flag&os.O_TRUNC != 0 {
+		f.Truncate(0)
+	}
+	return f, nil
+}
+
+func (fs *memFS) Rename(oldName, newName string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, ok := fs.files[oldName]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrNotExist}
+	}
+	fs.files[newName] = f
+	delete(fs.files, oldName)
+	return nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = append(f.data, p...)
+	return len(p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size <= int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return int64(len(f.data)), nil
+}
+
+func (f *memFile) Sync() error  { return nil }
+func (f *memFile) Close() error { return nil }
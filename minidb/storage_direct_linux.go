@@ -0,0 +1,68 @@
+//go:build linux
+
+package minidb
+
+import (
+	"io"
+	"log"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// directAlign 是 O_DIRECT 要求的缓冲区地址、偏移和长度的对齐单位
+const directAlign = 4096
+
+// directFile 的写入仍走普通句柄，读取走另一个 O_DIRECT 句柄，
+// 按块对齐读出后再拷贝需要的部分。内核保证两个句柄看到的数据一致
+type directFile struct {
+	osFile
+	direct *os.File
+}
+
+func openDirect(f osFile, name string, flag int) Storage {
+	if flag&os.O_WRONLY != 0 {
+		return f
+	}
+	d, err := os.OpenFile(name, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if err != nil {
+		log.Printf("Warn: O_DIRECT not supported for %s, falling back to buffered reads: %v", name, err)
+		return f
+	}
+	return directFile{osFile: f, direct: d}
+}
+
+func (f directFile) ReadAt(p []byte, off int64) (int, error) {
+	start := off &^ (directAlign - 1)
+	end := (off + int64(len(p)) + directAlign - 1) &^ (directAlign - 1)
+	buf := alignedBlock(int(end - start))
+
+	n, err := f.direct.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	skip := int(off - start)
+	if n <= skip {
+		return 0, io.EOF
+	}
+	copied := copy(p, buf[skip:n])
+	if copied < len(p) {
+		return copied, io.EOF
+	}
+	return copied, nil
+}
+
+func (f directFile) Close() error {
+	f.direct.Close()
+	return f.osFile.Close()
+}
+
+// alignedBlock 返回起始地址按 directAlign 对齐的缓冲区
+func alignedBlock(size int) []byte {
+	buf := make([]byte, size+directAlign)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (directAlign - 1)); rem != 0 {
+		shift = directAlign - rem
+	}
+	return buf[shift : shift+size]
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package minidb
+
+import (
+	"log"
+	"sync"
+)
+
+var directWarnOnce sync.Once
+
+func openDirect(f osFile, name string, flag int) Storage {
+	directWarnOnce.Do(func() {
+		log.Printf("Warn: O_DIRECT is not supported on this platform, falling back to buffered reads")
+	})
+	return f
+}
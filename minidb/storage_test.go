@@ -0,0 +1,217 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+var errFault = errors.New("injected I/O error")
+
+// faultFS 包装另一个 FileSystem，对名为 name 的文件在读到 badOffset 处的字节或 failWrites 时返回 errFault
+type faultFS struct {
+	FileSystem
+	name string
+
+	mu         sync.Mutex
+	badOffset  int64 // -1 表示不注入读错误
+	failWrites bool
+}
+
+type faultFile struct {
+	Storage
+	fs *faultFS
+}
+
+func (fs *faultFS) OpenFile(name string, flag int) (Storage, error) {
+	f, err := fs.FileSystem.OpenFile(name, flag)
+	if err != nil || name != fs.name {
+		return f, err
+	}
+	return faultFile{f, fs}, nil
+}
+
+func (fs *faultFS) set(badOffset int64, failWrites bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.badOffset, fs.failWrites = badOffset, failWrites
+}
+
+func (f faultFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	bad := f.fs.badOffset
+	f.fs.mu.Unlock()
+	if bad >= off && bad < off+int64(len(p)) {
+		return 0, errFault
+	}
+	return f.Storage.ReadAt(p, off)
+}
+
+func (f faultFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	fail := f.fs.failWrites
+	f.fs.mu.Unlock()
+	if fail {
+		return 0, errFault
+	}
+	return f.Storage.Write(p)
+}
+
+func TestStorageFaults(t *testing.T) {
+	fs := &faultFS{FileSystem: NewMemFS(), badOffset: -1}
+	fs.name = "fault/" + DefaultFilePrefix + ".data"
+	db := openTestDB(t, Options{FS: fs, FilePrefix: "fault/" + DefaultFilePrefix})
+	if db.names.data != fs.name {
+		t.Fatalf("data file is %q", db.names.data)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Put(fmt.Sprintf("k%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := db.KeyInfo("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 读错误原样返回，不当作 key 不存在或数据损坏，也不影响其他 key
+	fs.set(info.Offset+HeaderSize+2, false)
+	if _, err := db.Get("k1"); !errors.Is(err, errFault) {
+		t.Fatalf("Get(k1) = %v, want the injected error", err)
+	}
+	if v, err := db.Get("k0"); err != nil || v != "value" {
+		t.Fatalf("Get(k0) = %q, %v", v, err)
+	}
+	if err := db.Merge(); !errors.Is(err, errFault) {
+		t.Fatalf("Merge = %v, want the injected error", err)
+	}
+
+	// 写入失败时索引保持原样，恢复后可以继续写入
+	fs.set(-1, true)
+	if err := db.Put("k1", "changed"); !errors.Is(err, errFault) {
+		t.Fatalf("Put = %v, want the injected error", err)
+	}
+	fs.set(-1, false)
+	if v, err := db.Get("k1"); err != nil || v != "value" {
+		t.Fatalf("Get(k1) after failed Put = %q, %v", v, err)
+	}
+	if err := db.Put("k3", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一个内存文件系统上重新打开，数据仍在
+	db = reopen(t, db)
+	for i := 0; i < 4; i++ {
+		if v, err := db.Get(fmt.Sprintf("k%d", i)); err != nil || v != "value" {
+			t.Fatalf("Get(k%d) after reopen = %q, %v", i, v, err)
+		}
+	}
+}
+
+// flakyFS 让名为 name 的文件接下来的 failures 次 Write 只写入一半就返回 err
+type flakyFS struct {
+	FileSystem
+	name string
+
+	mu       sync.Mutex
+	failures int
+	err      error
+	attempts int
+}
+
+type flakyFile struct {
+	Storage
+	fs *flakyFS
+}
+
+func (fs *flakyFS) OpenFile(name string, flag int) (Storage, error) {
+	f, err := fs.FileSystem.OpenFile(name, flag)
+	if err != nil || name != fs.name {
+		return f, err
+	}
+	return flakyFile{f, fs}, nil
+}
+
+func (f flakyFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	f.fs.attempts++
+	fail := f.fs.failures > 0
+	if fail {
+		f.fs.failures--
+	}
+	f.fs.mu.Unlock()
+	if !fail {
+		return f.Storage.Write(p)
+	}
+	n, _ := f.Storage.Write(p[:len(p)/2])
+	return n, f.fs.err
+}
+
+func TestWriteRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		failures int
+		err      error
+		attempts int
+		ok       bool
+	}{
+		{"no retries", 0, 1, syscall.EINTR, 1, false},
+		{"retried", 2, 1, syscall.EINTR, 2, true},
+		{"retried twice", 2, 2, syscall.EAGAIN, 3, true},
+		{"out of retries", 2, 3, syscall.EINTR, 3, false},
+		{"fatal error", 3, 1, syscall.EIO, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &flakyFS{FileSystem: NewMemFS(), name: "flaky/" + DBFileName}
+			db := openTestDB(t, Options{FS: fs, FilePrefix: "flaky/" + DefaultFilePrefix, WriteRetries: tt.retries})
+			if err := db.Put("k", "old"); err != nil {
+				t.Fatal(err)
+			}
+			before := db.offset
+
+			fs.mu.Lock()
+			fs.failures, fs.err, fs.attempts = tt.failures, tt.err, 0
+			fs.mu.Unlock()
+			err := db.Put("k", "new")
+			if fs.attempts != tt.attempts {
+				t.Fatalf("%d write attempts, want %d", fs.attempts, tt.attempts)
+			}
+			want := "old"
+			if tt.ok {
+				want = "new"
+				if err != nil {
+					t.Fatalf("Put = %v", err)
+				}
+			} else if !errors.Is(err, tt.err) {
+				t.Fatalf("Put = %v, want %v", err, tt.err)
+			}
+
+			// 重试前截掉了写了一半的数据，文件中最多多出一条完整的记录
+			size, err := db.file.Size()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantSize := before
+			if tt.ok {
+				wantSize += HeaderSize + int64(len("k")+len("new"))
+			}
+			if size != db.offset || size != wantSize {
+				t.Fatalf("file size %d, offset %d, want %d", size, db.offset, wantSize)
+			}
+			db = reopen(t, db)
+			if v, err := db.Get("k"); err != nil || v != want {
+				t.Fatalf("Get after reopen = %q, %v, want %q", v, err, want)
+			}
+			if n := db.Stats().CorruptRecords; n != 0 {
+				t.Fatalf("%d corrupt records after reopen", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// ==========================================
+// 13. 持久化与组提交 (Group Commit)
+// ==========================================
+
+// SyncPolicy 决定写入何时 fsync
+type SyncPolicy int
+
+const (
+	SyncNone   SyncPolicy = iota // 交给操作系统刷盘 (默认)
+	SyncAlways                   // 每次写入返回前都已 fsync，并发写入共享同一次 fsync
+)
+
+// groupSync 实现组提交：同一时刻只有一个写入者 (leader) 执行 fsync，
+// 其他等待者在它完成后检查自己的数据是否已被覆盖，没有再由其中一个发起下一轮
+type groupSync struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	epoch   uint64 // Merge 替换数据文件后加一，旧文件上的等待者直接返回
+	synced  int64  // 当前数据文件已经 fsync 的长度
+	syncing bool
+}
+
+// syncToken 标记一次写入结束时数据文件的位置
+type syncToken struct {
+	epoch  uint64
+	offset int64
+}
+
+func newGroupSync() *groupSync {
+	g := &groupSync{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// update 在写锁内执行 fn，SyncAlways 模式下等到这次写入 fsync 完成后才返回，
+// 等待期间不持有写锁，其他写入可以继续进来并共享下一次 fsync
+func (db *MiniDB) update(fn func() error) error {
+	if db.maintMode.Load() {
+		return ErrMaintenanceMode
+	}
+	if err := db.enter(); err != nil {
+		return err
+	}
+	defer db.inflight.Done()
+	return db.commit(fn)
+}
+
+// commit 是 update 去掉维护模式检查和 enter 之后的部分，调用方需已通过 enter 登记
+func (db *MiniDB) commit(fn func() error) error {
+	tok, err := db.runLocked(fn)
+	// 超出 MaxFileSize 时淘汰旧 key 后重试一次，仍然放不下 (例如单个 value 超过上限) 时返回 ErrFileFull
+	if errors.Is(err, ErrFileFull) {
+		if err = db.evict(); err == nil {
+			tok, err = db.runLocked(fn)
+		}
+	}
+
+	if err != nil || db.opts.SyncPolicy != SyncAlways {
+		return err
+	}
+	return db.waitDurable(tok)
+}
+
+// runLocked 在写锁内执行 fn，返回用于等待落盘的令牌和 fn 的结果
+func (db *MiniDB) runLocked(fn func() error) (syncToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	err := db.checkOffset()
+	if err == nil {
+		db.maybeRotate()
+		err = fn()
+	}
+	if err == nil {
+		db.noteWrite()
+	}
+	return db.syncToken(), err
+}
+
+// defaultOffsetCheckInterval 是 OffsetCheckInterval 为 0 时的抽样间隔
+const defaultOffsetCheckInterval = 1000
+
+// checkOffset 每隔 OffsetCheckInterval 次写入确认数据文件长度仍等于 db.offset。
+// 不一致说明之后的记录位置都会算错，继续写入只会破坏数据。调用方需持有写锁
+func (db *MiniDB) checkOffset() error {
+	if db.diverged != nil {
+		return db.diverged
+	}
+	interval := db.opts.OffsetCheckInterval
+	if interval < 0 {
+		return nil
+	}
+	if interval == 0 {
+		interval = defaultOffsetCheckInterval
+	}
+	db.writeCount++
+	if db.writeCount%interval != 0 {
+		return nil
+	}
+
+	size, err := db.file.Size()
+	if err != nil {
+		return err
+	}
+	if size > db.offset && db.opts.AdoptExternalAppends {
+		if err := db.adoptAppends(size); !errors.Is(err, ErrStateDivergence) {
+			return err
+		}
+	}
+	if size != db.offset {
+		db.diverged = fmt.Errorf("%w: file size %d, offset %d", ErrStateDivergence, size, db.offset)
+		log.Printf("Error: %v, rejecting further writes", db.diverged)
+		return db.diverged
+	}
+	return nil
+}
+
+// adoptAppends 重放其他进程追加到 [db.offset, size) 的记录，随后的写入追加在它们之后。
+// 数据文件以 O_APPEND 打开，物理写入总在真实的末尾，只有索引中的位置需要跟上。
+// 末尾有不完整的记录时不能接着写，返回 ErrStateDivergence。调用方需持有写锁
+func (db *MiniDB) adoptAppends(size int64) error {
+	tail, err := db.replay(db.offset, size)
+	if err != nil {
+		return err
+	}
+	if tail != size {
+		return ErrStateDivergence
+	}
+	log.Printf("Warn: Adopted %d bytes appended to the data file by another process", size-db.offset)
+	db.offset = size
+	return nil
+}
+
+// syncToken 调用方需持有锁
+func (db *MiniDB) syncToken() syncToken {
+	db.gsync.mu.Lock()
+	defer db.gsync.mu.Unlock()
+	return syncToken{epoch: db.gsync.epoch, offset: db.offset}
+}
+
+func (db *MiniDB) waitDurable(tok syncToken) error {
+	g := db.gsync
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for g.epoch == tok.epoch && g.synced < tok.offset {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+
+		g.syncing = true
+		g.mu.Unlock()
+		epoch, target, err := db.syncFile()
+		g.mu.Lock()
+		g.syncing = false
+		g.cond.Broadcast()
+		if epoch != g.epoch {
+			// fsync 期间 Merge 替换了文件 (旧句柄可能已关闭)，新文件在替换前已经 fsync
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if target > g.synced {
+			g.synced = target
+		}
+	}
+	return nil
+}
+
+// syncFile 对当前数据文件执行 fsync，返回本次覆盖到的位置。
+// fsync 时不持有锁，期间的新写入会在下一轮 fsync 中一起落盘
+func (db *MiniDB) syncFile() (uint64, int64, error) {
+	db.mu.RLock()
+	file, vlog, target := db.file, db.vlog, db.offset
+	db.gsync.mu.Lock()
+	epoch := db.gsync.epoch
+	db.gsync.mu.Unlock()
+	db.mu.RUnlock()
+
+	// 数据文件中的引用落盘前，value log 中对应的 value 必须先落盘
+	if vlog != nil {
+		if err := vlog.Sync(); err != nil {
+			return epoch, target, err
+		}
+	}
+	if err := db.injectFault(fpBeforeSync); err != nil {
+		return epoch, target, err
+	}
+	return epoch, target, file.Sync()
+}
+
+// DurableOffset 返回当前数据文件中已经 fsync 的长度，之前的记录在断电后也不会丢失，
+// 复制的跟随者可以把它作为断点。Open 时 fsync 整个文件后为文件长度，之后只由组提交和 Sync 推进，
+// SyncNone 下不调用 Sync 就一直不变；Merge 替换数据文件后为新文件的长度 (新文件在替换前已经整体 fsync)。
+// 只读打开时总是 0
+func (db *MiniDB) DurableOffset() int64 {
+	g := db.gsync
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.synced
+}
+
+// Sync 立即 fsync 到目前为止写入的数据，返回之后的 DurableOffset。与并发写入的组提交共享同一次 fsync
+func (db *MiniDB) Sync() (int64, error) {
+	if db.opts.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	if err := db.enter(); err != nil {
+		return 0, err
+	}
+	defer db.inflight.Done()
+
+	db.mu.RLock()
+	tok := db.syncToken()
+	db.mu.RUnlock()
+	if err := db.waitDurable(tok); err != nil {
+		return 0, err
+	}
+	return db.DurableOffset(), nil
+}
+
+// resetSync 在 Merge 替换数据文件后调用，synced 为新文件已经 fsync 的长度。调用方需持有写锁
+func (db *MiniDB) resetSync(synced int64) {
+	g := db.gsync
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.epoch++
+	g.synced = synced
+	g.cond.Broadcast()
+}
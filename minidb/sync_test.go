@@ -0,0 +1,76 @@
+package minidb
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// BenchmarkDurablePut 比较 SyncAlways 下单个写入者和 50 个并发写入者的吞吐，后者共享组提交的 fsync
+func BenchmarkDurablePut(b *testing.B) {
+	for _, writers := range []int{1, 50} {
+		b.Run(fmt.Sprintf("writers=%d", writers), func(b *testing.B) {
+			db := openTestDB(b, Options{SyncPolicy: SyncAlways})
+			b.ResetTimer()
+
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := w; i < b.N; i += writers {
+						if err := db.Put(fmt.Sprintf("k%d", i), "value"); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "puts/s")
+		})
+	}
+}
+
+func TestDurablePutConcurrent(t *testing.T) {
+	db := openTestDB(t, Options{SyncPolicy: SyncAlways})
+	var wg sync.WaitGroup
+	for w := 0; w < 50; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := db.Put(fmt.Sprintf("w%d-%d", w, i), "value"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if got := db.DurableOffset(); got != db.offset {
+		t.Fatalf("DurableOffset = %d after all puts returned, want %d", got, db.offset)
+	}
+}
+
+func TestDurableOffsetAfterOpen(t *testing.T) {
+	db := openTestDB(t, Options{})
+	if got := db.DurableOffset(); got != FileHeaderSize {
+		t.Fatalf("DurableOffset of a new file = %d, want %d", got, FileHeaderSize)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("k%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// SyncNone 下没有 fsync，重新打开后整个文件都已落盘，崩溃也不会丢掉之前的写入
+	db = reopen(t, db)
+	if got := db.DurableOffset(); got != db.offset {
+		t.Fatalf("DurableOffset after reopen = %d, want %d", got, db.offset)
+	}
+	crash(t, db)
+	db = reopen(t, db)
+	if v, err := db.Get("k9"); err != nil || v != "value" {
+		t.Fatalf("Get after crash = %q, %v", v, err)
+	}
+}
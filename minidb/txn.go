@@ -0,0 +1,225 @@
+package minidb
+
+import "errors"
+
+// ==========================================
+// 9. 事务与批量写入 (Transaction)
+// ==========================================
+
+var (
+	ErrTxnClosed     = errors.New("transaction already committed or rolled back")
+	ErrBatchTooLarge = errors.New("batch too large")
+)
+
+// batchMarkerSize 是批次开始标记的大小: 空 key，value 为 8 字节的批次长度
+const batchMarkerSize = HeaderSize + 8
+
+// batchOp 是批量写入中的一个操作
+type batchOp struct {
+	key       string
+	value     []byte
+	meta      []byte
+	tombstone bool
+}
+
+// batchRecord 是已落盘、等待应用到索引的一条完整记录
+type batchRecord struct {
+	key       string
+	pos       recordPos
+	tombstone bool
+	ts        uint32 // 重放时记录头中的时间戳，0 表示刚刚写入
+	seq       uint64 // 重放时记录中的序号，0 表示没有序号或刚刚写入
+}
+
+// writeBatch 把 ops 编码后一次性连续写入，成功后再统一更新索引。
+// 多条记录时前面带一个 FlagBatch 开始标记，重启时不完整的批次会被整体丢弃。调用方需持有写锁
+func (db *MiniDB) writeBatch(ops []batchOp) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if limit := db.opts.MaxBatchSize; limit > 0 {
+		size := 0
+		for _, op := range ops {
+			size += HeaderSize + len(op.key) + len(op.meta) + len(op.value)
+		}
+		if size > limit {
+			return ErrBatchTooLarge
+		}
+	}
+
+	var buf []byte
+	var records []batchRecord
+	exists := make(map[string]bool)
+	delta := 0
+
+	for _, op := range ops {
+		if op.key == "" {
+			return ErrEmptyKey
+		}
+		if db.opts.MaxValueSize > 0 && len(op.value) > db.opts.MaxValueSize {
+			return ErrValueTooLarge
+		}
+		if err := db.checkMeta(len(op.meta) > 0); err != nil {
+			return err
+		}
+		ok, seen := exists[op.key]
+		if !seen {
+			_, ok = db.indexes.get(op.key)
+		}
+
+		start := len(buf)
+		if op.tombstone {
+			if !ok {
+				continue
+			}
+			value, flags := db.stamp(nil)
+			entry := NewEntry([]byte(op.key), value)
+			entry.Flags |= FlagTombstone | flags
+			buf = append(buf, db.encode(entry)...)
+			delta--
+		} else {
+			entries, err := db.encodeEntries([]byte(op.key), op.value, op.meta)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				buf = append(buf, db.encode(entry)...)
+			}
+			if !ok {
+				delta++
+			}
+		}
+		exists[op.key] = !op.tombstone
+		records = append(records, batchRecord{
+			key:       op.key,
+			pos:       recordPos{offset: int64(start), size: int64(len(buf) - start)},
+			tombstone: op.tombstone,
+		})
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+	if delta > 0 && db.opts.MaxKeys > 0 && db.indexes.len()+delta > db.opts.MaxKeys {
+		return ErrTooManyKeys
+	}
+
+	if err := db.checkDiskSpace(int64(batchMarkerSize + len(buf))); err != nil {
+		return err
+	}
+	if err := db.checkFileSize(int64(batchMarkerSize + len(buf))); err != nil {
+		return err
+	}
+
+	base := db.offset
+	if len(records) > 1 {
+		size := make([]byte, 8)
+		db.order.PutUint64(size, uint64(len(buf)))
+		marker := NewEntry(nil, size)
+		marker.Flags |= FlagBatch
+		buf = append(db.encode(marker), buf...)
+		base += batchMarkerSize
+	}
+
+	n, err := db.write(buf)
+	if err != nil {
+		return err
+	}
+	db.offset += int64(n)
+	db.bytesWritten += int64(n)
+
+	for _, r := range records {
+		r.pos.offset += base
+		db.applyRecord(r)
+	}
+	if len(records) > 1 {
+		db.deadBytes += batchMarkerSize
+	}
+	return nil
+}
+
+// Op 是 Apply 中的一个操作: Delete 为 true 时删除 Key，否则把 Key 设为 Value
+type Op struct {
+	Key    string
+	Value  string
+	Delete bool
+}
+
+// Apply 把 ops 作为一个批次连续写入，并在同一把锁内更新索引，重启后要么全部生效要么全部丢弃。
+// 任何一个操作不合法 (空 key、value 过大等) 时什么都不写。同一个 key 出现多次时以最后一次为准，
+// Rename 这类跨 key 的修改可以写成一个 Set 加一个 Delete
+func (db *MiniDB) Apply(ops []Op) error {
+	batch := make([]batchOp, len(ops))
+	for i, op := range ops {
+		batch[i] = batchOp{key: op.Key, value: []byte(op.Value), tombstone: op.Delete}
+	}
+	return db.update(func() error {
+		return db.writeBatch(batch)
+	})
+}
+
+// Txn 在内存中缓存写操作，Commit 时作为一个批次连续写入并在同一把锁内更新索引，
+// 其他读者要么看到全部修改，要么一个都看不到。事务不做冲突检测，并发提交时后提交的覆盖先提交的
+type Txn struct {
+	db     *MiniDB
+	ops    []batchOp
+	writes map[string]int // key -> 最后一次写操作在 ops 中的下标
+	closed bool
+}
+
+func (db *MiniDB) Begin() *Txn {
+	return &Txn{db: db, writes: make(map[string]int)}
+}
+
+func (tx *Txn) Set(key, value string) error {
+	return tx.add(batchOp{key: key, value: []byte(value)})
+}
+
+func (tx *Txn) Del(key string) error {
+	return tx.add(batchOp{key: key, tombstone: true})
+}
+
+func (tx *Txn) add(op batchOp) error {
+	if tx.closed {
+		return ErrTxnClosed
+	}
+	if op.key == "" {
+		return ErrEmptyKey
+	}
+	tx.writes[op.key] = len(tx.ops)
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+// Get 优先返回事务内尚未提交的写入
+func (tx *Txn) Get(key string) (string, error) {
+	if tx.closed {
+		return "", ErrTxnClosed
+	}
+	if i, ok := tx.writes[key]; ok {
+		if tx.ops[i].tombstone {
+			return "", ErrKeyNotFound
+		}
+		return string(tx.ops[i].value), nil
+	}
+	return tx.db.Get(key)
+}
+
+func (tx *Txn) Commit() error {
+	if tx.closed {
+		return ErrTxnClosed
+	}
+	tx.closed = true
+
+	return tx.db.update(func() error {
+		return tx.db.writeBatch(tx.ops)
+	})
+}
+
+// Rollback 丢弃所有未提交的写入
+func (tx *Txn) Rollback() {
+	tx.closed = true
+	tx.ops = nil
+	tx.writes = nil
+}
@@ -0,0 +1,229 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTxnCommitAndRollback(t *testing.T) {
+	db := openTestDB(t, Options{})
+	if err := db.Put("a", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := db.Begin()
+	tx.Set("a", "new")
+	tx.Set("b", "2")
+	tx.Del("a")
+	if _, err := tx.Get("a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("txn Get deleted key = %v, want ErrKeyNotFound", err)
+	}
+	if v, _ := tx.Get("b"); v != "2" {
+		t.Fatalf("txn Get pending key = %q", v)
+	}
+	if v, _ := db.Get("a"); v != "old" {
+		t.Fatalf("uncommitted write visible: %q", v)
+	}
+	tx.Rollback()
+	if _, err := db.Get("b"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("rolled back write visible: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxnClosed) {
+		t.Fatalf("Commit after Rollback = %v, want ErrTxnClosed", err)
+	}
+
+	tx = db.Begin()
+	tx.Set("a", "new")
+	tx.Set("b", "2")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db = reopen(t, db)
+	for k, want := range map[string]string{"a": "new", "b": "2"} {
+		if v, err := db.Get(k); err != nil || v != want {
+			t.Fatalf("Get(%q) = %q, %v, want %q", k, v, err, want)
+		}
+	}
+}
+
+func TestReplayTornTail(t *testing.T) {
+	tests := []struct {
+		name string
+		cut  int64 // 从文件末尾截掉的字节数
+	}{
+		{"partial header", HeaderSize + 3},
+		{"partial payload", 2},
+		{"last batch record", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, Options{})
+			if err := db.Put("a", "1"); err != nil {
+				t.Fatal(err)
+			}
+			full := db.offset
+			tx := db.Begin()
+			tx.Set("b", "2")
+			tx.Set("c", "3")
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			end := db.offset
+			opts := db.opts
+			db.Close()
+			data := newFileNames(opts.FilePrefix, opts.Extension).data
+			os.Remove(newFileNames(opts.FilePrefix, opts.Extension).hint)
+			if err := os.Truncate(data, end-tt.cut); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := OpenWithOptions(opts)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer db.Close()
+			if db.offset != full {
+				t.Fatalf("offset = %d, want the batch truncated back to %d", db.offset, full)
+			}
+			if v, err := db.Get("a"); err != nil || v != "1" {
+				t.Fatalf("Get(a) = %q, %v", v, err)
+			}
+			if _, err := db.Get("b"); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("Get(b) from a torn batch = %v, want ErrKeyNotFound", err)
+			}
+		})
+	}
+}
+
+func TestReplayCorruptLengthMidFile(t *testing.T) {
+	db := openTestDB(t, Options{})
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Put(k, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := db.opts
+	db.Close()
+	names := newFileNames(opts.FilePrefix, opts.Extension)
+	os.Remove(names.hint)
+
+	// 把第一条记录的 vSize 改成远超文件末尾的值
+	f, err := os.OpenFile(names.data, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0x7F, 0, 0, 0}, FileHeaderSize+12); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := f.Stat()
+	f.Close()
+
+	if _, err := OpenWithOptions(opts); !errors.Is(err, ErrDataCorrupted) {
+		t.Fatalf("open = %v, want ErrDataCorrupted", err)
+	}
+	after, err := os.Stat(names.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() != before.Size() {
+		t.Fatalf("data file shrank from %d to %d bytes", before.Size(), after.Size())
+	}
+}
+
+// shortWriteFS 打开的文件在 fail 置位后每次 Write 只写一半就返回错误，模拟磁盘写满
+type shortWriteFS struct {
+	FileSystem
+	fail *atomic.Bool
+}
+
+type shortWriteFile struct {
+	Storage
+	fail *atomic.Bool
+}
+
+var errShortWrite = errors.New("short write")
+
+func (fs shortWriteFS) OpenFile(name string, flag int) (Storage, error) {
+	f, err := fs.FileSystem.OpenFile(name, flag)
+	if err != nil {
+		return nil, err
+	}
+	return shortWriteFile{f, fs.fail}, nil
+}
+
+func (f shortWriteFile) Write(p []byte) (int, error) {
+	if !f.fail.Load() {
+		return f.Storage.Write(p)
+	}
+	n, _ := f.Storage.Write(p[:len(p)/2])
+	return n, errShortWrite
+}
+
+func TestApplyFailureLeavesDBUnchanged(t *testing.T) {
+	tests := []struct {
+		name      string
+		ops       []Op
+		failWrite bool
+		wantErr   error
+	}{
+		{
+			name:    "empty key",
+			ops:     []Op{{Key: "a", Value: "new"}, {Key: ""}, {Key: "c", Value: "3"}},
+			wantErr: ErrEmptyKey,
+		},
+		{
+			name:    "value too large",
+			ops:     []Op{{Key: "a", Value: "new"}, {Key: "c", Value: strings.Repeat("x", 100)}},
+			wantErr: ErrValueTooLarge,
+		},
+		{
+			name:    "batch too large",
+			ops:     []Op{{Key: "a", Value: strings.Repeat("x", 60)}, {Key: "c", Value: strings.Repeat("y", 60)}, {Key: "d", Value: strings.Repeat("z", 60)}},
+			wantErr: ErrBatchTooLarge,
+		},
+		{
+			name:      "short write",
+			ops:       []Op{{Key: "a", Value: "new"}, {Key: "b", Delete: true}, {Key: "c", Value: "3"}},
+			failWrite: true,
+			wantErr:   errShortWrite,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fail := new(atomic.Bool)
+			db := openTestDB(t, Options{
+				FS:           shortWriteFS{OSFS, fail},
+				MaxValueSize: 64,
+				MaxBatchSize: 200,
+			})
+			if err := db.Put("a", "1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put("b", "2"); err != nil {
+				t.Fatal(err)
+			}
+			want, offset := dump(t, db), db.offset
+
+			fail.Store(tt.failWrite)
+			if err := db.Apply(tt.ops); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Apply = %v, want %v", err, tt.wantErr)
+			}
+			fail.Store(false)
+			if db.offset != offset {
+				t.Fatalf("offset = %d, want %d", db.offset, offset)
+			}
+			if got := dump(t, db); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("state = %v, want %v", got, want)
+			}
+
+			db = reopen(t, db)
+			if got := dump(t, db); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("state after reopen = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package minidb
+
+import (
+	"bufio"
+	"io"
+)
+
+// ==========================================
+// 22. 在线校验 (Verify)
+// ==========================================
+
+// verifyProgressInterval 是 Verify 两次报告进度之间扫描的字节数
+const verifyProgressInterval = 64 << 20
+
+// verifyPageSize 是 Verify 每次与 Merge 互斥连续扫描的字节数，两页之间不阻塞 Merge
+const verifyPageSize = 4 << 20
+
+// VerifyProgress 是 Verify 的扫描进度，扫描结束时也作为最终结果返回
+type VerifyProgress struct {
+	Scanned int64 `json:"scanned"` // 已扫描的字节数 (包括文件头)
+	Total   int64 `json:"total"`   // 开始扫描时数据文件和 value log 的总长度，之后追加的记录不在本次校验范围内
+	Records int   `json:"records"` // 已校验的记录数
+	Corrupt int   `json:"corrupt"` // 其中 CRC 校验失败或不完整的记录数
+}
+
+// verifyFile 是 Verify 要扫描的一个文件及其范围
+type verifyFile struct {
+	file       Storage
+	start, end int64
+	valueLog   bool
+	merges     int // 分段存储开始扫描时的 merges，Merge 替换分段后 file 本身不变
+}
+
+// Verify 顺序扫描整个数据文件和 value log 并校验每条记录的 CRC，不修改索引，也不在整个扫描期间持有锁。
+// 每发现一条损坏的记录调用一次 onCorrupt，每扫描 verifyProgressInterval 字节调用一次 onProgress，
+// 两者都可以为 nil，返回错误时扫描立即停止 (例如客户端已断开)。
+// 记录长度超出文件末尾时无法找到下一条记录，报告后停止扫描这个文件。
+// 每页 (verifyPageSize) 的扫描与 Merge 互斥，期间 Merge 返回 ErrMergeInProgress；回调在两页之间调用，
+// 客户端读得慢不会阻塞 Merge。两页之间 Merge 替换了正在扫描的文件时 Verify 返回 ErrMergeInProgress
+func (db *MiniDB) Verify(onCorrupt func(*CorruptionError) error, onProgress func(VerifyProgress) error) (VerifyProgress, error) {
+	if err := db.enter(); err != nil {
+		return VerifyProgress{}, err
+	}
+	defer db.inflight.Done()
+
+	db.mu.RLock()
+	files := []verifyFile{{file: db.file, start: FileHeaderSize, end: db.offset}}
+	if s, ok := db.file.(*segmentedStorage); ok {
+		files[0].merges = s.merges
+	}
+	if db.vlog != nil && db.vlogOffset > 0 {
+		files = append(files, verifyFile{file: db.vlog, end: db.vlogOffset, valueLog: true})
+	}
+	db.mu.RUnlock()
+
+	p := VerifyProgress{Scanned: FileHeaderSize}
+	for _, f := range files {
+		p.Total += f.end
+	}
+	next := int64(verifyProgressInterval)
+	for _, f := range files {
+		reader := bufio.NewReader(io.NewSectionReader(f.file, f.start, f.end-f.start))
+		for off, done := f.start, false; off < f.end && !done; {
+			// 扫描一页时占用 merging 标记，避免扫描途中文件被替换
+			if err := db.claimVerify(f); err != nil {
+				return p, err
+			}
+			var corrupt []*CorruptionError
+			var err error
+			pageEnd := off + verifyPageSize
+			for off < f.end && off < pageEnd {
+				var cerr *CorruptionError
+				var size int64
+				if cerr, size, err = db.verifyRecord(reader, off, f.end); err != nil {
+					break
+				}
+				if cerr != nil {
+					cerr.ValueLog = f.valueLog
+					corrupt = append(corrupt, cerr)
+					p.Corrupt++
+				}
+				if size == 0 {
+					done = true
+					break
+				}
+				p.Records++
+				off += size
+				p.Scanned += size
+			}
+			db.merging.Store(false)
+
+			if onCorrupt != nil {
+				for _, cerr := range corrupt {
+					if err := onCorrupt(cerr); err != nil {
+						return p, err
+					}
+				}
+			}
+			if err != nil {
+				return p, err
+			}
+			if p.Scanned >= next && onProgress != nil {
+				next = p.Scanned + verifyProgressInterval
+				if err := onProgress(p); err != nil {
+					return p, err
+				}
+			}
+		}
+	}
+	return p, nil
+}
+
+// claimVerify 占用 merging 标记并确认 f 仍是当前的数据文件或 value log
+func (db *MiniDB) claimVerify(f verifyFile) error {
+	if !db.merging.CompareAndSwap(false, true) {
+		return ErrMergeInProgress
+	}
+	db.mu.RLock()
+	current, merges := db.file, 0
+	if s, ok := current.(*segmentedStorage); ok {
+		merges = s.merges
+	}
+	if f.valueLog {
+		current, merges = db.vlog, 0
+	}
+	db.mu.RUnlock()
+	if current != f.file || merges != f.merges {
+		db.merging.Store(false)
+		return ErrMergeInProgress
+	}
+	return nil
+}
+
+// verifyRecord 从 reader 读取 off 处的一条记录并校验 CRC，返回记录长度。
+// 记录超出 end 时返回的长度为 0，之后的内容无法解析
+func (db *MiniDB) verifyRecord(reader *bufio.Reader, off, end int64) (*CorruptionError, int64, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, 0, err
+	}
+	crc, _, kSize, vSize, _ := DecodeHeaderOrder(header, db.order)
+	size := HeaderSize + int64(kSize) + int64(vSize)
+	if off+size > end {
+		return &CorruptionError{Offset: off}, 0, nil
+	}
+
+	payload := make([]byte, size-HeaderSize)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, err
+	}
+	if actual := db.checksum(header, payload); actual != crc {
+		return &CorruptionError{Offset: off, Key: string(payload[:kSize]), Expected: crc, Actual: actual}, size, nil
+	}
+	return nil, size, nil
+}
@@ -0,0 +1,110 @@
+package minidb
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// corruptFileByte 改写 name 中 off 处的一个字节
+func corruptFileByte(t *testing.T, name string, off int64) {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("X"), off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name         string
+		corrupt      func(t *testing.T, db *MiniDB)
+		wantCorrupt  int
+		wantValueLog bool
+	}{
+		{name: "clean", corrupt: func(*testing.T, *MiniDB) {}},
+		{name: "data file", corrupt: corruptLastByte, wantCorrupt: 1},
+		{name: "value log", corrupt: func(t *testing.T, db *MiniDB) {
+			corruptFileByte(t, db.names.vlog, db.vlogOffset-1)
+		}, wantCorrupt: 1, wantValueLog: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, Options{ValueLogThreshold: 16})
+			if err := db.Put("small", "v"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put("large", strings.Repeat("L", 64)); err != nil {
+				t.Fatal(err)
+			}
+			tt.corrupt(t, db)
+
+			var got []*CorruptionError
+			p, err := db.Verify(func(cerr *CorruptionError) error {
+				got = append(got, cerr)
+				return nil
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 数据文件中两条记录，value log 中一条
+			if p.Records != 3 || p.Corrupt != tt.wantCorrupt || len(got) != tt.wantCorrupt {
+				t.Fatalf("Verify = %+v with %d reports, want 3 records and %d corrupt", p, len(got), tt.wantCorrupt)
+			}
+			if p.Scanned != p.Total || p.Total != db.offset+db.vlogOffset {
+				t.Fatalf("scanned %d of %d bytes, want %d", p.Scanned, p.Total, db.offset+db.vlogOffset)
+			}
+			if len(got) > 0 && got[0].ValueLog != tt.wantValueLog {
+				t.Fatalf("corruption %v: ValueLog = %v, want %v", got[0], got[0].ValueLog, tt.wantValueLog)
+			}
+		})
+	}
+}
+
+// 回调在两页之间调用，客户端处理得慢时 Merge 不会被挡住
+func TestMergeDuringVerifyCallback(t *testing.T) {
+	db := openTestDB(t, Options{})
+	for _, k := range []string{"a", "b", "a"} {
+		if err := db.Put(k, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corruptLastByte(t, db)
+
+	var mergeErr error
+	_, err := db.Verify(func(*CorruptionError) error {
+		mergeErr = db.Merge()
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("Verify = %v", err)
+	}
+	if mergeErr != nil {
+		t.Fatalf("Merge from the Verify callback = %v", mergeErr)
+	}
+}
+
+func TestVerifyStopsWhenMergeReplacesFile(t *testing.T) {
+	db := openTestDB(t, Options{})
+	// 两页以上的数据，第一页的回调中 Merge 替换数据文件
+	value := strings.Repeat("v", 64<<10)
+	for i := 0; i < 2*verifyPageSize/len(value)+1; i++ {
+		if err := db.Put("k", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corruptFileByte(t, db.names.data, FileHeaderSize+HeaderSize)
+
+	_, err := db.Verify(func(*CorruptionError) error { return db.Merge() }, nil)
+	if !errors.Is(err, ErrMergeInProgress) {
+		t.Fatalf("Verify = %v, want ErrMergeInProgress", err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatalf("Merge after Verify = %v", err)
+	}
+}
@@ -0,0 +1,452 @@
+package minidb
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// ==========================================
+// 14. 键值分离 (Value Log)
+// ==========================================
+
+// 超过 ValueLogThreshold 的 value 写入单独的 value log，数据文件中只保留一条
+// 带 FlagValueRef 的小记录，value 为指向 value log 的引用 [Offset 8][Size 4]。
+// Merge 只拷贝数据文件中的 key 和引用，大 value 不再被反复重写。
+// value log 中的记录与数据文件格式相同 (带 key 和 CRC)。失效数据超过 ValueLogGCRatio 时 Merge 把仍被引用的
+// value 拷贝到新的 value log 并改写引用，见 valueLogGC。
+// 开启 DedupThreshold 时 Merge 把相同的大 value 写成 key 为空的共享记录，多个 key 的引用指向同一条
+const (
+	ValueLogFileName = "minidb.vlog"
+	valueRefSize     = 12
+)
+
+var (
+	ErrValueLogMissing     = errors.New("value log not found")
+	ErrValueLogUnsupported = errors.New("value log is not supported for a database opened from a file handle")
+)
+
+// openValueLog 打开 value log。只有开启了 ValueLogThreshold 的读写模式才会创建文件，
+// 文件不存在时 db.vlog 保持为 nil，读到引用时返回 ErrValueLogMissing
+func (db *MiniDB) openValueLog() error {
+	// 合并视图中各个文件的 value log 由 mergedStorage 打开；OpenFile 传入的文件没有可以推算的路径，
+	// 按默认文件名打开会用到 (或在当前目录下新建) 别的库的 value log
+	switch db.file.(type) {
+	case *mergedStorage, fdFile:
+		return nil
+	}
+	flag := os.O_RDWR | os.O_APPEND
+	switch {
+	case db.opts.ReadOnly:
+		flag = os.O_RDONLY
+	case db.opts.ValueLogThreshold > 0 || db.opts.DedupThreshold > 0:
+		flag |= os.O_CREATE
+	}
+
+	file, err := db.fs.OpenFile(db.names.vlog, flag)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	db.vlog = file
+	if db.vlogOffset, err = file.Size(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// useValueLog 判断 value 是否写入 value log。版本 3 之前的数据文件不认识 FlagValueRef，始终内联保存
+func (db *MiniDB) useValueLog(value []byte) bool {
+	return db.opts.ValueLogThreshold > 0 && len(value) > db.opts.ValueLogThreshold &&
+		db.vlog != nil && db.version >= 3
+}
+
+// encodeEntries 返回 value 在数据文件中对应的记录: 先按需压缩，大 value 再写入 value log。调用方需持有写锁
+func (db *MiniDB) encodeEntries(key, value, meta []byte) ([]*Entry, error) {
+	var flags uint8
+	if compressed, ok := db.compress(value); ok {
+		value, flags = compressed, FlagCompressed
+	}
+	if !db.useValueLog(value) {
+		entries := db.splitEntries(key, value, meta)
+		for _, entry := range entries {
+			entry.Flags |= flags
+		}
+		return entries, nil
+	}
+
+	ref, err := db.appendValueLog(key, value)
+	if err != nil {
+		return nil, err
+	}
+	entries := db.splitEntries(key, ref, meta)
+	for _, entry := range entries {
+		entry.Flags |= flags | FlagValueRef
+	}
+	return entries, nil
+}
+
+// appendValueLog 把 value 写入 value log 并返回指向它的引用。key 为空的记录由 Merge 去重时写入，
+// 被多个 key 共享。调用方需持有写锁
+func (db *MiniDB) appendValueLog(key, value []byte) ([]byte, error) {
+	n, err := writeBuffers(db.vlog, db.encodeBuffers(NewEntry(key, value)))
+	if err != nil {
+		db.vlog.Truncate(db.vlogOffset)
+		return nil, err
+	}
+	ref := make([]byte, valueRefSize)
+	db.order.PutUint64(ref[0:8], uint64(db.vlogOffset))
+	db.order.PutUint32(ref[8:12], uint32(n))
+	db.vlogOffset += int64(n)
+	db.bytesWritten += int64(n)
+	return ref, nil
+}
+
+// valueLogAt 返回数据文件 at 处的记录中的引用指向的 value log，没有时为 nil。
+// 合并视图中的引用指向记录所在文件各自的 value log
+func (db *MiniDB) valueLogAt(at int64) Storage {
+	if m, ok := db.file.(*mergedStorage); ok {
+		return m.valueLogAt(at)
+	}
+	return db.vlog
+}
+
+// valueLogValue 返回数据文件 at 处的记录中的引用指向的 value 所在的 value log、位置和长度，只读取记录头。
+// 共享记录的 key 为空，不能按调用方的 key 推算 value 的位置
+func (db *MiniDB) valueLogValue(key string, at int64, ref []byte) (vlog Storage, offset, size int64, err error) {
+	if len(ref) != valueRefSize {
+		return nil, 0, 0, &CorruptionError{Offset: at, Key: key}
+	}
+	if vlog = db.valueLogAt(at); vlog == nil {
+		return nil, 0, 0, ErrValueLogMissing
+	}
+	recOffset := int64(db.order.Uint64(ref[0:8]))
+	header := make([]byte, HeaderSize)
+	if err := readFull(vlog, header, recOffset, key); err != nil {
+		return nil, 0, 0, err
+	}
+	_, _, kSize, vSize, _ := DecodeHeaderOrder(header, db.order)
+	if HeaderSize+int64(kSize)+int64(vSize) != int64(db.order.Uint32(ref[8:12])) {
+		return nil, 0, 0, &CorruptionError{Offset: recOffset, Key: key, ValueLog: true}
+	}
+	return vlog, recOffset + HeaderSize + int64(kSize), int64(vSize), nil
+}
+
+// dedupRecord 读取 pos 处的单条内联记录，value (元数据之后) 超过 DedupThreshold 时改写成指向 value log 的引用，
+// 内容相同 (SHA-256 相同) 的 value 只在 value log 中写一份，seen 记录已经写过的 value，
+// grow 为 false 时 seen 已达到内存上限，只复用其中已有的 value。
+// ok 为 false 表示记录不适合去重 (分块、删除标记、已经是引用或 CRC 校验失败)，由调用方原样拷贝。
+// 共享的 value 由 appendShared 写入 value log 并返回引用
+func (db *MiniDB) dedupRecord(file Storage, key string, pos recordPos, seen map[[sha256.Size]byte][]byte, grow bool,
+	appendShared func(value []byte) ([]byte, error)) (record []byte, ok bool, err error) {
+	if pos.size <= HeaderSize+int64(len(key))+int64(db.opts.DedupThreshold) {
+		return nil, false, nil
+	}
+	raw := make([]byte, pos.size)
+	if err := readFull(file, raw, pos.offset, key); err != nil {
+		return nil, false, err
+	}
+	crc, ts, kSize, vSize, flags := DecodeHeaderOrder(raw, db.order)
+	if HeaderSize+int64(kSize)+int64(vSize) != pos.size || flags&(FlagChunked|FlagTombstone|FlagBatch|FlagValueRef) != 0 ||
+		db.checksum(raw[:HeaderSize], raw[HeaderSize:]) != crc {
+		return nil, false, nil
+	}
+
+	// 序号和元数据原样保留在新记录中，只有之后的 value 换成引用
+	value := raw[HeaderSize+kSize:]
+	var n int
+	if flags&FlagSequence != 0 {
+		n += seqSize
+	}
+	if flags&FlagMeta != 0 {
+		n += 1 + int(value[n])
+	}
+	prefix, value := value[:n:n], value[n:]
+	if len(value) <= db.opts.DedupThreshold {
+		return nil, false, nil
+	}
+
+	sum := sha256.Sum256(value)
+	ref, ok := seen[sum]
+	if !ok && !grow {
+		return nil, false, nil
+	}
+	if !ok {
+		if ref, err = appendShared(value); err != nil {
+			return nil, false, err
+		}
+		seen[sum] = ref
+	}
+
+	entry := NewEntry(raw[HeaderSize:HeaderSize+kSize], append(prefix, ref...))
+	entry.Timestamp = ts
+	entry.Flags = flags | FlagValueRef
+	return db.encode(entry), true, nil
+}
+
+// readValueLog 按数据文件 at 处的记录中的引用读取 value log 中的 value 并校验 CRC
+func (db *MiniDB) readValueLog(key string, at int64, ref []byte) ([]byte, *CorruptionError, error) {
+	if len(ref) != valueRefSize {
+		return nil, &CorruptionError{Offset: at, Key: key}, nil
+	}
+	vlog := db.valueLogAt(at)
+	if vlog == nil {
+		return nil, nil, ErrValueLogMissing
+	}
+
+	offset := int64(db.order.Uint64(ref[0:8]))
+	buf := make([]byte, db.order.Uint32(ref[8:12]))
+	if err := readFull(vlog, buf, offset, key); err != nil {
+		return nil, nil, err
+	}
+	if len(buf) < HeaderSize {
+		return nil, &CorruptionError{Offset: offset, Key: key, ValueLog: true}, nil
+	}
+	crc, _, kSize, vSize, _ := DecodeHeaderOrder(buf, db.order)
+	// Merge 去重写入的共享记录 key 为空
+	if HeaderSize+int64(kSize)+int64(vSize) != int64(len(buf)) || (kSize != 0 && string(buf[HeaderSize:HeaderSize+kSize]) != key) {
+		return nil, &CorruptionError{Offset: offset, Key: key, ValueLog: true}, nil
+	}
+	if actual := db.checksum(buf[:HeaderSize], buf[HeaderSize:]); actual != crc {
+		return nil, &CorruptionError{Offset: offset, Key: key, Expected: crc, Actual: actual, ValueLog: true}, nil
+	}
+	return buf[HeaderSize+kSize:], nil, nil
+}
+
+// defaultValueLogGCRatio 是 ValueLogGCRatio 为 0 时使用的值
+const defaultValueLogGCRatio = 0.5
+
+// valueLogGC 在 Merge 时把仍被引用的 value 拷贝到新的 value log (names.vlogMerge)，并改写数据文件记录中的引用。
+// value log 中的记录原样拷贝 (包括 key 和 CRC)，引用的长度不变，改写后的数据记录与原记录一样长。
+// 多个 key 引用同一条共享记录时只拷贝一次。只由 Merge 的 goroutine 使用
+type valueLogGC struct {
+	db     *MiniDB
+	old    Storage
+	file   Storage
+	offset int64
+	moved  map[int64][]byte // 旧 value log 中的位置 -> 新引用
+}
+
+// startValueLogGC 按 positions 处的记录估算 value log 中失效数据的占比，达到 ValueLogGCRatio 时
+// 创建新的 value log 并返回 valueLogGC，否则返回 nil
+func (db *MiniDB) startValueLogGC(file, vlog Storage, vlogEnd int64, positions []recordPos) (*valueLogGC, error) {
+	ratio := db.opts.ValueLogGCRatio
+	if ratio == 0 {
+		ratio = defaultValueLogGCRatio
+	}
+	if ratio > 1 {
+		return nil, nil
+	}
+	live, err := db.liveValueLogBytes(file, positions)
+	if err != nil {
+		return nil, err
+	}
+	if float64(vlogEnd-live) < ratio*float64(vlogEnd) {
+		return nil, nil
+	}
+	f, err := db.fs.OpenFile(db.names.vlogMerge, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Merge rewrites the value log, %d of %d bytes are still referenced", live, vlogEnd)
+	return &valueLogGC{db: db, old: vlog, file: f, moved: make(map[int64][]byte)}, nil
+}
+
+// liveValueLogBytes 读取 positions 处的记录，估算其中的引用在 value log 中仍占用的字节数，同一条共享记录只算一次
+func (db *MiniDB) liveValueLogBytes(file Storage, positions []recordPos) (int64, error) {
+	seen := make(map[int64]struct{})
+	var live int64
+	header := make([]byte, HeaderSize)
+	for _, pos := range positions {
+		if _, err := file.ReadAt(header, pos.offset); err != nil {
+			return 0, err
+		}
+		if _, _, _, _, flags := DecodeHeaderOrder(header, db.order); flags&FlagValueRef == 0 {
+			continue
+		}
+		raw := make([]byte, pos.size)
+		if err := readFull(file, raw, pos.offset, ""); err != nil {
+			return 0, err
+		}
+		idx, ok := db.chainRef(raw)
+		if !ok {
+			continue
+		}
+		ref := gatherRef(raw, idx)
+		offset := int64(db.order.Uint64(ref[0:8]))
+		if _, ok := seen[offset]; !ok {
+			seen[offset] = struct{}{}
+			live += int64(db.order.Uint32(ref[8:12]))
+		}
+	}
+	return live, nil
+}
+
+// chainRef 返回 raw (一整条分块链) 中引用的 12 个字节在 raw 中的下标。引用是整条链 value 的最后 12 个字节，
+// 分块很小时可能跨两条记录。记录长度与 raw 不符时返回 false
+func (db *MiniDB) chainRef(raw []byte) ([]int, bool) {
+	var idx []int
+	off := 0
+	for off+HeaderSize <= len(raw) {
+		_, _, kSize, vSize, _ := DecodeHeaderOrder(raw[off:], db.order)
+		start := off + HeaderSize + int(kSize)
+		end := start + int(vSize)
+		if end > len(raw) {
+			return nil, false
+		}
+		for i := max(start, end-valueRefSize); i < end; i++ {
+			idx = append(idx, i)
+		}
+		off = end
+	}
+	if off != len(raw) || len(idx) < valueRefSize {
+		return nil, false
+	}
+	return idx[len(idx)-valueRefSize:], true
+}
+
+func gatherRef(raw []byte, idx []int) []byte {
+	ref := make([]byte, len(idx))
+	for i, j := range idx {
+		ref[i] = raw[j]
+	}
+	return ref
+}
+
+// chainIntact 判断 raw 中每条记录的 CRC 都正确
+func (db *MiniDB) chainIntact(raw []byte) bool {
+	for off := 0; off < len(raw); {
+		crc, _, kSize, vSize, _ := DecodeHeaderOrder(raw[off:], db.order)
+		end := off + HeaderSize + int(kSize) + int(vSize)
+		if db.checksum(raw[off:off+HeaderSize], raw[off+HeaderSize:end]) != crc {
+			return false
+		}
+		off = end
+	}
+	return true
+}
+
+// rewrite 把 raw (一整条引用 value log 的分块链) 引用的 value 拷贝到新的 value log，原地改写引用并重新计算 CRC，
+// 返回写入新 value log 的字节数。CRC 校验失败的记录原样保留，读取时仍报告损坏，
+// 不能因为改写引用而让它重新通过校验
+func (g *valueLogGC) rewrite(key string, raw, buf []byte) (int64, error) {
+	db := g.db
+	idx, ok := db.chainRef(raw)
+	if !ok || !db.chainIntact(raw) {
+		return 0, nil
+	}
+	before := g.offset
+	ref, err := g.relocate(key, gatherRef(raw, idx), buf)
+	if err != nil {
+		return 0, err
+	}
+	for i, j := range idx {
+		raw[j] = ref[i]
+	}
+	for off := 0; off < len(raw); {
+		_, _, kSize, vSize, _ := DecodeHeaderOrder(raw[off:], db.order)
+		end := off + HeaderSize + int(kSize) + int(vSize)
+		if !db.noCRC {
+			db.order.PutUint32(raw[off:off+4], Checksum(raw[off:off+HeaderSize], raw[off+HeaderSize:end]))
+		}
+		off = end
+	}
+	return g.offset - before, nil
+}
+
+// relocate 把旧引用指向的 value log 记录按 buf 分段拷贝到新的 value log，返回新引用
+func (g *valueLogGC) relocate(key string, ref, buf []byte) ([]byte, error) {
+	order := g.db.order
+	offset, size := int64(order.Uint64(ref[0:8])), int64(order.Uint32(ref[8:12]))
+	if moved, ok := g.moved[offset]; ok {
+		return moved, nil
+	}
+	oldSize, err := g.old.Size()
+	if err != nil {
+		return nil, err
+	}
+	if offset+size > oldSize {
+		return nil, &CorruptionError{Offset: offset, Key: key, ValueLog: true}
+	}
+	newRef := make([]byte, valueRefSize)
+	order.PutUint64(newRef[0:8], uint64(g.offset))
+	order.PutUint32(newRef[8:12], uint32(size))
+	for off, end := offset, offset+size; off < end; {
+		chunk := buf[:min(int64(len(buf)), end-off)]
+		if _, err := g.old.ReadAt(chunk, off); err != nil {
+			return nil, fmt.Errorf("merge: read value log of key %q at offset %d: %w", key, offset, err)
+		}
+		n, err := g.file.Write(chunk)
+		if err != nil {
+			return nil, err
+		}
+		off += int64(n)
+		g.offset += int64(n)
+	}
+	g.moved[offset] = newRef
+	return newRef, nil
+}
+
+// append 把去重共享的 value 写入新的 value log，与 appendValueLog 相同返回引用
+func (g *valueLogGC) append(value []byte) ([]byte, error) {
+	n, err := writeBuffers(g.file, g.db.encodeBuffers(NewEntry(nil, value)))
+	if err != nil {
+		return nil, err
+	}
+	ref := make([]byte, valueRefSize)
+	g.db.order.PutUint64(ref[0:8], uint64(g.offset))
+	g.db.order.PutUint32(ref[8:12], uint32(n))
+	g.offset += int64(n)
+	return ref, nil
+}
+
+// readChain 读取 off 处整条分块链的原始字节
+func (db *MiniDB) readChain(file Storage, key string, off int64) ([]byte, error) {
+	header := make([]byte, HeaderSize)
+	end := off
+	for {
+		if _, err := file.ReadAt(header, end); err != nil {
+			return nil, err
+		}
+		_, _, kSize, vSize, flags := DecodeHeaderOrder(header, db.order)
+		end += HeaderSize + int64(kSize) + int64(vSize)
+		if flags&FlagChunked == 0 {
+			break
+		}
+	}
+	raw := make([]byte, end-off)
+	if err := readFull(file, raw, off, key); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// recoverValueLogMerge 处理回收 value log 的 Merge 中途崩溃后留下的新 value log。
+// Merge 先创建 merge 文件再创建新 value log，先 rename 数据文件再 rename value log：
+// merge 文件还在说明数据文件没有被替换，新 value log 直接删除；否则数据文件中的引用已经指向新 value log，补上 rename
+func (db *MiniDB) recoverValueLogMerge() error {
+	f, err := db.fs.OpenFile(db.names.vlogMerge, os.O_RDONLY)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	mergeFile, err := db.fs.OpenFile(db.names.merge, os.O_RDONLY)
+	if err == nil {
+		mergeFile.Close()
+		log.Printf("Warn: Removing stale value log %s left by an interrupted merge", db.names.vlogMerge)
+		return db.fs.Remove(db.names.vlogMerge)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	log.Printf("Warn: Finishing interrupted merge, replacing the value log with %s", db.names.vlogMerge)
+	return db.fs.Rename(db.names.vlogMerge, db.names.vlog)
+}
@@ -0,0 +1,254 @@
+package minidb
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// vlogSize 返回磁盘上 value log 的长度
+func vlogSize(t *testing.T, db *MiniDB) int64 {
+	t.Helper()
+	info, err := os.Stat(db.names.vlog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestValueLogGC(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      Options
+		overwrite int  // 10 个 key 中改写为内联短 value 的个数
+		wantGC    bool // Merge 后 value log 是否缩小
+	}{
+		{name: "mostly dead", opts: Options{ValueLogThreshold: 16}, overwrite: 8, wantGC: true},
+		{name: "mostly live", opts: Options{ValueLogThreshold: 16}, overwrite: 2},
+		{name: "custom ratio", opts: Options{ValueLogThreshold: 16, ValueLogGCRatio: 0.1}, overwrite: 2, wantGC: true},
+		{name: "never", opts: Options{ValueLogThreshold: 16, ValueLogGCRatio: 2}, overwrite: 10},
+		// 引用跨越两个分块，序号和元数据在引用之前
+		{name: "chunked refs", opts: Options{ValueLogThreshold: 16, ChunkSize: 5, Sequence: true}, overwrite: 8, wantGC: true},
+		{name: "dedup", opts: Options{ValueLogThreshold: 16, DedupThreshold: 8}, overwrite: 8, wantGC: true},
+		{name: "no crc", opts: Options{ValueLogThreshold: 16, DisableCRC: true}, overwrite: 8, wantGC: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, tt.opts)
+			want := make(map[string]string)
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("k%d", i)
+				want[key] = strings.Repeat(key, 40)
+				if err := db.PutWithMeta(key, want[key], []byte("m")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.overwrite; i++ {
+				key := fmt.Sprintf("k%d", i)
+				want[key] = "new" + key
+				if err := db.Put(key, want[key]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before := vlogSize(t, db)
+			if err := db.Merge(); err != nil {
+				t.Fatal(err)
+			}
+			after := vlogSize(t, db)
+			if shrunk := after < before; shrunk != tt.wantGC {
+				t.Fatalf("value log %d -> %d bytes, want GC = %v", before, after, tt.wantGC)
+			}
+			if after != db.vlogOffset {
+				t.Fatalf("vlogOffset = %d, file is %d bytes", db.vlogOffset, after)
+			}
+			if err := db.Put("later", strings.Repeat("L", 100)); err != nil {
+				t.Fatal(err)
+			}
+			want["later"] = strings.Repeat("L", 100)
+
+			for _, reload := range []bool{false, true} {
+				if reload {
+					db = reopen(t, db)
+				}
+				for k, v := range want {
+					if got, err := db.Get(k); err != nil || got != v {
+						t.Fatalf("reload=%v: Get(%q) = %q, %v, want %q", reload, k, got, err, v)
+					}
+				}
+				if p, err := db.Verify(nil, nil); err != nil || p.Corrupt != 0 {
+					t.Fatalf("reload=%v: Verify = %+v, %v", reload, p, err)
+				}
+			}
+			if _, err := os.Stat(db.names.vlogMerge); !os.IsNotExist(err) {
+				t.Fatalf("new value log left behind: %v", err)
+			}
+		})
+	}
+}
+
+// syncHookFS 在第一次 fsync 名为 name 的文件之前调用 hook
+type syncHookFS struct {
+	FileSystem
+	name string
+	hook func()
+}
+
+type syncHookFile struct {
+	Storage
+	hook *func()
+}
+
+func (fs *syncHookFS) OpenFile(name string, flag int) (Storage, error) {
+	f, err := fs.FileSystem.OpenFile(name, flag)
+	if err != nil || name != fs.name {
+		return f, err
+	}
+	return syncHookFile{f, &fs.hook}, nil
+}
+
+func (f syncHookFile) Sync() error {
+	if hook := *f.hook; hook != nil {
+		*f.hook = nil
+		hook()
+	}
+	return f.Storage.Sync()
+}
+
+// Merge 加锁之前写入的记录也引用 value log，补到新文件末尾时同样要改写到新 value log
+func TestValueLogGCWritesDuringMerge(t *testing.T) {
+	fs := &syncHookFS{FileSystem: OSFS}
+	db := openTestDB(t, Options{FS: fs, ValueLogThreshold: 16})
+	fs.name = db.names.merge
+	for i := 0; i < 3; i++ {
+		if err := db.Put("k", strings.Repeat(fmt.Sprint(i), 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.hook = func() {
+		if err := db.Put("during", strings.Repeat("d", 100)); err != nil {
+			t.Error(err)
+		}
+		if err := db.Put("k", strings.Repeat("x", 100)); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if fs.hook != nil {
+		t.Fatal("merge file was never synced")
+	}
+	for _, reload := range []bool{false, true} {
+		if reload {
+			db = reopen(t, db)
+		}
+		for k, v := range map[string]string{"k": strings.Repeat("x", 100), "during": strings.Repeat("d", 100)} {
+			if got, err := db.Get(k); err != nil || got != v {
+				t.Fatalf("reload=%v: Get(%q) = %q, %v", reload, k, got, err)
+			}
+		}
+	}
+}
+
+// BenchmarkMergeLargeValues 比较 500 个 64KB value 内联和放入 value log 时一次 Merge 的写入量。
+// 每轮 Merge 前覆盖一半的 key，value log 中的失效数据达到默认的 ValueLogGCRatio 时一并回收
+func BenchmarkMergeLargeValues(b *testing.B) {
+	const keys, size = 500, 64 << 10
+	value := strings.Repeat("v", size)
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"inline", Options{}},
+		{"value log", Options{ValueLogThreshold: 1024, ValueLogGCRatio: 2}},
+		{"value log gc", Options{ValueLogThreshold: 1024}},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			db := openTestDB(b, tt.opts)
+			for i := 0; i < keys; i++ {
+				if err := db.Put(fmt.Sprintf("k%d", i), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			var written int64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := 0; j < keys; j += 2 {
+					if err := db.Put(fmt.Sprintf("k%d", j), value); err != nil {
+						b.Fatal(err)
+					}
+				}
+				before := db.Stats().BytesWritten
+				b.StartTimer()
+				if err := db.Merge(); err != nil {
+					b.Fatal(err)
+				}
+				written += db.Stats().BytesWritten - before
+			}
+			b.ReportMetric(float64(written)/float64(b.N)/(1<<20), "MB-written/op")
+		})
+	}
+}
+
+// TestDedupShrinksMergedFile 100 个 key 共享同一个 10KB value，Merge 后数据文件只剩引用，value log 只多一份 value
+func TestDedupShrinksMergedFile(t *testing.T) {
+	shared := strings.Repeat("s", 10<<10)
+	db := openTestDB(t, Options{DedupThreshold: 1024})
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		want[fmt.Sprintf("shared-%d", i)] = shared
+	}
+	// 不同的大 value 各自保存一份，不超过阈值的小 value 即使相同也留在数据文件中
+	want["unique"] = strings.Repeat("u", 10<<10)
+	want["small-1"], want["small-2"] = "tiny", "tiny"
+	for k, v := range want {
+		if err := db.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := db.offset
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if db.offset > before/100 {
+		t.Fatalf("merged data file is %d bytes, was %d", db.offset, before)
+	}
+	// value log 中只有 shared 和 unique 各一份
+	if size := vlogSize(t, db); size > 2*(10<<10)+4*HeaderSize {
+		t.Fatalf("value log is %d bytes, want one copy of each distinct value", size)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for k, v := range want {
+			if got, err := db.Get(k); err != nil || got != v {
+				t.Fatalf("%s: Get(%q) = %d bytes, %v, want %d bytes", stage, k, len(got), err, len(v))
+			}
+			if n, err := db.ValueSize(k); err != nil || n != int64(len(v)) {
+				t.Fatalf("%s: ValueSize(%q) = %d, %v", stage, k, n, err)
+			}
+			if info, err := db.KeyInfo(k); err != nil || info.ValueSize != int64(len(v)) {
+				t.Fatalf("%s: KeyInfo(%q).ValueSize = %d, %v", stage, k, info.ValueSize, err)
+			}
+		}
+	}
+	check("merged")
+	vlogAfter := vlogSize(t, db)
+	db = reopen(t, db)
+	check("reopened")
+
+	// 覆盖其中一个共享 key 不影响其他引用同一份 value 的 key，再次 Merge 也不会重复写入 value
+	want["shared-0"] = "new"
+	if err := db.Put("shared-0", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check("merged again")
+	if size := vlogSize(t, db); size != vlogAfter {
+		t.Fatalf("second merge grew the value log from %d to %d bytes", vlogAfter, size)
+	}
+}